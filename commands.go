@@ -0,0 +1,584 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A subcommand.  setup defines the command's flags on fs, and returns the
+// function that runs the command with the remaining arguments once the flags
+// have been parsed.
+type command struct {
+	name    string
+	args    string
+	summary string
+	setup   func(fs *flag.FlagSet) func(args []string)
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"create", "[options] directory...", "create an archive of the given directories", setupCreate},
+		{"extract", "[options]", "extract an archive", setupExtract},
+		{"diff-create", "[options] old new", "create an archive of the differences between two directory trees", setupDiffCreate},
+		{"apply", "[options] directory", "apply a diff-create archive to the old directory tree, making it the same as the new one", setupApply},
+		{"list", "[options]", "list the files and directories in an archive", setupList},
+		{"verify", "[options]", "check an archive's checksums and structure without extracting it", setupVerify},
+		{"convert", "[options] tar|zip", "convert an archive to a tar or zip file, written to stdout", setupConvert},
+		{"hash", "[options] directory...", "compute the SHA-256 of every file in directory trees in parallel, and print a sha256sum manifest", setupHash},
+		{"find", "[options] pattern...", "find files in a catalog, and the archives with their latest copies", setupFind},
+		{"repo", "list|prune [options] pattern", "list or prune the archives named like pattern, with a time in place of its %t", setupRepo},
+		{"mount", "[options] archive mountpoint", "serve an archive as a read-only filesystem", setupMount},
+		{"serve", "[options] archive", "serve an archive over HTTP, to browse and download its files", setupServe},
+		{"transcode", "[options]", "rewrite an archive with different compression, block size, or format, without extracting it", setupTranscode},
+		{"train-dictionary", "[options] directory...", "build a compression dictionary for create --compress-dict from the small files in directory trees", setupTrainDictionary},
+		{"completion", "bash|zsh|fish", "print a shell completion script", setupCompletion},
+		{"help", "[command]", "show help for a command", setupHelp},
+	}
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+func (c command) flagSet() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n\n%s.\n", os.Args[0], c.name, c.args, strings.ToUpper(c.summary[:1])+c.summary[1:])
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(os.Stderr, "\nOptions:\n")
+			fs.PrintDefaults()
+			fmt.Fprintf(os.Stderr, "\n%s\n", envHelp)
+		}
+	}
+	return fs, c.setup(fs)
+}
+
+func (c command) run(args []string) {
+	fs, run := c.flagSet()
+	run(parseFlags(fs, args))
+}
+
+// Long options can be given defaults with environment variables named after
+// them: FAST_ARCHIVER_BLOCK_SIZE=65536 is the same as --block-size 65536 given
+// before the other options, which still override it.
+const envPrefix = "FAST_ARCHIVER_"
+
+const envHelp = "Long options can also be set with environment variables, such as\n" +
+	envPrefix + "BLOCK_SIZE=65536 for --block-size 65536; options given\n" +
+	"on the command line override them."
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// Parses args into the flags of fs, once any defaults are taken from the
+// environment and then the --config file, and returns the remaining
+// arguments, or the config file's sources if there are none.  Single-letter
+// flags can be combined, as in -cv or -cvo out.fa.
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	fs.VisitAll(func(f *flag.Flag) {
+		if len(f.Name) < 2 {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			fatal(exitUsage, "Invalid "+envName(f.Name)+":", err.Error())
+		}
+	})
+	args = splitCombinedFlags(fs, args)
+	// --fsync can be given without a value, so the flag package would report
+	// a bad one as an invalid boolean; check it here instead.
+	if fs.Lookup("fsync") != nil {
+		if value := flagValue(fs, args, "fsync"); value != "" {
+			if err := (&fsyncPolicy{}).Set(value); err != nil {
+				fatal(exitUsage, "Invalid --fsync:", err.Error())
+			}
+		}
+	}
+	var sources []string
+	if config := fs.Lookup("config"); config != nil {
+		fileName := flagValue(fs, args, "config")
+		if fileName == "" {
+			fileName = config.Value.String()
+		}
+		if fileName != "" {
+			sources = applyConfig(fs, fileName)
+		}
+	}
+	// A repeatable flag given on the command line replaces the values from
+	// the environment and the config file, rather than adding to them.
+	visitArgFlags(fs, args, func(name, value string) {
+		if f := fs.Lookup(name); f != nil {
+			if repeatable, ok := f.Value.(repeatableFlag); ok {
+				repeatable.reset()
+			}
+		}
+	})
+	fs.Parse(args)
+	if fs.Lookup("fsync") != nil {
+		if err := checkBareFsync(fs, args, fs.Args()); err != nil {
+			fatal(exitUsage, "Invalid --fsync:", err.Error())
+		}
+	}
+	if fs.NArg() == 0 {
+		return sources
+	}
+	return fs.Args()
+}
+
+// Returns the value that args give the flag name, without parsing them.
+func flagValue(fs *flag.FlagSet, args []string, name string) string {
+	value := ""
+	visitArgFlags(fs, args, func(argName, argValue string) {
+		if argName == name {
+			value = argValue
+		}
+	})
+	return value
+}
+
+// Calls fn with the name and value of each flag in args, in order, without
+// parsing them.  Boolean flags given without a value have an empty one.
+func visitArgFlags(fs *flag.FlagSet, args []string, fn func(name, value string)) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		name := strings.TrimPrefix(arg[1:], "-")
+		if equals := strings.Index(name, "="); equals >= 0 {
+			fn(name[:equals], name[equals+1:])
+			continue
+		}
+		value := ""
+		if f := fs.Lookup(name); f != nil && !isBoolFlag(f) && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		fn(name, value)
+	}
+}
+
+// A flag that can be given more than once, each value adding to the last.
+type repeatableFlag interface {
+	flag.Value
+	reset()
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// Expands each group of combined single-letter flags in args, like -cv, into
+// separate flags (-c -v) that the flag package can parse.  As with tar, the
+// last flag in a group can be one that takes a value, which is the rest of the
+// group if there is any (-ofile.fa), and otherwise the next argument (-cvo
+// file.fa).  Like the flag package, it stops at the first argument that isn't
+// a flag, or at --.
+func splitCombinedFlags(fs *flag.FlagSet, args []string) []string {
+	var retval []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			return append(retval, args[i:]...)
+		}
+		retval = append(retval, arg)
+		name := strings.TrimPrefix(arg[1:], "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		if f := fs.Lookup(name); f != nil {
+			if !isBoolFlag(f) && i+1 < len(args) {
+				// The next argument is this flag's value.
+				i++
+				retval = append(retval, args[i])
+			}
+			continue
+		}
+		if strings.HasPrefix(arg, "--") {
+			continue
+		}
+		var split []string
+		for j, letter := range name {
+			f := fs.Lookup(string(letter))
+			if f == nil {
+				split = nil
+				break
+			}
+			split = append(split, "-"+string(letter))
+			if !isBoolFlag(f) {
+				if value := name[j+utf8.RuneLen(letter):]; value != "" {
+					split = append(split, value)
+				} else if i+1 < len(args) {
+					i++
+					split = append(split, args[i])
+				}
+				break
+			}
+		}
+		if split != nil {
+			retval = append(retval[:len(retval)-1], split...)
+		}
+	}
+	return retval
+}
+
+// Options shared by every command that reads or writes archives.
+type commonOptions struct {
+	verbose    *bool
+	dryRun     *bool
+	strict     *bool
+	multiCpu   *int
+	transforms *transformFlags
+	eventsJSON *string
+	cpuProfile *string
+	memProfile *string
+	trace      *string
+	absolute   *bool
+	birthTime  *bool
+	fsync      *fsyncPolicy
+}
+
+func addCommonFlags(fs *flag.FlagSet) *commonOptions {
+	opts := &commonOptions{
+		verbose:    fs.Bool("v", false, "verbose output on stderr"),
+		dryRun:     fs.Bool("n", false, "dry run; show what would be done, but do not write anything"),
+		strict:     fs.Bool("strict", false, "fail instead of warning when any file data or metadata can't be archived or restored faithfully"),
+		multiCpu:   fs.Int("multicpu", 1, "maximum number of CPUs that can be executing simultaneously"),
+		eventsJSON: fs.String("events-json", "", "write newline-delimited JSON events (file-started, file-done, error, summary) to this file descriptor number or file"),
+		cpuProfile: fs.String("cpuprofile", "", "write a CPU profile for go tool pprof to this file"),
+		memProfile: fs.String("memprofile", "", "write a heap profile for go tool pprof to this file at the end of the run"),
+		trace:      fs.String("trace", "", "write an execution trace for go tool trace to this file"),
+		absolute:   fs.Bool("P", false, "keep leading / and ../ in archived paths, and extract such paths where they say, instead of making them relative"),
+		birthTime:  fs.Bool("btime", false, "record when files and directories were created, where the filesystem keeps track of it, and restore it where the platform allows it"),
+	}
+	// Read by parseFlags, before the other flags are parsed.
+	fs.String("config", "", "read default options, and the sources to archive, from this YAML file; options given on the command line override it")
+	fs.BoolVar(opts.dryRun, "dry-run", false, "same as -n; when creating, files are not read, and the number and total size of files that would be archived is reported")
+	opts.fsync = &fsyncPolicy{}
+	fs.Var(opts.fsync, "fsync", "what to fsync for crash durability: archive (the archive file once it's complete), files (each extracted file before it's renamed into place), dirs (the directories entries were extracted into), all, or none; a bare --fsync means files")
+	opts.transforms = &transformFlags{}
+	fs.Var(opts.transforms, "transform", "filter the contents of files matching PATTERN through a shell command, or a built-in transform (@crlf-to-lf, @lf-to-crlf), as PATTERN=COMMAND or PATTERN=@NAME; can be repeated")
+	return opts
+}
+
+func (opts *commonOptions) apply() {
+	runtime.GOMAXPROCS(*opts.multiCpu)
+	if *opts.dryRun {
+		*opts.verbose = true
+	}
+	if *opts.eventsJSON != "" && events == nil {
+		stream, err := openEventStream(*opts.eventsJSON)
+		if err != nil {
+			fatal(exitError, "Error opening --events-json:", err.Error())
+		}
+		events = stream
+	}
+	startProfiling(opts)
+}
+
+func (opts *commonOptions) logger() *MultiLevelLogger {
+	return &MultiLevelLogger{logger, *opts.verbose}
+}
+
+func setupCreate(fs *flag.FlagSet) func(args []string) {
+	common := addCommonFlags(fs)
+	opts := addCreateFlags(fs)
+	return func(args []string) {
+		exitWith(runCreate(common, opts, args))
+	}
+}
+
+func setupExtract(fs *flag.FlagSet) func(args []string) {
+	common := addCommonFlags(fs)
+	input := addInputFlags(fs)
+	opts := addExtractFlags(fs)
+	return func(args []string) {
+		exitWith(runExtract(common, input, opts))
+	}
+}
+
+// Creates a delta archive between an old and a new tree, which apply turns
+// a copy of the old tree into the new one with.
+func setupDiffCreate(fs *flag.FlagSet) func(args []string) {
+	common := addCommonFlags(fs)
+	opts := addCreateFlags(fs)
+	return func(args []string) {
+		if len(args) != 2 {
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		if *opts.snapshotFileName != "" || *opts.newerThan != "" || *opts.filesFrom != "" || *opts.watch || *opts.splitByDir || *opts.shards > 1 || *opts.maxDepth != 0 || *opts.types != "" ||
+			*opts.owner != "" || *opts.group != "" {
+			fatal(exitUsage, "diff-create cannot be used with --snapshot-file, --newer-than, --files-from, --watch, --split-by-dir, --shards, --max-depth, --types, --owner, or --group")
+		}
+		for _, directory := range args {
+			if fileInfo, err := os.Stat(directory); err != nil || !fileInfo.IsDir() {
+				fatal(exitUsage, directory, "is not a directory")
+			}
+		}
+		opts.compareWith = args[0]
+		exitWith(runCreate(common, opts, args[1:]))
+	}
+}
+
+// Extracts a delta archive over the directory it was created from.
+func setupApply(fs *flag.FlagSet) func(args []string) {
+	common := addCommonFlags(fs)
+	input := addInputFlags(fs)
+	opts := addExtractFlags(fs)
+	return func(args []string) {
+		if len(args) != 1 {
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		if fileInfo, err := os.Stat(args[0]); err != nil || !fileInfo.IsDir() {
+			fatal(exitUsage, args[0], "is not a directory")
+		}
+		opts.outputPath = args[0]
+		exitWith(runExtract(common, input, opts))
+	}
+}
+
+func setupList(fs *flag.FlagSet) func(args []string) {
+	input := addInputFlags(fs)
+	verbose := fs.Bool("v", false, "show the mode, owner, and size of each entry")
+	describe := fs.Bool("describe", false, "instead of listing the entries, describe the archive: its format, how and where it was created, and how much it holds")
+	return func(args []string) {
+		inputFile := input.open()
+		if conn, ok := inputFile.(net.Conn); ok {
+			err := sendEmptyResumeRequest(conn)
+			if err != nil {
+				fatal(exitError, "Error sending resume request:", err.Error())
+			}
+		}
+		if *describe {
+			description, err := falib.Describe(inputFile)
+			if err != nil {
+				fatal(archiveErrorStatus(err), "Error reading archive:", err.Error())
+			}
+			printDescription(description)
+			inputFile.Close()
+			return
+		}
+		err := falib.List(inputFile, func(entry falib.ListEntry) {
+			fmt.Println(listLine(entry, *verbose))
+		})
+		if err != nil {
+			fatal(archiveErrorStatus(err), "Error reading archive:", err.Error())
+		}
+		inputFile.Close()
+	}
+}
+
+// Returns the line that list shows for entry: its path, and with -v, its mode,
+// owner, and size.
+func listLine(entry falib.ListEntry, verbose bool) string {
+	if verbose && entry.Changed {
+		return fmt.Sprintf("%s %d/%d %12d %s (changed while archived)", entry.Mode, entry.Uid, entry.Gid, entry.Size, displayPath(entry.Path))
+	} else if verbose && entry.Linkname != "" {
+		return fmt.Sprintf("%s %d/%d %12d %s -> %s", entry.Mode, entry.Uid, entry.Gid, entry.Size, displayPath(entry.Path), displayPath(entry.Linkname))
+	} else if verbose {
+		return fmt.Sprintf("%s %d/%d %12d %s", entry.Mode, entry.Uid, entry.Gid, entry.Size, displayPath(entry.Path))
+	}
+	return displayPath(entry.Path)
+}
+
+// Returns a path as it should be shown in a listing, one per line: as it is,
+// unless it contains control characters (such as a newline) or invalid UTF-8,
+// in which case it's quoted and escaped as a Go string literal.
+func displayPath(filePath string) string {
+	if !utf8.ValidString(filePath) {
+		return strconv.Quote(filePath)
+	}
+	for _, r := range filePath {
+		if unicode.IsControl(r) {
+			return strconv.Quote(filePath)
+		}
+	}
+	return filePath
+}
+
+// Prints what an archive says about itself, for list --describe.
+func printDescription(d *falib.Description) {
+	value := func(properties map[string]string, name string) string {
+		if v, ok := properties[name]; ok {
+			return v
+		}
+		return "unknown"
+	}
+	fmt.Printf("Format version:  %d\n", d.FormatVersion)
+	fmt.Printf("Created:         %s\n", value(d.Info, "created"))
+	fmt.Printf("Host:            %s\n", value(d.Info, "host"))
+	fmt.Printf("Block size:      %s\n", value(d.Info, "block-size"))
+	fmt.Printf("Compression:     %s\n", value(d.Info, "compression"))
+	fmt.Printf("Encryption:      none\n")
+	fmt.Printf("Deduplication:   %s\n", value(d.Info, "dedup"))
+	fmt.Printf("Run-length:      %s\n", value(d.Info, "run-length"))
+	fmt.Printf("Alignment:       %s\n", value(d.Info, "align"))
+	if id, ok := d.Info["archive-id"]; ok {
+		fmt.Printf("Archive ID:      %s\n", id)
+	}
+	if id, ok := d.Info["parent-id"]; ok {
+		fmt.Printf("Based on:        %s\n", id)
+	}
+	if len(d.Source) > 0 {
+		var properties []string
+		for name, v := range d.Source {
+			properties = append(properties, name+"="+v)
+		}
+		sort.Strings(properties)
+		fmt.Printf("Source:          %s\n", strings.Join(properties, " "))
+	}
+	fmt.Printf("Files:           %d\n", d.Files)
+	fmt.Printf("Directories:     %d\n", d.Directories)
+	fmt.Printf("Special files:   %d\n", d.Specials)
+	fmt.Printf("Symbolic links:  %d\n", d.Symlinks)
+	fmt.Printf("Deletions:       %d\n", d.Deletions)
+	if d.Bytes >= 0 {
+		fmt.Printf("Bytes:           %d\n", d.Bytes)
+	} else {
+		fmt.Printf("Bytes:           unknown\n")
+	}
+}
+
+func setupVerify(fs *flag.FlagSet) func(args []string) {
+	input := addInputFlags(fs)
+	verbose := fs.Bool("v", false, "list each entry as it's checked")
+	return func(args []string) {
+		inputFile := input.open()
+		unarchiver := falib.NewUnarchiver(inputFile)
+		unarchiver.Logger = &MultiLevelLogger{logger, *verbose}
+		unarchiver.DryRun = true
+		if conn, ok := inputFile.(net.Conn); ok {
+			err := unarchiver.WriteResumeRequest(conn)
+			if err != nil {
+				fatal(exitError, "Error sending resume request:", err.Error())
+			}
+		}
+		err := unarchiver.Run()
+		if err != nil {
+			fatal(archiveErrorStatus(err), "Archive verification failed:", err.Error())
+		}
+		inputFile.Close()
+	}
+}
+
+func setupFind(fs *flag.FlagSet) func(args []string) {
+	catalogFileName := fs.String("catalog", "", "catalog file recorded by create --catalog")
+	all := fs.Bool("all", false, "show every archived copy of each file, oldest first, instead of only the latest")
+	verbose := fs.Bool("v", false, "show the size and SHA-256 of each copy")
+	return func(args []string) {
+		if *catalogFileName == "" || len(args) == 0 {
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		for _, pattern := range args {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				fatal(exitUsage, "Invalid pattern", pattern+":", err.Error())
+			}
+		}
+		// A pattern matches either a file's whole path, or its name.
+		matches := func(filePath string) bool {
+			for _, pattern := range args {
+				if match, _ := filepath.Match(pattern, filePath); match {
+					return true
+				}
+				if match, _ := filepath.Match(pattern, filepath.Base(filePath)); match {
+					return true
+				}
+			}
+			return false
+		}
+		show := func(entry falib.CatalogEntry) {
+			if *verbose {
+				fmt.Printf("%s %s @%d %d %x %s\n", entry.Created.Format(time.RFC3339), displayPath(entry.Archive), entry.Offset,
+					entry.Size, entry.SHA256, displayPath(entry.Path))
+			} else {
+				fmt.Printf("%s %s @%d %s\n", entry.Created.Format(time.RFC3339), displayPath(entry.Archive), entry.Offset,
+					displayPath(entry.Path))
+			}
+		}
+
+		found := 0
+		latest := make(map[string]falib.CatalogEntry)
+		err := falib.ScanCatalog(*catalogFileName, func(entry falib.CatalogEntry) {
+			if !matches(entry.Path) {
+				return
+			}
+			found++
+			if *all {
+				show(entry)
+			} else if previous, ok := latest[entry.Path]; !ok || !entry.Created.Before(previous.Created) {
+				latest[entry.Path] = entry
+			}
+		})
+		if err != nil {
+			fatal(exitError, "Error reading catalog:", err.Error())
+		}
+		paths := make([]string, 0, len(latest))
+		for filePath := range latest {
+			paths = append(paths, filePath)
+		}
+		sort.Strings(paths)
+		for _, filePath := range paths {
+			show(latest[filePath])
+		}
+		if found == 0 {
+			fatal(exitError, "Not found in catalog:", strings.Join(args, " "))
+		}
+	}
+}
+
+func setupCompletion(fs *flag.FlagSet) func(args []string) {
+	return func(args []string) {
+		if len(args) != 1 {
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		script, ok := completionScripts[args[0]]
+		if !ok {
+			fatal(exitUsage, "Unknown shell:", args[0])
+		}
+		fmt.Print(script())
+	}
+}
+
+func setupHelp(fs *flag.FlagSet) func(args []string) {
+	return func(args []string) {
+		if len(args) == 0 {
+			printCommands()
+			return
+		}
+		c, ok := findCommand(args[0])
+		if !ok {
+			fatal(exitUsage, "Unknown command:", args[0])
+		}
+		subcommandFlags, _ := c.flagSet()
+		subcommandFlags.Usage()
+	}
+}
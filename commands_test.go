@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitCombinedFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Bool("c", false, "")
+	fs.Bool("x", false, "")
+	fs.Bool("v", false, "")
+	fs.String("o", "", "")
+	fs.Var(&inputFlags{}, "i", "")
+	fs.Int("block-size", 4096, "")
+	fs.Var(&fsyncPolicy{}, "fsync", "")
+
+	for _, test := range []struct {
+		args     string
+		expected string
+	}{
+		{"-cv dir", "-c -v dir"},
+		{"-cvo out.fa dir", "-c -v -o out.fa dir"},
+		{"-xvi in.fa", "-x -v -i in.fa"},
+		{"-cvoout.fa dir", "-c -v -o out.fa dir"},
+		{"-oout.fa dir", "-o out.fa dir"},
+		{"-cvo", "-c -v -o"},
+		{"-o -cv dir", "-o -cv dir"},
+		{"--block-size 512 -cv dir", "--block-size 512 -c -v dir"},
+		{"-block-size=512 -cv dir", "-block-size=512 -c -v dir"},
+		{"--fsync -cv dir", "--fsync -c -v dir"},
+		{"-cq dir", "-cq dir"},
+		{"-c -- -vo", "-c -- -vo"},
+		{"dir -cv", "dir -cv"},
+	} {
+		actual := strings.Join(splitCombinedFlags(fs, strings.Fields(test.args)), " ")
+		if actual != test.expected {
+			t.Errorf("%s: split into %s, expected %s", test.args, actual, test.expected)
+		}
+	}
+}
+
+// Checks that options on the command line override the config file, which
+// overrides the environment, for repeatable options as well as others.
+func TestParseFlagsPrecedence(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(config, []byte("exclude: [a, b]\ntransform: [\"*.txt=@crlf-to-lf\", \"*.md=@crlf-to-lf\"]\ninput: config.fa\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envName("transform"), "*.env=@lf-to-crlf")
+
+	parse := func(args ...string) (*commonOptions, *createOptions, *inputOptions) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		common := addCommonFlags(fs)
+		opts := addCreateFlags(fs)
+		input := addInputFlags(fs)
+		parseFlags(fs, append([]string{"--config", config}, args...))
+		return common, opts, input
+	}
+	patterns := func(common *commonOptions) string {
+		var retval []string
+		for _, transform := range *common.transforms {
+			retval = append(retval, transform.Pattern)
+		}
+		return strings.Join(retval, " ")
+	}
+
+	common, opts, input := parse()
+	if patterns(common) != "*.txt *.md" {
+		t.Errorf("transforms from the config file are %s", patterns(common))
+	}
+	if *opts.exclude != "a"+string(filepath.ListSeparator)+"b" {
+		t.Errorf("exclude from the config file is %s", *opts.exclude)
+	}
+	if input.inputFileNames.String() != "config.fa" {
+		t.Errorf("input from the config file is %s", input.inputFileNames.String())
+	}
+
+	common, opts, input = parse("--transform", "*.c=@crlf-to-lf", "--transform", "*.h=@crlf-to-lf", "--exclude", "c",
+		"-i", "one.fa", "-i", "two.fa")
+	if patterns(common) != "*.c *.h" {
+		t.Errorf("transforms from the command line are %s", patterns(common))
+	}
+	if *opts.exclude != "c" {
+		t.Errorf("exclude from the command line is %s", *opts.exclude)
+	}
+	if input.inputFileNames.String() != "one.fa two.fa" {
+		t.Errorf("input from the command line is %s", input.inputFileNames.String())
+	}
+}
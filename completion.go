@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The shells that completion scripts can be generated for.
+var completionScripts = map[string]func() string{
+	"bash": bashCompletion,
+	"zsh":  zshCompletion,
+	"fish": fishCompletion,
+}
+
+// Flags whose value is the path of a file in the archive, which the scripts
+// complete by listing the archive given with -i.
+var memberFlags = map[string]bool{
+	"to-stdout": true,
+}
+
+// Returns the flags of command c, in order of name.
+func commandFlags(c command) []*flag.Flag {
+	fs, _ := c.flagSet()
+	var flags []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, f)
+	})
+	return flags
+}
+
+// Returns how flag f is usually spelled: -v for single letters, and --name
+// for the rest.
+func flagSpelling(f *flag.Flag) string {
+	if len(f.Name) == 1 {
+		return "-" + f.Name
+	}
+	return "--" + f.Name
+}
+
+// Generates a bash completion script that completes command names, each
+// command's flags, and the values of member flags.
+func bashCompletion() string {
+	var names []string
+	var cases []string
+	var members []string
+	for _, c := range commands {
+		names = append(names, c.name)
+		var flags []string
+		for _, f := range commandFlags(c) {
+			flags = append(flags, flagSpelling(f))
+		}
+		if len(flags) > 0 {
+			cases = append(cases, fmt.Sprintf("        %s) flags=%q ;;", c.name, strings.Join(flags, " ")))
+		}
+	}
+	for name := range memberFlags {
+		members = append(members, "-"+name, "--"+name)
+	}
+	sort.Strings(members)
+
+	return fmt.Sprintf(`_fast_archiver() {
+    local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]} flags= archive= i
+    if [ "$COMP_CWORD" -eq 1 ]; then
+        COMPREPLY=($(compgen -W %q -- "$cur"))
+        return
+    fi
+    case " %s " in
+    *" $prev "*)
+        for ((i = 2; i < COMP_CWORD - 1; i++)); do
+            case ${COMP_WORDS[i]} in
+            -i|--i) archive=${COMP_WORDS[i+1]/#\~/$HOME} ;;
+            esac
+        done
+        if [ -n "$archive" ]; then
+            local IFS=$'\n'
+            COMPREPLY=($(compgen -W "$(fast-archiver list -i "$archive" 2>/dev/null)" -- "$cur"))
+            return
+        fi
+        ;;
+    esac
+    case ${COMP_WORDS[1]} in
+%s
+    esac
+    if [[ $cur == -* ]]; then
+        COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+    else
+        COMPREPLY=($(compgen -f -- "$cur"))
+    fi
+}
+complete -F _fast_archiver fast-archiver
+`, strings.Join(names, " "), strings.Join(members, " "), strings.Join(cases, "\n"))
+}
+
+// Quotes s in single quotes for a zsh script.
+func zshQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Quotes s in single quotes for a fish script, where backslashes are escapes
+// even inside them.
+func fishQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
+
+// Generates a zsh completion script, for a file named _fast_archiver in
+// $fpath, or to be loaded with source.  Flags are completed with their
+// descriptions.
+func zshCompletion() string {
+	var names []string
+	var cases []string
+	for _, c := range commands {
+		names = append(names, "        "+zshQuote(c.name+":"+c.summary))
+		var specs []string
+		for _, f := range commandFlags(c) {
+			description := strings.NewReplacer("[", `\[`, "]", `\]`).Replace(f.Usage)
+			// Every flag can be given more than once, since some
+			// (such as --exclude) are meant to be repeated.
+			spec := "*" + flagSpelling(f) + "[" + description + "]"
+			if memberFlags[f.Name] {
+				spec += ":member:_fast_archiver_members"
+			} else if !isBoolFlag(f) {
+				spec += ":value:_files"
+			}
+			specs = append(specs, " \\\n            "+zshQuote(spec))
+		}
+		cases = append(cases, fmt.Sprintf("    %s)\n        _arguments -s%s \\\n            '*:file:_files' ;;", c.name, strings.Join(specs, "")))
+	}
+
+	return fmt.Sprintf(`#compdef fast-archiver
+
+_fast_archiver_members() {
+    local i=${words[(I)(-i|--i)]}
+    (( i )) || return 1
+    local -a members
+    members=(${(f)"$(fast-archiver list -i ${~words[i+1]} 2>/dev/null)"})
+    compadd -a members
+}
+
+_fast_archiver() {
+    local -a commands
+    commands=(
+%s
+    )
+    if (( CURRENT == 2 )); then
+        _describe command commands
+        return
+    fi
+    shift words
+    (( CURRENT-- ))
+    case $words[1] in
+%s
+    esac
+}
+
+if [ "$funcstack[1]" = _fast_archiver ]; then
+    _fast_archiver "$@"
+else
+    compdef _fast_archiver fast-archiver
+fi
+`, strings.Join(names, "\n"), strings.Join(cases, "\n"))
+}
+
+// Generates a fish completion script, for
+// ~/.config/fish/completions/fast-archiver.fish.
+func fishCompletion() string {
+	var lines []string
+	for _, c := range commands {
+		lines = append(lines, fmt.Sprintf("complete -c fast-archiver -n __fish_use_subcommand -f -a %s -d %s",
+			c.name, fishQuote(c.summary)))
+	}
+	for _, c := range commands {
+		for _, f := range commandFlags(c) {
+			line := fmt.Sprintf("complete -c fast-archiver -n '__fish_seen_subcommand_from %s'", c.name)
+			if len(f.Name) == 1 {
+				line += " -s " + f.Name
+			} else {
+				line += " -l " + f.Name
+			}
+			if memberFlags[f.Name] {
+				line += " -x -a '(__fast_archiver_members)'"
+			} else if !isBoolFlag(f) {
+				line += " -r"
+			}
+			lines = append(lines, line+" -d "+fishQuote(f.Usage))
+		}
+	}
+
+	return `function __fast_archiver_members
+    set -l tokens (commandline -opc)
+    set -l archive
+    for i in (seq (count $tokens))
+        if contains -- $tokens[$i] -i --i; and test $i -lt (count $tokens)
+            set archive $tokens[(math $i + 1)]
+        end
+    end
+    test -n "$archive"; and fast-archiver list -i $archive 2>/dev/null
+end
+
+` + strings.Join(lines, "\n") + "\n"
+}
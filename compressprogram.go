@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// The value of --use-compress-program, an external command that archives are
+// piped through: as it is to compress, and with -d added to decompress, as
+// with tar's -I.
+type programFlag struct {
+	command string
+}
+
+func (p *programFlag) String() string {
+	if p == nil {
+		return ""
+	}
+	return p.command
+}
+
+func (p *programFlag) Set(value string) error {
+	p.command = value
+	return nil
+}
+
+// Adds the --use-compress-program flag to fs, unless it's already there; the
+// original -c/-x form registers the create and input options on the same flag
+// set, and they share it.
+func addCompressProgramFlag(fs *flag.FlagSet) *programFlag {
+	if f := fs.Lookup("use-compress-program"); f != nil {
+		return f.Value.(*programFlag)
+	}
+	p := &programFlag{}
+	fs.Var(p, "use-compress-program", "pipe the archive through this command (eg. \"zstd -T0\"), which is given -d to decompress")
+	return p
+}
+
+// Starts the compress program, writing its output to output.  Closing the
+// returned writer waits for the program to finish, and then closes output.
+func compressOutput(command string, output io.WriteCloser) (*programWriter, error) {
+	writer, err := startProgramWriter(exec.Command("/bin/sh", "-c", command), "compress program", output)
+	if err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Writes to the stdin of a command, whose stdout goes to output.  name
+// describes the command in errors.
+type programWriter struct {
+	cmd    *exec.Cmd
+	name   string
+	stdin  io.WriteCloser
+	output io.WriteCloser
+
+	// Fsync output, if it's a file, before closing it.
+	sync bool
+}
+
+func startProgramWriter(cmd *exec.Cmd, name string, output io.WriteCloser) (*programWriter, error) {
+	cmd.Stdout = output
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &programWriter{cmd: cmd, name: name, stdin: stdin, output: output}, nil
+}
+
+func (w *programWriter) Write(p []byte) (int, error) {
+	return w.stdin.Write(p)
+}
+
+func (w *programWriter) Close() error {
+	err := w.stdin.Close()
+	if werr := w.cmd.Wait(); werr != nil {
+		err = fmt.Errorf("%s: %w", w.name, werr)
+	}
+	if err == nil && w.sync {
+		err = syncFile(w.output)
+	}
+	closeErr := w.output.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Stops the program without waiting for it to finish its output.
+func (w *programWriter) kill() {
+	w.stdin.Close()
+	w.cmd.Process.Kill()
+	w.cmd.Wait()
+}
+
+// Starts the compress program to decompress input.  Closing the returned
+// reader stops the program if it's still running, and closes input.
+func decompressInput(command string, input io.ReadCloser) (io.ReadCloser, error) {
+	cmd := exec.Command("/bin/sh", "-c", command+" -d")
+	cmd.Stdin = input
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &programReader{commandReader{cmd: cmd, stdout: stdout, name: "compress program"}, input}, nil
+}
+
+type programReader struct {
+	commandReader
+	input io.ReadCloser
+}
+
+func (r *programReader) Close() error {
+	r.commandReader.Close()
+	return r.input.Close()
+}
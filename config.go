@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A --config file holds defaults for long options, so that a recurring job
+// doesn't need a long command line.  It's a small subset of YAML: each option
+// is a top-level "name: value", where a list of values, either as "- value"
+// lines below the name or as [a, b], is given for options that take several.
+// "sources" lists the directories or files to archive, when none are given on
+// the command line.  For example:
+//
+//	sources:
+//	  - /etc
+//	  - /var/lib/app
+//	exclude: [core.*, "*.tmp"]
+//	compress: true
+//	destination: /backups/app.fa
+type configEntry struct {
+	name   string
+	values []string
+	line   int
+}
+
+// Options known by other names in config files, since they've no long name.
+var configAliases = map[string]string{
+	"destination": "o",
+	"input":       "i",
+}
+
+// Options that take a list of values in one string, and what separates them.
+var configListSeparators = map[string]string{
+	"exclude":              string(filepath.ListSeparator),
+	"store-only":           string(filepath.ListSeparator),
+	"no-compress-suffixes": ",",
+}
+
+// Reads the entries of a config file, in order.
+func parseConfig(input io.Reader) ([]configEntry, error) {
+	var entries []configEntry
+	scanner := bufio.NewScanner(input)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+
+		if trimmed != line {
+			// An indented line continues the list of the entry above it.
+			if len(entries) == 0 || !strings.HasPrefix(trimmed, "- ") && trimmed != "-" {
+				return nil, fmt.Errorf("line %d: expected a list item (- value)", lineNumber)
+			}
+			value, err := configValue(strings.TrimPrefix(trimmed, "-"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err.Error())
+			}
+			last := &entries[len(entries)-1]
+			last.values = append(last.values, value)
+			continue
+		}
+
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			return nil, fmt.Errorf("line %d: expected name: value", lineNumber)
+		}
+		entry := configEntry{name: strings.TrimSpace(line[:colon]), line: lineNumber}
+		rest := strings.TrimSpace(line[colon+1:])
+		if strings.HasPrefix(rest, "[") {
+			values, err := configInlineList(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err.Error())
+			}
+			entry.values = values
+		} else if rest != "" && !strings.HasPrefix(rest, "#") {
+			value, err := configValue(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err.Error())
+			}
+			entry.values = []string{value}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Returns a scalar value, which can be quoted, and can be followed by a
+// comment.
+func configValue(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case strings.HasPrefix(text, `"`):
+		end := closingQuote(text)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string: %s", text)
+		}
+		return strconv.Unquote(text[:end+1])
+	case strings.HasPrefix(text, "'"):
+		value := ""
+		for i := 1; i < len(text); i++ {
+			if text[i] != '\'' {
+				value += text[i : i+1]
+			} else if i+1 < len(text) && text[i+1] == '\'' {
+				value += "'"
+				i++
+			} else {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("unterminated string: %s", text)
+	}
+	if comment := strings.Index(text, " #"); comment >= 0 {
+		text = strings.TrimSpace(text[:comment])
+	}
+	return text, nil
+}
+
+// Returns the index of the quote that ends the double-quoted string at the
+// start of text, or -1.
+func closingQuote(text string) int {
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the values of a list written as [a, b, c].
+func configInlineList(text string) ([]string, error) {
+	end := strings.LastIndex(text, "]")
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated list: %s", text)
+	}
+	var values []string
+	for _, item := range strings.Split(text[1:end], ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		value, err := configValue(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Sets the flags of fs from the config file fileName, and returns the sources
+// it lists.  Flags given on the command line are parsed afterwards, and so
+// override it; see parseFlags for how they replace the values of repeatable
+// flags.
+func applyConfig(fs *flag.FlagSet, fileName string) []string {
+	file, err := os.Open(fileName)
+	if err != nil {
+		fatal(exitUsage, "Error opening --config:", err.Error())
+	}
+	defer file.Close()
+	entries, err := parseConfig(file)
+	if err != nil {
+		fatal(exitUsage, "Error reading --config "+fileName+":", err.Error())
+	}
+
+	var sources []string
+	replaced := make(map[string]bool)
+	for _, entry := range entries {
+		invalid := func(message ...interface{}) {
+			fatal(exitUsage, append([]interface{}{fmt.Sprintf("%s:%d: %s:", fileName, entry.line, entry.name)}, message...)...)
+		}
+		if entry.name == "sources" {
+			sources = append(sources, entry.values...)
+			continue
+		}
+		name := entry.name
+		if alias, ok := configAliases[name]; ok {
+			name = alias
+		}
+		f := fs.Lookup(name)
+		if f == nil || name == "config" {
+			invalid("not an option of this command")
+		}
+		values := entry.values
+		if separator, ok := configListSeparators[name]; ok && len(values) > 1 {
+			values = []string{strings.Join(values, separator)}
+		}
+		if _, single := f.Value.(flag.Getter); single && len(values) > 1 {
+			invalid("takes a single value")
+		}
+		// The file's values of a repeatable flag replace the environment's.
+		if repeatable, ok := f.Value.(repeatableFlag); ok && !replaced[name] {
+			repeatable.reset()
+			replaced[name] = true
+		}
+		for _, value := range values {
+			if isBoolFlag(f) {
+				value = yamlBool(value)
+			}
+			if err := fs.Set(name, value); err != nil {
+				invalid(err.Error())
+			}
+		}
+	}
+	return sources
+}
+
+// Converts the other spellings of booleans that YAML allows to ones that the
+// flag package understands.
+func yamlBool(value string) string {
+	switch strings.ToLower(value) {
+	case "yes", "on", "y":
+		return "true"
+	case "no", "off", "n":
+		return "false"
+	}
+	return value
+}
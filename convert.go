@@ -0,0 +1,242 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"flag"
+	"github.com/replicon/fast-archiver/falib"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+// The most of a file's contents that are held in memory while converting an
+// archive to tar; the contents of larger files are spooled to a temporary
+// file.
+const spoolMemoryLimit = 32 * 1024 * 1024
+
+// Converts the -i archive to the tar or zip file given as the argument,
+// written to stdout; the same as extract --output-format.
+func setupConvert(fs *flag.FlagSet) func(args []string) {
+	input := addInputFlags(fs)
+	verbose := fs.Bool("v", false, "list each entry as it's converted")
+	strict := fs.Bool("strict", false, "fail instead of warning when an entry can't be held by the format")
+	return func(args []string) {
+		if len(args) != 1 {
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		if args[0] != "tar" && args[0] != "zip" {
+			fatal(exitUsage, "Unknown format:", args[0])
+		}
+		inputFile := input.open()
+		defer inputFile.Close()
+		if conn, ok := inputFile.(net.Conn); ok {
+			err := sendEmptyResumeRequest(conn)
+			if err != nil {
+				fatal(exitError, "Error sending resume request:", err.Error())
+			}
+		}
+		exitWith(convertArchive(inputFile, args[0], &MultiLevelLogger{logger, *verbose}, *strict))
+	}
+}
+
+// Writes the archive read from input to stdout as a tar or zip file, for
+// convert and extract --output-format, converting each entry as it's read.  What the
+// format can't hold, such as a deletion recorded by an incremental archive,
+// is left out with a warning, or with strict, fails the conversion.
+func convertArchive(input io.Reader, format string, logger *MultiLevelLogger, strict bool) error {
+	reader := falib.NewReader(input)
+	defer reader.Close()
+	output := bufio.NewWriter(os.Stdout)
+	var tarWriter *tar.Writer
+	var zipWriter *zip.Writer
+	if format == "tar" {
+		tarWriter = tar.NewWriter(output)
+	} else {
+		zipWriter = zip.NewWriter(output)
+	}
+
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return failure(archiveErrorStatus(err), "Error reading archive:", err.Error())
+		}
+		entry.Path = falib.RelativePath(entry.Path)
+		if entry.Path == "." {
+			continue
+		}
+		logger.Verbose(entry.Path)
+
+		converted := false
+		if entry.Deleted {
+			// Neither format can record that a path was deleted.
+		} else if tarWriter != nil {
+			converted, err = writeTarEntry(tarWriter, entry, reader)
+		} else {
+			converted, err = writeZipEntry(zipWriter, entry, reader)
+		}
+		if err != nil {
+			return failure(archiveErrorStatus(err), "Error converting archive:", err.Error())
+		} else if !converted && strict {
+			return failure(exitError, "Unable to store", entry.Path, "in a", format, "file")
+		} else if !converted {
+			logger.Warning("unable to store", entry.Path, "in a", format, "file; leaving it out")
+		}
+	}
+
+	var err error
+	if tarWriter != nil {
+		err = tarWriter.Close()
+	} else {
+		err = zipWriter.Close()
+	}
+	if err == nil {
+		err = output.Flush()
+	}
+	if err != nil {
+		return failure(exitError, "Error writing to stdout:", err.Error())
+	}
+	return nil
+}
+
+// Returns the tar header for an entry whose contents are size bytes long, or
+// false if it's a socket, which tar can't store.
+func tarHeader(entry *falib.Entry, size int64) (*tar.Header, bool) {
+	header := &tar.Header{
+		Name:    entry.Path,
+		Mode:    int64(entry.Mode.Perm()),
+		Uid:     entry.Uid,
+		Gid:     entry.Gid,
+		ModTime: entry.ModTime,
+	}
+	if entry.Mode&os.ModeSetuid != 0 {
+		header.Mode |= 04000
+	}
+	if entry.Mode&os.ModeSetgid != 0 {
+		header.Mode |= 02000
+	}
+	if entry.Mode&os.ModeSticky != 0 {
+		header.Mode |= 01000
+	}
+	switch {
+	case entry.Mode.IsDir():
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+	case entry.Mode.IsRegular():
+		header.Typeflag = tar.TypeReg
+		header.Size = size
+	case entry.Mode&os.ModeSymlink != 0:
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = entry.Linkname
+	case entry.Mode&os.ModeNamedPipe != 0:
+		header.Typeflag = tar.TypeFifo
+	case entry.Mode&os.ModeCharDevice != 0:
+		header.Typeflag = tar.TypeChar
+		header.Devmajor, header.Devminor = int64(entry.Major), int64(entry.Minor)
+	case entry.Mode&os.ModeDevice != 0:
+		header.Typeflag = tar.TypeBlock
+		header.Devmajor, header.Devminor = int64(entry.Major), int64(entry.Minor)
+	default:
+		return nil, false
+	}
+	return header, true
+}
+
+// Writes an entry read by reader to a tar file.  A tar header comes before
+// the file's contents and records their size, so the contents are read in
+// full first.
+func writeTarEntry(writer *tar.Writer, entry *falib.Entry, reader io.Reader) (bool, error) {
+	var contents io.Reader
+	var size int64
+	if entry.Mode.IsRegular() {
+		spooled, err := spool(reader)
+		if err != nil {
+			return false, err
+		}
+		defer spooled.Close()
+		contents, size = spooled, spooled.size
+	}
+	header, ok := tarHeader(entry, size)
+	if !ok {
+		return false, nil
+	}
+	err := writer.WriteHeader(header)
+	if err == nil && contents != nil {
+		_, err = io.Copy(writer, contents)
+	}
+	return true, err
+}
+
+// Writes an entry read by reader to a zip file, which can hold only files,
+// directories, and symbolic links, and records their permissions but not their
+// owners.  A symbolic link is stored as a file whose contents are its target,
+// as Info-ZIP stores them.
+func writeZipEntry(writer *zip.Writer, entry *falib.Entry, reader io.Reader) (bool, error) {
+	symlink := entry.Mode&os.ModeSymlink != 0
+	if !entry.Mode.IsDir() && !entry.Mode.IsRegular() && !symlink {
+		return false, nil
+	}
+	header := &zip.FileHeader{Name: entry.Path, Method: zip.Deflate, Modified: entry.ModTime}
+	header.SetMode(entry.Mode)
+	if entry.Mode.IsDir() {
+		header.Name += "/"
+		header.Method = zip.Store
+	} else if symlink {
+		header.Method = zip.Store
+	}
+	contents, err := writer.CreateHeader(header)
+	if err == nil && entry.Mode.IsRegular() {
+		_, err = io.Copy(contents, reader)
+	} else if err == nil && symlink {
+		_, err = io.WriteString(contents, entry.Linkname)
+	}
+	return true, err
+}
+
+// A file's contents, read in full, in memory or in a temporary file.
+type spooledContents struct {
+	io.Reader
+	size int64
+	file *os.File
+}
+
+// Reads contents in full, so that their size is known before they're used.
+func spool(contents io.Reader) (*spooledContents, error) {
+	var buffer bytes.Buffer
+	n, err := io.CopyN(&buffer, contents, spoolMemoryLimit+1)
+	if err == io.EOF {
+		return &spooledContents{Reader: &buffer, size: n}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile("", "fast-archiver-spool")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &spooledContents{Reader: file, file: file}
+	spooled.size, err = io.Copy(file, io.MultiReader(&buffer, contents))
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
+
+// Removes the temporary file, if the contents needed one.
+func (s *spooledContents) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
@@ -0,0 +1,835 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type createOptions struct {
+	outputFileName         *string
+	requestedBlockSize     *uint
+	dirReaderCount         *int
+	fileReaderCount        *int
+	directoryScanQueueSize *int
+	fileReadQueueSize      *int
+	blockQueueSize         *int
+	align                  *int
+	manifestFileName       *string
+	dedup                  *bool
+	runLength              *bool
+	splitByDir             *bool
+	newerThan              *string
+	newerMtime             *string
+	olderMtime             *string
+	volumeSize             *string
+	snapshotFileName       *string
+	readLimit              *string
+	writeLimit             *string
+	writeBatchSize         *string
+	flushInterval          *time.Duration
+	exclude                *string
+	dereference            *bool
+	oneFileSystem          *bool
+	maxDepth               *int
+	types                  *string
+	owner                  *string
+	group                  *string
+	minSize                *string
+	maxSize                *string
+	excludeHashes          *string
+	listen                 *string
+	tlsCert                *string
+	tlsKey                 *string
+	filesFrom              *string
+	nulSeparated           *bool
+	compress               *bool
+	compressWorkers        *int
+	noCompressSuffixes     *string
+	storeOnly              *string
+	compressDict           *string
+	hashWorkers            *int
+	formatVersion          *int
+	stats                  *bool
+	progress               *bool
+	metricsListen          *string
+	estimate               *bool
+	statsJSON              *string
+	maxMemory              *string
+	mmap                   *bool
+	directIO               *bool
+	dropCache              *bool
+	excludeVCS             *bool
+	excludeVCSIgnores      *bool
+	watch                  *bool
+	watchInterval          *time.Duration
+	shards                 *int
+	compressProgram        *programFlag
+	retries                *int
+	retryDelay             *time.Duration
+	consistencyCheck       *int
+	snapshot               *string
+	deterministic          *bool
+	order                  *string
+	adaptive               *bool
+	prune                  *string
+	catalog                *string
+	resumeUpload           *bool
+	uploadState            *string
+
+	// Set by diff-create: the old tree that the archive is a delta from.
+	compareWith string
+}
+
+func addCreateFlags(fs *flag.FlagSet) *createOptions {
+	return &createOptions{
+		outputFileName:         fs.String("o", "", "output file, s3://, gs://, az:// object, or [user@]host:path over ssh; defaults to stdout"),
+		requestedBlockSize:     fs.Uint("block-size", 4096, "internal block-size"),
+		dirReaderCount:         fs.Int("dir-readers", 16, "number of simultaneous directory readers"),
+		fileReaderCount:        fs.Int("file-readers", 16, "number of simultaneous file readers"),
+		directIO:               fs.Bool("direct-io", false, "read files with O_DIRECT, bypassing the page cache; needs a --block-size that's a multiple of 4096"),
+		dropCache:              fs.Bool("drop-cache", false, "advise the kernel to drop files from the page cache once they've been read"),
+		mmap:                   fs.Bool("mmap", false, "read files of 1MB or more by memory-mapping them, instead of with read()"),
+		directoryScanQueueSize: fs.Int("queue-dir", 128, "initial queue size for scanning directories; the queue grows as needed"),
+		fileReadQueueSize:      fs.Int("queue-read", 128, "queue size for reading files"),
+		blockQueueSize:         fs.Int("queue-write", 128, "queue size for archive write; increasing can cause increased memory usage"),
+		maxMemory:              fs.String("max-memory", "", "maximum memory for blocks read but not yet written (eg. 256M); file readers wait when it's used up"),
+		align:                  fs.Int("align", 0, "pad the archive so that file data starts at multiples of this many bytes"),
+		manifestFileName:       fs.String("manifest", "", "write a sha256sum-compatible manifest of archived files to this file"),
+		dedup:                  fs.Bool("dedup", false, "split files into content-defined chunks and store each unique chunk only once"),
+		compress:               fs.Bool("compress", false, "compress each data block with deflate, in parallel"),
+		compressWorkers:        fs.Int("compress-workers", 0, "number of goroutines compressing blocks for --compress; defaults to --multicpu"),
+		hashWorkers:            fs.Int("hash-workers", 0, "number of goroutines hashing files for --manifest, --catalog, and --events-json, apart from the file readers; defaults to --multicpu"),
+		noCompressSuffixes:     fs.String("no-compress-suffixes", "", "with --compress, store files with these comma-separated name suffixes (eg. .jpg,.mp4,.zst) uncompressed"),
+		storeOnly:              fs.String("store-only", "", "with --compress, store files whose names match these patterns (eg. *.iso) uncompressed; can be path list separated for multiple patterns"),
+		compressDict:           fs.String("compress-dict", "", "with --compress, compress blocks with this preset dictionary (see train-dictionary), stored in the archive"),
+		formatVersion:          fs.Int("format-version", 1, "archive format version; 2 is smaller, but can't be read by older versions of fast-archiver"),
+		deterministic:          fs.Bool("deterministic", false, "always write the same archive for the same files: read them one at a time in order, without owners, and with times clamped to $SOURCE_DATE_EPOCH, or left out"),
+		adaptive:               fs.Bool("adaptive", false, "grow and shrink the number of file readers while archiving, starting from --file-readers, to get the most read throughput"),
+		prune:                  fs.String("prune", "", "after a successful run, delete the older archives named like -o, with a time in place of its %t, that aren't kept by this policy (eg. keep-daily=7,keep-weekly=4)"),
+		catalog:                fs.String("catalog", "", "record the archive, offset, size, and SHA-256 of each archived file in this catalog file, for fast-archiver find"),
+		order:                  fs.String("order", "as-scanned", "order to read files in: as-scanned, small-first, or large-first, among the files waiting to be read (see --queue-read)"),
+		runLength:              fs.Bool("run-length", false, "store runs of identical blocks within a file, such as zeros, as a single block and a repeat count"),
+		splitByDir:             fs.Bool("split-by-dir", false, "write a separate archive for each directory argument, named by replacing %s in -o with the directory"),
+		newerThan:              fs.String("newer-than", "", "only archive files modified after this RFC 3339 timestamp or date"),
+		newerMtime:             fs.String("newer-mtime", "", "only archive files modified within this long (eg. 7d, 12h) before now, or after this timestamp or date"),
+		olderMtime:             fs.String("older-mtime", "", "only archive files modified more than this long (eg. 30d) before now, or before this timestamp or date"),
+		shards:                 fs.Int("shards", 1, "write this many archives in parallel, named by replacing %s in -o with 1, 2, ...; each file goes to one of them"),
+		volumeSize:             fs.String("volume-size", "", "split the archive into volumes of this size (eg. 4G), named by appending .001, .002, ... to -o"),
+		watch:                  fs.Bool("watch", false, "keep running, and write an incremental archive whenever files change; needs --snapshot-file, and -o containing %s"),
+		watchInterval:          fs.Duration("watch-interval", time.Minute, "with --watch, the minimum time between archives"),
+		resumeUpload:           fs.Bool("resume-upload", false, "keep track of the parts of an s3://, gs://, or az:// upload, and resume it if it fails and is run again"),
+		uploadState:            fs.String("upload-state", ".fast-archiver-upload", "file that --resume-upload keeps track of uploads in"),
+		snapshotFileName:       fs.String("snapshot-file", "", "create an incremental archive of the changes since the snapshot in this file, and update it"),
+		retries:                fs.Int("retries", 0, "retry opening or reading a file this many times after transient errors (EIO, ESTALE), as on NFS"),
+		retryDelay:             fs.Duration("retry-delay", time.Second, "with --retries, the delay before the first retry, doubled for each one after"),
+		snapshot:               fs.String("snapshot", "", "with auto, archive directories on btrfs, ZFS, or LVM thin volumes from a read-only snapshot, removed afterwards"),
+		consistencyCheck:       fs.Int("consistency-check", 0, "read a file that changes while it's being read again, up to this many times, before archiving it as possibly inconsistent"),
+		readLimit:              fs.String("read-limit", "", "maximum rate at which to read files, in bytes per second (eg. 50M)"),
+		writeLimit:             fs.String("write-limit", "", "maximum rate at which to write the archive, in bytes per second (eg. 50M)"),
+		writeBatchSize:         fs.String("write-batch-size", "1M", "write the archive out in batches of this size, from a goroutine of its own; 0 writes it through a plain buffer"),
+		flushInterval:          fs.Duration("flush-interval", time.Second, "write out a batch that isn't full once it has been waiting this long; 0 waits until it's full"),
+		exclude:                fs.String("exclude", "", "file patterns to exclude (eg. core.*); can be path list separated (eg. : in Linux) for multiple excludes"),
+		dereference:            fs.Bool("dereference", false, "archive the files and directories that symbolic links point to, instead of skipping the links"),
+		oneFileSystem:          fs.Bool("one-file-system", false, "don't descend into directories on other filesystems than the directory being archived"),
+		minSize:                fs.String("min-size", "", "only archive files of at least this size (eg. 100M)"),
+		maxSize:                fs.String("max-size", "", "only archive files of at most this size (eg. 4G)"),
+		maxDepth:               fs.Int("max-depth", 0, "only descend this many directories below each directory being archived; 0 is unlimited"),
+		owner:                  fs.String("owner", "", "only archive files owned by these users, as names or uids separated by commas; directories are archived whoever owns them"),
+		group:                  fs.String("group", "", "only archive files belonging to these groups, as names or gids separated by commas"),
+		types:                  fs.String("types", "", "only archive entries of these types, as find -type letters (eg. f,l): f files, d directories, l symbolic links, p FIFOs, c and b devices, s sockets"),
+		excludeVCS:             fs.Bool("exclude-vcs", false, "leave out version control directories (.git, .hg, .svn, .bzr, CVS, _darcs)"),
+		excludeVCSIgnores:      fs.Bool("exclude-vcs-ignores", false, "leave out files ignored by .gitignore files and .git/info/exclude"),
+		excludeHashes:          fs.String("exclude-hashes", "", "file listing SHA-256s (eg. sha256sum output) of file contents to leave out of the archive"),
+		stats:                  fs.Bool("stats", false, "print a summary of what was archived, and how fast each stage ran, on stderr at the end"),
+		progress:               fs.Bool("progress", false, "show the files and bytes read so far, and the read rate, on stderr"),
+		metricsListen:          fs.String("metrics-listen", "", "serve Prometheus metrics of the files and bytes archived, queue depths, and warnings on this address (eg. :9100) at /metrics"),
+		estimate:               fs.Bool("estimate", false, "add up the files to archive before starting, and show --progress as a percentage with the time left"),
+		statsJSON:              fs.String("stats-json", "", "write the --stats summary to this file as JSON"),
+		listen:                 fs.String("listen", "", "address to serve the archive on to a single tcp:// or tls:// client, instead of writing it out"),
+		tlsCert:                fs.String("tls-cert", "", "certificate file to serve --listen connections over TLS"),
+		tlsKey:                 fs.String("tls-key", "", "private key file for --tls-cert"),
+		filesFrom:              fs.String("files-from", "", "archive exactly the paths listed in this file, one per line, instead of scanning directories; - reads stdin"),
+		nulSeparated:           fs.Bool("0", false, "paths in --files-from are separated by NUL bytes (eg. find -print0)"),
+		compressProgram:        addCompressProgramFlag(fs),
+	}
+}
+
+// Returns the file order selected by --order.
+func (opts *createOptions) fileOrder() (falib.FileOrder, error) {
+	switch *opts.order {
+	case "as-scanned":
+		return falib.OrderAsScanned, nil
+	case "small-first":
+		return falib.OrderSmallFirst, nil
+	case "large-first":
+		return falib.OrderLargeFirst, nil
+	}
+	return falib.OrderAsScanned, failure(exitUsage, "--order must be as-scanned, small-first, or large-first")
+}
+
+// Opens the -o destination for writing, whether it's a file, object storage,
+// or a file on another host.  With uploads, object storage uploads are
+// resumable.
+func createOutput(name string, uploads *uploadState) (io.WriteCloser, error) {
+	if isObjectURL(name) {
+		return createObjectWriter(name, uploads)
+	} else if isSSHPath(name) {
+		return createSSHWriter(name)
+	}
+	return os.Create(name)
+}
+
+// Discards an output that won't be completed.  Uploads are abandoned, and
+// when interrupted, an archive file that was partly written is removed too.
+func abortOutput(output io.WriteCloser, interrupted bool) {
+	if writer, ok := output.(*programWriter); ok {
+		writer.kill()
+		abortOutput(writer.output, interrupted)
+	} else if target, ok := output.(*sshTarget); ok && interrupted {
+		target.remove()
+	} else if writer, ok := output.(interface{ Abort() error }); ok {
+		writer.Abort()
+	} else if file, ok := output.(*os.File); ok && interrupted && file != os.Stdout {
+		file.Close()
+		os.Remove(file.Name())
+	}
+}
+
+// Converts a directory argument into a name to substitute into the -o template
+// with --split-by-dir, eg. "tenants/acme/" becomes "tenants_acme".
+func splitName(directoryPath string) string {
+	name := strings.Trim(filepath.ToSlash(filepath.Clean(directoryPath)), "/")
+	name = strings.Replace(name, "/", "_", -1)
+	if name == "" || name == "." {
+		name = "root"
+	}
+	return name
+}
+
+// Returns the name to substitute into the -o template for shard i of n,
+// zero-padded so that the shards sort in order.
+func shardName(i, n int) string {
+	return fmt.Sprintf("%0*d", len(strconv.Itoa(n)), i)
+}
+
+// Parses a --newer-than argument, which can be an RFC 3339 timestamp or a date.
+func parseTimestamp(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02", value, time.Local)
+	}
+	return t, err
+}
+
+// Parses a --newer-mtime or --older-mtime value: an age before now, as a
+// duration (eg. 12h) or a number of days or weeks (eg. 7d, 2w), or else a
+// timestamp or date, as for --newer-than.
+func parseMtime(value string, now time.Time) (time.Time, error) {
+	unit := time.Duration(0)
+	if strings.HasSuffix(value, "d") {
+		unit = 24 * time.Hour
+	} else if strings.HasSuffix(value, "w") {
+		unit = 7 * 24 * time.Hour
+	}
+	if unit != 0 {
+		days, err := strconv.ParseFloat(value[:len(value)-1], 64)
+		if err == nil && days >= 0 {
+			return now.Add(-time.Duration(days * float64(unit))), nil
+		}
+	}
+	if age, err := time.ParseDuration(value); err == nil && age >= 0 {
+		return now.Add(-age), nil
+	}
+	return parseTimestamp(value)
+}
+
+// Parses a --types list of find -type letters, separated by commas or not,
+// into the form of Archiver.Types.
+func parseTypes(value string) (string, error) {
+	types := strings.Replace(value, ",", "", -1)
+	if types == "" {
+		return "", fmt.Errorf("no types given")
+	}
+	for _, letter := range types {
+		if !strings.ContainsRune("fdlpcbs", letter) {
+			return "", fmt.Errorf("unknown type %q; expected f, d, l, p, c, b, or s", letter)
+		}
+	}
+	return types, nil
+}
+
+// Parses an --owner or --group list of names or numeric IDs, separated by
+// commas, looking up the names with lookup.
+func parseIds(value string, lookup func(name string) (string, error)) ([]int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var ids []int
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		id, err := strconv.Atoi(name)
+		if err != nil {
+			var found string
+			found, err = lookup(name)
+			if err == nil {
+				id, err = strconv.Atoi(found)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func lookupUid(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGid(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+func runCreate(common *commonOptions, opts *createOptions, directories []string) error {
+	common.apply()
+
+	if len(directories) == 0 && *opts.filesFrom == "" {
+		return failure(exitUsage, "Files or directories to archive must be specified")
+	}
+	if (*opts.noCompressSuffixes != "" || *opts.storeOnly != "" || *opts.compressDict != "") && !*opts.compress {
+		return failure(exitUsage, "--no-compress-suffixes, --store-only, and --compress-dict require --compress")
+	}
+	if *opts.compress && *opts.align != 0 {
+		return failure(exitUsage, "--compress and --align cannot be used together")
+	}
+	if *opts.filesFrom != "" && *opts.splitByDir {
+		return failure(exitUsage, "--files-from and --split-by-dir cannot be used together")
+	}
+	if *opts.shards < 1 {
+		return failure(exitUsage, "--shards must be at least 1")
+	}
+	if *opts.newerThan != "" && *opts.newerMtime != "" {
+		return failure(exitUsage, "--newer-than and --newer-mtime cannot be used together")
+	}
+	if *opts.maxDepth < 0 {
+		return failure(exitUsage, "--max-depth can't be negative")
+	}
+	if *opts.shards > 1 && (*opts.splitByDir || *opts.listen != "") {
+		return failure(exitUsage, "--shards cannot be used with --split-by-dir or --listen")
+	}
+	if *opts.estimate && *opts.filesFrom != "" {
+		return failure(exitUsage, "--estimate cannot be used with --files-from")
+	}
+	if *opts.snapshot != "" && *opts.snapshot != "auto" {
+		return failure(exitUsage, "--snapshot must be auto")
+	}
+	if *opts.snapshot != "" && (*opts.watch || *opts.filesFrom != "") {
+		return failure(exitUsage, "--snapshot cannot be used with --watch or --files-from")
+	}
+	order, err := opts.fileOrder()
+	if err != nil {
+		return err
+	}
+	if *opts.types != "" {
+		_, err = parseTypes(*opts.types)
+		if err != nil {
+			return failure(exitUsage, "Invalid --types:", err.Error())
+		}
+	}
+	_, err = parseIds(*opts.owner, lookupUid)
+	if err != nil {
+		return failure(exitUsage, "Invalid --owner:", err.Error())
+	}
+	_, err = parseIds(*opts.group, lookupGid)
+	if err != nil {
+		return failure(exitUsage, "Invalid --group:", err.Error())
+	}
+	if order != falib.OrderAsScanned && *opts.deterministic {
+		return failure(exitUsage, "--order cannot be used with --deterministic")
+	}
+	if *opts.adaptive && *opts.deterministic {
+		return failure(exitUsage, "--adaptive cannot be used with --deterministic")
+	}
+	if *common.birthTime && *opts.deterministic {
+		return failure(exitUsage, "--btime cannot be used with --deterministic")
+	}
+	if *opts.requestedBlockSize > math.MaxUint16 {
+		return failure(exitUsage, "block-size must be less than or equal to", math.MaxUint16)
+	}
+	var retention retentionPolicy
+	if *opts.prune != "" {
+		retention, err = parseRetention(*opts.prune)
+		if err != nil {
+			return failure(exitUsage, "Invalid --prune:", err.Error())
+		}
+		if !strings.Contains(*opts.outputFileName, "%t") || isSSHPath(*opts.outputFileName) {
+			return failure(exitUsage, "--prune requires a local or object storage -o name containing", "%t")
+		}
+		if *opts.watch || *opts.snapshotFileName != "" || *opts.splitByDir || *opts.shards > 1 || *opts.volumeSize != "" || *opts.listen != "" {
+			return failure(exitUsage, "--prune cannot be used with --watch, --snapshot-file, --split-by-dir, --shards, --volume-size, or --listen")
+		}
+	}
+	if *opts.catalog != "" && (*opts.outputFileName == "" || *opts.splitByDir || *opts.shards > 1 || *opts.listen != "") {
+		return failure(exitUsage, "--catalog requires -o, and cannot be used with --split-by-dir, --shards, or --listen")
+	}
+	if *opts.metricsListen != "" {
+		metrics, err = startMetrics(*opts.metricsListen)
+		if err != nil {
+			return failure(exitError, "Error starting metrics server:", err.Error())
+		}
+	}
+	if !*common.absolute && opts.compareWith == "" {
+		for _, directory := range directories {
+			if falib.RelativePath(directory) != filepath.Clean(directory) {
+				logger.Println("Removing leading / and ../ from archived paths; use -P to keep them")
+				break
+			}
+		}
+	}
+	if *opts.watch {
+		return runWatch(common, opts, directories)
+	}
+	_, err = createArchive(common, opts, directories, *opts.outputFileName)
+	if err != nil {
+		return err
+	}
+	if *opts.prune != "" {
+		if atomic.LoadInt64(&warningCount) > 0 {
+			logger.Println("Not pruning older archives, since this one may be incomplete")
+		} else {
+			err = pruneArchives(*opts.outputFileName, retention, *common.dryRun, common.logger())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return warned()
+}
+
+// Creates an archive of directories, written to outputName (or according to
+// the other output options), and returns the archiver's stats.
+func createArchive(common *commonOptions, opts *createOptions, directories []string, outputName string) (falib.Stats, error) {
+	outputName = strings.Replace(outputName, "%t", time.Now().UTC().Format(archiveTimestampFormat), -1)
+	var uploads *uploadState
+	if *opts.resumeUpload && !*common.dryRun {
+		if !isObjectURL(outputName) {
+			return falib.Stats{}, failure(exitUsage, "--resume-upload requires an s3://, gs://, or az:// -o")
+		}
+		var err error
+		uploads, err = loadUploadState(*opts.uploadState)
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error loading --upload-state:", err.Error())
+		}
+	}
+	openOutput := func(name string) (io.WriteCloser, error) {
+		return createOutput(name, uploads)
+	}
+	if *opts.volumeSize != "" && !*common.dryRun {
+		size, err := parseSize(*opts.volumeSize)
+		if err != nil {
+			return falib.Stats{}, failure(exitUsage, "Invalid --volume-size:", err.Error())
+		}
+		if outputName == "" || *opts.listen != "" {
+			return falib.Stats{}, failure(exitUsage, "--volume-size requires -o")
+		}
+		openOutput = func(name string) (io.WriteCloser, error) {
+			w, err := newVolumeWriter(name, size, uploads)
+			if err != nil {
+				return nil, err
+			}
+			w.sync = common.fsync.archive
+			return w, nil
+		}
+	}
+
+	if program := opts.compressProgram.command; program != "" && !*common.dryRun {
+		if *opts.listen != "" {
+			return falib.Stats{}, failure(exitUsage, "--use-compress-program and --listen cannot be used together")
+		}
+		// Volumes are split from the compressed stream, rather than each
+		// being compressed separately.
+		openRaw := openOutput
+		openOutput = func(name string) (io.WriteCloser, error) {
+			output, err := openRaw(name)
+			if err != nil {
+				return nil, err
+			}
+			writer, err := compressOutput(program, output)
+			if err != nil {
+				abortOutput(output, true)
+				return nil, err
+			}
+			writer.sync = common.fsync.archive
+			return writer, nil
+		}
+	}
+
+	var snapshots *volumeSnapshots
+	if *opts.snapshot != "" && !*common.dryRun {
+		var err error
+		snapshots, err = takeVolumeSnapshots(directories, common.logger())
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error taking snapshot:", err.Error())
+		}
+		defer snapshots.release()
+	}
+
+	var outputFile io.WriteCloser
+	var outputWriter io.Writer
+	var resumeSet *falib.ResumeSet
+	if *common.dryRun {
+		outputWriter = sink(true)
+	} else if *opts.listen != "" {
+		if outputName != "" {
+			return falib.Stats{}, failure(exitUsage, "-o and --listen cannot be used together")
+		}
+		conn, err := listenForArchive(*opts.listen, *opts.tlsCert, *opts.tlsKey)
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error accepting connection:", err.Error())
+		}
+		resumeSet, err = readResumeRequest(conn)
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error reading resume request:", err.Error())
+		}
+		if resumeSet.Len() > 0 {
+			logger.Println("resuming; receiver already has", resumeSet.Len(), "files")
+		}
+		outputFile = conn
+		outputWriter = conn
+	} else if *opts.splitByDir {
+		if !strings.Contains(outputName, "%s") {
+			return falib.Stats{}, failure(exitUsage, "--split-by-dir requires an -o name containing", "%s")
+		}
+	} else if *opts.shards > 1 {
+		if !strings.Contains(outputName, "%s") {
+			return falib.Stats{}, failure(exitUsage, "--shards requires an -o name containing", "%s")
+		}
+	} else if outputName != "" {
+		output, err := openOutput(outputName)
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error creating output:", err.Error())
+		}
+		outputFile = output
+		outputWriter = output
+	} else if program := opts.compressProgram.command; program != "" {
+		output, err := compressOutput(program, os.Stdout)
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error starting compress program:", err.Error())
+		}
+		output.sync = common.fsync.archive
+		outputFile = output
+		outputWriter = output
+	} else {
+		outputFile = os.Stdout
+		outputWriter = os.Stdout
+	}
+
+	archiver := falib.NewArchiver(outputWriter)
+	archiver.BlockSize = uint16(*opts.requestedBlockSize)
+	archiver.DirScanQueueSize = *opts.directoryScanQueueSize
+	archiver.FileReadQueueSize = *opts.fileReadQueueSize
+	archiver.BlockQueueSize = *opts.blockQueueSize
+	archiver.ExcludePatterns = filepath.SplitList(*opts.exclude)
+	archiver.Align = *opts.align
+	archiver.DirReaderCount = *opts.dirReaderCount
+	archiver.FileReaderCount = *opts.fileReaderCount
+	archiver.DryRun = *common.dryRun
+	archiver.Strict = *common.strict
+	archiver.Dedup = *opts.dedup
+	archiver.RunLength = *opts.runLength
+	archiver.Compress = *opts.compress
+	archiver.FormatVersion = *opts.formatVersion
+	archiver.CompressWorkers = *opts.compressWorkers
+	archiver.HashWorkers = *opts.hashWorkers
+	if *opts.compressDict != "" {
+		dictionary, err := ioutil.ReadFile(*opts.compressDict)
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error reading --compress-dict:", err.Error())
+		}
+		archiver.CompressDictionary = dictionary
+	}
+	for _, suffix := range strings.Split(*opts.noCompressSuffixes, ",") {
+		if suffix = strings.TrimSpace(suffix); suffix != "" {
+			archiver.NoCompressSuffixes = append(archiver.NoCompressSuffixes, suffix)
+		}
+	}
+	archiver.StoreOnlyPatterns = filepath.SplitList(*opts.storeOnly)
+	archiver.Dereference = *opts.dereference
+	archiver.OneFileSystem = *opts.oneFileSystem
+	archiver.MaxDepth = *opts.maxDepth
+	archiver.Types, _ = parseTypes(*opts.types)
+	archiver.Owners, _ = parseIds(*opts.owner, lookupUid)
+	archiver.Groups, _ = parseIds(*opts.group, lookupGid)
+	archiver.Transforms = *common.transforms
+	archiver.Mmap = *opts.mmap
+	archiver.DirectIO = *opts.directIO
+	archiver.DropCache = *opts.dropCache
+	archiver.ExcludeVCS = *opts.excludeVCS
+	archiver.ExcludeVCSIgnores = *opts.excludeVCSIgnores
+	archiver.Resume = resumeSet
+	archiver.Retries = *opts.retries
+	archiver.RetryDelay = *opts.retryDelay
+	archiver.ConsistencyRetries = *opts.consistencyCheck
+	archiver.Deterministic = *opts.deterministic
+	archiver.BirthTime = *common.birthTime
+	archiver.Order, _ = opts.fileOrder()
+	archiver.Adaptive = *opts.adaptive
+	archiver.AbsolutePaths = *common.absolute
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" && *opts.deterministic {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return falib.Stats{}, failure(exitUsage, "Invalid SOURCE_DATE_EPOCH:", err.Error())
+		}
+		archiver.ClampModTime = time.Unix(seconds, 0)
+	}
+	if *opts.readLimit != "" {
+		limit, err := parseSize(*opts.readLimit)
+		if err != nil {
+			return falib.Stats{}, failure(exitUsage, "Invalid --read-limit:", err.Error())
+		}
+		archiver.ReadLimit = limit
+	}
+	if *opts.maxMemory != "" {
+		limit, err := parseSize(*opts.maxMemory)
+		if err != nil {
+			return falib.Stats{}, failure(exitUsage, "Invalid --max-memory:", err.Error())
+		}
+		archiver.MaxMemory = limit
+	}
+	if *opts.writeLimit != "" {
+		limit, err := parseSize(*opts.writeLimit)
+		if err != nil {
+			return falib.Stats{}, failure(exitUsage, "Invalid --write-limit:", err.Error())
+		}
+		archiver.WriteLimit = limit
+	}
+	if *opts.writeBatchSize != "" {
+		size, err := parseSize(*opts.writeBatchSize)
+		if err != nil || size > math.MaxInt32 {
+			return falib.Stats{}, failure(exitUsage, "Invalid --write-batch-size:", *opts.writeBatchSize)
+		}
+		archiver.OutputBatchSize = int(size)
+	}
+	archiver.FlushInterval = *opts.flushInterval
+	archiver.SyncOutput = common.fsync.archive
+	if *opts.minSize != "" {
+		size, err := parseSize(*opts.minSize)
+		if err != nil {
+			return falib.Stats{}, failure(exitUsage, "Invalid --min-size:", err.Error())
+		}
+		archiver.MinSize = size
+	}
+	if *opts.maxSize != "" {
+		size, err := parseSize(*opts.maxSize)
+		if err != nil {
+			return falib.Stats{}, failure(exitUsage, "Invalid --max-size:", err.Error())
+		}
+		archiver.MaxSize = size
+	}
+	if *opts.newerThan != "" {
+		t, err := parseTimestamp(*opts.newerThan)
+		if err != nil {
+			return falib.Stats{}, failure(exitUsage, "Invalid --newer-than timestamp:", err.Error())
+		}
+		archiver.NewerThan = t
+	}
+	if *opts.newerMtime != "" {
+		t, err := parseMtime(*opts.newerMtime, time.Now())
+		if err != nil {
+			return falib.Stats{}, failure(exitUsage, "Invalid --newer-mtime:", err.Error())
+		}
+		archiver.NewerThan = t
+	}
+	if *opts.olderMtime != "" {
+		t, err := parseMtime(*opts.olderMtime, time.Now())
+		if err != nil {
+			return falib.Stats{}, failure(exitUsage, "Invalid --older-mtime:", err.Error())
+		}
+		archiver.OlderThan = t
+	}
+	if *opts.excludeHashes != "" {
+		hashes, err := falib.LoadHashSet(*opts.excludeHashes)
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error loading --exclude-hashes:", err.Error())
+		}
+		archiver.ExcludeHashes = hashes
+	}
+	if *opts.snapshotFileName != "" {
+		snapshot, err := falib.LoadSnapshot(*opts.snapshotFileName)
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error loading snapshot file:", err.Error())
+		}
+		archiver.Snapshot = snapshot
+	}
+	var extraOutputs []io.WriteCloser
+	if *opts.splitByDir && !*common.dryRun {
+		archiver.SplitOutput = func(directoryPath string) (io.Writer, error) {
+			output, err := openOutput(strings.Replace(outputName, "%s", splitName(directoryPath), -1))
+			if err == nil {
+				extraOutputs = append(extraOutputs, output)
+			}
+			return output, err
+		}
+	}
+	if *opts.shards > 1 && !*common.dryRun {
+		for i := 1; i <= *opts.shards; i++ {
+			output, err := openOutput(strings.Replace(outputName, "%s", shardName(i, *opts.shards), -1))
+			if err != nil {
+				for _, output := range extraOutputs {
+					abortOutput(output, true)
+				}
+				return falib.Stats{}, failure(exitError, "Error creating output:", err.Error())
+			}
+			extraOutputs = append(extraOutputs, output)
+			archiver.ShardOutputs = append(archiver.ShardOutputs, output)
+		}
+	}
+	var manifestFile *os.File
+	if *opts.manifestFileName != "" && !*common.dryRun {
+		file, err := os.Create(*opts.manifestFileName)
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error creating manifest file:", err.Error())
+		}
+		manifestFile = file
+		archiver.Manifest = file
+	}
+	if *opts.catalog != "" && !*common.dryRun {
+		catalog := falib.NewCatalog(*opts.catalog)
+		archiveName := outputName
+		if !isObjectURL(outputName) && !isSSHPath(outputName) {
+			archiveName, _ = filepath.Abs(outputName)
+		}
+		err := catalog.StartArchive(archiveName)
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error starting --catalog entry:", err.Error())
+		}
+		defer catalog.AbortArchive()
+		archiver.Catalog = catalog
+	}
+	if *opts.filesFrom == "-" {
+		archiver.FilesFrom = os.Stdin
+	} else if *opts.filesFrom != "" {
+		file, err := os.Open(*opts.filesFrom)
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error opening --files-from list:", err.Error())
+		}
+		defer file.Close()
+		archiver.FilesFrom = file
+	}
+	archiver.FilesFromNul = *opts.nulSeparated
+	archiver.Logger = common.logger()
+	if events != nil {
+		archiver.StartHook = events.fileStarted
+		archiver.ArchiveHook = events.archived
+	}
+	archiver.CompareWith = opts.compareWith
+	for _, directory := range directories {
+		source := directory
+		if snapshots != nil {
+			source = snapshots.source(directory)
+		}
+		if opts.compareWith != "" {
+			// A delta's paths are relative to the tops of the trees.
+			archiver.AddDirFrom(".", source)
+		} else {
+			archiver.AddDirFrom(directory, source)
+		}
+	}
+	var progress *progressDisplay
+	if *opts.progress || *opts.estimate {
+		var estimate *falib.Estimate
+		if *opts.estimate {
+			e := archiver.Estimate()
+			logger.Println("estimated", e.Files, "files,", formatSize(e.Bytes))
+			estimate = &e
+		}
+		progress = startProgress(archiver, estimate)
+	}
+	handleInterrupts(archiver.Interrupt)
+	metrics.track(archiver)
+	err := archiver.Run()
+	metrics.done(archiver, err)
+	if progress != nil {
+		progress.close()
+	}
+	if err != nil {
+		for _, output := range append(extraOutputs, outputFile) {
+			abortOutput(output, err == falib.ErrInterrupted)
+		}
+		if err == falib.ErrInterrupted {
+			if manifestFile != nil {
+				manifestFile.Close()
+				os.Remove(manifestFile.Name())
+			}
+			return falib.Stats{}, err
+		}
+		return falib.Stats{}, failure(exitError, "Fatal error in archiver:", err.Error())
+	}
+	if manifestFile != nil {
+		err = manifestFile.Close()
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error closing manifest file:", err.Error())
+		}
+	}
+	if *opts.stats {
+		printStats(archiver.Stats())
+	}
+	if *opts.statsJSON != "" {
+		err = writeStatsJSON(*opts.statsJSON, archiver.Stats())
+		if err != nil {
+			return falib.Stats{}, failure(exitError, "Error writing --stats-json:", err.Error())
+		}
+	}
+	if excluded := archiver.ExcludedByHash(); len(excluded) > 0 {
+		logger.Println("excluded", len(excluded), "files matching --exclude-hashes")
+	}
+	if *common.dryRun {
+		files, bytes := archiver.DryRunTotals()
+		logger.Println("would archive", files, "files,", bytes, "bytes")
+	} else {
+		if outputFile != nil {
+			extraOutputs = append(extraOutputs, outputFile)
+		}
+		for _, output := range extraOutputs {
+			err = output.Close()
+			if err != nil {
+				return falib.Stats{}, failure(exitError, "Error closing output:", err.Error())
+			}
+		}
+		// Only once the archive is complete can the next incremental leave out
+		// what's in it.
+		if archiver.Snapshot != nil {
+			err = archiver.Snapshot.Save(*opts.snapshotFileName)
+			if err != nil {
+				return falib.Stats{}, failure(exitError, "Error saving snapshot file:", err.Error())
+			}
+		}
+		if archiver.Catalog != nil {
+			err = archiver.Catalog.FinishArchive()
+			if err != nil {
+				return falib.Stats{}, failure(exitError, "Error updating --catalog:", err.Error())
+			}
+		}
+	}
+	return archiver.Stats(), nil
+}
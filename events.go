@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/replicon/fast-archiver/falib"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The --events-json stream, or nil if it wasn't asked for.
+var events *eventStream
+
+// Newline-delimited JSON events describing a run as it happens, for
+// orchestration systems to follow instead of parsing stderr.  Every event has
+// an "event" name and a "time"; a run's last event is always its summary.
+type eventStream struct {
+	lock     sync.Mutex
+	output   io.WriteCloser
+	started  time.Time
+	files    int64
+	bytes    int64
+	finished bool
+}
+
+type fileStartedEvent struct {
+	Event string `json:"event"`
+	Time  string `json:"time"`
+	Path  string `json:"path"`
+}
+
+type fileDoneEvent struct {
+	Event    string  `json:"event"`
+	Time     string  `json:"time"`
+	Path     string  `json:"path"`
+	Size     int64   `json:"size"`
+	SHA256   string  `json:"sha256"`
+	Duration float64 `json:"duration"`
+}
+
+type errorEvent struct {
+	Event   string `json:"event"`
+	Time    string `json:"time"`
+	Message string `json:"message"`
+}
+
+type summaryEvent struct {
+	Event    string  `json:"event"`
+	Time     string  `json:"time"`
+	Status   int     `json:"status"`
+	Files    int64   `json:"files"`
+	Bytes    int64   `json:"bytes"`
+	Warnings int64   `json:"warnings"`
+	Elapsed  float64 `json:"elapsed"`
+}
+
+// Opens the --events-json destination: a file descriptor number that the
+// caller has opened (eg. 3, with 3>events.json in a shell), or a file name.
+func openEventStream(target string) (*eventStream, error) {
+	var output io.WriteCloser
+	if fd, err := strconv.Atoi(target); err == nil && fd >= 0 {
+		output = os.NewFile(uintptr(fd), "fd "+target)
+	} else {
+		file, err := os.Create(target)
+		if err != nil {
+			return nil, err
+		}
+		output = file
+	}
+	return &eventStream{output: output, started: time.Now()}, nil
+}
+
+func eventTime() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+// Writes an event as a line of JSON.  Write errors are ignored, since a
+// consumer going away shouldn't stop the run.
+func (s *eventStream) emit(event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.finished {
+		s.output.Write(append(data, '\n'))
+	}
+}
+
+func (s *eventStream) fileStarted(filePath string) {
+	s.emit(fileStartedEvent{"file-started", eventTime(), filePath})
+}
+
+func (s *eventStream) fileDone(filePath string, sum []byte, size int64, duration time.Duration) {
+	atomic.AddInt64(&s.files, 1)
+	atomic.AddInt64(&s.bytes, size)
+	s.emit(fileDoneEvent{"file-done", eventTime(), filePath, size, hex.EncodeToString(sum), duration.Seconds()})
+}
+
+func (s *eventStream) archived(file falib.ArchivedFile) {
+	s.fileDone(file.Path, file.SHA256, file.Size, file.Duration)
+}
+
+func (s *eventStream) restored(file falib.RestoredFile) {
+	s.fileDone(file.Path, file.SHA256, file.Size, file.Duration)
+}
+
+// Reports a warning or error; nothing is written if there's no stream.
+func (s *eventStream) error(message string) {
+	if s == nil {
+		return
+	}
+	s.emit(errorEvent{"error", eventTime(), message})
+}
+
+// Ends the stream with the summary of the run, which exits with status.
+// Nothing is written if there's no stream.
+func (s *eventStream) finish(status int) {
+	if s == nil {
+		return
+	}
+	s.emit(summaryEvent{"summary", eventTime(), status, atomic.LoadInt64(&s.files), atomic.LoadInt64(&s.bytes),
+		atomic.LoadInt64(&warningCount), time.Since(s.started).Seconds()})
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.finished = true
+	s.output.Close()
+}
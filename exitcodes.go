@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Exit statuses, so that scripts can tell what went wrong.  An interrupted
+// run exits with 128 plus the signal number instead (see signals.go).
+const (
+	exitOK = 0
+
+	// An error reading or writing files, the network, or object storage;
+	// also anything not covered by another status.
+	exitError = 1
+
+	// Invalid command line arguments.
+	exitUsage = 2
+
+	// The run completed, but warned about something it couldn't do, such as
+	// a file it couldn't read or restore faithfully; or, with --salvage, the
+	// archive couldn't be read to the end.
+	exitPartial = 3
+
+	// The archive is corrupt or truncated.
+	exitCorrupt = 4
+
+	// A --diff comparison found differences between the archive and the
+	// filesystem.
+	exitDifferent = 5
+)
+
+// The number of warnings logged, which make a run that otherwise succeeds
+// exit with exitPartial.
+var warningCount int64
+
+// Logs v and exits with the given status.
+func fatal(status int, v ...interface{}) {
+	logger.Println(v...)
+	events.error(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+	exit(status)
+}
+
+// Exits with the given status, after writing out any profiles, and ending any
+// --events-json stream with a summary of the run.
+func exit(status int) {
+	stopProfiling()
+	events.finish(status)
+	os.Exit(status)
+}
+
+// An error that ends a command with a particular exit status.  Commands
+// return these rather than exiting, so that they clean up after themselves,
+// and can be run more than once in a process; only the command's entry point
+// exits, with exitWith.
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// Returns a statusError with the message v, formatted as by fmt.Sprintln.
+func failure(status int, v ...interface{}) error {
+	return &statusError{status, strings.TrimSuffix(fmt.Sprintln(v...), "\n")}
+}
+
+// Exits with the status for err, if it isn't nil, after logging it.
+func exitWith(err error) {
+	var statusErr *statusError
+	if err == nil {
+		return
+	} else if err == falib.ErrInterrupted {
+		exitInterrupted()
+	} else if errors.As(err, &statusErr) {
+		if statusErr.message != "" {
+			logger.Println(statusErr.message)
+			events.error(statusErr.message)
+		}
+		exit(statusErr.status)
+	}
+	fatal(exitError, err.Error())
+}
+
+// Returns the exit status for an error reading an archive: exitCorrupt if the
+// archive is damaged, and exitError otherwise.
+func archiveErrorStatus(err error) int {
+	for _, corrupt := range []error{
+		io.ErrUnexpectedEOF,
+		falib.ErrFileHeaderMismatch,
+		falib.ErrCrcMismatch,
+		falib.ErrUnrecognizedBlockType,
+		falib.ErrUnknownChunk,
+		falib.ErrUnexpectedRepeat,
+		falib.ErrCompressedSizeMismatch,
+		falib.ErrUnknownFileId,
+		falib.ErrUnsupportedVersion,
+		falib.ErrDuplicateFile,
+		falib.ErrDuplicateFileId,
+		falib.ErrBlockTooLarge,
+		falib.ErrPathTooLong,
+		falib.ErrCorruptSummary,
+	} {
+		if errors.Is(err, corrupt) {
+			return exitCorrupt
+		}
+	}
+	return exitError
+}
+
+// Returns a statusError with exitPartial if any warnings were logged during an
+// otherwise successful run.
+func warned() error {
+	if n := atomic.LoadInt64(&warningCount); n > 0 {
+		return failure(exitPartial, "completed with", n, "warnings")
+	}
+	return nil
+}
+
+// Exits with exitPartial if any warnings were logged during an otherwise
+// successful run.
+func exitIfWarned() {
+	exitWith(warned())
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Options for commands that read an archive.
+type inputOptions struct {
+	inputFileNames  *inputFlags
+	tlsCA           *string
+	compressProgram *programFlag
+}
+
+// The values of -i flags, which can be given more than once.
+type inputFlags []string
+
+func (i *inputFlags) String() string {
+	return strings.Join(*i, " ")
+}
+
+func (i *inputFlags) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+func (i *inputFlags) reset() {
+	*i = nil
+}
+
+func addInputFlags(fs *flag.FlagSet) *inputOptions {
+	opts := &inputOptions{
+		inputFileNames:  &inputFlags{},
+		tlsCA:           fs.String("tls-ca", "", "CA certificate file to verify a tls:// input against"),
+		compressProgram: addCompressProgramFlag(fs),
+	}
+	fs.Var(opts.inputFileNames, "i", "input file, glob pattern, http(s):// URL, s3://, gs://, az:// object, [user@]host:path over ssh, or tcp:// or tls:// host:port; defaults to stdin; can be repeated to extract several archives at once")
+	return opts
+}
+
+// Returns the names of the -i archives, with glob patterns expanded, or "" for
+// stdin.  Of a set of volumes matched by a pattern, only the first is kept.
+func (opts *inputOptions) names() ([]string, error) {
+	if len(*opts.inputFileNames) == 0 {
+		return []string{""}, nil
+	}
+	var names []string
+	for _, name := range *opts.inputFileNames {
+		if isNetworkURL(name) || isObjectURL(name) || isHTTPURL(name) || isSSHPath(name) || !strings.ContainsAny(name, "*?[") {
+			names = append(names, name)
+			continue
+		}
+		matches, err := filepath.Glob(name)
+		if err != nil {
+			return nil, failure(exitUsage, "Invalid -i pattern:", err.Error())
+		} else if len(matches) == 0 {
+			return nil, failure(exitError, "No archives match", name)
+		}
+		for _, match := range matches {
+			if !laterVolume(match) {
+				names = append(names, match)
+			}
+		}
+	}
+	return names, nil
+}
+
+// Opens the single -i archive of a command that reads only one.
+func (opts *inputOptions) open() io.ReadCloser {
+	names, err := opts.names()
+	exitWith(err)
+	if len(names) > 1 {
+		fatal(exitUsage, "Only one -i archive can be given")
+	}
+	input, err := opts.openName(names[0])
+	exitWith(err)
+	return input
+}
+
+// Opens an archive, whether it's a file, a set of volumes, an object, a
+// network connection, or stdin if name is "", and starts decompressing it with
+// --use-compress-program.  A zip file is converted into an archive as it's
+// read.
+func (opts *inputOptions) openName(name string) (io.ReadCloser, error) {
+	input, err := opts.openRaw(name)
+	if file, ok := input.(*os.File); ok && err == nil && opts.compressProgram.command == "" {
+		converted, err := zipInput(file)
+		if err != nil {
+			file.Close()
+			return nil, failure(exitError, "Error reading zip file:", err.Error())
+		}
+		return converted, nil
+	}
+	if err != nil || opts.compressProgram.command == "" {
+		return input, err
+	}
+	if isNetworkURL(name) {
+		input.Close()
+		return nil, failure(exitUsage, "--use-compress-program can't be used with a tcp:// or tls:// input")
+	}
+	reader, err := decompressInput(opts.compressProgram.command, input)
+	if err != nil {
+		input.Close()
+		return nil, failure(exitError, "Error starting compress program:", err.Error())
+	}
+	return reader, nil
+}
+
+func (opts *inputOptions) openRaw(name string) (io.ReadCloser, error) {
+	if isNetworkURL(name) {
+		conn, err := dialArchive(name, *opts.tlsCA)
+		if err != nil {
+			return nil, failure(exitError, "Error connecting to archive source:", err.Error())
+		}
+		return conn, nil
+	} else if isObjectURL(name) {
+		reader, err := openObjectReader(name)
+		if err != nil {
+			return nil, failure(exitError, "Error opening input object:", err.Error())
+		}
+		return reader, nil
+	} else if base, ok := volumeSetName(name); ok {
+		return openVolumes(base), nil
+	} else if isHTTPURL(name) {
+		reader, err := openHTTPReader(name)
+		if err != nil {
+			return nil, failure(exitError, "Error downloading input:", err.Error())
+		}
+		return reader, nil
+	} else if isSSHPath(name) {
+		reader, err := openSSHReader(name)
+		if err != nil {
+			return nil, failure(exitError, "Error running ssh:", err.Error())
+		}
+		return reader, nil
+	} else if name != "" {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, failure(exitError, "Error opening input file:", err.Error())
+		}
+		return file, nil
+	}
+	return os.Stdin, nil
+}
+
+type extractOptions struct {
+	ignorePerms     *bool
+	ignoreOwners    *bool
+	resume          *bool
+	journalFileName *string
+	restoreHook     *string
+	specials        *bool
+	attributes      *bool
+	diff            *bool
+	diffContents    *bool
+	overwrite       *bool
+	skipExisting    *bool
+	keepNewer       *bool
+	errorIfExists   *bool
+	toStdout        *string
+	outputFormat    *string
+	salvage         *bool
+	duplicates      *string
+	sanitizeNames   *bool
+	diffWrite       *bool
+	parallel        *int
+	restoreChain    *bool
+
+	// Set by apply: the directory to extract into.
+	outputPath string
+}
+
+func addExtractFlags(fs *flag.FlagSet) *extractOptions {
+	return &extractOptions{
+		ignorePerms:     fs.Bool("ignore-perms", false, "ignore permissions when restoring files"),
+		ignoreOwners:    fs.Bool("ignore-owners", false, "ignore owners when restoring files"),
+		resume:          fs.Bool("resume", false, "record completed files in a journal, and skip files the journal shows were already extracted"),
+		journalFileName: fs.String("journal", ".fast-archiver-journal", "journal file used by --resume"),
+		restoreHook:     fs.String("restore-hook", "", "report each extracted file as JSON to this http(s):// URL or unix:PATH socket"),
+		specials:        fs.Bool("specials", false, "recreate FIFOs, devices, and sockets"),
+		attributes:      fs.Bool("attributes", false, "restore file capabilities and immutable and append-only flags; needs root"),
+		diff:            fs.Bool("diff", false, "compare the archive with the filesystem instead of extracting it, and report differences"),
+		diffContents:    fs.Bool("diff-contents", false, "with --diff, also compare file contents"),
+		overwrite:       fs.Bool("overwrite", false, "replace files that already exist (the default)"),
+		skipExisting:    fs.Bool("skip-existing", false, "don't replace files that already exist"),
+		keepNewer:       fs.Bool("keep-newer", false, "don't replace files that already exist and are newer than the archived ones"),
+		errorIfExists:   fs.Bool("error-if-exists", false, "fail if a file being extracted already exists"),
+		toStdout:        fs.String("to-stdout", "", "write the contents of this one archived file to stdout, instead of extracting anything"),
+		outputFormat:    fs.String("output-format", "", "instead of extracting, convert the archive to this format, tar or zip, written to stdout"),
+		duplicates:      fs.String("duplicates", "error", "what to do if a corrupt archive starts the same file twice: error, rename, or last-wins"),
+		salvage:         fs.Bool("salvage", false, "extract as much as possible of a truncated or corrupt archive, keeping partly extracted files, and exit with status 3"),
+		parallel:        fs.Int("parallel", 4, "with several -i archives, how many to extract at once"),
+		sanitizeNames:   fs.Bool("sanitize-names", false, "replace control characters and invalid UTF-8 in extracted file names with %XX escapes"),
+		diffWrite:       fs.Bool("diff-write", false, "update existing files in place, only writing the parts that differ from the archive"),
+		restoreChain:    fs.Bool("restore-chain", false, "extract the -i archives one at a time, in order, checking that they're a full archive and its incremental archives"),
+	}
+}
+
+// Returns the overwrite policy selected by the flags.
+func (opts *extractOptions) overwritePolicy() (falib.OverwritePolicy, error) {
+	policy := falib.OverwriteAlways
+	selected := 0
+	for _, option := range []struct {
+		set    bool
+		policy falib.OverwritePolicy
+	}{
+		{*opts.overwrite, falib.OverwriteAlways},
+		{*opts.skipExisting, falib.OverwriteNever},
+		{*opts.keepNewer, falib.OverwriteOlder},
+		{*opts.errorIfExists, falib.OverwriteError},
+	} {
+		if option.set {
+			policy = option.policy
+			selected += 1
+		}
+	}
+	if selected > 1 {
+		return policy, failure(exitUsage, "only one of --overwrite, --skip-existing, --keep-newer, and --error-if-exists can be used")
+	}
+	return policy, nil
+}
+
+// Returns the policy for duplicate files selected by --duplicates.
+func (opts *extractOptions) duplicatePolicy() (falib.DuplicatePolicy, error) {
+	switch *opts.duplicates {
+	case "error":
+		return falib.DuplicateError, nil
+	case "rename":
+		return falib.DuplicateRename, nil
+	case "last-wins":
+		return falib.DuplicateLastWins, nil
+	}
+	return falib.DuplicateError, failure(exitUsage, "--duplicates must be error, rename, or last-wins")
+}
+
+func runExtract(common *commonOptions, input *inputOptions, opts *extractOptions) error {
+	common.apply()
+	names, err := input.names()
+	if err != nil {
+		return err
+	}
+	if *opts.restoreChain {
+		err = extractChain(common, input, opts, names)
+	} else if len(names) > 1 {
+		err = extractArchives(common, input, opts, names)
+	} else {
+		var inputFile io.ReadCloser
+		inputFile, err = input.openName(names[0])
+		if err != nil {
+			return err
+		}
+		err = extractArchive(common, opts, inputFile)
+		inputFile.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return warned()
+}
+
+// What's shared by the unarchivers of an extraction: the policies selected by
+// the flags, and the restore hook and journal.
+type extraction struct {
+	common     *commonOptions
+	opts       *extractOptions
+	overwrite  falib.OverwritePolicy
+	duplicates falib.DuplicatePolicy
+	hook       falib.RestoreHookFunc
+	journal    *falib.Journal
+	closers    []io.Closer
+}
+
+func startExtraction(common *commonOptions, opts *extractOptions) (*extraction, error) {
+	e := &extraction{common: common, opts: opts}
+	var err error
+	e.overwrite, err = opts.overwritePolicy()
+	if err != nil {
+		return nil, err
+	}
+	e.duplicates, err = opts.duplicatePolicy()
+	if err != nil {
+		return nil, err
+	}
+	if format := *opts.outputFormat; format != "" && format != "tar" && format != "zip" {
+		return nil, failure(exitUsage, "--output-format must be tar or zip")
+	} else if format != "" && *opts.toStdout != "" {
+		return nil, failure(exitUsage, "--output-format and --to-stdout cannot be used together")
+	}
+	if *opts.attributes && !*common.dryRun && os.Geteuid() != 0 {
+		return nil, failure(exitUsage, "--attributes requires running as root")
+	}
+	if *opts.restoreHook != "" && !*common.dryRun {
+		hook, closer, err := newRestoreHook(*opts.restoreHook, logger.Println)
+		if err != nil {
+			return nil, failure(exitError, "Error setting up restore hook:", err.Error())
+		}
+		if closer != nil {
+			e.closers = append(e.closers, closer)
+		}
+		e.hook = hook
+	}
+	if *opts.resume && !*common.dryRun {
+		journal, err := falib.OpenJournal(*opts.journalFileName)
+		if err != nil {
+			e.close()
+			return nil, failure(exitError, "Error opening journal:", err.Error())
+		}
+		e.closers = append(e.closers, journal)
+		e.journal = journal
+	}
+	return e, nil
+}
+
+func (e *extraction) close() {
+	for _, closer := range e.closers {
+		closer.Close()
+	}
+}
+
+// Returns an unarchiver for the archive read from inputFile; for an archive
+// read from the network, the sender is told which files to skip.
+func (e *extraction) unarchiver(inputFile io.Reader) (*falib.Unarchiver, error) {
+	unarchiver := falib.NewUnarchiver(inputFile)
+	unarchiver.Logger = e.common.logger()
+	unarchiver.IgnorePerms = *e.opts.ignorePerms
+	unarchiver.IgnoreOwners = *e.opts.ignoreOwners
+	unarchiver.DryRun = *e.common.dryRun
+	unarchiver.Fsync = e.common.fsync.files
+	unarchiver.FsyncDirs = e.common.fsync.dirs
+	unarchiver.Strict = *e.common.strict
+	unarchiver.Specials = *e.opts.specials
+	unarchiver.Attributes = *e.opts.attributes
+	unarchiver.BirthTime = *e.common.birthTime
+	unarchiver.Overwrite = e.overwrite
+	unarchiver.Duplicates = e.duplicates
+	unarchiver.Transforms = *e.common.transforms
+	unarchiver.Salvage = *e.opts.salvage
+	unarchiver.SanitizeNames = *e.opts.sanitizeNames
+	unarchiver.DiffWrite = *e.opts.diffWrite
+	unarchiver.AbsolutePaths = *e.common.absolute
+	unarchiver.OutputPath = e.opts.outputPath
+	unarchiver.RestoreHook = e.hook
+	if events != nil {
+		unarchiver.StartHook = events.fileStarted
+		unarchiver.RestoreHook = func(file falib.RestoredFile) {
+			events.restored(file)
+			if e.hook != nil {
+				e.hook(file)
+			}
+		}
+	}
+	unarchiver.Journal = e.journal
+	if conn, ok := inputFile.(net.Conn); ok {
+		err := unarchiver.WriteResumeRequest(conn)
+		if err != nil {
+			return nil, failure(exitError, "Error sending resume request:", err.Error())
+		}
+	}
+	return unarchiver, nil
+}
+
+// Runs an unarchiver, and returns its error as a statusError, or
+// falib.ErrInterrupted.
+func (e *extraction) run(unarchiver *falib.Unarchiver) error {
+	err := unarchiver.Run()
+	if unarchiver.DiffWrite && !unarchiver.DryRun {
+		written, unchanged := unarchiver.DiffWriteTotals()
+		logger.Println("wrote", written, "bytes to existing files;", unchanged, "bytes were unchanged")
+	}
+	if errors.Is(err, falib.ErrSalvaged) {
+		return failure(exitPartial, err.Error())
+	} else if err != nil && err != falib.ErrInterrupted {
+		return failure(archiveErrorStatus(err), "Fatal error in archiver:", err.Error())
+	}
+	return err
+}
+
+// Extracts the archive read from inputFile, or with --diff or --to-stdout,
+// does what they ask for instead.
+func extractArchive(common *commonOptions, opts *extractOptions, inputFile io.Reader) error {
+	e, err := startExtraction(common, opts)
+	if err != nil {
+		return err
+	}
+	defer e.close()
+	unarchiver, err := e.unarchiver(inputFile)
+	if err != nil {
+		return err
+	}
+	if *opts.toStdout != "" {
+		return extractToStdout(inputFile, *opts.toStdout)
+	}
+	if *opts.outputFormat != "" {
+		return convertArchive(inputFile, *opts.outputFormat, common.logger(), *common.strict)
+	}
+	if *opts.diff {
+		return diffArchive(unarchiver, *opts.diffContents)
+	}
+	handleInterrupts(unarchiver.Interrupt)
+	return e.run(unarchiver)
+}
+
+// Extracts several archives into the same tree, up to --parallel of them at
+// once.  Every archive is extracted even if others fail; each failure is
+// reported, and the first one's exit status is returned.
+func extractArchives(common *commonOptions, input *inputOptions, opts *extractOptions, names []string) error {
+	if *opts.toStdout != "" || *opts.outputFormat != "" || *opts.diff {
+		return failure(exitUsage, "--to-stdout, --output-format, and --diff take a single -i archive")
+	}
+	if *opts.parallel < 1 {
+		return failure(exitUsage, "--parallel must be at least 1")
+	}
+	e, err := startExtraction(common, opts)
+	if err != nil {
+		return err
+	}
+	defer e.close()
+
+	var lock sync.Mutex
+	running := make(map[*falib.Unarchiver]bool)
+	interrupted := false
+	handleInterrupts(func() {
+		lock.Lock()
+		defer lock.Unlock()
+		interrupted = true
+		for unarchiver := range running {
+			unarchiver.Interrupt()
+		}
+	})
+
+	errs := make([]error, len(names))
+	slots := make(chan struct{}, *opts.parallel)
+	var wg sync.WaitGroup
+	for i, name := range names {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			inputFile, err := input.openName(name)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer inputFile.Close()
+			unarchiver, err := e.unarchiver(inputFile)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			lock.Lock()
+			if interrupted {
+				lock.Unlock()
+				errs[i] = falib.ErrInterrupted
+				return
+			}
+			running[unarchiver] = true
+			lock.Unlock()
+			common.logger().Verbose("extracting", name)
+			errs[i] = e.run(unarchiver)
+			lock.Lock()
+			delete(running, unarchiver)
+			lock.Unlock()
+		}(i, name)
+	}
+	wg.Wait()
+
+	var result error
+	for i, err := range errs {
+		var statusErr *statusError
+		if err == falib.ErrInterrupted {
+			result = err
+		} else if errors.As(err, &statusErr) {
+			logger.Println(names[i]+":", statusErr.message)
+			if result == nil {
+				result = &statusError{status: statusErr.status}
+			}
+		}
+	}
+	return result
+}
+
+// Extracts a full archive followed by its incremental archives, one at a time
+// in the order given, so that the deletions and changes of each are applied
+// over the ones before it.  Each archive must be based on the one before it,
+// going by the IDs recorded from their snapshot files; the restore stops at
+// the first one that isn't, or that fails.
+func extractChain(common *commonOptions, input *inputOptions, opts *extractOptions, names []string) error {
+	if *opts.toStdout != "" || *opts.outputFormat != "" || *opts.diff || *opts.resume {
+		return failure(exitUsage, "--restore-chain can't be used with --to-stdout, --output-format, --diff, or --resume")
+	}
+	e, err := startExtraction(common, opts)
+	if err != nil {
+		return err
+	}
+	defer e.close()
+
+	var parentId []byte
+	for _, name := range names {
+		if interruptReceived() {
+			return falib.ErrInterrupted
+		}
+		inputFile, err := input.openName(name)
+		if err != nil {
+			return err
+		}
+		unarchiver, err := e.unarchiver(inputFile)
+		if err != nil {
+			inputFile.Close()
+			return err
+		}
+		unarchiver.CheckChain = true
+		unarchiver.ChainParent = parentId
+		handleInterrupts(unarchiver.Interrupt)
+		common.logger().Verbose("extracting", name)
+		err = e.run(unarchiver)
+		inputFile.Close()
+		if err != nil {
+			var statusErr *statusError
+			if errors.As(err, &statusErr) {
+				statusErr.message = name + ": " + statusErr.message
+			}
+			return err
+		}
+		parentId = unarchiver.ArchiveId()
+	}
+	return nil
+}
+
+// Copies the contents of the archived file filePath to stdout.  The archive is
+// read only as far as the end of that file.
+func extractToStdout(input io.Reader, filePath string) error {
+	reader := falib.NewReader(input)
+	defer reader.Close()
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return failure(exitError, "Not found in archive:", filePath)
+		} else if err != nil {
+			return failure(archiveErrorStatus(err), "Error reading archive:", err.Error())
+		}
+		if entry.Deleted || filepath.Clean(entry.Path) != filepath.Clean(filePath) {
+			continue
+		}
+		if !entry.Mode.IsRegular() {
+			return failure(exitError, "Not a regular file:", filePath)
+		}
+		_, err = io.Copy(os.Stdout, reader)
+		if err != nil {
+			return failure(exitError, "Error writing to stdout:", err.Error())
+		}
+		return nil
+	}
+}
+
+// Reports the differences between the archive and the filesystem, failing
+// with exitDifferent if there are any.
+func diffArchive(unarchiver *falib.Unarchiver, compareContents bool) error {
+	differences := 0
+	err := unarchiver.Diff(compareContents, func(d falib.Difference) {
+		differences += 1
+		switch d.Kind {
+		case falib.DifferenceAdded:
+			fmt.Println("added  ", displayPath(d.Path))
+		case falib.DifferenceRemoved:
+			fmt.Println("removed", displayPath(d.Path))
+		case falib.DifferenceChanged:
+			fmt.Printf("changed %s (%s)\n", displayPath(d.Path), strings.Join(d.Reasons, ", "))
+		}
+	})
+	if err != nil {
+		return failure(archiveErrorStatus(err), "Error reading archive:", err.Error())
+	}
+	if differences > 0 {
+		return failure(exitDifferent)
+	}
+	return nil
+}
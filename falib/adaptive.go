@@ -0,0 +1,98 @@
+package falib
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How often the adaptive controller resizes the file reader pool, the most
+// readers it will run, and the change in read throughput or latency between
+// intervals that it takes to be more than noise.
+const (
+	adaptiveInterval   = 500 * time.Millisecond
+	adaptiveMaxReaders = 256
+	adaptiveTolerance  = 0.05
+)
+
+// With Adaptive, resizes the file reader pool while the archive is created,
+// until stop is closed once scanning has finished.  It climbs towards the
+// number of readers that gives the most read throughput: it keeps adding
+// readers while that helps (eg. on NVMe, which needs many reads in flight),
+// and backs off when it stops helping, or when each read starts taking much
+// longer (eg. a spinning disk seeking between too many files).  Readers are
+// only added while files are waiting to be read, and are taken away while the
+// block queue is nearly full, since then the archive writer is what's holding
+// things up.
+//
+// The controller holds a count in the reading wait group while it runs, so
+// that the readers it adds are counted before the group can reach zero.
+func (a *Archiver) adaptiveController(stop <-chan struct{}) {
+	defer a.reading.Done()
+	readers := a.FileReaderCount
+	direction := 1
+	var lastRate, lastLatency float64
+	lastBytes := atomic.LoadInt64(&a.stats.bytesRead)
+	lastReadTime := atomic.LoadInt64(&a.stats.readTime)
+
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		bytesRead := atomic.LoadInt64(&a.stats.bytesRead)
+		readTime := atomic.LoadInt64(&a.stats.readTime)
+		rate := float64(bytesRead-lastBytes) / adaptiveInterval.Seconds()
+		// The time spent reading per byte read, added up across
+		// readers.
+		latency := 0.0
+		if bytesRead > lastBytes {
+			latency = float64(readTime-lastReadTime) / float64(bytesRead-lastBytes)
+		}
+		lastBytes, lastReadTime = bytesRead, readTime
+
+		depths := a.QueueDepths()
+		switch {
+		case depths.Blocks >= cap(a.blockQueue)*3/4:
+			direction = -1
+		case depths.Files == 0:
+			// Reading is keeping up with scanning; more readers
+			// would have nothing to do.
+			lastRate, lastLatency = rate, latency
+			continue
+		case rate < lastRate*(1-adaptiveTolerance):
+			// The last change made things worse; undo it.
+			direction = -direction
+		case lastLatency > 0 && latency > lastLatency*(1+adaptiveTolerance) && rate < lastRate*(1+adaptiveTolerance):
+			// Reads are taking longer without getting more done.
+			direction = -1
+		}
+		lastRate, lastLatency = rate, latency
+
+		if direction > 0 && readers < adaptiveMaxReaders {
+			readers++
+			a.reading.Add(1)
+			go a.fileReader()
+		} else if direction < 0 && readers > 1 {
+			readers--
+			a.readerStop <- struct{}{}
+		} else {
+			continue
+		}
+		a.Logger.Verbose("adaptive: now", readers, "file readers")
+	}
+}
+
+// Returns true if a file reader should exit, because the adaptive controller
+// is shrinking the pool.
+func (a *Archiver) readerStopped() bool {
+	select {
+	case <-a.readerStop:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,279 +1,1639 @@
 package falib
 
 import (
-	"bufio"
-	"encoding/binary"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"hash"
-	"hash/crc64"
+	"hash/fnv"
 	"io"
 	"os"
 	"path/filepath"
-//	"strings"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// Called by the archiver's file readers for each file they archive.  If a
+// non-nil writer is returned, the file's contents are copied to it as they are
+// read, and it's closed once the whole file has been read; this allows the data
+// to be processed (eg. indexed) without reading the source files a second time.
+// Tee functions are called concurrently from multiple file readers.
+type TeeFunc func(filePath string) io.WriteCloser
+
+// A file that has been completely read into the archive: its path as
+// archived, and the sha256 sum and size of its archived contents.
+type ArchivedFile struct {
+	Path     string
+	SHA256   []byte
+	Size     int64
+	Duration time.Duration
+}
+
+// Called by the archiver's file readers after each file is archived.  Archive
+// hooks are called concurrently from multiple file readers.
+type ArchiveHookFunc func(file ArchivedFile)
+
+// Called as each file starts to be archived, with its path as archived, or
+// extracted, with the path it's extracted to.
+type StartHookFunc func(filePath string)
+
+// Called for each directory added to the archiver when creating a separate
+// archive per directory; returns the writer for that directory's archive.
+type SplitOutputFunc func(directoryPath string) (io.Writer, error)
+
+// A directory or file queued for scanning or reading, the index of the
+// top-level directory that it was found in, and with ExcludeVCSIgnores, the
+// .gitignore rules that apply to it.
+type scanItem struct {
+	path    string
+	root    int
+	ignores *ignoreRules
+}
+
+// Identifies a file by device and inode number.
+type fileId struct {
+	dev uint64
+	ino uint64
+}
+
 type Archiver struct {
-	DirReaderCount    int
-	FileReaderCount   int
-	DirScanQueueSize  int
-	FileReadQueueSize int
-	BlockQueueSize    int
-	ExcludePatterns   []string
-	Logger            Logger
-	BlockSize         uint16
-
-	directoryScanQueue chan string
-	fileReadQueue      chan string
+	DirReaderCount     int
+	FileReaderCount    int
+	DirScanQueueSize   int
+	FileReadQueueSize  int
+	BlockQueueSize     int
+	ExcludePatterns    []string
+	Logger             Logger
+	BlockSize          uint16
+	MaxEmptyReads      int
+	Align              int
+	DryRun             bool
+	Manifest           io.Writer
+	Tee                TeeFunc
+	StartHook          StartHookFunc
+	ArchiveHook        ArchiveHookFunc
+	Strict             bool
+	Dedup              bool
+	Resume             *ResumeSet
+	SplitOutput        SplitOutputFunc
+	ShardOutputs       []io.Writer
+	NewerThan          time.Time
+	OlderThan          time.Time
+	Snapshot           *Snapshot
+	ReadLimit          int64
+	WriteLimit         int64
+	RunLength          bool
+	ExcludeHashes      HashSet
+	Dereference        bool
+	OneFileSystem      bool
+	FilesFrom          io.Reader
+	FilesFromNul       bool
+	Compress           bool
+	CompressWorkers    int
+	NoCompressSuffixes []string
+	StoreOnlyPatterns  []string
+	FormatVersion      int
+	Transforms         []Transform
+	MaxMemory          int64
+	Mmap               bool
+	DirectIO           bool
+	DropCache          bool
+	ExcludeVCS         bool
+	ExcludeVCSIgnores  bool
+	Retries            int
+	RetryDelay         time.Duration
+	ConsistencyRetries int
+
+	// Only archive regular files of at least MinSize bytes, and if MaxSize
+	// isn't 0, of at most MaxSize bytes.  Directories and special files are
+	// archived whatever their size.
+	MinSize int64
+	MaxSize int64
+
+	// Only descend this many directories below each directory added with
+	// AddDir: with 1, the directory's own entries are archived, but the
+	// subdirectories among them are archived without their contents.
+	// Unlimited if it's 0.
+	MaxDepth int
+
+	// Only archive entries of these types, as letters like find -type's: f
+	// for regular files, d for directories, l for symbolic links, p for
+	// FIFOs, c and b for character and block devices, and s for sockets.
+	// Directories left out are still scanned for entries of the other
+	// types.  If it's empty, everything but symbolic links is archived;
+	// symbolic links are only archived, rather than skipped with a warning,
+	// if l is included.
+	Types string
+
+	// The archive is written out in batches of OutputBatchSize bytes, by a
+	// goroutine of its own, so that the next batch is filled while the last
+	// one is written; this keeps slow writes, such as to network
+	// filesystems, from holding up the pipeline.  A batch that isn't full
+	// is written once it has been waiting for FlushInterval, unless that's
+	// 0.  If OutputBatchSize is 0, the archive is written through a plain
+	// buffer instead.  With SyncOutput, outputs that are regular files are
+	// fsynced once the archive is complete.
+	OutputBatchSize int
+	FlushInterval   time.Duration
+	SyncOutput      bool
+
+	// Only archive files, special files, and symbolic links owned by one of
+	// the user IDs in Owners, if it isn't empty, and belonging to one of the
+	// group IDs in Groups, if it isn't empty.  Directories are archived
+	// whoever owns them, so that the files keep the directories they're in.
+	// Ignored on platforms that don't have owners.
+	Owners []int
+	Groups []int
+
+	// Write the same archive every time for the same files: scan and read
+	// one directory and file at a time, in order of name, record no owners,
+	// and leave out details of when, where, and from what filesystem the
+	// archive was created.  Modification times are clamped to ClampModTime,
+	// or left out if it's zero.
+	Deterministic bool
+	ClampModTime  time.Time
+
+	// The order that files are read in.  Files are read as they're found
+	// by default.
+	Order FileOrder
+
+	// Grow and shrink the pool of file readers while archiving, starting
+	// from FileReaderCount, according to how read throughput and the
+	// queues respond.
+	Adaptive bool
+
+	// Archive paths as they were given, instead of making them relative by
+	// removing any leading / and ../ components.
+	AbsolutePaths bool
+
+	// Record where each file is in the archive, after calling the
+	// catalog's StartArchive with the archive's name.
+	Catalog *Catalog
+
+	// Make the archive a delta from the tree at CompareWith to the
+	// directories being archived: files whose type, permissions, and
+	// contents are the same as the file at the same archived path under
+	// CompareWith are left out, and paths that are only under CompareWith
+	// are recorded as deletions.  Extracting it over a copy of that tree
+	// turns it into a copy of the archived directories.
+	CompareWith string
+
+	// With Compress, a preset dictionary of up to 32768 bytes of content
+	// that's common to the archived files, such as one written by
+	// TrainDictionary, which makes blocks of small, similar files compress
+	// much better.  It's stored in the archive, so extracting needs no
+	// options.
+	CompressDictionary []byte
+
+	// Record when each file and directory was created, where the platform
+	// and filesystem keep track of that.
+	BirthTime bool
+
+	// Number of goroutines hashing files' contents for the Manifest,
+	// ArchiveHook, and Catalog, apart from the file readers; defaults to
+	// GOMAXPROCS.
+	HashWorkers int
+
+	// Read and hash the files for the Manifest (and ArchiveHook), without
+	// writing an archive; the output isn't used.
+	HashOnly bool
+
+	directoryScanQueue *scanQueue
+	fileReadQueue      chan scanItem
+	fileSchedule       *fileSchedule
+	readerStop         chan struct{}
 	blockQueue         chan block
-	workInProgress     sync.WaitGroup
+	scanning           sync.WaitGroup
+	reading            sync.WaitGroup
 	excludePatterns    []string
-	output             *bufio.Writer
+	output             io.Writer
+	roots              []string
+	sources            []string
 	error              error
+	errorLock          sync.Mutex
+	manifestLock       sync.Mutex
+	dryRunFiles        int64
+	dryRunBytes        int64
+	readLimiter        *rateLimiter
+	excludedByHash     []string
+	excludedLock       sync.Mutex
+	visited            map[fileId]bool
+	visitedLock        sync.Mutex
+	rootDevices        map[int]uint64
+	stream             *archiveStream
+	interrupt          chan struct{}
+	interruptOnce      sync.Once
+	stats              statsCounters
+	memory             *memoryBudget
+	delta              *treeDelta
 }
 
 func NewArchiver(output io.Writer) *Archiver {
 	retval := &Archiver{}
 	retval.ExcludePatterns = []string{}
-	retval.output = bufio.NewWriter(output)
+	retval.output = output
 	retval.DirReaderCount = 16
 	retval.FileReaderCount = 16
 	retval.DirScanQueueSize = 128
 	retval.FileReadQueueSize = 128
 	retval.BlockQueueSize = 128
 	retval.BlockSize = 4096
+	retval.MaxEmptyReads = 100
+	retval.OutputBatchSize = 1024 * 1024
+	retval.FlushInterval = time.Second
+	retval.interrupt = make(chan struct{})
 	return retval
 }
 
+// Stops a Run in progress as soon as possible, without finishing the archive;
+// Run then returns ErrInterrupted.  Can be called from any goroutine, such as
+// a signal handler.
+func (a *Archiver) Interrupt() {
+	a.interruptOnce.Do(func() { close(a.interrupt) })
+}
+
+func (a *Archiver) interrupted() bool {
+	select {
+	case <-a.interrupt:
+		return true
+	default:
+		return false
+	}
+}
+
 func (a *Archiver) AddDir(directoryPath string) {
+	a.AddDirFrom(directoryPath, directoryPath)
+}
+
+// Adds a directory whose contents are read from sourcePath, such as a snapshot
+// of the directory, but archived as though they'd been read from
+// directoryPath.
+func (a *Archiver) AddDirFrom(directoryPath, sourcePath string) {
 	if a.directoryScanQueue == nil {
-		a.directoryScanQueue = make(chan string, a.DirScanQueueSize)
+		a.directoryScanQueue = newScanQueue(a.DirScanQueueSize)
 	}
-	a.workInProgress.Add(1)
-	a.directoryScanQueue <- directoryPath
+	a.roots = append(a.roots, directoryPath)
+	a.sources = append(a.sources, sourcePath)
+	a.scanning.Add(1)
+	a.directoryScanQueue.push(scanItem{sourcePath, len(a.roots) - 1, nil})
 }
 
 func (a *Archiver) Run() error {
+	if a.DirectIO && int(a.BlockSize)%directIOAlignment != 0 {
+		return ErrDirectIOBlockSize
+	}
+	if len(a.CompressDictionary) > maxDictionarySize {
+		return ErrDictionaryTooLarge
+	}
 	if a.directoryScanQueue == nil {
-		a.directoryScanQueue = make(chan string, a.DirScanQueueSize)
+		a.directoryScanQueue = newScanQueue(a.DirScanQueueSize)
+	}
+	a.fileReadQueue = make(chan scanItem, a.FileReadQueueSize)
+	if a.Order != OrderAsScanned {
+		a.fileSchedule = newFileSchedule(a.FileReadQueueSize, a.Order)
 	}
-	a.fileReadQueue = make(chan string, a.FileReadQueueSize)
 	a.blockQueue = make(chan block, a.BlockQueueSize)
+	if a.Adaptive {
+		a.readerStop = make(chan struct{}, adaptiveMaxReaders)
+	}
+	a.readLimiter = newRateLimiter(a.ReadLimit)
+	if a.CompareWith != "" {
+		a.delta = newTreeDelta(a.CompareWith)
+	}
+	a.memory = newMemoryBudget(a.MaxMemory)
+	a.visited = make(map[fileId]bool)
+	a.rootDevices = make(map[int]uint64)
+	if a.OneFileSystem {
+		for i, source := range a.sources {
+			fileInfo, err := os.Stat(source)
+			if err != nil {
+				continue
+			}
+			if id, ok := fileIdentity(fileInfo); ok {
+				a.rootDevices[i] = id.dev
+			}
+		}
+	}
 	a.error = nil
+	atomic.StoreInt64(&a.stats.started, time.Now().UnixNano())
+	defer func() { atomic.StoreInt64(&a.stats.finished, time.Now().UnixNano()) }()
 
-	for i := 0; i < a.DirReaderCount; i++ {
-		go a.directoryScanner()
-	}
-	for i := 0; i < a.FileReaderCount; i++ {
-		go a.fileReader()
+	// The pipeline is shut down a stage at a time, each stage only once
+	// the one feeding it has finished.  Every count in the scanning and
+	// reading wait groups is added either before this goroutine starts
+	// waiting, or by something that holds a count of its own in the same
+	// group, so neither group can reach zero while more work is on its way.
+	scanned := make(chan struct{})
+	if a.Deterministic {
+		if a.FilesFrom != nil {
+			a.scanning.Add(1)
+		}
+		go a.deterministicScanner()
+	} else {
+		for i := 0; i < a.DirReaderCount; i++ {
+			go a.directoryScanner()
+		}
+		a.reading.Add(a.FileReaderCount)
+		for i := 0; i < a.FileReaderCount; i++ {
+			go a.fileReader()
+		}
+		if a.Adaptive {
+			a.reading.Add(1)
+			go a.adaptiveController(scanned)
+		}
+		if a.FilesFrom != nil {
+			a.scanning.Add(1)
+			go a.fileListReader()
+		}
 	}
 
 	go func() {
-		a.workInProgress.Wait()
-		close(a.directoryScanQueue)
+		// Once every directory has been scanned, no more files can be
+		// queued, so the directory scanners are stopped, and the file
+		// readers left to finish what's queued.
+		a.scanning.Wait()
+		a.directoryScanQueue.close()
 		close(a.fileReadQueue)
+		if a.fileSchedule != nil {
+			a.fileSchedule.close()
+		}
+		close(scanned)
+
+		// Once the file readers have exited, nothing else can queue
+		// blocks to be written.
+		a.reading.Wait()
+		if a.Snapshot != nil {
+			for _, filePath := range a.Snapshot.deleted() {
+				a.Logger.Verbose("deleted", filePath)
+				atomic.AddInt64(&a.stats.deleted, 1)
+				a.blockQueue <- block{filePath: filePath, blockType: blockTypeDelete, root: a.rootOf(filePath)}
+			}
+		}
+		if a.delta != nil {
+			deleted, err := a.delta.deleted()
+			if err != nil {
+				a.lossWarning("unable to find all deleted files:", err.Error())
+			}
+			for _, filePath := range deleted {
+				a.Logger.Verbose("deleted", filePath)
+				a.queueDelete(filePath)
+			}
+		}
 		close(a.blockQueue)
 	}()
 
-	err := a.archiveWriter()
-	a.output.Flush()
-
+	blocks := (<-chan block)(a.blockQueue)
+	if a.hashing() {
+		blocks = a.hashBlocks(blocks)
+	}
+	if a.Compress {
+		blocks = a.compressBlocks(blocks)
+	}
+	err := a.archiveWriter(blocks)
 	if err != nil {
 		return err
 	}
+	a.errorLock.Lock()
+	defer a.errorLock.Unlock()
 	return a.error
 }
 
+// Returns the index of the top-level directory that contains filePath.
+func (a *Archiver) rootOf(filePath string) int {
+	for i, root := range a.roots {
+		root = filepath.Clean(root)
+		if filePath == root || strings.HasPrefix(filePath, root+string(filepath.Separator)) {
+			return i
+		}
+	}
+	return 0
+}
+
+// Returns the path that filePath, read from within the given top-level
+// directory, is archived as.  This is filePath itself, unless the directory's
+// contents are being read from elsewhere with AddDirFrom.
+func (a *Archiver) archivePath(filePath string, root int) string {
+	if root >= len(a.sources) || a.sources[root] == a.roots[root] {
+		return filePath
+	}
+	if filePath == a.sources[root] {
+		return a.roots[root]
+	}
+	source := filepath.Clean(a.sources[root])
+	if strings.HasPrefix(filePath, source+string(filepath.Separator)) {
+		return filepath.Join(a.roots[root], filePath[len(source):])
+	}
+	return filePath
+}
+
+// Returns the path that filePath is recorded as in the archive: its archive
+// path, made relative unless AbsolutePaths is set.
+func (a *Archiver) storedPath(filePath string, root int) string {
+	filePath = a.archivePath(filePath, root)
+	if a.AbsolutePaths {
+		return filePath
+	}
+	return RelativePath(filePath)
+}
+
+// Logs a problem that means the archive won't be a faithful copy of the
+// source.  In Strict mode, this also causes the run to fail.
+func (a *Archiver) lossWarning(v ...interface{}) {
+	a.Logger.Warning(v...)
+	if a.Strict {
+		a.errorLock.Lock()
+		if a.error == nil {
+			a.error = fmt.Errorf("%w: %s", ErrStrict, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+		}
+		a.errorLock.Unlock()
+	}
+}
+
+// Returns the number of files, and their total size in bytes, that a DryRun
+// found would have been archived.
+func (a *Archiver) DryRunTotals() (files int64, bytes int64) {
+	return atomic.LoadInt64(&a.dryRunFiles), atomic.LoadInt64(&a.dryRunBytes)
+}
+
+// Returns the paths of the files that were left out of the archive because
+// their contents matched ExcludeHashes.
+func (a *Archiver) ExcludedByHash() []string {
+	a.excludedLock.Lock()
+	defer a.excludedLock.Unlock()
+	return append([]string(nil), a.excludedByHash...)
+}
+
 func (a *Archiver) directoryScanner() {
-	for directoryPath := range a.directoryScanQueue {
-/*
-		if strings.HasPrefix(directoryPath, "/") {
-			a.error = ErrAbsoluteDirectoryPath
-			a.workInProgress.Done()
-			continue
+	for {
+		item, ok := a.directoryScanQueue.pop()
+		if !ok {
+			break
+		}
+		a.scanDirectory(item)
+	}
+}
+
+// With Deterministic, does all of the scanning and reading, one directory and
+// file at a time, so that the archive's blocks always come out in the same
+// order.  The top-level directories are scanned in the order they were added.
+func (a *Archiver) deterministicScanner() {
+	if a.FilesFrom != nil {
+		a.fileListReader()
+	}
+	for _, item := range a.directoryScanQueue.drain() {
+		a.scanDirectory(item)
+	}
+}
+
+// Archives a directory, and queues its subdirectories to be scanned and its
+// files to be read; with Deterministic, they're scanned and read straight
+// away, in order of name.
+func (a *Archiver) scanDirectory(item scanItem) {
+	directoryPath := item.path
+	if a.interrupted() {
+		a.scanning.Done()
+		return
+	}
+	if directoryPath == a.sources[item.root] {
+		// A top-level argument can be a file rather than a directory.
+		if fileInfo, err := os.Stat(directoryPath); err == nil && !fileInfo.IsDir() {
+			a.archiveTopLevelFile(item, fileInfo)
+			a.scanning.Done()
+			return
 		}
-*/
-		a.Logger.Verbose(directoryPath)
+	}
+	a.Logger.Verbose(a.archivePath(directoryPath, item.root))
+	scanStart := time.Now()
+
+	directory, err := os.Open(directoryPath)
+	if err != nil {
+		a.lossWarning("directory read error:", err.Error())
+		a.scanning.Done()
+		return
+	}
+
+	// When following symbolic links, a directory could be reached more
+	// than once, or even from inside itself; only scan it the first time.
+	if a.Dereference && !a.firstVisit(directory) {
+		a.Logger.Warning("skipping directory that was already archived (symbolic link loop?)", directoryPath)
+		directory.Close()
+		a.scanning.Done()
+		return
+	}
+
+	if a.Snapshot != nil || a.delta != nil {
+		fileInfo, err := directory.Stat()
+		if err == nil && a.Snapshot != nil {
+			a.Snapshot.observe(a.archivePath(directoryPath, item.root), fileInfo)
+		}
+		if err == nil && a.delta != nil {
+			_, replaced := a.delta.observe(a.archivePath(directoryPath, item.root), directoryPath, fileInfo)
+			if replaced {
+				a.queueDelete(a.archivePath(directoryPath, item.root))
+			}
+		}
+	}
 
-		directory, err := os.Open(directoryPath)
+	if a.typeIncluded(os.ModeDir) {
+		if fileInfo, err := directory.Stat(); err == nil {
+			a.blockQueue <- a.fileTimesBlock(directory, directoryPath, fileInfo.ModTime(), item.root)
+		}
+		a.queueAttributes(directory, directoryPath, item.root)
+		uid, gid, mode := a.getModeOwnership(directory)
+		a.blockQueue <- block{filePath: directoryPath, blockType: blockTypeDirectory, uid: uid, gid: gid, mode: mode, root: item.root}
+	}
+
+	if a.MaxDepth > 0 && a.depth(directoryPath, item.root) >= a.MaxDepth {
+		a.Logger.Verbose("skipping contents of directory at the maximum depth", directoryPath)
+		directory.Close()
+		atomic.AddInt64(&a.stats.directories, 1)
+		addTime(&a.stats.scanTime, scanStart)
+		a.scanning.Done()
+		return
+	}
+
+	ignores := item.ignores
+	if a.ExcludeVCSIgnores {
+		ignores, err = loadIgnoreRules(directoryPath, ignores)
 		if err != nil {
-			a.Logger.Warning("directory read error:", err.Error())
-			a.workInProgress.Done()
+			a.lossWarning("unable to read ignore file:", err.Error())
+		}
+	}
+
+	for entry := range a.directoryEntries(directory) {
+		filePath := filepath.Join(directoryPath, entry.name)
+		if a.excluded(a.archivePath(filePath, item.root)) {
+			a.Logger.Verbose("skipping excluded file", filePath)
 			continue
 		}
 
-		uid, gid, mode := a.getModeOwnership(directory)
-		a.blockQueue <- block{directoryPath, 0, nil, blockTypeDirectory, uid, gid, mode}
-
-		for fileName := range a.readdirnames(directory) {
-			filePath := filepath.Join(directoryPath, fileName)
-			excludeFile := false
-			for _, excludePattern := range a.ExcludePatterns {
-				match, err := filepath.Match(excludePattern, filePath)
-				if err == nil && match {
-					excludeFile = true
-					break
+		// The directory read usually tells us the entry type already;
+		// only lstat the entries where it couldn't, or where more than
+		// the type is needed, and the reader didn't already look them
+		// up.
+		mode := entry.mode
+		fileInfo := entry.info
+		if fileInfo != nil {
+			mode = fileInfo.Mode()
+		} else if !entry.typeKnown || a.needsFileInfo() {
+			fileInfo, err = os.Lstat(filePath)
+			if err != nil {
+				a.lossWarning("unable to lstat file", err.Error())
+				continue
+			}
+			mode = fileInfo.Mode()
+		}
+		if (mode&os.ModeSymlink) != 0 && a.Dereference {
+			fileInfo, err = os.Stat(filePath)
+			if err != nil {
+				a.lossWarning("unable to follow symbolic link", err.Error())
+				continue
+			}
+			mode = fileInfo.Mode()
+		} else if (mode&os.ModeSymlink) != 0 && a.Types == "" {
+			a.lossWarning("skipping symbolic link", filePath)
+			continue
+		}
+
+		if ignores != nil && ignores.ignored(filePath, mode.IsDir()) {
+			a.Logger.Verbose("skipping ignored file", filePath)
+			continue
+		}
+
+		if !mode.IsDir() && !a.typeIncluded(mode) {
+			a.Logger.Verbose("skipping file of an excluded type", filePath)
+			continue
+		}
+
+		if a.OneFileSystem && mode.IsDir() {
+			if fileInfo == nil {
+				fileInfo, err = os.Lstat(filePath)
+				if err != nil {
+					a.lossWarning("unable to lstat file", err.Error())
+					continue
 				}
 			}
-			if excludeFile {
-				a.Logger.Verbose("skipping excluded file", filePath)
+			if !a.onRootFileSystem(item.root, fileInfo) {
+				a.Logger.Verbose("skipping directory on another filesystem", filePath)
 				continue
 			}
+		}
 
-			fileInfo, err := os.Lstat(filePath)
+		if mode.IsRegular() && a.outsideSizeLimits(fileInfo) {
+			a.Logger.Verbose("skipping file outside the size limits", filePath)
+			continue
+		}
+
+		if !mode.IsDir() && !a.ownerIncluded(fileInfo) {
+			a.Logger.Verbose("skipping file of another owner or group", filePath)
+			continue
+		}
+
+		if !mode.IsDir() && !a.changed(filePath, item.root, fileInfo) {
+			a.Logger.Verbose("skipping unchanged file", filePath)
+			continue
+		}
+
+		// FIFOs, devices, sockets, and symbolic links have no contents
+		// to read; only their metadata is archived.
+		if mode&(specialFileModes|os.ModeSymlink) != 0 && fileInfo == nil {
+			fileInfo, err = os.Lstat(filePath)
 			if err != nil {
-				a.Logger.Warning("unable to lstat file", err.Error())
-				continue
-			} else if (fileInfo.Mode() & os.ModeSymlink) != 0 {
-				a.Logger.Warning("skipping symbolic link", filePath)
+				a.lossWarning("unable to lstat file", err.Error())
 				continue
 			}
+		}
+		if mode&specialFileModes != 0 {
+			a.archiveSpecial(scanItem{filePath, item.root, ignores}, fileInfo)
+			continue
+		} else if mode&os.ModeSymlink != 0 {
+			a.archiveSymlink(scanItem{filePath, item.root, ignores}, fileInfo)
+			continue
+		} else if mode&os.ModeIrregular != 0 {
+			a.lossWarning("skipping file of unknown type", filePath)
+			continue
+		}
 
-			a.workInProgress.Add(1)
-			if fileInfo.IsDir() {
-				// Sending to directoryScanQueue can block if it's full; since
-				// we're also the goroutine responsible for reading from it,
-				// this could cause a deadlock.  We break that deadlock by
-				// performing the send in a goroutine, where it can block
-				// safely.  This does have the side-effect that
-				// directoryScanQueue's max size is pretty much ineffective...
-				// but that's better than a deadlock.
-				go func(filePath string) {
-					a.directoryScanQueue <- filePath
-				}(filePath)
+		if mode.IsDir() {
+			// This directory's own count keeps the scanning group
+			// above zero until after the subdirectory is counted.
+			a.scanning.Add(1)
+			if a.Deterministic {
+				a.scanDirectory(scanItem{filePath, item.root, ignores})
 			} else {
-				a.fileReadQueue <- filePath
+				a.directoryScanQueue.push(scanItem{filePath, item.root, ignores})
 			}
+		} else {
+			a.queueFile(scanItem{filePath, item.root, ignores}, fileInfo)
 		}
+	}
 
-		directory.Close()
-		a.workInProgress.Done()
+	directory.Close()
+	atomic.AddInt64(&a.stats.directories, 1)
+	addTime(&a.stats.scanTime, scanStart)
+	a.scanning.Done()
+}
+
+// Returns how many directories below the directory it was found under, which
+// was added with AddDir, filePath is: 0 for the directory itself, 1 for its
+// entries, and so on.
+func (a *Archiver) depth(filePath string, root int) int {
+	relative, err := filepath.Rel(a.sources[root], filePath)
+	if err != nil || relative == "." {
+		return 0
 	}
+	return strings.Count(relative, string(filepath.Separator)) + 1
 }
 
-func (a *Archiver) fileReader() {
-	for filePath := range a.fileReadQueue {
-		a.Logger.Verbose(filePath)
+// Archives a file given as a top-level argument, instead of a directory, by
+// queueing it to be read like a file found by a directory scan.
+func (a *Archiver) archiveTopLevelFile(item scanItem, fileInfo os.FileInfo) {
+	mode := fileInfo.Mode()
+	switch {
+	case !a.typeIncluded(mode):
+		a.Logger.Verbose("skipping file of an excluded type", item.path)
+	case a.outsideSizeLimits(fileInfo):
+		a.Logger.Verbose("skipping file outside the size limits", item.path)
+	case !a.ownerIncluded(fileInfo):
+		a.Logger.Verbose("skipping file of another owner or group", item.path)
+	case !a.changed(item.path, item.root, fileInfo):
+		a.Logger.Verbose("skipping unchanged file", item.path)
+	case mode&specialFileModes != 0:
+		a.archiveSpecial(item, fileInfo)
+	case mode.IsRegular():
+		a.queueFile(item, fileInfo)
+	default:
+		a.lossWarning("skipping file of unknown type", item.path)
+	}
+}
 
-		file, err := os.Open(filePath)
-		if err == nil {
+// Returns the entries of a directory as they're read, or with Deterministic,
+// all of them, sorted by name.
+func (a *Archiver) directoryEntries(directory *os.File) chan dirEntry {
+	if !a.Deterministic {
+		return a.readdirentries(directory)
+	}
+	var entries []dirEntry
+	for entry := range a.readdirentries(directory) {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	retval := make(chan dirEntry, len(entries))
+	for _, entry := range entries {
+		retval <- entry
+	}
+	close(retval)
+	return retval
+}
 
-			uid, gid, mode := a.getModeOwnership(file)
-			a.blockQueue <- block{filePath, 0, nil, blockTypeStartOfFile, uid, gid, mode}
+// Returns true if filePath matches any of the ExcludePatterns, or with
+// ExcludeVCS, is a version control directory.
+func (a *Archiver) excluded(filePath string) bool {
+	if a.ExcludeVCS && vcsDirectories[filepath.Base(filePath)] {
+		return true
+	}
+	for _, excludePattern := range a.ExcludePatterns {
+		match, err := filepath.Match(excludePattern, filePath)
+		if err == nil && match {
+			return true
+		}
+	}
+	return false
+}
 
-			bufferedFile := bufio.NewReader(file)
+// Archives the metadata of a FIFO, device, or socket.
+func (a *Archiver) archiveSpecial(item scanItem, fileInfo os.FileInfo) {
+	a.Logger.Verbose(item.path)
+	atomic.AddInt64(&a.stats.specials, 1)
+	a.blockQueue <- timesBlock(item.path, fileInfo.ModTime(), item.root)
+	uid, gid, major, minor := a.getSpecialInfo(fileInfo)
+	a.blockQueue <- block{filePath: item.path, blockType: blockTypeSpecial, uid: uid, gid: gid, mode: fileInfo.Mode(),
+		major: major, minor: minor, root: item.root}
+}
 
-			for {
-				buffer := make([]byte, a.BlockSize)
-				bytesRead, err := bufferedFile.Read(buffer)
-				if err == io.EOF {
-					break
-				} else if err != nil {
-					a.Logger.Warning("file read error; file contents will be incomplete:", err.Error())
-					break
-				}
+// Archives a symbolic link, and what it points to, without following it.
+func (a *Archiver) archiveSymlink(item scanItem, fileInfo os.FileInfo) {
+	target, err := os.Readlink(item.path)
+	if err != nil {
+		a.lossWarning("unable to read symbolic link", err.Error())
+		return
+	}
+	a.Logger.Verbose(item.path)
+	atomic.AddInt64(&a.stats.symlinks, 1)
+	a.blockQueue <- timesBlock(item.path, fileInfo.ModTime(), item.root)
+	uid, gid, _, _ := a.getSpecialInfo(fileInfo)
+	a.blockQueue <- block{filePath: item.path, blockType: blockTypeSymlink, uid: uid, gid: gid, mode: fileInfo.Mode(),
+		linkTarget: target, root: item.root}
+}
+
+// Returns true if fileInfo describes a file on the same filesystem as the
+// top-level directory root, or if that can't be determined.
+func (a *Archiver) onRootFileSystem(root int, fileInfo os.FileInfo) bool {
+	rootDevice, ok := a.rootDevices[root]
+	if !ok {
+		return true
+	}
+	id, ok := fileIdentity(fileInfo)
+	return !ok || id.dev == rootDevice
+}
+
+// Records that directory has been visited, returning false if it already was.
+func (a *Archiver) firstVisit(directory *os.File) bool {
+	fileInfo, err := directory.Stat()
+	if err != nil {
+		return true
+	}
+	id, ok := fileIdentity(fileInfo)
+	if !ok {
+		return true
+	}
+	a.visitedLock.Lock()
+	defer a.visitedLock.Unlock()
+	if a.visited[id] {
+		return false
+	}
+	a.visited[id] = true
+	return true
+}
+
+// Returns true if the scanner needs to lstat every entry, rather than only
+// those whose type the directory read didn't report.
+func (a *Archiver) needsFileInfo() bool {
+	return !a.NewerThan.IsZero() || !a.OlderThan.IsZero() || a.Snapshot != nil || a.delta != nil || a.Order != OrderAsScanned || a.MinSize > 0 || a.MaxSize > 0 ||
+		len(a.Owners) > 0 || len(a.Groups) > 0
+}
+
+// Returns true if the scanner will need more than the type of a directory
+// entry of type mode, which the directory read may not have known.
+func (a *Archiver) entryNeedsFileInfo(mode os.FileMode, typeKnown bool) bool {
+	return !typeKnown || a.needsFileInfo() || mode&(specialFileModes|os.ModeSymlink) != 0 || (a.OneFileSystem && mode.IsDir())
+}
+
+// Returns true if entries of mode's type are to be archived, according to
+// Types.
+func (a *Archiver) typeIncluded(mode os.FileMode) bool {
+	if a.Types == "" {
+		return mode&os.ModeSymlink == 0
+	}
+	return strings.ContainsRune(a.Types, typeLetter(mode))
+}
+
+// Returns the letter that stands for mode's type in Types.
+func typeLetter(mode os.FileMode) rune {
+	switch {
+	case mode.IsDir():
+		return 'd'
+	case mode&os.ModeSymlink != 0:
+		return 'l'
+	case mode&os.ModeNamedPipe != 0:
+		return 'p'
+	case mode&os.ModeCharDevice != 0:
+		return 'c'
+	case mode&os.ModeDevice != 0:
+		return 'b'
+	case mode&os.ModeSocket != 0:
+		return 's'
+	case mode.IsRegular():
+		return 'f'
+	}
+	return '?'
+}
+
+// Returns true if fileInfo is of a regular file that's smaller than MinSize or
+// larger than MaxSize.
+func (a *Archiver) outsideSizeLimits(fileInfo os.FileInfo) bool {
+	if (a.MinSize <= 0 && a.MaxSize <= 0) || !fileInfo.Mode().IsRegular() {
+		return false
+	}
+	return fileInfo.Size() < a.MinSize || (a.MaxSize > 0 && fileInfo.Size() > a.MaxSize)
+}
+
+// Returns true if fileInfo is of a directory, or of a file whose owner and
+// group are among Owners and Groups.
+func (a *Archiver) ownerIncluded(fileInfo os.FileInfo) bool {
+	if (len(a.Owners) == 0 && len(a.Groups) == 0) || fileInfo.IsDir() {
+		return true
+	}
+	uid, gid, ok := fileOwner(fileInfo)
+	if !ok {
+		return true
+	}
+	return (len(a.Owners) == 0 || containsId(a.Owners, uid)) && (len(a.Groups) == 0 || containsId(a.Groups, gid))
+}
+
+func containsId(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the file should be included in an incremental archive, or
+// a delta.
+func (a *Archiver) changed(filePath string, root int, fileInfo os.FileInfo) bool {
+	archivePath := a.archivePath(filePath, root)
+	retval := true
+	if !a.NewerThan.IsZero() && !fileInfo.ModTime().After(a.NewerThan) {
+		retval = false
+	}
+	if !a.OlderThan.IsZero() && !fileInfo.ModTime().Before(a.OlderThan) {
+		retval = false
+	}
+	if a.Snapshot != nil && !a.Snapshot.observe(archivePath, fileInfo) {
+		retval = false
+	}
+	if a.delta != nil {
+		changed, replaced := a.delta.observe(archivePath, filePath, fileInfo)
+		if replaced {
+			// The file takes the place of a directory, which has to
+			// be deleted first.
+			a.queueDelete(archivePath)
+		}
+		if !changed {
+			retval = false
+		}
+	}
+	return retval
+}
 
-				a.blockQueue <- block{filePath, uint16(bytesRead), buffer, blockTypeData, 0, 0, 0}
+// Queues a delete block for a path in a delta's base tree.  It's already an
+// archived path, so it's given a root past the last one, which leaves it as
+// it is.
+func (a *Archiver) queueDelete(archivePath string) {
+	atomic.AddInt64(&a.stats.deleted, 1)
+	a.blockQueue <- block{filePath: archivePath, blockType: blockTypeDelete, root: len(a.sources)}
+}
+
+func (a *Archiver) fileReader() {
+	defer a.reading.Done()
+	if a.fileSchedule != nil {
+		for !a.readerStopped() {
+			item, ok := a.fileSchedule.pop()
+			if !ok {
+				break
 			}
+			a.readFile(item)
+		}
+		return
+	}
+	for item := range a.fileReadQueue {
+		a.readFile(item)
+		if a.readerStopped() {
+			break
+		}
+	}
+}
 
-			a.blockQueue <- block{filePath, 0, nil, blockTypeEndOfFile, 0, 0, 0}
-			file.Close()
-		} else {
-			a.Logger.Warning("file open error:", err.Error())
+// Queues a file to be read by the file readers, or with Deterministic, reads
+// it straight away.  fileInfo gives its size when files are read in order of
+// size.
+func (a *Archiver) queueFile(item scanItem, fileInfo os.FileInfo) {
+	if a.Deterministic {
+		a.readFile(item)
+	} else if a.fileSchedule != nil {
+		var size int64
+		if fileInfo != nil {
+			size = fileInfo.Size()
 		}
+		a.fileSchedule.push(item, size)
+	} else {
+		a.fileReadQueue <- item
+	}
+}
 
-		a.workInProgress.Done()
+func (a *Archiver) readFile(item scanItem) {
+	filePath := item.path
+	if a.interrupted() {
+		return
+	}
+	a.Logger.Verbose(a.archivePath(filePath, item.root))
+
+	if a.DryRun {
+		stat := os.Lstat
+		if a.Dereference {
+			stat = os.Stat
+		}
+		fileInfo, err := stat(filePath)
+		if err != nil {
+			a.lossWarning("unable to lstat file", err.Error())
+		} else {
+			atomic.AddInt64(&a.dryRunFiles, 1)
+			atomic.AddInt64(&a.dryRunBytes, fileInfo.Size())
+		}
+	} else {
+		a.archiveFile(item)
 	}
 }
 
-func (b *block) writeBlock(output io.Writer) error {
-	filePath := []byte(b.filePath)
-	err := binary.Write(output, binary.BigEndian, uint16(len(filePath)))
-	if err == nil {
-		_, err = output.Write(filePath)
+func (a *Archiver) archiveFile(item scanItem) {
+	filePath := item.path
+	archivePath := a.storedPath(filePath, item.root)
+	file, err := a.openFile(filePath)
+	if err != nil {
+		a.lossWarning("file open error:", err.Error())
+		return
 	}
-	if err == nil {
-		blockType := []byte{byte(b.blockType)}
-		_, err = output.Write(blockType)
+	defer file.Close()
+	if a.DropCache {
+		defer dropCachedPages(file, 0, 0)
+	}
+
+	if a.Resume != nil && a.Resume.has(archivePath, file) {
+		a.Logger.Verbose("skipping file already extracted by receiver", filePath)
+		return
 	}
+
+	startTime := time.Now()
+	var hashing *fileHashing
+	if a.hashing() {
+		hashing = &fileHashing{hash: &sizedHash{Hash: sha256.New()}}
+		hashing.finished = func(sum []byte, size int64) {
+			if a.Manifest != nil {
+				a.writeManifestEntry(archivePath, sum)
+			}
+			if a.ArchiveHook != nil {
+				a.ArchiveHook(ArchivedFile{archivePath, sum, size, time.Since(startTime)})
+			}
+			if a.Catalog != nil {
+				a.Catalog.archived(archivePath, size, sum)
+			}
+		}
+	}
+
+	var tee io.WriteCloser
+	if a.Tee != nil {
+		tee = a.Tee(archivePath)
+	}
+
+	var source io.ReadSeeker = file
+	if a.Retries > 0 {
+		retrier := &retryReader{archiver: a, filePath: filePath, file: file}
+		defer retrier.Close()
+		source = retrier
+	}
+	input := a.fileInput(file, source)
+
+	// Excluding by hash takes an extra pass over the file, since whether it's
+	// excluded has to be known before any of it is archived.
+	if a.ExcludeHashes != nil {
+		digest, err := hashContents(input)
+		if err == nil {
+			_, err = source.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			a.lossWarning("file read error:", err.Error())
+			return
+		}
+		input = a.fileInput(file, source)
+		if a.ExcludeHashes[digest] {
+			a.Logger.Verbose("excluding file by hash", hex.EncodeToString(digest[:]), filePath)
+			a.excludedLock.Lock()
+			a.excludedByHash = append(a.excludedByHash, archivePath)
+			a.excludedLock.Unlock()
+			return
+		}
+	}
+
+	if len(a.Transforms) > 0 {
+		transformed, closeTransforms, err := applyTransforms(a.Transforms, archivePath, input)
+		if err != nil {
+			a.lossWarning("transform error; file skipped:", filePath, err.Error())
+			return
+		}
+		defer closeTransforms()
+		input = transformed
+	}
+
+	var mapping []byte
+	if a.Mmap && len(matchingTransforms(a.Transforms, archivePath)) == 0 {
+		mapping = a.mapFile(file)
+	}
+	if mapping != nil && a.Dedup {
+		// Chunks are copied out of the mapping, but that still saves the
+		// read calls.
+		input = bytes.NewReader(mapping)
+		if a.readLimiter != nil {
+			input = rateLimitedReader{input, a.readLimiter}
+		}
+	}
+
+	before, err := file.Stat()
 	if err == nil {
-		switch b.blockType {
-		case blockTypeDirectory, blockTypeStartOfFile:
-			err = binary.Write(output, binary.BigEndian, uint32(b.uid))
-			if err == nil {
-				err = binary.Write(output, binary.BigEndian, uint32(b.gid))
+		a.blockQueue <- a.fileTimesBlock(file, filePath, before.ModTime(), item.root)
+	}
+	a.queueAttributes(file, filePath, item.root)
+	uid, gid, mode := a.getModeOwnership(file)
+	a.blockQueue <- block{filePath: filePath, blockType: blockTypeStartOfFile, uid: uid, gid: gid, mode: mode, root: item.root}
+	atomic.AddInt64(&a.stats.files, 1)
+	if a.StartHook != nil {
+		a.StartHook(archivePath)
+	}
+
+	// Direct I/O needs aligned reads, which only reading straight into block
+	// buffers does.
+	directIO := false
+	if a.DirectIO && mapping == nil && !a.Dedup && len(matchingTransforms(a.Transforms, archivePath)) == 0 {
+		err := enableDirectIO(file)
+		if err != nil {
+			a.Logger.Verbose("unable to use direct I/O; reading file normally:", err.Error())
+		} else {
+			directIO = true
+			input = &directReader{file: input}
+		}
+	}
+
+	var chunks *chunker
+	if a.Dedup {
+		chunks = newChunker(input, a.fillBlock)
+	}
+
+	// A file that changes while it's read can be read again from the start,
+	// as long as nothing but the file itself has seen its contents.
+	rereadable := before != nil && mapping == nil && tee == nil && len(matchingTransforms(a.Transforms, archivePath)) == 0
+
+	for rereads := 0; ; rereads++ {
+		err = a.readFileBlocks(item, input, chunks, mapping, directIO, hashing, &tee)
+		if err == ErrInterrupted {
+			// Any mapping is left in place, as blocks still waiting to
+			// be written may refer to it.
+			return
+		} else if err != nil || before == nil || !changedWhileReading(file, before) {
+			break
+		}
+		if !rereadable || rereads >= a.ConsistencyRetries {
+			a.lossWarning("file changed while it was being read; its archived contents may be inconsistent:", filePath)
+			a.blockQueue <- block{filePath: filePath, blockType: blockTypeFileChanged, root: item.root}
+			break
+		}
+
+		a.Logger.Verbose("file changed while it was being read; reading it again:", filePath)
+		atomic.AddInt64(&a.stats.rereads, 1)
+		_, err = source.Seek(0, io.SeekStart)
+		if err != nil {
+			a.lossWarning("file changed while it was being read, and couldn't be read again:", filePath, err.Error())
+			a.blockQueue <- block{filePath: filePath, blockType: blockTypeFileChanged, root: item.root}
+			break
+		}
+		a.blockQueue <- block{filePath: filePath, blockType: blockTypeRestartFile, root: item.root, hashing: hashing}
+		before, _ = file.Stat()
+		input = a.fileInput(file, source)
+		if directIO {
+			input = &directReader{file: input}
+		}
+		if chunks != nil {
+			chunks = newChunker(input, a.fillBlock)
+		}
+	}
+
+	end := block{filePath: filePath, blockType: blockTypeEndOfFile, root: item.root, hashing: hashing}
+	if mapping != nil {
+		end.written = func() { munmapFile(mapping) }
+	}
+	a.blockQueue <- end
+
+	if tee != nil {
+		err = tee.Close()
+		if err != nil {
+			a.Logger.Warning("tee close error:", err.Error())
+		}
+	}
+}
+
+// Returns true if files' contents are hashed, for the Manifest, ArchiveHook,
+// or Catalog.
+func (a *Archiver) hashing() bool {
+	return a.Manifest != nil || a.ArchiveHook != nil || a.Catalog != nil
+}
+
+// A hash that also counts the bytes written to it.
+type sizedHash struct {
+	hash.Hash
+	size int64
+}
+
+func (h *sizedHash) Write(p []byte) (int, error) {
+	h.size += int64(len(p))
+	return h.Hash.Write(p)
+}
+
+func (h *sizedHash) Reset() {
+	h.size = 0
+	h.Hash.Reset()
+}
+
+// Reads a file's contents from input (or its mapping), and queues its data or
+// chunk blocks.  Returns nil at the end of the file, ErrInterrupted if the run
+// was interrupted, or the read error that it stopped at, which has already
+// been warned about.
+func (a *Archiver) readFileBlocks(item scanItem, input io.Reader, chunks *chunker, mapping []byte, directIO bool, hashing *fileHashing, tee *io.WriteCloser) error {
+	offset := 0
+	for {
+		var buffer []byte
+		var bytesRead int
+		var err error
+		var reserved int64
+		readStart := time.Now()
+		if chunks != nil {
+			reserved = a.memory.acquire(maxChunkSize)
+			buffer, err = chunks.next()
+			bytesRead = len(buffer)
+		} else if mapping != nil {
+			// Blocks are slices of the mapping, without copying.
+			reserved = a.memory.acquire(int64(a.BlockSize))
+			end := offset + int(a.BlockSize)
+			if end >= len(mapping) {
+				end = len(mapping)
+				err = io.EOF
 			}
-			if err == nil {
-				err = binary.Write(output, binary.BigEndian, b.mode)
+			buffer = mapping[offset:end]
+			bytesRead = len(buffer)
+			offset = end
+			if a.readLimiter != nil {
+				a.readLimiter.wait(bytesRead)
 			}
-		case blockTypeEndOfFile:
-			// Nothing to write aside from the block type
-		case blockTypeData:
-			err = binary.Write(output, binary.BigEndian, uint16(b.numBytes))
-			if err == nil {
-				_, err = output.Write(b.buffer[:b.numBytes])
+		} else {
+			reserved = a.memory.acquire(int64(a.BlockSize))
+			if directIO {
+				buffer = alignedBuffer(int(a.BlockSize))
+			} else {
+				buffer = make([]byte, a.BlockSize)
 			}
-		default:
-			panic("Internal error: unexpected block type")
+			bytesRead, err = a.fillBlock(input, buffer)
+		}
+		addTime(&a.stats.readTime, readStart)
+		// Chunks are usually smaller than the most that was reserved for
+		// them, and an empty read holds nothing at all.
+		if bytesRead == 0 {
+			a.memory.release(reserved)
+			reserved = 0
+		} else if int64(len(buffer)) < reserved {
+			a.memory.release(reserved - int64(len(buffer)))
+			reserved = int64(len(buffer))
+		}
+		atomic.AddInt64(&a.stats.bytesRead, int64(bytesRead))
+		// A read can return data along with an error (including
+		// io.EOF); the data is still good and has to be archived.
+		if bytesRead > 0 {
+			if *tee != nil {
+				_, err := (*tee).Write(buffer[:bytesRead])
+				if err != nil {
+					a.Logger.Warning("tee write error:", err.Error())
+					(*tee).Close()
+					*tee = nil
+				}
+			}
+			b := block{filePath: item.path, numBytes: uint16(bytesRead), buffer: buffer, blockType: blockTypeData, root: item.root, reserved: reserved, hashing: hashing}
+			if chunks != nil {
+				b.blockType = blockTypeChunk
+				b.digest = sha256.Sum256(buffer)
+			}
+			a.blockQueue <- b
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			a.lossWarning("file read error; file contents will be incomplete:", err.Error())
+			return err
+		} else if a.interrupted() {
+			return ErrInterrupted
 		}
 	}
-	return err
+
 }
 
-func (a *Archiver) archiveWriter() error {
-	hash := crc64.New(crc64.MakeTable(crc64.ECMA))
-	output := io.MultiWriter(a.output, hash)
-	blockCount := 0
+// Returns true if a file's size or modification time is different from what
+// they were before it was read.
+func changedWhileReading(file *os.File, before os.FileInfo) bool {
+	after, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime())
+}
 
-	_, err := output.Write(fastArchiverHeader)
+// Returns the reader that a file's blocks are read from: source, limited by
+// ReadLimit, and with DropCache, dropping the pages read from the cache.
+func (a *Archiver) fileInput(file *os.File, source io.Reader) io.Reader {
+	input := source
+	if a.readLimiter != nil {
+		input = rateLimitedReader{input, a.readLimiter}
+	}
+	if a.DropCache {
+		input = &dropCacheReader{file: file, reader: input}
+	}
+	return input
+}
+
+// Files smaller than this are read normally even with Mmap, since mapping
+// them costs more than it saves.
+const minMmapSize = 1 << 20
+
+// Maps file into memory for Mmap, if it's a regular file large enough to be
+// worth it.  Otherwise, or if it can't be mapped, returns nil, and the file is
+// read normally.
+func (a *Archiver) mapFile(file *os.File) []byte {
+	fileInfo, err := file.Stat()
+	if err != nil || !fileInfo.Mode().IsRegular() || fileInfo.Size() < minMmapSize || int64(int(fileInfo.Size())) != fileInfo.Size() {
+		return nil
+	}
+	mapping, err := mmapFile(file, fileInfo.Size())
+	if err != nil {
+		a.Logger.Verbose("unable to mmap file; reading it normally:", err.Error())
+		return nil
+	}
+	return mapping
+}
+
+// Writes a line to the Manifest in the format used by sha256sum, so that
+// extracted files can be checked with "sha256sum -c".
+func (a *Archiver) writeManifestEntry(filePath string, sum []byte) {
+	a.manifestLock.Lock()
+	defer a.manifestLock.Unlock()
+	_, err := io.WriteString(a.Manifest, manifestLine(filePath, sum))
 	if err != nil {
+		a.Logger.Warning("manifest write error:", err.Error())
+	}
+}
+
+// Reads from input until buffer is full, returning the number of bytes read.
+// Interrupted reads are retried, and reads that return neither data nor an
+// error are tolerated up to MaxEmptyReads times in a row before giving up with
+// io.ErrNoProgress.  If the end of the input is reached, io.EOF is returned
+// along with whatever data was read before it.
+func (a *Archiver) fillBlock(input io.Reader, buffer []byte) (int, error) {
+	total := 0
+	emptyReads := 0
+	for total < len(buffer) {
+		n, err := input.Read(buffer[total:])
+		total += n
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			return total, err
+		}
+		if n == 0 {
+			emptyReads += 1
+			if emptyReads >= a.MaxEmptyReads {
+				return total, io.ErrNoProgress
+			}
+		} else {
+			emptyReads = 0
+		}
+	}
+	return total, nil
+}
+
+func (a *Archiver) archiveWriter(blocks <-chan block) error {
+	if a.Align < 0 || a.Align > maxAlign {
+		return ErrInvalidAlignment
+	}
+	if a.FormatVersion < 0 || a.FormatVersion > 2 {
+		return ErrUnsupportedVersion
+	}
+	if a.HashOnly {
+		return a.hashOnlyWriter(blocks)
+	}
+
+	// One limiter is shared by all outputs, so that the limit applies to the
+	// total rate at which archives are written.
+	writeLimiter := newRateLimiter(a.WriteLimit)
+	newStream := func(output io.Writer) *archiveStream {
+		var sync func() error
+		if a.SyncOutput {
+			sync = fileSyncer(output)
+		}
+		if writeLimiter != nil {
+			output = rateLimitedWriter{output, writeLimiter}
+		}
+		var stream *archiveStream
+		if a.OutputBatchSize > 0 {
+			stream = newBufferedArchiveStream(newBatchWriter(output, a.OutputBatchSize, a.FlushInterval), a.Align)
+		} else {
+			stream = newArchiveStream(output, a.Align)
+		}
+		stream.sync = sync
+		stream.runLength = a.RunLength
+		if a.FormatVersion != 0 {
+			stream.version = a.FormatVersion
+		}
+		return stream
+	}
+
+	var streams []*archiveStream
+	if a.stream != nil {
+		// Adding to an archive that a Writer has already started.
+		streams = append(streams, a.stream)
+	} else if a.SplitOutput != nil {
+		if len(a.ShardOutputs) > 0 {
+			return ErrShardedSplit
+		}
+		for _, root := range a.roots {
+			output, err := a.SplitOutput(root)
+			if err != nil {
+				return err
+			}
+			streams = append(streams, newStream(output))
+		}
+	} else if len(a.ShardOutputs) > 0 {
+		for _, output := range a.ShardOutputs {
+			streams = append(streams, newStream(output))
+		}
+	} else {
+		streams = append(streams, newStream(a.output))
+	}
+
+	// Counts what's written to a stream by write towards the stats.
+	countWrite := func(stream *archiveStream, write func() error) error {
+		start, before := time.Now(), stream.counter.count
+		err := write()
+		atomic.AddInt64(&a.stats.bytesWritten, stream.counter.count-before)
+		addTime(&a.stats.writeTime, start)
 		return err
 	}
 
-	for block := range a.blockQueue {
-		err = block.writeBlock(output)
+	for i := 0; i < len(streams) && a.stream == nil; i++ {
+		err := countWrite(streams[i], streams[i].writeHeader)
+		if err == nil {
+			err = streams[i].writeBlock(archiveInfoBlock(a.BlockSize, a.Compress, a.Dedup, a.RunLength, a.Align, a.Deterministic, a.Snapshot.chain()))
+		}
+		if err == nil && a.Compress && len(a.CompressDictionary) > 0 {
+			err = streams[i].writeBlock(block{blockType: blockTypeDictionary, buffer: a.CompressDictionary})
+		}
+		root := 0
+		if a.SplitOutput != nil {
+			root = i
+		}
+		if err == nil && len(a.roots) > 0 && !a.Deterministic {
+			// Record what the source filesystem could represent, so that
+			// extraction can warn about anything the destination can't.
+			props := block{blockType: blockTypeSourceProperties, buffer: sourceProperties(a.sources[root]).encode()}
+			err = streams[i].writeBlock(props)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(a.ShardOutputs) > 0 && a.stream == nil {
+		return a.shardWriter(blocks, streams, countWrite)
+	}
 
-		blockCount += 1
-		if err == nil && (blockCount%1000) == 0 {
-			err = writeChecksumBlock(hash, output)
+	for {
+		var block block
+		var ok bool
+		select {
+		case block, ok = <-blocks:
+		case <-a.interrupt:
+			// Keep the scanners and readers from blocking while they
+			// wind down.
+			go a.discardBlocks(blocks)
+			return ErrInterrupted
+		}
+		if !ok {
+			break
+		}
+		if !a.prepareBlock(&block) {
+			a.blockDone(block)
+			continue
 		}
 
+		stream := streams[0]
+		if a.SplitOutput != nil {
+			stream = streams[block.root]
+		}
+		if a.Catalog != nil && block.blockType == blockTypeStartOfFile {
+			a.Catalog.started(block.filePath, stream.counter.count)
+		}
+		err := countWrite(stream, func() error { return stream.writeBlock(block) })
+		a.blockDone(block)
 		if err != nil {
 			return err
 		}
 	}
 
-	return writeChecksumBlock(hash, output)
+	if a.stream != nil {
+		return nil
+	}
+	for _, stream := range streams {
+		err := countWrite(stream, stream.finish)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func writeChecksumBlock(hash hash.Hash64, output io.Writer) error {
-	// file path length... zero
-	err := binary.Write(output, binary.BigEndian, uint16(0))
-	if err == nil {
-		blockType := []byte{byte(blockTypeChecksum)}
-		_, err = output.Write(blockType)
+// Makes the last changes to a block before it's written: its path is changed
+// to the one it's stored as, and with Deterministic, its owner and
+// modification time are dropped or clamped.  Returns false if the block is to
+// be left out.
+func (a *Archiver) prepareBlock(b *block) bool {
+	b.filePath = a.storedPath(b.filePath, b.root)
+	if !a.Deterministic {
+		return true
 	}
-	if err == nil {
-		err = binary.Write(output, binary.BigEndian, hash.Sum64())
+	b.uid, b.gid = 0, 0
+	if b.blockType == blockTypeTimes {
+		if a.ClampModTime.IsZero() {
+			return false
+		} else if b.modTime().After(a.ClampModTime) {
+			*b = timesBlock(b.filePath, a.ClampModTime, b.root)
+		}
 	}
-	return err
+	return true
 }
 
-// Wrapper for Readdirnames that converts it into a generator-style method.
-func (a *Archiver) readdirnames(dir *os.File) chan string {
-	retval := make(chan string, 256)
-	go func(dir *os.File) {
-		for {
-			names, err := dir.Readdirnames(256)
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				a.Logger.Warning("error reading directory:", err.Error())
+// Writes the blocks of a sharded archive, with each stream written by a
+// goroutine of its own.  Every block of a file goes to the same shard, chosen
+// by a hash of the file's path, so each shard is a complete archive of its
+// files.
+func (a *Archiver) shardWriter(blocks <-chan block, streams []*archiveStream, countWrite func(*archiveStream, func() error) error) error {
+	queues := make([]chan block, len(streams))
+	failed := make(chan error, len(streams))
+	done := make(chan error, len(streams))
+	// Closed if the archive is abandoned, so that the shards aren't finished.
+	abandoned := make(chan struct{})
+	for i := range streams {
+		queues[i] = make(chan block, a.BlockQueueSize)
+		go func(stream *archiveStream, queue <-chan block) {
+			var err error
+			for block := range queue {
+				if err == nil {
+					err = countWrite(stream, func() error { return stream.writeBlock(block) })
+					if err != nil {
+						failed <- err
+					}
+				}
+				a.blockDone(block)
 			}
-			for _, name := range names {
-				retval <- name
+			select {
+			case <-abandoned:
+			default:
+				if err == nil {
+					err = countWrite(stream, stream.finish)
+				}
 			}
+			done <- err
+		}(streams[i], queues[i])
+	}
+	closeQueues := func() {
+		for _, queue := range queues {
+			close(queue)
 		}
-		close(retval)
-	}(dir)
+	}
+	abandon := func() {
+		close(abandoned)
+		closeQueues()
+		go a.discardBlocks(blocks)
+	}
+
+	for {
+		var block block
+		var ok bool
+		select {
+		case block, ok = <-blocks:
+		case err := <-failed:
+			abandon()
+			return err
+		case <-a.interrupt:
+			abandon()
+			return ErrInterrupted
+		}
+		if !ok {
+			break
+		}
+		if !a.prepareBlock(&block) {
+			a.blockDone(block)
+			continue
+		}
+		if block.blockType == blockTypeDirectory {
+			// Every shard has all of the directories, so that each can
+			// be extracted on its own.
+			for i, queue := range queues {
+				if i > 0 {
+					block.reserved = 0
+					block.written = nil
+				}
+				queue <- block
+			}
+		} else {
+			queues[shardOf(block.filePath, len(queues))] <- block
+		}
+	}
+
+	closeQueues()
+	var retval error
+	for range queues {
+		if err := <-done; err != nil && retval == nil {
+			retval = err
+		}
+	}
 	return retval
 }
+
+// Returns the shard that the blocks for filePath are written to.
+func shardOf(filePath string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(filePath))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// Releases what's held by a block once it has been written, or abandoned.
+func (a *Archiver) blockDone(block block) {
+	a.memory.release(block.reserved)
+	if block.written != nil {
+		block.written()
+	}
+}
+
+// Takes the place of the archive writer with HashOnly, letting go of each
+// block as it comes.
+func (a *Archiver) hashOnlyWriter(blocks <-chan block) error {
+	for {
+		select {
+		case block, ok := <-blocks:
+			if !ok {
+				return nil
+			}
+			a.blockDone(block)
+		case <-a.interrupt:
+			go a.discardBlocks(blocks)
+			return ErrInterrupted
+		}
+	}
+}
+
+// Abandons the blocks that are still to come, so that the scanners and
+// readers don't block while they wind down after the writer has stopped.
+func (a *Archiver) discardBlocks(blocks <-chan block) {
+	for block := range blocks {
+		a.blockDone(block)
+	}
+}
+
+// Wrapper for Readdirnames that converts it into a generator-style method.
+// This is the portable directory reader; entry types are left unknown so that
+// the scanner will lstat each one.
+func (a *Archiver) readdirnames(dir *os.File, retval chan dirEntry) {
+	for {
+		names, err := dir.Readdirnames(256)
+		for _, name := range names {
+			retval <- dirEntry{name: name}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			a.lossWarning("error reading directory:", err.Error())
+			break
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package falib
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// One result of a scriptedReader's Read.
+type readResult struct {
+	data string
+	err  error
+}
+
+// A reader that returns each of its results in turn, and then io.EOF.
+type scriptedReader struct {
+	results []readResult
+	reads   int
+}
+
+func (r *scriptedReader) Read(p []byte) (int, error) {
+	r.reads++
+	if r.reads > len(r.results) {
+		return 0, io.EOF
+	}
+	result := r.results[r.reads-1]
+	if len(result.data) > len(p) {
+		panic("scripted read larger than the buffer")
+	}
+	return copy(p, result.data), result.err
+}
+
+func TestFillBlock(t *testing.T) {
+	interrupted := &os.PathError{Op: "read", Path: "file", Err: syscall.EINTR}
+	for _, test := range []struct {
+		name    string
+		results []readResult
+		size    int
+		data    string
+		err     error
+		reads   int
+	}{
+		{"one read", []readResult{{"abcd", nil}}, 4, "abcd", nil, 1},
+		{"short reads", []readResult{{"ab", nil}, {"c", nil}, {"d", nil}}, 4, "abcd", nil, 3},
+		{"data with EOF", []readResult{{"ab", io.EOF}}, 4, "ab", io.EOF, 1},
+		{"EOF after data", []readResult{{"ab", nil}}, 4, "ab", io.EOF, 2},
+		{"data with an error", []readResult{{"ab", io.ErrUnexpectedEOF}, {"cd", nil}}, 4, "ab", io.ErrUnexpectedEOF, 1},
+		{"EINTR", []readResult{{"", syscall.EINTR}, {"abcd", nil}}, 4, "abcd", nil, 2},
+		{"data with EINTR", []readResult{{"ab", syscall.EINTR}, {"cd", nil}}, 4, "abcd", nil, 2},
+		{"wrapped EINTR", []readResult{{"a", interrupted}, {"", interrupted}, {"bcd", nil}}, 4, "abcd", nil, 3},
+		{"EINTR isn't an empty read", []readResult{{"", syscall.EINTR}, {"", syscall.EINTR}, {"", syscall.EINTR},
+			{"", syscall.EINTR}, {"abcd", nil}}, 4, "abcd", nil, 5},
+		{"empty reads under the limit", []readResult{{"", nil}, {"", nil}, {"abcd", nil}}, 4, "abcd", nil, 3},
+		{"empty reads reset by data", []readResult{{"", nil}, {"", nil}, {"a", nil}, {"", nil}, {"", nil}, {"bcd", nil}},
+			4, "abcd", nil, 6},
+		{"too many empty reads", []readResult{{"a", nil}, {"", nil}, {"", nil}, {"", nil}, {"bcd", nil}},
+			4, "a", io.ErrNoProgress, 4},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			archiver := &Archiver{MaxEmptyReads: 3}
+			input := &scriptedReader{results: test.results}
+			buffer := make([]byte, test.size)
+			n, err := archiver.fillBlock(input, buffer)
+			if string(buffer[:n]) != test.data {
+				t.Errorf("read %q, expected %q", buffer[:n], test.data)
+			}
+			if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+				t.Errorf("returned error %v, expected %v", err, test.err)
+			}
+			if input.reads != test.reads {
+				t.Errorf("read %d times, expected %d", input.reads, test.reads)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package falib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// An io.Reader implementation that also keeps a crc64 as it reads.  Fancy!
+type hashingReader struct {
+	innerReader io.Reader
+	hasher      hash.Hash64
+}
+
+func (r hashingReader) Read(buf []byte) (int, error) {
+	n, err := r.innerReader.Read(buf)
+	r.hasher.Write(buf[:n])
+	return n, err
+}
+
+// The largest extension block that's read into memory, rather than skipped.
+// Those this reader decodes are much smaller; anything bigger is corrupt.
+const maxDecodedExtensionSize = 1 << 20
+
+// Returns true for the extension blocks that this reader decodes.
+func isDecodedExtension(t blockType) bool {
+	switch t {
+	case blockTypeSourceProperties, blockTypeTimes, blockTypeArchiveInfo, blockTypeSummary, blockTypeFileChanged, blockTypeAttributes:
+		return true
+	}
+	return false
+}
+
+// Decodes the blocks of an archive.  Padding and checksum blocks are handled
+// internally, as are extension blocks of types this reader doesn't know about,
+// which are skipped.
+type archiveReader struct {
+	reader        hashingReader
+	skippedBlocks map[blockType]int
+	version       int
+	filePaths     map[uint64]string
+
+	// The preset dictionary that compressed data blocks were compressed
+	// with, from the archive's dictionary block.
+	dictionary []byte
+}
+
+func newArchiveReader(input io.Reader) *archiveReader {
+	return &archiveReader{
+		reader:        hashingReader{input, crc64.New(crc64.MakeTable(crc64.ECMA))},
+		skippedBlocks: make(map[blockType]int),
+		filePaths:     make(map[uint64]string),
+	}
+}
+
+func (r *archiveReader) readHeader() error {
+	fileHeader := make([]byte, len(fastArchiverHeader))
+	_, err := io.ReadFull(r.reader, fileHeader)
+	if err != nil {
+		return err
+	} else if bytes.Equal(fileHeader, fastArchiverHeader) {
+		r.version = 1
+	} else if bytes.Equal(fileHeader, fastArchiverHeaderV2) {
+		r.version = 2
+	} else {
+		return ErrFileHeaderMismatch
+	}
+	return nil
+}
+
+// Reads the type and path of the next block, in whichever order the archive's
+// version puts them.  Returns io.EOF only if the archive ends cleanly before
+// the block.
+func (r *archiveReader) readBlockPrefix() (blockType, string, error) {
+	var typeBuf [1]byte
+	if r.version < 2 {
+		filePath, err := readPath(r.reader)
+		if err == nil {
+			_, err = io.ReadFull(r.reader, typeBuf[:])
+			err = unexpectedEOF(err)
+		}
+		return blockType(typeBuf[0]), filePath, err
+	}
+
+	_, err := io.ReadFull(r.reader, typeBuf[:])
+	if err != nil {
+		return 0, "", err
+	}
+	t := blockType(typeBuf[0])
+	if !isFileContentBlock(t) {
+		filePath, err := readPath(r.reader)
+		return t, filePath, unexpectedEOF(err)
+	}
+	id, err := binary.ReadUvarint(byteReader{r.reader})
+	if err != nil {
+		return t, "", unexpectedEOF(err)
+	}
+	filePath, ok := r.filePaths[id]
+	if !ok {
+		return t, "", ErrUnknownFileId
+	}
+	if t == blockTypeEndOfFile {
+		delete(r.filePaths, id)
+	}
+	return t, filePath, nil
+}
+
+// Adapts a reader to io.ByteReader, for reading varints a byte at a time.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var buf [1]byte
+	_, err := io.ReadFull(r.Reader, buf[:])
+	return buf[0], err
+}
+
+// Returns the next file, directory, or known extension block in the archive,
+// or io.EOF at the end of the archive.
+func (r *archiveReader) readBlock() (block, error) {
+	for {
+		blockType, filePath, err := r.readBlockPrefix()
+		if err != nil {
+			return block{}, err
+		}
+
+		switch {
+		case blockType == blockTypeStartOfFile || blockType == blockTypeDirectory || blockType == blockTypeSpecial:
+			var uid uint32
+			var gid uint32
+			var mode os.FileMode
+
+			err = binary.Read(r.reader, binary.BigEndian, &uid)
+			if err == nil {
+				err = binary.Read(r.reader, binary.BigEndian, &gid)
+			}
+			if err == nil {
+				err = binary.Read(r.reader, binary.BigEndian, &mode)
+			}
+			b := block{filePath: filePath, blockType: blockType, uid: int(uid), gid: int(gid), mode: mode}
+			if err == nil && blockType == blockTypeSpecial {
+				err = binary.Read(r.reader, binary.BigEndian, &b.major)
+				if err == nil {
+					err = binary.Read(r.reader, binary.BigEndian, &b.minor)
+				}
+			}
+			if err == nil && blockType == blockTypeStartOfFile && r.version >= 2 {
+				var id uint64
+				id, err = binary.ReadUvarint(byteReader{r.reader})
+				if _, inUse := r.filePaths[id]; inUse && err == nil {
+					return block{}, ErrDuplicateFileId
+				}
+				r.filePaths[id] = filePath
+			}
+			if err != nil {
+				return block{}, unexpectedEOF(err)
+			}
+			return b, nil
+
+		case blockType == blockTypeSymlink:
+			var uid, gid uint32
+			var mode os.FileMode
+			err = binary.Read(r.reader, binary.BigEndian, &uid)
+			if err == nil {
+				err = binary.Read(r.reader, binary.BigEndian, &gid)
+			}
+			if err == nil {
+				err = binary.Read(r.reader, binary.BigEndian, &mode)
+			}
+			b := block{filePath: filePath, blockType: blockType, uid: int(uid), gid: int(gid), mode: mode}
+			if err == nil {
+				b.linkTarget, err = readPath(r.reader)
+			}
+			if err != nil {
+				return block{}, unexpectedEOF(err)
+			}
+			return b, nil
+
+		case blockType == blockTypeEndOfFile || blockType == blockTypeDelete || blockType == blockTypeRestartFile:
+			return block{filePath: filePath, blockType: blockType}, nil
+
+		case blockType == blockTypeData:
+			var blockSize uint16
+			err = binary.Read(r.reader, binary.BigEndian, &blockSize)
+			if err != nil {
+				return block{}, unexpectedEOF(err)
+			}
+
+			blockData := make([]byte, blockSize)
+			_, err = io.ReadFull(r.reader, blockData)
+			if err != nil {
+				return block{}, unexpectedEOF(err)
+			}
+			return block{filePath: filePath, numBytes: blockSize, buffer: blockData, blockType: blockType}, nil
+
+		case blockType == blockTypeCompressedData:
+			var blockSize, compressedSize uint16
+			err = binary.Read(r.reader, binary.BigEndian, &blockSize)
+			if err == nil {
+				err = binary.Read(r.reader, binary.BigEndian, &compressedSize)
+			}
+			compressed := make([]byte, compressedSize)
+			if err == nil {
+				_, err = io.ReadFull(r.reader, compressed)
+			}
+			if err != nil {
+				return block{}, unexpectedEOF(err)
+			}
+			blockData, err := decompressBlock(compressed, blockSize, r.dictionary)
+			if err != nil {
+				return block{}, err
+			}
+			return block{filePath: filePath, numBytes: blockSize, buffer: blockData, blockType: blockTypeData, compressed: compressed}, nil
+
+		case blockType == blockTypeChunk || blockType == blockTypeChunkReference:
+			b := block{filePath: filePath, blockType: blockType}
+			_, err = io.ReadFull(r.reader, b.digest[:])
+			if err == nil && blockType == blockTypeChunk {
+				err = binary.Read(r.reader, binary.BigEndian, &b.numBytes)
+				if err == nil {
+					b.buffer = make([]byte, b.numBytes)
+					_, err = io.ReadFull(r.reader, b.buffer)
+				}
+			}
+			if err != nil {
+				return block{}, unexpectedEOF(err)
+			}
+			return b, nil
+
+		case blockType == blockTypeRepeat:
+			b := block{filePath: filePath, blockType: blockType}
+			err = binary.Read(r.reader, binary.BigEndian, &b.repeat)
+			if err != nil {
+				return block{}, unexpectedEOF(err)
+			}
+			return b, nil
+
+		case blockType == blockTypePadding:
+			var paddingSize uint16
+			err = binary.Read(r.reader, binary.BigEndian, &paddingSize)
+			if err == nil {
+				_, err = io.CopyN(ioutil.Discard, r.reader, int64(paddingSize))
+			}
+			if err != nil {
+				return block{}, unexpectedEOF(err)
+			}
+
+		case blockType == blockTypeDictionary:
+			var dictionarySize uint16
+			err = binary.Read(r.reader, binary.BigEndian, &dictionarySize)
+			if err == nil {
+				r.dictionary = make([]byte, dictionarySize)
+				_, err = io.ReadFull(r.reader, r.dictionary)
+			}
+			if err != nil {
+				return block{}, unexpectedEOF(err)
+			}
+
+		case blockType == blockTypeChecksum:
+			currentChecksum := r.reader.hasher.Sum64()
+
+			var expectedChecksum uint64
+			err = binary.Read(r.reader, binary.BigEndian, &expectedChecksum)
+			if err != nil {
+				return block{}, unexpectedEOF(err)
+			}
+			if expectedChecksum != currentChecksum {
+				return block{}, ErrCrcMismatch
+			}
+
+		case blockType >= blockTypeFirstExtension:
+			var payloadSize uint32
+			err = binary.Read(r.reader, binary.BigEndian, &payloadSize)
+			if err == nil && isDecodedExtension(blockType) {
+				if payloadSize > maxDecodedExtensionSize {
+					return block{}, ErrBlockTooLarge
+				}
+				b := block{filePath: filePath, blockType: blockType, buffer: make([]byte, payloadSize)}
+				_, err = io.ReadFull(r.reader, b.buffer)
+				if err == nil {
+					return b, nil
+				}
+			} else if err == nil {
+				r.skippedBlocks[blockType] += 1
+				_, err = io.CopyN(ioutil.Discard, r.reader, int64(payloadSize))
+			}
+			if err != nil {
+				return block{}, unexpectedEOF(err)
+			}
+
+		default:
+			return block{}, ErrUnrecognizedBlockType
+		}
+	}
+}
+
+// Describes the extension blocks that were skipped because this reader didn't
+// understand them, one line per block type.
+func (r *archiveReader) skippedBlockSummary() []string {
+	var types []int
+	for t := range r.skippedBlocks {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+
+	var retval []string
+	for _, t := range types {
+		retval = append(retval, fmt.Sprintf("skipped %d blocks of unknown type %d; this archive may have been created by a newer version",
+			r.skippedBlocks[blockType(t)], t))
+	}
+	return retval
+}
+
+// An end of file partway through a block is never a clean end of the archive.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
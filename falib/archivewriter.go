@@ -0,0 +1,310 @@
+package falib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/crc64"
+	"io"
+	"math"
+)
+
+// Size of the buffer between the archive writer and its output.  Blocks are
+// written a few fields at a time, so this is what keeps the number of write
+// syscalls down; it holds a few of the largest blocks.
+const outputBufferSize = 256 * 1024
+
+// An io.Writer that keeps track of how many bytes have passed through it.
+type countingWriter struct {
+	innerWriter io.Writer
+	count       int64
+}
+
+func (w *countingWriter) Write(buf []byte) (int, error) {
+	n, err := w.innerWriter.Write(buf)
+	w.count += int64(n)
+	return n, err
+}
+
+// The state of an archive being written: its running checksum, its current
+// offset, and the chunks already stored in it.
+type archiveStream struct {
+	output        flushWriter
+	counter       *countingWriter
+	hash          hash.Hash64
+	writer        io.Writer
+	align         int
+	blockCount    int
+	writtenChunks map[[sha256.Size]byte]bool
+	runLength     bool
+	lastData      map[string]block
+	repeats       map[string]uint32
+	header        []byte
+	version       int
+	fileIds       map[string]uint64
+	freeIds       []uint64
+	nextId        uint64
+	summary       archiveSummary
+
+	// Called once the archive is complete, if it isn't nil, to fsync the
+	// output.
+	sync func() error
+}
+
+func newArchiveStream(output io.Writer, align int) *archiveStream {
+	return newBufferedArchiveStream(bufio.NewWriterSize(output, outputBufferSize), align)
+}
+
+// Returns a stream that writes to output, which does its own buffering.
+func newBufferedArchiveStream(output flushWriter, align int) *archiveStream {
+	s := &archiveStream{
+		output:        output,
+		hash:          crc64.New(crc64.MakeTable(crc64.ECMA)),
+		align:         align,
+		writtenChunks: make(map[[sha256.Size]byte]bool),
+		lastData:      make(map[string]block),
+		repeats:       make(map[string]uint32),
+		version:       1,
+		fileIds:       make(map[string]uint64),
+	}
+	s.counter = &countingWriter{s.output, 0}
+	s.writer = io.MultiWriter(s.counter, s.hash)
+	return s
+}
+
+func (s *archiveStream) writeHeader() error {
+	header := fastArchiverHeader
+	if s.version >= 2 {
+		header = fastArchiverHeaderV2
+	}
+	_, err := s.writer.Write(header)
+	return err
+}
+
+func (s *archiveStream) writeBlock(block block) error {
+	s.summary.count(block)
+
+	// With run-length encoding, a data block that's identical to the previous
+	// one in the same file is only counted, and the count is written out as a
+	// repeat block before the file's next different block.
+	if s.runLength && (block.blockType == blockTypeData || block.blockType == blockTypeEndOfFile || block.blockType == blockTypeRestartFile) {
+		last, ok := s.lastData[block.filePath]
+		if block.blockType == blockTypeData && ok && s.repeats[block.filePath] < math.MaxUint32 &&
+			bytes.Equal(block.buffer[:block.numBytes], last.buffer[:last.numBytes]) {
+			s.repeats[block.filePath] += 1
+			return nil
+		}
+		err := s.flushRepeats(block.filePath)
+		if err != nil {
+			return err
+		}
+		if block.blockType == blockTypeData {
+			s.lastData[block.filePath] = block
+		} else {
+			delete(s.lastData, block.filePath)
+		}
+	}
+
+	// When deduplicating, any chunk that's already in the archive is written
+	// as a reference instead.
+	if block.blockType == blockTypeChunk {
+		if s.writtenChunks[block.digest] {
+			block.blockType = blockTypeChunkReference
+		} else {
+			s.writtenChunks[block.digest] = true
+		}
+	}
+
+	var err error
+	s.header, err = s.appendBlockPrefix(s.header[:0], block)
+	if err != nil {
+		return err
+	}
+	var payload []byte
+	s.header, payload = block.appendFields(s.header)
+	if block.blockType == blockTypeStartOfFile && s.version >= 2 {
+		s.header = binary.AppendUvarint(s.header, s.assignFileId(block.filePath))
+	}
+
+	if s.align > 0 && ((block.blockType == blockTypeData && block.compressed == nil) || block.blockType == blockTypeChunk) {
+		err = s.writePaddingBlock(s.counter.count + int64(len(s.header)))
+	}
+	if err == nil {
+		_, err = s.writer.Write(s.header)
+	}
+	if err == nil && len(payload) > 0 {
+		_, err = s.writer.Write(payload)
+	}
+	if block.blockType == blockTypeEndOfFile && s.version >= 2 {
+		s.releaseFileId(block.filePath)
+	}
+
+	s.blockCount += 1
+	if err == nil && (s.blockCount%1000) == 0 {
+		err = s.writeChecksumBlock()
+	}
+	return err
+}
+
+// Appends the part of a block's header that identifies it: its type, and the
+// path it applies to.  In version 1 archives this is always the path followed
+// by the type.  Version 2 archives put the type first, and follow it with the
+// file's ID instead of its path for the blocks of a file's contents.
+func (s *archiveStream) appendBlockPrefix(buf []byte, b block) ([]byte, error) {
+	blockType := b.encodedType()
+	if s.version < 2 {
+		buf, err := appendPath(buf, b.filePath)
+		return append(buf, byte(blockType)), err
+	}
+
+	buf = append(buf, byte(blockType))
+	if !isFileContentBlock(blockType) {
+		return appendPath(buf, b.filePath)
+	}
+	id, ok := s.fileIds[b.filePath]
+	if !ok {
+		return buf, ErrUnknownFileId
+	}
+	return binary.AppendUvarint(buf, id), nil
+}
+
+// Assigns an ID to a file that's being started.  IDs of files that have ended
+// are reused, so that they stay small, and take only a byte or two.
+func (s *archiveStream) assignFileId(filePath string) uint64 {
+	var id uint64
+	if n := len(s.freeIds); n > 0 {
+		id = s.freeIds[n-1]
+		s.freeIds = s.freeIds[:n-1]
+	} else {
+		id = s.nextId
+		s.nextId += 1
+	}
+	s.fileIds[filePath] = id
+	return id
+}
+
+func (s *archiveStream) releaseFileId(filePath string) {
+	if id, ok := s.fileIds[filePath]; ok {
+		delete(s.fileIds, filePath)
+		s.freeIds = append(s.freeIds, id)
+	}
+}
+
+func (s *archiveStream) flushRepeats(filePath string) error {
+	count := s.repeats[filePath]
+	if count == 0 {
+		return nil
+	}
+	delete(s.repeats, filePath)
+	return s.writeBlock(block{filePath: filePath, blockType: blockTypeRepeat, repeat: count})
+}
+
+// Writes the summary of the archive's contents and the final checksum, and
+// flushes the archive.
+func (s *archiveStream) finish() error {
+	err := s.writeBlock(block{blockType: blockTypeSummary, buffer: s.summary.encode()})
+	if err == nil {
+		err = s.writeChecksumBlock()
+	}
+	flushErr := s.output.Flush()
+	if err == nil {
+		err = flushErr
+	}
+	if err == nil && s.sync != nil {
+		err = s.sync()
+	}
+	return err
+}
+
+// Returns the type that the block is written as.
+func (b *block) encodedType() blockType {
+	if b.blockType == blockTypeData && b.compressed != nil {
+		return blockTypeCompressedData
+	}
+	return b.blockType
+}
+
+// Appends the block's type-specific fields, up to its payload, to buf, and
+// returns it along with the payload.  The payload is left to be written
+// separately so that it isn't copied, while the header goes out in a single
+// write.
+func (b *block) appendFields(buf []byte) ([]byte, []byte) {
+	var payload []byte
+	switch blockType := b.encodedType(); blockType {
+	case blockTypeDirectory, blockTypeStartOfFile, blockTypeSpecial:
+		buf = binary.BigEndian.AppendUint32(buf, uint32(b.uid))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(b.gid))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(b.mode))
+		if blockType == blockTypeSpecial {
+			buf = binary.BigEndian.AppendUint32(buf, b.major)
+			buf = binary.BigEndian.AppendUint32(buf, b.minor)
+		}
+	case blockTypeSymlink:
+		buf = binary.BigEndian.AppendUint32(buf, uint32(b.uid))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(b.gid))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(b.mode))
+		// Link targets are no longer than paths, which fit.
+		buf, _ = appendPath(buf, b.linkTarget)
+	case blockTypeEndOfFile, blockTypeDelete, blockTypeRestartFile:
+		// Nothing to write aside from the block type
+	case blockTypeData:
+		buf = binary.BigEndian.AppendUint16(buf, b.numBytes)
+		payload = b.buffer[:b.numBytes]
+	case blockTypeCompressedData:
+		buf = binary.BigEndian.AppendUint16(buf, b.numBytes)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(b.compressed)))
+		payload = b.compressed
+	case blockTypeChunk:
+		buf = append(buf, b.digest[:]...)
+		buf = binary.BigEndian.AppendUint16(buf, b.numBytes)
+		payload = b.buffer[:b.numBytes]
+	case blockTypeChunkReference:
+		buf = append(buf, b.digest[:]...)
+	case blockTypeRepeat:
+		buf = binary.BigEndian.AppendUint32(buf, b.repeat)
+	case blockTypeDictionary:
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(b.buffer)))
+		payload = b.buffer
+	default:
+		if blockType < blockTypeFirstExtension {
+			panic("Internal error: unexpected block type")
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(b.buffer)))
+		payload = b.buffer
+	}
+	return buf, payload
+}
+
+func (s *archiveStream) writeChecksumBlock() error {
+	// The checksum covers its own block's header, so that has to be
+	// written before it's calculated.
+	header, _ := s.appendBlockPrefix(nil, block{blockType: blockTypeChecksum})
+	_, err := s.writer.Write(header)
+	if err == nil {
+		err = binary.Write(s.writer, binary.BigEndian, s.hash.Sum64())
+	}
+	return err
+}
+
+// Writes a padding block sized so that a block payload which would otherwise
+// start at payloadOffset will instead start at a multiple of align.
+func (s *archiveStream) writePaddingBlock(payloadOffset int64) error {
+	align := int64(s.align)
+	pad := int((align - payloadOffset%align) % align)
+	if pad == 0 {
+		return nil
+	}
+
+	// The padding block's own header takes up some of the space to be filled.
+	padding := pad - paddingBlockHeaderSize
+	if padding < 0 {
+		padding += s.align
+	}
+
+	buf, _ := s.appendBlockPrefix(make([]byte, 0, paddingBlockHeaderSize+padding), block{blockType: blockTypePadding})
+	buf = binary.BigEndian.AppendUint16(buf, uint16(padding))
+	_, err := s.writer.Write(append(buf, make([]byte, padding)...))
+	return err
+}
@@ -0,0 +1,89 @@
+package falib
+
+import (
+	"encoding/binary"
+	"os"
+	"sort"
+)
+
+// The inode flags (as set by chattr) that are archived: those that restrict
+// what can be done to a file, and so are part of a system's configuration.
+const (
+	fileFlagImmutable  uint32 = 0x10
+	fileFlagAppendOnly uint32 = 0x20
+
+	archivedFileFlags = fileFlagImmutable | fileFlagAppendOnly
+)
+
+// The extended attributes that are archived.  security.capability holds the
+// capabilities granted to an executable, such as ping's CAP_NET_RAW.
+var archivedXattrs = []string{"security.capability"}
+
+// Linux attributes of a file or directory beyond its mode and ownership: its
+// inode flags, and the extended attributes in archivedXattrs that it has.
+type fileAttributes struct {
+	flags  uint32
+	xattrs map[string][]byte
+}
+
+func (f fileAttributes) empty() bool {
+	return f.flags == 0 && len(f.xattrs) == 0
+}
+
+// Queues an attributes block for the file or directory at filePath, if it has
+// any attributes worth archiving.  file is the open file or directory.
+func (a *Archiver) queueAttributes(file *os.File, filePath string, root int) {
+	attributes, err := readAttributes(file, filePath)
+	if err != nil {
+		a.lossWarning("unable to read file flags or capabilities:", err.Error())
+	}
+	if !attributes.empty() {
+		a.blockQueue <- block{filePath: filePath, blockType: blockTypeAttributes, buffer: attributes.encode(), root: root}
+	}
+}
+
+func (f fileAttributes) encode() []byte {
+	buffer := binary.BigEndian.AppendUint32(nil, f.flags)
+	names := make([]string, 0, len(f.xattrs))
+	for name := range f.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(name)))
+		buffer = append(buffer, name...)
+		buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(f.xattrs[name])))
+		buffer = append(buffer, f.xattrs[name]...)
+	}
+	return buffer
+}
+
+// Decodes the data of an attributes block.
+func decodeAttributes(buffer []byte) (fileAttributes, error) {
+	if len(buffer) < 4 {
+		return fileAttributes{}, ErrCorruptAttributes
+	}
+	f := fileAttributes{flags: binary.BigEndian.Uint32(buffer)}
+	buffer = buffer[4:]
+	for len(buffer) > 0 {
+		if len(buffer) < 2 {
+			return fileAttributes{}, ErrCorruptAttributes
+		}
+		nameLength := int(binary.BigEndian.Uint16(buffer))
+		if len(buffer) < 2+nameLength+4 {
+			return fileAttributes{}, ErrCorruptAttributes
+		}
+		name := string(buffer[2 : 2+nameLength])
+		buffer = buffer[2+nameLength:]
+		valueLength := binary.BigEndian.Uint32(buffer)
+		if uint64(len(buffer)-4) < uint64(valueLength) {
+			return fileAttributes{}, ErrCorruptAttributes
+		}
+		if f.xattrs == nil {
+			f.xattrs = make(map[string][]byte)
+		}
+		f.xattrs[name] = buffer[4 : 4+valueLength]
+		buffer = buffer[4+valueLength:]
+	}
+	return f, nil
+}
@@ -0,0 +1,112 @@
+package falib
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// FS_IOC_GETFLAGS and FS_IOC_SETFLAGS, whose numbers encode the size of a
+// long, although the flags themselves are an int.
+const (
+	fsIocGetFlags = 0x80006601 | unsafe.Sizeof(uintptr(0))<<16
+	fsIocSetFlags = 0x40006602 | unsafe.Sizeof(uintptr(0))<<16
+)
+
+// Reads the archived attributes of file, which is open at filePath.  Missing
+// attributes, and filesystems that don't support them, aren't errors.
+func readAttributes(file *os.File, filePath string) (fileAttributes, error) {
+	var f fileAttributes
+	flags, err := getFileFlags(file)
+	if err != nil && !unsupportedAttribute(err) {
+		return f, err
+	}
+	f.flags = flags & archivedFileFlags
+
+	for _, name := range archivedXattrs {
+		value, err := getXattr(filePath, name)
+		if err != nil && !unsupportedAttribute(err) {
+			return f, err
+		}
+		if value != nil {
+			if f.xattrs == nil {
+				f.xattrs = make(map[string][]byte)
+			}
+			f.xattrs[name] = value
+		}
+	}
+	return f, nil
+}
+
+// Sets the extended attributes recorded in f on the file at filePath.  This
+// has to be done after its contents are written and its owner set, since
+// both clear its capabilities.
+func restoreXattrs(filePath string, f fileAttributes) error {
+	for name, value := range f.xattrs {
+		err := syscall.Setxattr(filePath, name, value, 0)
+		if err != nil {
+			return &os.PathError{Op: "setxattr " + name, Path: filePath, Err: err}
+		}
+	}
+	return nil
+}
+
+// Sets the inode flags recorded in f on the file or directory at filePath,
+// keeping any others that it already has.  Once a file is immutable, it can't
+// be written to, renamed, or have its attributes changed, so this comes last.
+func restoreFileFlags(filePath string, f fileAttributes) error {
+	if f.flags == 0 {
+		return nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	flags, err := getFileFlags(file)
+	if err == nil {
+		flags = flags&^archivedFileFlags | f.flags&archivedFileFlags
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), fsIocSetFlags, uintptr(unsafe.Pointer(&flags)))
+		if errno != 0 {
+			err = errno
+		}
+	}
+	if err != nil {
+		return &os.PathError{Op: "set flags", Path: filePath, Err: err}
+	}
+	return nil
+}
+
+func getFileFlags(file *os.File) (uint32, error) {
+	var flags uint32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), fsIocGetFlags, uintptr(unsafe.Pointer(&flags)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return flags, nil
+}
+
+// Returns the value of an extended attribute, or nil if the file doesn't
+// have it.
+func getXattr(filePath, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(filePath, name, nil)
+	if err == syscall.ENODATA {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(filePath, name, value)
+	if err == syscall.ENODATA {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+// Returns true for the errors given by filesystems (and file types) that
+// don't support inode flags or extended attributes.
+func unsupportedAttribute(err error) bool {
+	return err == syscall.ENOTSUP || err == syscall.ENOTTY || err == syscall.EINVAL || err == syscall.ENOSYS
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package falib
+
+import "os"
+
+// Inode flags and capabilities are Linux features; there are none to archive
+// on other platforms, and those in an archive can't be restored.
+func readAttributes(file *os.File, filePath string) (fileAttributes, error) {
+	return fileAttributes{}, nil
+}
+
+func restoreXattrs(filePath string, f fileAttributes) error {
+	if len(f.xattrs) > 0 {
+		return ErrAttributesUnsupported
+	}
+	return nil
+}
+
+func restoreFileFlags(filePath string, f fileAttributes) error {
+	if f.flags != 0 {
+		return ErrAttributesUnsupported
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package falib
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// What an archive stream writes its blocks through: a buffer that's flushed
+// once the archive is complete.
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// A buffer that gathers an archive's blocks, headers and payloads alike, into
+// batches of up to size bytes, and writes each batch to its output from a
+// goroutine of its own.  The next batch is filled while the last one is being
+// written, so a slow write, such as to a network filesystem, doesn't hold up
+// the pipeline.  A batch that isn't full is written once it has been waiting
+// for interval, if that isn't 0, so that a reader at the other end of a pipe
+// or socket isn't kept waiting while the archive trickles out.  It's safe to
+// use from several goroutines.
+type batchWriter struct {
+	output   io.Writer
+	interval time.Duration
+
+	lock    sync.Mutex
+	batch   []byte
+	spare   []byte
+	timer   *time.Timer
+	writing sync.WaitGroup
+	err     error
+}
+
+func newBatchWriter(output io.Writer, size int, interval time.Duration) *batchWriter {
+	return &batchWriter{
+		output:   output,
+		interval: interval,
+		batch:    make([]byte, 0, size),
+		spare:    make([]byte, 0, size),
+	}
+}
+
+func (w *batchWriter) Write(buf []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	written := 0
+	for len(buf) > 0 {
+		if len(w.batch) == 0 && w.interval > 0 {
+			w.startTimer()
+		}
+		n := copy(w.batch[len(w.batch):cap(w.batch)], buf)
+		w.batch = w.batch[:len(w.batch)+n]
+		buf = buf[n:]
+		written += n
+		if len(w.batch) == cap(w.batch) {
+			err := w.flushBatch()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Writes out the batch that's been filled so far, and waits until it has been
+// written.
+func (w *batchWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	err := w.flushBatch()
+	w.writing.Wait()
+	if err == nil {
+		err = w.err
+	}
+	return err
+}
+
+// Starts writing the current batch, once the previous one has been written,
+// and starts filling the spare.  Called with the lock held.
+func (w *batchWriter) flushBatch() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	w.writing.Wait()
+	if w.err != nil {
+		return w.err
+	}
+	batch := w.batch
+	w.batch = w.spare
+	w.spare = nil
+	w.writing.Add(1)
+	go func() {
+		defer w.writing.Done()
+		_, err := w.output.Write(batch)
+		w.err = err
+		w.spare = batch[:0]
+	}()
+	return nil
+}
+
+// Arranges for the batch that's just been started to be written once it has
+// been waiting for the interval.  Called with the lock held.
+func (w *batchWriter) startTimer() {
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.interval, w.timedFlush)
+	} else {
+		w.timer.Reset(w.interval)
+	}
+}
+
+func (w *batchWriter) timedFlush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.flushBatch()
+}
+
+// Returns the function that fsyncs output, or nil if it isn't a regular
+// file; pipes and terminals can't be fsynced.
+func fileSyncer(output io.Writer) func() error {
+	file, ok := output.(*os.File)
+	if !ok {
+		return nil
+	}
+	fileInfo, err := file.Stat()
+	if err != nil || !fileInfo.Mode().IsRegular() {
+		return nil
+	}
+	return file.Sync
+}
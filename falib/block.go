@@ -1,6 +1,12 @@
 package falib
 
-import "os"
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+)
 
 type blockType byte
 
@@ -10,8 +16,51 @@ const (
 	blockTypeEndOfFile
 	blockTypeDirectory
 	blockTypeChecksum
+	blockTypePadding
+	blockTypeChunk
+	blockTypeChunkReference
+	blockTypeDelete
+	blockTypeRepeat
+	blockTypeSpecial
+	blockTypeCompressedData
+	blockTypeRestartFile
+	blockTypeDictionary
+	blockTypeSymlink
 )
 
+// The file types that are archived as special file blocks.
+const specialFileModes = os.ModeNamedPipe | os.ModeDevice | os.ModeCharDevice | os.ModeSocket
+
+// Block types from here on up are extension blocks, which carry a uint32
+// payload length after the block type.  Readers skip extension blocks that
+// they don't understand, so new ones can be added without breaking older
+// readers.
+const blockTypeFirstExtension blockType = 0x80
+
+const (
+	blockTypeSourceProperties blockType = blockTypeFirstExtension + iota
+	blockTypeTimes
+	blockTypeArchiveInfo
+	blockTypeSummary
+	blockTypeFileChanged
+	blockTypeAttributes
+)
+
+// A file path length of longPathMarker means that the real length follows as a
+// uint32, for paths that don't fit in the uint16 length used by other blocks.
+const longPathMarker = 0xFFFF
+
+// The longest path that will be written or read, to keep a corrupt length from
+// causing a huge allocation.
+const maxPathLength = 1 << 24
+
+// Size of a padding block with no padding: path length, block type, and
+// padding length.
+const paddingBlockHeaderSize = 2 + 1 + 2
+
+// The largest supported --align value; padding lengths are stored as uint16.
+const maxAlign = 65536
+
 type block struct {
 	filePath  string
 	numBytes  uint16
@@ -20,8 +69,107 @@ type block struct {
 	uid       int
 	gid       int
 	mode      os.FileMode
+	digest    [sha256.Size]byte
+	repeat    uint32
+	major     uint32
+	minor     uint32
+	root      int
+
+	// For a symbolic link block, the link's target.
+	linkTarget string
+
+	// For a data block, its payload compressed with deflate, if that's
+	// smaller; it's written as a compressed data block instead.
+	compressed []byte
+
+	// For an end of file block that the unarchiver makes up when salvaging
+	// a file that the archive ended partway through.
+	incomplete bool
+
+	// The bytes of the archiver's MaxMemory budget held by the block's
+	// buffer, to be released once it's written.
+	reserved int64
+
+	// Called once the block has been written; for the end of file block of
+	// a file read with Mmap, this unmaps the file, since every block of
+	// its contents has been written by then.
+	written func()
+
+	// For the data, restart, and end of file blocks of a file whose
+	// contents are hashed, the hash that the hash stage adds them to.
+	hashing *fileHashing
 }
 
 // Archive header: stole ideas from the PNG file header here, but replaced
 // 'PNG' with 'FA1' to identify the fast-archive format (version 1).
 var fastArchiverHeader = []byte{0x89, 0x46, 0x41, 0x31, 0x0D, 0x0A, 0x1A, 0x0A}
+
+// The header of version 2 archives, in which the blocks of a file's contents
+// refer to it by a numeric ID rather than repeating its path.
+var fastArchiverHeaderV2 = []byte{0x89, 0x46, 0x41, 0x32, 0x0D, 0x0A, 0x1A, 0x0A}
+
+// Returns true for the blocks that carry a file's contents, which follow its
+// start of file block; in version 2 archives, these identify the file by ID.
+func isFileContentBlock(t blockType) bool {
+	switch t {
+	case blockTypeData, blockTypeEndOfFile, blockTypeChunk, blockTypeChunkReference, blockTypeRepeat, blockTypeCompressedData, blockTypeRestartFile:
+		return true
+	}
+	return false
+}
+
+// Appends a block's file path, preceded by its length, to buf.
+func appendPath(buf []byte, filePath string) ([]byte, error) {
+	if len(filePath) > maxPathLength {
+		return buf, ErrPathTooLong
+	}
+	if len(filePath) >= longPathMarker {
+		buf = binary.BigEndian.AppendUint16(buf, longPathMarker)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(filePath)))
+	} else {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(filePath)))
+	}
+	return append(buf, filePath...), nil
+}
+
+// Reads a block's file path, as written by appendPath.  Returns io.EOF if the
+// input ends before the path, and io.ErrUnexpectedEOF if it ends part way.
+func readPath(input io.Reader) (string, error) {
+	var pathSize uint16
+	err := binary.Read(input, binary.BigEndian, &pathSize)
+	if err != nil {
+		return "", err
+	}
+	length := uint32(pathSize)
+	if pathSize == longPathMarker {
+		err = binary.Read(input, binary.BigEndian, &length)
+		if err != nil {
+			return "", unexpectedEOF(err)
+		} else if length > maxPathLength {
+			return "", ErrPathTooLong
+		}
+	}
+
+	buf := make([]byte, length)
+	_, err = io.ReadFull(input, buf)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	return string(buf), nil
+}
+
+// Returns a times extension block recording the modification time of the
+// file or directory at filePath; it precedes the file's own block.
+func timesBlock(filePath string, modTime time.Time, root int) block {
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, uint64(modTime.UnixNano()))
+	return block{filePath: filePath, blockType: blockTypeTimes, buffer: buffer, root: root}
+}
+
+// Returns the modification time recorded by a times block.
+func (b *block) modTime() time.Time {
+	if len(b.buffer) < 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b.buffer)))
+}
@@ -0,0 +1,90 @@
+package falib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Returns a path of exactly length bytes.
+func pathOfLength(length int) string {
+	component := strings.Repeat("p", 254) + "/"
+	path := strings.Repeat(component, length/len(component))
+	return path + strings.Repeat("q", length-len(path))
+}
+
+// Checks that paths on either side of the uint16 length limit, including one
+// as long as longPathMarker itself, survive a round trip in each format.
+func TestLongPaths(t *testing.T) {
+	lengths := []int{longPathMarker - 1, longPathMarker, longPathMarker + 1, 1<<16 + 1, 3 << 16}
+	for _, version := range []int{1, 2} {
+		for _, length := range lengths {
+			t.Run(fmt.Sprintf("v%d/%d", version, length), func(t *testing.T) {
+				filePath := pathOfLength(length)
+				var archive bytes.Buffer
+				writer := NewWriter(&archive)
+				writer.FormatVersion = version
+				err := writer.WriteHeader(&Entry{Path: filePath + "/dir", Mode: os.ModeDir | 0755})
+				if err == nil {
+					err = writer.WriteHeader(&Entry{Path: filePath, Mode: 0644})
+				}
+				if err == nil {
+					_, err = writer.Write([]byte("contents"))
+				}
+				if err == nil {
+					err = writer.Close()
+				}
+				if err != nil {
+					t.Fatal("writing:", err)
+				}
+
+				reader := NewReader(&archive)
+				for _, expected := range []string{filePath + "/dir", filePath} {
+					entry, err := reader.Next()
+					if err != nil {
+						t.Fatal("reading:", err)
+					}
+					if entry.Path != expected {
+						t.Fatalf("read a path of %d bytes, expected %d", len(entry.Path), len(expected))
+					}
+				}
+				contents, err := ioutil.ReadAll(reader)
+				if err != nil || string(contents) != "contents" {
+					t.Errorf("read %q, %v", contents, err)
+				}
+			})
+		}
+	}
+}
+
+// Checks that a path longer than maxPathLength is refused when it's written,
+// and that a length over it in an archive is an error rather than an attempt
+// to allocate that much.
+func TestPathTooLong(t *testing.T) {
+	writer := NewWriter(ioutil.Discard)
+	err := writer.WriteHeader(&Entry{Path: pathOfLength(maxPathLength + 1), Mode: 0644})
+	if err != ErrPathTooLong {
+		t.Errorf("writing returned %v, expected %v", err, ErrPathTooLong)
+	}
+
+	for _, length := range []uint32{maxPathLength + 1, 1<<32 - 1} {
+		for _, header := range [][]byte{fastArchiverHeader, fastArchiverHeaderV2} {
+			archive := append([]byte{}, header...)
+			if bytes.Equal(header, fastArchiverHeaderV2) {
+				// Version 2 blocks start with their type.
+				archive = append(archive, byte(blockTypeDirectory))
+			}
+			archive = binary.BigEndian.AppendUint16(archive, longPathMarker)
+			archive = binary.BigEndian.AppendUint32(archive, length)
+			_, err := NewReader(bytes.NewReader(archive)).Next()
+			if !errors.Is(err, ErrPathTooLong) {
+				t.Errorf("%s with a path of %d bytes: got %v, expected %v", header[1:4], length, err, ErrPathTooLong)
+			}
+		}
+	}
+}
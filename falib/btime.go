@@ -0,0 +1,52 @@
+package falib
+
+import (
+	"encoding/binary"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Returns the times block for the open file or directory at filePath, which
+// with BirthTime also records when it was created, where the platform and
+// filesystem keep track of that.
+func (a *Archiver) fileTimesBlock(file *os.File, filePath string, modTime time.Time, root int) block {
+	b := timesBlock(filePath, modTime, root)
+	if a.BirthTime {
+		if birthTime, ok := readBirthTime(file); ok {
+			b = addBirthTime(b, birthTime)
+		}
+	}
+	return b
+}
+
+// Adds a creation time to a times block, after the modification time, where
+// readers that don't know about it ignore it.
+func addBirthTime(b block, birthTime time.Time) block {
+	b.buffer = binary.BigEndian.AppendUint64(b.buffer, uint64(birthTime.UnixNano()))
+	return b
+}
+
+// Returns the creation time recorded by a times block, or the zero time if it
+// doesn't have one.
+func (b *block) birthTime() time.Time {
+	if len(b.buffer) < 16 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b.buffer[8:])))
+}
+
+// With BirthTime, sets the creation time of the file or directory at
+// filePath.  Where the platform can't, it's only counted, so that a single
+// warning can be given at the end.
+func (u *Unarchiver) restoreBirthTime(filePath string, birthTime time.Time) {
+	if !u.BirthTime || birthTime.IsZero() {
+		return
+	}
+	err := setBirthTime(filePath, birthTime)
+	if err == ErrBirthTimeUnsupported {
+		atomic.AddInt64(&u.unrestoredBirthTimes, 1)
+	} else if err != nil {
+		u.lossWarning("Unable to restore creation time:", err.Error())
+	}
+}
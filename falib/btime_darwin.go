@@ -0,0 +1,54 @@
+package falib
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	attrBitMapCount = 5
+	attrCmnCrtime   = 0x200
+)
+
+// struct attrlist, for setattrlist(2).
+type attrList struct {
+	bitmapCount uint16
+	reserved    uint16
+	commonAttr  uint32
+	volAttr     uint32
+	dirAttr     uint32
+	fileAttr    uint32
+	forkAttr    uint32
+}
+
+// Returns the creation time of file, which every macOS filesystem records.
+func readBirthTime(file *os.File) (time.Time, bool) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return time.Time{}, false
+	}
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(stat.Birthtimespec.Sec, stat.Birthtimespec.Nsec), true
+}
+
+// Sets the creation time of the file or directory at filePath with
+// setattrlist(2).
+func setBirthTime(filePath string, birthTime time.Time) error {
+	path, err := syscall.BytePtrFromString(filePath)
+	if err != nil {
+		return err
+	}
+	attributes := attrList{bitmapCount: attrBitMapCount, commonAttr: attrCmnCrtime}
+	value := syscall.NsecToTimespec(birthTime.UnixNano())
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETATTRLIST, uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&attributes)),
+		uintptr(unsafe.Pointer(&value)), unsafe.Sizeof(value), 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "setattrlist", Path: filePath, Err: errno}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package falib
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	atSymlinkNofollow = 0x100
+	atEmptyPath       = 0x1000
+	statxBasicStats   = 0x7ff
+	statxBtime        = 0x800
+)
+
+type statxTimestamp struct {
+	sec      int64
+	nsec     uint32
+	reserved int32
+}
+
+// struct statx, of which only the fields up to the device numbers are used.
+type statxInfo struct {
+	mask           uint32
+	blksize        uint32
+	attributes     uint64
+	nlink          uint32
+	uid            uint32
+	gid            uint32
+	mode           uint16
+	spare0         uint16
+	ino            uint64
+	size           uint64
+	blocks         uint64
+	attributesMask uint64
+	atime          statxTimestamp
+	btime          statxTimestamp
+	ctime          statxTimestamp
+	mtime          statxTimestamp
+	rdevMajor      uint32
+	rdevMinor      uint32
+	devMajor       uint32
+	devMinor       uint32
+	spare          [14]uint64
+}
+
+// Returns the creation time of file from statx(2), which has it on Linux 4.11
+// and later, for filesystems that record it (such as ext4, XFS, and btrfs).
+func readBirthTime(file *os.File) (time.Time, bool) {
+	if sysStatx == 0 {
+		return time.Time{}, false
+	}
+	var info statxInfo
+	empty := []byte{0}
+	_, _, errno := syscall.Syscall6(sysStatx, file.Fd(), uintptr(unsafe.Pointer(&empty[0])), atEmptyPath, statxBtime,
+		uintptr(unsafe.Pointer(&info)), 0)
+	if errno != 0 || info.mask&statxBtime == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(info.btime.sec, int64(info.btime.nsec)), true
+}
+
+// Linux has no way to set a file's creation time.
+func setBirthTime(filePath string, birthTime time.Time) error {
+	return ErrBirthTimeUnsupported
+}
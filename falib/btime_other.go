@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package falib
+
+import (
+	"os"
+	"time"
+)
+
+// Creation times aren't read or set on other platforms.
+func readBirthTime(file *os.File) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func setBirthTime(filePath string, birthTime time.Time) error {
+	return ErrBirthTimeUnsupported
+}
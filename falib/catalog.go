@@ -0,0 +1,196 @@
+package falib
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Catalog records where each archived file can be found, across all of the
+// archives created with it: the archive, the offset of the file's first block
+// in it, and the file's size and SHA-256.  That way the archive with the latest
+// copy of a file can be found without reading through every archive.  It's a
+// text file that each run adds to, one tab-separated line per file.  The
+// files of an archive are only added once it's been finished, so that a
+// failed run doesn't leave the catalog pointing at an incomplete archive.
+type Catalog struct {
+	lock     sync.Mutex
+	path     string
+	pending  *os.File
+	archive  string
+	created  time.Time
+	offsets  map[string]int64
+	finished map[string]finishedFile
+	err      error
+}
+
+type finishedFile struct {
+	size int64
+	sum  []byte
+}
+
+// A file's entry in a catalog.
+type CatalogEntry struct {
+	Archive string
+	Created time.Time
+	Path    string
+	Offset  int64
+	Size    int64
+	SHA256  []byte
+}
+
+// Returns the catalog at path, which is created when the first archive is
+// added to it.
+func NewCatalog(path string) *Catalog {
+	return &Catalog{path: path}
+}
+
+// Starts recording the files of an archive with the given name (eg. its -o
+// path), created now.  They're kept in a temporary file next to the catalog
+// until FinishArchive.
+func (c *Catalog) StartArchive(name string) error {
+	pending, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".pending")
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pending = pending
+	c.archive = name
+	c.created = time.Now().UTC()
+	c.offsets = make(map[string]int64)
+	c.finished = make(map[string]finishedFile)
+	c.err = nil
+	return nil
+}
+
+// Adds the files recorded since StartArchive to the catalog.
+func (c *Catalog) FinishArchive() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	defer c.discardPending()
+	if c.err != nil {
+		return c.err
+	}
+	_, err := c.pending.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, c.pending)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Forgets the files recorded since StartArchive, since the archive wasn't
+// finished.
+func (c *Catalog) AbortArchive() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.discardPending()
+}
+
+func (c *Catalog) discardPending() {
+	if c.pending != nil {
+		c.pending.Close()
+		os.Remove(c.pending.Name())
+		c.pending = nil
+	}
+}
+
+// Notes that the first block of filePath has been written at offset.  The
+// writer can get to a file's first block before or after its reader has
+// finished with it, so whichever of started and archived comes second records
+// the file.
+func (c *Catalog) started(filePath string, offset int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if file, ok := c.finished[filePath]; ok {
+		delete(c.finished, filePath)
+		c.record(filePath, offset, file)
+	} else {
+		c.offsets[filePath] = offset
+	}
+}
+
+// Notes that filePath has been read, with the given size and SHA-256.
+func (c *Catalog) archived(filePath string, size int64, sum []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if offset, ok := c.offsets[filePath]; ok {
+		delete(c.offsets, filePath)
+		c.record(filePath, offset, finishedFile{size, sum})
+	} else {
+		c.finished[filePath] = finishedFile{size, sum}
+	}
+}
+
+func (c *Catalog) record(filePath string, offset int64, file finishedFile) {
+	_, err := fmt.Fprintf(c.pending, "%s\t%d\t%d\t%x\t%s\t%s\n", c.created.Format(time.RFC3339), offset, file.size,
+		file.sum, strconv.Quote(c.archive), strconv.Quote(filePath))
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+}
+
+// Calls fn with each entry in the catalog at path, in the order they were
+// recorded.  Lines that don't parse, such as one cut short by a run being
+// killed, are skipped.
+func ScanCatalog(path string, fn func(entry CatalogEntry)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		entry, ok := parseCatalogLine(scanner.Text())
+		if ok {
+			fn(entry)
+		}
+	}
+	return scanner.Err()
+}
+
+func parseCatalogLine(line string) (CatalogEntry, bool) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 6 {
+		return CatalogEntry{}, false
+	}
+	var entry CatalogEntry
+	var err error
+	if entry.Created, err = time.Parse(time.RFC3339, fields[0]); err != nil {
+		return CatalogEntry{}, false
+	}
+	if entry.Offset, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return CatalogEntry{}, false
+	}
+	if entry.Size, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return CatalogEntry{}, false
+	}
+	if entry.SHA256, err = hex.DecodeString(fields[3]); err != nil {
+		return CatalogEntry{}, false
+	}
+	if entry.Archive, err = strconv.Unquote(fields[4]); err != nil {
+		return CatalogEntry{}, false
+	}
+	if entry.Path, err = strconv.Unquote(fields[5]); err != nil {
+		return CatalogEntry{}, false
+	}
+	return entry, true
+}
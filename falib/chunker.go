@@ -0,0 +1,82 @@
+package falib
+
+import "io"
+
+// Content-defined chunking parameters.  Chunk boundaries are placed where a
+// rolling "gear" hash of the data matches chunkMask, so that inserting or
+// removing data in a file only changes the chunks around the edit; identical
+// runs of data produce identical chunks wherever they appear.  The average
+// chunk size is about minChunkSize + 8 KiB, and chunks must fit in a uint16
+// data block length.
+const (
+	minChunkSize = 2 * 1024
+	maxChunkSize = 65535
+	chunkMask    = (1 << 13) - 1
+)
+
+var gearTable [256]uint64
+
+func init() {
+	// The table must never change, or chunk boundaries would move between
+	// versions; it's generated from a fixed seed with splitmix64.
+	seed := uint64(0x66617374) // "fast"
+	for i := range gearTable {
+		seed += 0x9E3779B97F4A7C15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// Splits the data read from input into content-defined chunks.
+type chunker struct {
+	input io.Reader
+	fill  func(io.Reader, []byte) (int, error)
+	buf   []byte
+	start int
+	end   int
+	err   error
+}
+
+func newChunker(input io.Reader, fill func(io.Reader, []byte) (int, error)) *chunker {
+	return &chunker{input: input, fill: fill, buf: make([]byte, maxChunkSize)}
+}
+
+// Returns the next chunk of input, or the error that ended the input (io.EOF
+// if it simply ran out) once all the data before it has been returned.
+func (c *chunker) next() ([]byte, error) {
+	if c.end-c.start < maxChunkSize && c.err == nil {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+		n, err := c.fill(c.input, c.buf[c.end:])
+		c.end += n
+		c.err = err
+	}
+
+	available := c.buf[c.start:c.end]
+	if len(available) == 0 {
+		return nil, c.err
+	}
+	n := chunkBoundary(available)
+	chunk := make([]byte, n)
+	copy(chunk, available)
+	c.start += n
+	return chunk, nil
+}
+
+// Returns the length of the first chunk in data.
+func chunkBoundary(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+	var hash uint64
+	for i := minChunkSize; i < len(data); i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
@@ -0,0 +1,60 @@
+package falib
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+)
+
+// Keeps the chunks of a deduplicated archive as they're extracted, so that
+// later references to them can be resolved.  The chunk data is spilled to a
+// temporary file rather than held in memory; only the index is kept in memory.
+type chunkStore struct {
+	file   *os.File
+	size   int64
+	chunks map[[sha256.Size]byte]chunkLocation
+}
+
+type chunkLocation struct {
+	offset int64
+	size   uint16
+}
+
+func (s *chunkStore) add(digest [sha256.Size]byte, data []byte) error {
+	if s.file == nil {
+		file, err := ioutil.TempFile("", "fast-archiver-chunks")
+		if err != nil {
+			return err
+		}
+		s.file = file
+		s.chunks = make(map[[sha256.Size]byte]chunkLocation)
+	}
+	if _, ok := s.chunks[digest]; ok {
+		return nil
+	}
+
+	_, err := s.file.WriteAt(data, s.size)
+	if err != nil {
+		return err
+	}
+	s.chunks[digest] = chunkLocation{s.size, uint16(len(data))}
+	s.size += int64(len(data))
+	return nil
+}
+
+func (s *chunkStore) get(digest [sha256.Size]byte) ([]byte, error) {
+	location, ok := s.chunks[digest]
+	if !ok {
+		return nil, ErrUnknownChunk
+	}
+	data := make([]byte, location.size)
+	_, err := s.file.ReadAt(data, location.offset)
+	return data, err
+}
+
+func (s *chunkStore) close() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+}
@@ -0,0 +1,118 @@
+package falib
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A block waiting to be compressed or hashed, and where to deliver it
+// afterwards.
+type blockJob struct {
+	block  block
+	result chan block
+}
+
+// Compresses the data blocks from input on a pool of CompressWorkers
+// goroutines, and returns a channel that delivers every block from input in
+// its original order.  Each block is compressed independently, so that the
+// work can be spread across cores; blocks that don't get smaller, and those of
+// files that are to be stored as they are, are left uncompressed.
+func (a *Archiver) compressBlocks(input <-chan block) <-chan block {
+	workers := a.CompressWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	jobs := make(chan blockJob, a.BlockQueueSize)
+	pending := make(chan chan block, a.BlockQueueSize)
+	output := make(chan block, a.BlockQueueSize)
+
+	for i := 0; i < workers; i++ {
+		go a.compressWorker(jobs)
+	}
+	go func() {
+		for b := range input {
+			result := make(chan block, 1)
+			pending <- result
+			if b.blockType == blockTypeData && !a.storeOnly(b.filePath) {
+				jobs <- blockJob{b, result}
+			} else {
+				result <- b
+			}
+		}
+		close(jobs)
+		close(pending)
+	}()
+	go func() {
+		for result := range pending {
+			output <- <-result
+		}
+		close(output)
+	}()
+	return output
+}
+
+// Returns true if the file at filePath shouldn't be compressed: its name ends
+// with one of the NoCompressSuffixes, ignoring case, or matches one of the
+// StoreOnlyPatterns.
+func (a *Archiver) storeOnly(filePath string) bool {
+	name := filepath.Base(filePath)
+	lowerName := strings.ToLower(name)
+	for _, suffix := range a.NoCompressSuffixes {
+		if strings.HasSuffix(lowerName, strings.ToLower(suffix)) {
+			return true
+		}
+	}
+	for _, pattern := range a.StoreOnlyPatterns {
+		if match, err := filepath.Match(pattern, name); err == nil && match {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Archiver) compressWorker(jobs <-chan blockJob) {
+	var buffer bytes.Buffer
+	compressor, _ := flate.NewWriterDict(&buffer, flate.DefaultCompression, a.CompressDictionary)
+	for job := range jobs {
+		b := job.block
+		start := time.Now()
+		buffer.Reset()
+		compressor.Reset(&buffer)
+		compressor.Write(b.buffer[:b.numBytes])
+		compressor.Close()
+		outputSize := int(b.numBytes)
+		if buffer.Len() < int(b.numBytes) {
+			b.compressed = append([]byte(nil), buffer.Bytes()...)
+			outputSize = len(b.compressed)
+			atomic.AddInt64(&a.stats.compressedBlocks, 1)
+		}
+		atomic.AddInt64(&a.stats.compressIn, int64(b.numBytes))
+		atomic.AddInt64(&a.stats.compressOut, int64(outputSize))
+		addTime(&a.stats.compressTime, start)
+		job.result <- b
+	}
+}
+
+// Decompresses the payload of a compressed data block, which must expand to
+// exactly size bytes, with the archive's preset dictionary, if it has one.
+func decompressBlock(compressed []byte, size uint16, dictionary []byte) ([]byte, error) {
+	decompressor := flate.NewReaderDict(bytes.NewReader(compressed), dictionary)
+	defer decompressor.Close()
+	data := make([]byte, size)
+	_, err := io.ReadFull(decompressor, data)
+	if err == nil {
+		var extra [1]byte
+		if n, _ := decompressor.Read(extra[:]); n > 0 {
+			err = ErrCompressedSizeMismatch
+		}
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrCompressedSizeMismatch
+	}
+	return data, err
+}
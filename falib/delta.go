@@ -0,0 +1,113 @@
+package falib
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// The size of the pieces that files are compared in.
+const deltaCompareSize = 64 * 1024
+
+// With an Archiver's CompareWith, the archive is a delta between two trees:
+// it holds only what differs in the directories being archived from the tree
+// at base, and records what's only in base as deleted, so that extracting it
+// over a copy of base turns it into a copy of them.
+type treeDelta struct {
+	base string
+	lock sync.Mutex
+	seen map[string]bool
+}
+
+func newTreeDelta(base string) *treeDelta {
+	return &treeDelta{base: base, seen: make(map[string]bool)}
+}
+
+// Records that archivePath exists, returning true unless the same path in
+// base is the same type of file, with the same permissions, and for a
+// regular file, the same contents as sourcePath.  Also returns true if base
+// has a directory where archivePath isn't one, or the other way around, since
+// what's in base has to be deleted before it can be replaced.
+func (d *treeDelta) observe(archivePath, sourcePath string, fileInfo os.FileInfo) (bool, bool) {
+	archivePath = RelativePath(archivePath)
+	d.lock.Lock()
+	d.seen[archivePath] = true
+	d.lock.Unlock()
+
+	baseInfo, err := os.Lstat(filepath.Join(d.base, archivePath))
+	if err != nil {
+		return true, false
+	}
+	replaced := baseInfo.IsDir() != fileInfo.IsDir()
+	if baseInfo.Mode() != fileInfo.Mode() {
+		return true, replaced
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return false, false
+	}
+	if baseInfo.Size() != fileInfo.Size() {
+		return true, false
+	}
+	same, err := sameFileContents(filepath.Join(d.base, archivePath), sourcePath)
+	return err != nil || !same, false
+}
+
+// Returns true if two files have the same contents.
+func sameFileContents(path1, path2 string) (bool, error) {
+	file1, err := os.Open(path1)
+	if err != nil {
+		return false, err
+	}
+	defer file1.Close()
+	file2, err := os.Open(path2)
+	if err != nil {
+		return false, err
+	}
+	defer file2.Close()
+
+	buf1 := make([]byte, deltaCompareSize)
+	buf2 := make([]byte, deltaCompareSize)
+	for {
+		n1, err1 := io.ReadFull(file1, buf1)
+		n2, err2 := io.ReadFull(file2, buf2)
+		if !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false, nil
+		}
+		if err1 == io.EOF || err1 == io.ErrUnexpectedEOF {
+			return err2 == io.EOF || err2 == io.ErrUnexpectedEOF, nil
+		} else if err1 != nil {
+			return false, err1
+		} else if err2 != nil {
+			return false, err2
+		}
+	}
+}
+
+// Returns the paths in base that weren't observed, in sorted order.  Paths
+// inside deleted directories are left out, since they go with them.
+func (d *treeDelta) deleted() ([]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var retval []string
+	err := filepath.Walk(d.base, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(d.base, filePath)
+		if err != nil || relative == "." {
+			return err
+		}
+		if !d.seen[relative] {
+			retval = append(retval, relative)
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	sort.Strings(retval)
+	return retval, err
+}
@@ -0,0 +1,187 @@
+package falib
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Names of the properties recorded in an archive info block, which describe
+// how and where the archive was created.
+const (
+	infoCreated     = "created"
+	infoHost        = "host"
+	infoBlockSize   = "block-size"
+	infoCompression = "compression"
+	infoDedup       = "dedup"
+	infoRunLength   = "run-length"
+	infoAlign       = "align"
+	infoArchiveId   = "archive-id"
+	infoParentId    = "parent-id"
+)
+
+// Returns an archive info block for an archive being created now with the
+// given settings, and chain, the IDs of an incremental archive and the one
+// it's based on, if any.  Its properties are encoded like source properties.
+// A deterministic archive's info leaves out when and where it was created, and
+// its chain.
+func archiveInfoBlock(blockSize uint16, compress, dedup, runLength bool, align int, deterministic bool, chain fsProperties) block {
+	info := fsProperties{
+		infoBlockSize:   strconv.Itoa(int(blockSize)),
+		infoCompression: "none",
+		infoDedup:       yesNo(dedup),
+		infoRunLength:   yesNo(runLength),
+		infoAlign:       strconv.Itoa(align),
+	}
+	if compress {
+		info[infoCompression] = "deflate"
+	}
+	if deterministic {
+		// The same files always make the same archive, wherever and
+		// whenever it's created.
+		return block{blockType: blockTypeArchiveInfo, buffer: info.encode()}
+	}
+	for name, value := range chain {
+		info[name] = value
+	}
+	info[infoCreated] = time.Now().UTC().Format(time.RFC3339)
+	if host, err := os.Hostname(); err == nil {
+		info[infoHost] = host
+	}
+	return block{blockType: blockTypeArchiveInfo, buffer: info.encode()}
+}
+
+// Counts of what an archive holds, written in a summary block at its end.
+type archiveSummary struct {
+	files       int64
+	directories int64
+	specials    int64
+	symlinks    int64
+	deletions   int64
+	bytes       int64
+
+	// The bytes counted so far for each file that has been started but not
+	// ended, which no longer count if the file is read again.
+	fileBytes map[string]int64
+}
+
+func (s *archiveSummary) count(b block) {
+	switch b.blockType {
+	case blockTypeStartOfFile:
+		s.files += 1
+	case blockTypeDirectory:
+		s.directories += 1
+	case blockTypeSpecial:
+		s.specials += 1
+	case blockTypeSymlink:
+		s.symlinks += 1
+	case blockTypeDelete:
+		s.deletions += 1
+	case blockTypeData, blockTypeChunk:
+		s.bytes += int64(b.numBytes)
+		if s.fileBytes == nil {
+			s.fileBytes = make(map[string]int64)
+		}
+		s.fileBytes[b.filePath] += int64(b.numBytes)
+	case blockTypeRestartFile:
+		s.bytes -= s.fileBytes[b.filePath]
+		delete(s.fileBytes, b.filePath)
+	case blockTypeEndOfFile:
+		delete(s.fileBytes, b.filePath)
+	}
+}
+
+func (s *archiveSummary) encode() []byte {
+	return fsProperties{
+		"files":       strconv.FormatInt(s.files, 10),
+		"directories": strconv.FormatInt(s.directories, 10),
+		"specials":    strconv.FormatInt(s.specials, 10),
+		"symlinks":    strconv.FormatInt(s.symlinks, 10),
+		"deletions":   strconv.FormatInt(s.deletions, 10),
+		"bytes":       strconv.FormatInt(s.bytes, 10),
+	}.encode()
+}
+
+// What an archive says about itself, as reported by Describe.  Info and
+// Source are empty for archives created before they were recorded.
+type Description struct {
+	FormatVersion int
+
+	// How and where the archive was created: "created" (an RFC 3339 UTC
+	// time), "host", "block-size", "compression" ("none" or "deflate"),
+	// "dedup", "run-length", and "align"; and for archives created with a
+	// snapshot, "archive-id", and for incremental ones, "parent-id".
+	Info map[string]string
+
+	// The properties of the filesystem that the archive's files came from:
+	// "case-sensitive", "xattrs", and "time-granularity".
+	Source map[string]string
+
+	Files       int64
+	Directories int64
+	Specials    int64
+	Symlinks    int64
+	Deletions   int64
+
+	// The total size of the archived files, or -1 if the archive has no
+	// summary block, as in archives created by older versions.
+	Bytes int64
+}
+
+// Reads an archive's header and the info, source properties, and summary
+// blocks that describe it.  The summary is at the end of the archive, so the
+// whole archive is read; for archives without one, the entries are counted
+// as they're read instead.
+func Describe(input io.Reader) (*Description, error) {
+	reader := newArchiveReader(bufio.NewReader(input))
+	err := reader.readHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Description{FormatVersion: reader.version, Info: map[string]string{}, Source: map[string]string{}}
+	var counted archiveSummary
+	var summary fsProperties
+	for {
+		b, err := reader.readBlock()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch b.blockType {
+		case blockTypeArchiveInfo:
+			d.Info = decodeFsProperties(b.buffer)
+		case blockTypeSourceProperties:
+			d.Source = decodeFsProperties(b.buffer)
+		case blockTypeSummary:
+			summary = decodeFsProperties(b.buffer)
+		default:
+			counted.count(b)
+		}
+	}
+
+	if summary == nil {
+		d.Files, d.Directories, d.Specials, d.Deletions = counted.files, counted.directories, counted.specials, counted.deletions
+		d.Symlinks = counted.symlinks
+		d.Bytes = -1
+		return d, nil
+	}
+	for name, count := range map[string]*int64{"files": &d.Files, "directories": &d.Directories, "specials": &d.Specials, "deletions": &d.Deletions, "bytes": &d.Bytes} {
+		*count, err = strconv.ParseInt(summary[name], 10, 64)
+		if err != nil {
+			return nil, ErrCorruptSummary
+		}
+	}
+	// Summaries written before symbolic links could be archived don't
+	// count them.
+	if symlinks, ok := summary["symlinks"]; ok {
+		d.Symlinks, err = strconv.ParseInt(symlinks, 10, 64)
+		if err != nil {
+			return nil, ErrCorruptSummary
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,17 @@
+package falib
+
+// Splits a FreeBSD device number, which has had 32-bit major and minor
+// numbers since FreeBSD 12, into its major and minor numbers.
+func splitDevice(dev uint64) (uint32, uint32) {
+	major := uint32((dev>>32)&0xffffff00) | uint32((dev>>8)&0xff)
+	minor := uint32((dev>>24)&0xff00) | uint32(dev&0xffff00ff)
+	return major, minor
+}
+
+func joinDevice(major, minor uint32) uint64 {
+	dev := (uint64(major) & 0xffffff00) << 32
+	dev |= (uint64(major) & 0xff) << 8
+	dev |= (uint64(minor) & 0xff00) << 24
+	dev |= uint64(minor) & 0xffff00ff
+	return dev
+}
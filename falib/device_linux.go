@@ -0,0 +1,16 @@
+package falib
+
+// Splits a Linux device number into its major and minor numbers.
+func splitDevice(dev uint64) (uint32, uint32) {
+	major := uint32((dev>>8)&0xfff) | uint32((dev>>32)&^0xfff)
+	minor := uint32(dev&0xff) | uint32((dev>>12)&^0xff)
+	return major, minor
+}
+
+func joinDevice(major, minor uint32) uint64 {
+	dev := (uint64(major) & 0xfff) << 8
+	dev |= (uint64(major) &^ 0xfff) << 32
+	dev |= uint64(minor) & 0xff
+	dev |= (uint64(minor) &^ 0xff) << 12
+	return dev
+}
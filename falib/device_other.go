@@ -0,0 +1,12 @@
+//go:build !linux && !freebsd
+
+package falib
+
+// Splits a BSD-style device number into its major and minor numbers.
+func splitDevice(dev uint64) (uint32, uint32) {
+	return uint32((dev >> 24) & 0xff), uint32(dev & 0xffffff)
+}
+
+func joinDevice(major, minor uint32) uint64 {
+	return uint64(major)<<24 | uint64(minor)&0xffffff
+}
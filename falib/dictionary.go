@@ -0,0 +1,116 @@
+package falib
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// The largest preset dictionary that deflate can use: the size of its window.
+const maxDictionarySize = 32768
+
+const (
+	// Length of the substrings that TrainDictionary counts.
+	dictionaryKmerSize = 8
+	// Length of the pieces of samples that dictionaries are made of, and
+	// the distance between the starts of the pieces considered.
+	dictionarySegmentSize = 128
+	dictionarySegmentStep = 32
+)
+
+// A piece of a sample that's a candidate for the dictionary.
+type dictionarySegment struct {
+	data  []byte
+	score int
+}
+
+// Builds a preset dictionary of up to size bytes, and at most 32768, for
+// Archiver.CompressDictionary from samples of the files to be archived.  The
+// dictionary is made of the pieces of the samples whose substrings are found
+// in the most other samples, so that it holds what the files have in common,
+// with the most common pieces last, where deflate finds them at the shortest
+// distances.  Returns nil if the samples have nothing in common.
+func TrainDictionary(samples [][]byte, size int) []byte {
+	if size <= 0 || size > maxDictionarySize {
+		size = maxDictionarySize
+	}
+
+	// How many samples each substring is found in.
+	frequency := make(map[uint64]int)
+	for _, sample := range samples {
+		seen := make(map[uint64]bool)
+		for i := 0; i+dictionaryKmerSize <= len(sample); i++ {
+			kmer := binary.LittleEndian.Uint64(sample[i:])
+			if !seen[kmer] {
+				seen[kmer] = true
+				frequency[kmer] += 1
+			}
+		}
+	}
+
+	var candidates [][]byte
+	for _, sample := range samples {
+		for i := 0; i+dictionaryKmerSize <= len(sample); i += dictionarySegmentStep {
+			end := i + dictionarySegmentSize
+			if end > len(sample) {
+				end = len(sample)
+			}
+			candidates = append(candidates, sample[i:end])
+		}
+	}
+
+	// The candidates are split into as many consecutive runs as there are
+	// segments in the dictionary, and the best of each run is chosen, so
+	// that the dictionary draws on all of the samples.  Substrings already
+	// in the dictionary don't count towards later segments.
+	epochs := size / dictionarySegmentSize
+	if epochs < 1 {
+		epochs = 1
+	}
+	epochSize := (len(candidates) + epochs - 1) / epochs
+	var chosen []dictionarySegment
+	for start := 0; start < len(candidates); start += epochSize {
+		end := start + epochSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		var best dictionarySegment
+		for _, candidate := range candidates[start:end] {
+			score := segmentScore(candidate, frequency)
+			if score > best.score {
+				best = dictionarySegment{candidate, score}
+			}
+		}
+		if best.score == 0 {
+			continue
+		}
+		for i := 0; i+dictionaryKmerSize <= len(best.data); i++ {
+			delete(frequency, binary.LittleEndian.Uint64(best.data[i:]))
+		}
+		chosen = append(chosen, best)
+	}
+
+	sort.SliceStable(chosen, func(i, j int) bool { return chosen[i].score < chosen[j].score })
+	var dictionary []byte
+	for _, segment := range chosen {
+		dictionary = append(dictionary, segment.data...)
+	}
+	if len(dictionary) > size {
+		dictionary = dictionary[len(dictionary)-size:]
+	}
+	return dictionary
+}
+
+// Adds up how many samples each distinct substring of a segment is found in,
+// counting only those found in more than one.
+func segmentScore(segment []byte, frequency map[uint64]int) int {
+	score := 0
+	seen := make(map[uint64]bool)
+	for i := 0; i+dictionaryKmerSize <= len(segment); i++ {
+		kmer := binary.LittleEndian.Uint64(segment[i:])
+		if n := frequency[kmer]; n > 1 && !seen[kmer] {
+			seen[kmer] = true
+			score += n
+		}
+	}
+	return score
+}
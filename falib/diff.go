@@ -0,0 +1,146 @@
+package falib
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type DifferenceKind int
+
+const (
+	// On disk, but not in the archive.
+	DifferenceAdded DifferenceKind = iota
+	// In the archive, but not on disk.
+	DifferenceRemoved
+	// In both, but different; Reasons says how.
+	DifferenceChanged
+)
+
+// A path that differs between an archive and the filesystem.
+type Difference struct {
+	Path    string
+	Kind    DifferenceKind
+	Reasons []string
+}
+
+// Compares the archive with the files at the paths that it would be extracted
+// to, instead of extracting it, and reports every path that differs.  Files
+// are compared by type, size, permissions, and modification time (if the
+// archive records it), and also by contents if compareContents is set;
+// symbolic links are compared by target.
+// Entries in each archived directory that aren't in the archive are reported
+// as added, but aren't descended into.
+func (u *Unarchiver) Diff(compareContents bool, report func(Difference)) error {
+	reader := NewReader(u.file)
+	defer reader.Close()
+
+	archived := make(map[string]bool)
+	var directories []string
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if entry.Deleted {
+			continue
+		}
+
+		filePath := u.outputPath(entry.Path)
+		archived[filepath.Clean(filePath)] = true
+		u.Logger.Verbose(filePath)
+
+		var size int64
+		hash := sha256.New()
+		if entry.Mode.IsRegular() {
+			var output io.Writer = hash
+			if !compareContents {
+				output = ioutil.Discard
+			}
+			size, err = io.Copy(output, reader)
+			if err != nil {
+				return err
+			}
+		}
+
+		fileInfo, err := os.Lstat(filePath)
+		if os.IsNotExist(err) {
+			report(Difference{filePath, DifferenceRemoved, nil})
+			continue
+		} else if err != nil {
+			report(Difference{filePath, DifferenceChanged, []string{err.Error()}})
+			continue
+		}
+
+		if entry.Mode.IsDir() && fileInfo.IsDir() {
+			directories = append(directories, filePath)
+		}
+
+		var reasons []string
+		if fileInfo.Mode().Type() != entry.Mode.Type() {
+			reasons = append(reasons, "type")
+		} else if entry.Mode&os.ModeSymlink != 0 {
+			// A symbolic link's permissions and modification time
+			// aren't restored, so only its target is compared.
+			if target, err := os.Readlink(filePath); err != nil || target != entry.Linkname {
+				reasons = append(reasons, "target")
+			}
+		} else {
+			if fileInfo.Mode().Perm() != entry.Mode.Perm() {
+				reasons = append(reasons, "mode")
+			}
+			if entry.Mode.IsRegular() && fileInfo.Size() != size {
+				reasons = append(reasons, "size")
+			}
+			if !entry.ModTime.IsZero() && !entry.Mode.IsDir() && !fileInfo.ModTime().Equal(entry.ModTime) {
+				reasons = append(reasons, "mtime")
+			}
+			if compareContents && entry.Mode.IsRegular() && fileInfo.Size() == size {
+				same, err := sameContents(filePath, hash.Sum(nil))
+				if err != nil {
+					reasons = append(reasons, err.Error())
+				} else if !same {
+					reasons = append(reasons, "contents")
+				}
+			}
+		}
+		if len(reasons) > 0 {
+			report(Difference{filePath, DifferenceChanged, reasons})
+		}
+	}
+
+	for _, directory := range directories {
+		file, err := os.Open(directory)
+		if err != nil {
+			continue
+		}
+		names, _ := file.Readdirnames(-1)
+		file.Close()
+		sort.Strings(names)
+		for _, name := range names {
+			filePath := filepath.Join(directory, name)
+			if !archived[filePath] {
+				report(Difference{filePath, DifferenceAdded, nil})
+			}
+		}
+	}
+	return nil
+}
+
+func sameContents(filePath string, digest []byte) (bool, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	fileDigest, err := hashContents(file)
+	if err != nil {
+		return false, err
+	}
+	return string(fileDigest[:]) == string(digest), nil
+}
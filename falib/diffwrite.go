@@ -0,0 +1,61 @@
+package falib
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// Writes a file's contents over an existing file in place, comparing each
+// block with what's already there and only writing those that differ.  Used
+// by Unarchiver.DiffWrite, so that restoring over a mostly unchanged tree
+// rewrites only what has changed.
+type changedBlockWriter struct {
+	file      *os.File
+	offset    int64
+	existing  []byte
+	written   *int64
+	unchanged *int64
+}
+
+func (w *changedBlockWriter) Write(p []byte) (int, error) {
+	if cap(w.existing) < len(p) {
+		w.existing = make([]byte, len(p))
+	}
+	existing := w.existing[:len(p)]
+	n, err := w.file.ReadAt(existing, w.offset)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if n == len(p) && bytes.Equal(existing, p) {
+		atomic.AddInt64(w.unchanged, int64(len(p)))
+		w.offset += int64(len(p))
+		return len(p), nil
+	}
+	n, err = w.file.WriteAt(p, w.offset)
+	atomic.AddInt64(w.written, int64(n))
+	w.offset += int64(n)
+	return n, err
+}
+
+// Opens the existing regular file at filePath to be written in place by
+// DiffWrite.  Returns nil if there isn't one that can be written, in which
+// case the file is extracted as usual.
+func openForDiffWrite(filePath string) *os.File {
+	fi, err := os.Lstat(filePath)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if err != nil {
+		return nil
+	}
+	return file
+}
+
+// Returns the number of bytes that DiffWrite wrote to existing files, and the
+// number it left alone because they were already the same as the archive's.
+func (u *Unarchiver) DiffWriteTotals() (written, unchanged int64) {
+	return atomic.LoadInt64(&u.diffWritten), atomic.LoadInt64(&u.diffUnchanged)
+}
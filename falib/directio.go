@@ -0,0 +1,40 @@
+package falib
+
+import (
+	"io"
+	"unsafe"
+)
+
+// The alignment of the buffers, read sizes, and file offsets used with
+// DirectIO, which suits devices with 512 byte or 4KB logical blocks.
+const directIOAlignment = 4096
+
+// Returns a buffer of size bytes that starts at a multiple of
+// directIOAlignment in memory.
+func alignedBuffer(size int) []byte {
+	buffer := make([]byte, size+directIOAlignment)
+	offset := int(uintptr(unsafe.Pointer(&buffer[0])) & (directIOAlignment - 1))
+	if offset != 0 {
+		offset = directIOAlignment - offset
+	}
+	return buffer[offset : offset+size : offset+size]
+}
+
+// Reads a file opened for direct I/O.  Only whole, aligned blocks can be
+// read, so a short read is taken as the end of the file, rather than
+// continuing from an unaligned offset.
+type directReader struct {
+	file io.Reader
+	eof  bool
+}
+
+func (r *directReader) Read(buf []byte) (int, error) {
+	if r.eof {
+		return 0, io.EOF
+	}
+	n, err := r.file.Read(buf)
+	if err == nil && n < len(buf) {
+		r.eof = true
+	}
+	return n, err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package falib
+
+import (
+	"errors"
+	"os"
+)
+
+// Direct I/O isn't supported on this platform; files are always read through
+// the page cache.
+func enableDirectIO(file *os.File) error {
+	return errors.New("direct I/O isn't supported on this platform")
+}
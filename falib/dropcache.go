@@ -0,0 +1,29 @@
+package falib
+
+import (
+	"io"
+	"os"
+)
+
+// How often DropCache drops the pages read so far from a large file.
+const dropCacheInterval = 8 << 20
+
+// Reads a file for DropCache, dropping the pages that have been read from the
+// page cache as it goes, so that a very large file doesn't fill the cache
+// before it's finished.
+type dropCacheReader struct {
+	file    *os.File
+	reader  io.Reader
+	offset  int64
+	dropped int64
+}
+
+func (r *dropCacheReader) Read(buf []byte) (int, error) {
+	n, err := r.reader.Read(buf)
+	r.offset += int64(n)
+	if r.offset-r.dropped >= dropCacheInterval {
+		dropCachedPages(r.file, r.dropped, r.offset-r.dropped)
+		r.dropped = r.offset
+	}
+	return n, err
+}
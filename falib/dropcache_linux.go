@@ -0,0 +1,16 @@
+//go:build linux && (amd64 || arm64 || ppc64le || riscv64)
+
+package falib
+
+import (
+	"os"
+	"syscall"
+)
+
+const fadvDontNeed = 4
+
+// Advises the kernel that the cached pages of length bytes of file, from
+// offset, won't be needed again; a length of 0 means the rest of the file.
+func dropCachedPages(file *os.File, offset, length int64) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), uintptr(offset), uintptr(length), fadvDontNeed, 0, 0)
+}
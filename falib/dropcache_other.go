@@ -0,0 +1,9 @@
+//go:build !linux || !(amd64 || arm64 || ppc64le || riscv64)
+
+package falib
+
+import "os"
+
+// The page cache is left alone on this platform.
+func dropCachedPages(file *os.File, offset, length int64) {
+}
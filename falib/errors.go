@@ -3,8 +3,37 @@ package falib
 import "errors"
 
 var (
-	ErrAbsoluteDirectoryPath = errors.New("unable to process archive with absolute path reference")
-	ErrFileHeaderMismatch    = errors.New("unexpected file header")
-	ErrCrcMismatch           = errors.New("crc64 mismatch")
-	ErrUnrecognizedBlockType = errors.New("unrecognized block type")
+	ErrAbsoluteDirectoryPath  = errors.New("unable to process archive with absolute path reference")
+	ErrFileHeaderMismatch     = errors.New("unexpected file header")
+	ErrCrcMismatch            = errors.New("crc64 mismatch")
+	ErrUnrecognizedBlockType  = errors.New("unrecognized block type")
+	ErrInvalidAlignment       = errors.New("alignment must be between 0 and 65536")
+	ErrStrict                 = errors.New("strict mode")
+	ErrResumeRequestMismatch  = errors.New("unexpected resume request header")
+	ErrSnapshotHeaderMismatch = errors.New("unrecognized snapshot file")
+	ErrUnknownChunk           = errors.New("reference to a chunk that isn't in the archive")
+	ErrUnexpectedRepeat       = errors.New("repeat block without a preceding data block")
+	ErrUnrecognizedSpecial    = errors.New("unrecognized special file type")
+	ErrSpecialsUnsupported    = errors.New("special files can't be created on this platform")
+	ErrUnsupportedEntry       = errors.New("unsupported entry type")
+	ErrNoFileEntry            = errors.New("write without a current file entry")
+	ErrInterrupted            = errors.New("interrupted")
+	ErrPathTooLong            = errors.New("file path too long")
+	ErrCompressedSizeMismatch = errors.New("compressed block doesn't expand to its recorded size")
+	ErrUnknownFileId          = errors.New("block for a file that hasn't been started")
+	ErrUnsupportedVersion     = errors.New("unsupported archive format version")
+	ErrFileExists             = errors.New("file already exists")
+	ErrSalvaged               = errors.New("archive is truncated or corrupt; only the readable part was extracted")
+	ErrDuplicateFile          = errors.New("file started again before its end")
+	ErrDuplicateFileId        = errors.New("file ID reused before the end of its file")
+	ErrBlockTooLarge          = errors.New("block too large")
+	ErrDirectIOBlockSize      = errors.New("direct I/O needs a block size that's a multiple of 4096")
+	ErrCorruptSummary         = errors.New("archive summary block is corrupt")
+	ErrShardedSplit           = errors.New("an archive can't be both sharded and split by directory")
+	ErrFileRestarted          = errors.New("file was archived again from the start after part of it was read")
+	ErrCorruptAttributes      = errors.New("file attributes block is corrupt")
+	ErrAttributesUnsupported  = errors.New("file flags and capabilities can't be restored on this platform")
+	ErrBirthTimeUnsupported   = errors.New("creation times can't be restored on this platform")
+	ErrBrokenChain            = errors.New("archive isn't the next in the chain of incremental archives")
+	ErrDictionaryTooLarge     = errors.New("compression dictionary is larger than 32768 bytes")
 )
@@ -0,0 +1,69 @@
+package falib
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// The number of files, and their total size, that a Run is expected to
+// archive, as found by Estimate.
+type Estimate struct {
+	Files int64
+	Bytes int64
+}
+
+// Walks the directories added to the archiver and adds up the files in them
+// and their sizes, without reading any of them, so that the progress of a Run
+// can be shown as a percentage.  Exclusions, MaxDepth, Types, the size
+// limits, Owners and Groups, and the NewerThan and OlderThan cutoffs are
+// applied, but it's only an estimate: ignore files, snapshots, and files
+// changing in the meantime aren't taken into account, and errors are left for
+// the Run to report.
+func (a *Archiver) Estimate() Estimate {
+	var estimate Estimate
+	for root, source := range a.sources {
+		filepath.WalkDir(source, func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if filePath != source && a.excluded(a.archivePath(filePath, root)) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if a.MaxDepth > 0 && entry.IsDir() && a.depth(filePath, root) >= a.MaxDepth {
+				return filepath.SkipDir
+			}
+			mode := entry.Type()
+			var fileInfo os.FileInfo
+			if mode&os.ModeSymlink != 0 && a.Dereference {
+				fileInfo, err = os.Stat(filePath)
+				if err != nil || !fileInfo.Mode().IsRegular() {
+					return nil
+				}
+			} else if !mode.IsRegular() {
+				return nil
+			} else {
+				fileInfo, err = entry.Info()
+				if err != nil {
+					return nil
+				}
+			}
+			if !a.NewerThan.IsZero() && !fileInfo.ModTime().After(a.NewerThan) {
+				return nil
+			}
+			if !a.OlderThan.IsZero() && !fileInfo.ModTime().Before(a.OlderThan) {
+				return nil
+			}
+			if a.outsideSizeLimits(fileInfo) || !a.typeIncluded(fileInfo.Mode()) || !a.ownerIncluded(fileInfo) {
+				return nil
+			}
+			estimate.Files++
+			estimate.Bytes += fileInfo.Size()
+			return nil
+		})
+	}
+	return estimate
+}
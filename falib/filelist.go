@@ -0,0 +1,109 @@
+package falib
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"sync/atomic"
+)
+
+// Archives exactly the paths listed in FilesFrom, one per line (or separated
+// by NUL bytes if FilesFromNul is set), such as the output of find.  Listed
+// directories are archived as directory entries, but aren't scanned; their
+// contents are only archived if they're listed too.
+func (a *Archiver) fileListReader() {
+	defer a.scanning.Done()
+
+	separator := byte('\n')
+	if a.FilesFromNul {
+		separator = 0
+	}
+	scanner := bufio.NewScanner(a.FilesFrom)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, separator); i >= 0 {
+			return i + 1, data[:i], nil
+		} else if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	for scanner.Scan() {
+		if filePath := scanner.Text(); filePath != "" {
+			a.addListedPath(filePath)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		a.errorLock.Lock()
+		if a.error == nil {
+			a.error = err
+		}
+		a.errorLock.Unlock()
+	}
+}
+
+func (a *Archiver) addListedPath(filePath string) {
+	if a.excluded(filePath) {
+		a.Logger.Verbose("skipping excluded file", filePath)
+		return
+	}
+
+	item := scanItem{filePath, a.rootOf(filePath), nil}
+	fileInfo, err := os.Lstat(filePath)
+	if err == nil && fileInfo.Mode()&os.ModeSymlink != 0 {
+		if !a.Dereference && a.Types == "" {
+			a.lossWarning("skipping symbolic link", filePath)
+			return
+		} else if a.Dereference {
+			fileInfo, err = os.Stat(filePath)
+		}
+	}
+	if err != nil {
+		a.lossWarning("unable to lstat file", err.Error())
+		return
+	}
+	mode := fileInfo.Mode()
+
+	switch {
+	case !a.typeIncluded(mode):
+		a.Logger.Verbose("skipping file of an excluded type", filePath)
+
+	case mode.IsDir():
+		a.Logger.Verbose(filePath)
+		directory, err := os.Open(filePath)
+		if err != nil {
+			a.lossWarning("directory read error:", err.Error())
+			return
+		}
+		if a.Snapshot != nil {
+			a.Snapshot.observe(filePath, fileInfo)
+		}
+		a.blockQueue <- a.fileTimesBlock(directory, filePath, fileInfo.ModTime(), item.root)
+		a.queueAttributes(directory, filePath, item.root)
+		uid, gid, mode := a.getModeOwnership(directory)
+		a.blockQueue <- block{filePath: filePath, blockType: blockTypeDirectory, uid: uid, gid: gid, mode: mode, root: item.root}
+		directory.Close()
+		atomic.AddInt64(&a.stats.directories, 1)
+
+	case a.outsideSizeLimits(fileInfo):
+		a.Logger.Verbose("skipping file outside the size limits", filePath)
+
+	case !a.ownerIncluded(fileInfo):
+		a.Logger.Verbose("skipping file of another owner or group", filePath)
+
+	case !a.changed(filePath, item.root, fileInfo):
+		a.Logger.Verbose("skipping unchanged file", filePath)
+
+	case mode&specialFileModes != 0:
+		a.archiveSpecial(item, fileInfo)
+
+	case mode&os.ModeSymlink != 0:
+		a.archiveSymlink(item, fileInfo)
+
+	case mode.IsRegular():
+		a.queueFile(item, fileInfo)
+
+	default:
+		a.lossWarning("skipping file of unknown type", filePath)
+	}
+}
@@ -0,0 +1,189 @@
+package falib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Properties of a filesystem that affect how faithfully files can be restored
+// on it, keyed by name.  Properties that couldn't be determined are left out.
+// Values are "yes" or "no" for propCaseSensitive and propXattrs, and a
+// duration for propTimeGranularity.
+type fsProperties map[string]string
+
+const (
+	propCaseSensitive   = "case-sensitive"
+	propXattrs          = "xattrs"
+	propTimeGranularity = "time-granularity"
+)
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// Determines the properties of the filesystem holding the source directory
+// dir, without writing to it.
+func sourceProperties(dir string) fsProperties {
+	props := make(fsProperties)
+
+	names, _ := readdirnamesLimit(dir, 100)
+
+	// Look up one of the names with its case swapped; if that finds the same
+	// file, the filesystem ignores case.
+	for _, name := range names {
+		swapped := swapCase(name)
+		if swapped == name {
+			continue
+		}
+		original, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			break
+		}
+		other, err := os.Lstat(filepath.Join(dir, swapped))
+		if err == nil {
+			props[propCaseSensitive] = yesNo(!os.SameFile(original, other))
+		} else if os.IsNotExist(err) {
+			props[propCaseSensitive] = "yes"
+		}
+		break
+	}
+
+	if supported, ok := xattrsSupported(dir); ok {
+		props[propXattrs] = yesNo(supported)
+	}
+
+	// The granularity can only be guessed from existing timestamps: the
+	// coarsest unit that divides all of them.
+	var times []time.Time
+	if fi, err := os.Stat(dir); err == nil {
+		times = append(times, fi.ModTime())
+	}
+	for _, name := range names {
+		if fi, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			times = append(times, fi.ModTime())
+		}
+	}
+	if len(times) > 0 {
+		props[propTimeGranularity] = timeGranularity(times).String()
+	}
+	return props
+}
+
+// Determines the properties of the filesystem holding the destination
+// directory dir, by creating and examining a temporary file in it.
+func destinationProperties(dir string) fsProperties {
+	props := make(fsProperties)
+
+	file, err := ioutil.TempFile(dir, ".fast-archiver-probe-")
+	if err != nil {
+		return props
+	}
+	tempPath := file.Name()
+	file.Close()
+	defer os.Remove(tempPath)
+
+	original, err := os.Lstat(tempPath)
+	if err == nil {
+		other, err := os.Lstat(filepath.Join(dir, swapCase(filepath.Base(tempPath))))
+		props[propCaseSensitive] = yesNo(err != nil || !os.SameFile(original, other))
+	}
+
+	if supported, ok := xattrsSupported(tempPath); ok {
+		props[propXattrs] = yesNo(supported)
+	}
+
+	probe := time.Unix(1000000000, 123456789)
+	if os.Chtimes(tempPath, probe, probe) == nil {
+		if fi, err := os.Stat(tempPath); err == nil {
+			props[propTimeGranularity] = timeGranularity([]time.Time{fi.ModTime()}).String()
+		}
+	}
+	return props
+}
+
+func timeGranularity(times []time.Time) time.Duration {
+	for _, granularity := range []time.Duration{2 * time.Second, time.Second, time.Millisecond, time.Microsecond} {
+		ok := true
+		for _, t := range times {
+			if t.UnixNano()%int64(granularity) != 0 {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return granularity
+		}
+	}
+	return time.Nanosecond
+}
+
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, s)
+}
+
+func readdirnamesLimit(dir string, limit int) ([]string, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Readdirnames(limit)
+}
+
+func (p fsProperties) encode() []byte {
+	var keys []string
+	for key := range p {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var retval []byte
+	for _, key := range keys {
+		retval = append(retval, key+"="+p[key]+"\n"...)
+	}
+	return retval
+}
+
+func decodeFsProperties(data []byte) fsProperties {
+	props := make(fsProperties)
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 {
+			props[parts[0]] = parts[1]
+		}
+	}
+	return props
+}
+
+// Describes the ways in which restoring files from a filesystem with the
+// source properties onto one with the destination properties could lose
+// fidelity.
+func fidelityDifferences(source, destination fsProperties) []string {
+	var retval []string
+	if source[propCaseSensitive] == "yes" && destination[propCaseSensitive] == "no" {
+		retval = append(retval, "the archive came from a case-sensitive filesystem, but the destination is not; files whose names differ only in case will overwrite each other")
+	}
+	if source[propXattrs] == "yes" && destination[propXattrs] == "no" {
+		retval = append(retval, "the archive came from a filesystem with extended attributes, but the destination doesn't support them; they can't be restored")
+	}
+	sourceGranularity, err1 := time.ParseDuration(source[propTimeGranularity])
+	destinationGranularity, err2 := time.ParseDuration(destination[propTimeGranularity])
+	if err1 == nil && err2 == nil && destinationGranularity > sourceGranularity {
+		retval = append(retval, fmt.Sprintf("the destination filesystem stores timestamps to %s, coarser than the source's %s; timestamps will lose precision",
+			destinationGranularity, sourceGranularity))
+	}
+	return retval
+}
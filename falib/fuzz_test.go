@@ -0,0 +1,81 @@
+package falib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// How much of each file's contents FuzzReader reads; a large repeat count can
+// legitimately stand for a lot of data.
+const fuzzMaxReadPerFile = 64 << 20
+
+// Seeds f with the golden archives, which the fuzzer damages in search of an
+// archive that crashes or hangs a reader rather than failing with an error.
+func addGoldenSeeds(f *testing.F) {
+	names, err := filepath.Glob(filepath.Join("..", "testdata", "golden", "*.fa"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	if len(names) == 0 {
+		f.Fatal("no golden archives found")
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+func FuzzReadBlock(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := newArchiveReader(bytes.NewReader(data))
+		if reader.readHeader() != nil {
+			return
+		}
+		for {
+			_, err := reader.readBlock()
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+func FuzzReader(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := NewReader(bytes.NewReader(data))
+		defer reader.Close()
+		for {
+			_, err := reader.Next()
+			if err != nil {
+				return
+			}
+			io.CopyN(ioutil.Discard, reader, fuzzMaxReadPerFile)
+		}
+	})
+}
+
+func FuzzList(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		List(bytes.NewReader(data), func(ListEntry) {})
+		Describe(bytes.NewReader(data))
+	})
+}
+
+func FuzzUnarchiver(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		unarchiver := NewUnarchiver(bytes.NewReader(data))
+		unarchiver.DryRun = true
+		unarchiver.Logger = nullLogger{}
+		unarchiver.Run()
+	})
+}
@@ -0,0 +1,163 @@
+package falib
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Names of the directories that version control systems keep their data in,
+// which ExcludeVCS leaves out.
+var vcsDirectories = map[string]bool{
+	".git":   true,
+	".hg":    true,
+	".svn":   true,
+	".bzr":   true,
+	"CVS":    true,
+	"_darcs": true,
+}
+
+// One line of a .gitignore file.
+type ignorePattern struct {
+	segments []string
+	negated  bool
+	dirOnly  bool
+	anchored bool
+}
+
+// The .gitignore patterns that apply within a directory: those from the
+// directory's own .gitignore, and, through parent, those of the directories
+// above it.  Patterns are relative to base, the directory they were read from.
+type ignoreRules struct {
+	parent   *ignoreRules
+	base     string
+	patterns []ignorePattern
+}
+
+// Returns the rules that apply within directoryPath, given those that apply
+// to the directory it's in.  Patterns are read from the directory's .gitignore,
+// and if it's the top of a git working tree, from .git/info/exclude.  If there
+// are none, parent is returned as it is.
+func loadIgnoreRules(directoryPath string, parent *ignoreRules) (*ignoreRules, error) {
+	rules := parent
+	// Patterns in .git/info/exclude take precedence over none of the
+	// .gitignore files, so they're added first.
+	for _, name := range []string{filepath.Join(".git", "info", "exclude"), ".gitignore"} {
+		patterns, err := readIgnoreFile(filepath.Join(directoryPath, name))
+		if err != nil {
+			return parent, err
+		}
+		if len(patterns) > 0 {
+			rules = &ignoreRules{parent: rules, base: directoryPath, patterns: patterns}
+		}
+	}
+	return rules, nil
+}
+
+// Reads the patterns from a .gitignore format file.  A file that doesn't exist
+// has no patterns.
+func readIgnoreFile(fileName string) ([]ignorePattern, error) {
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if pattern, ok := parseIgnorePattern(scanner.Text()); ok {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns, scanner.Err()
+}
+
+func parseIgnorePattern(line string) (ignorePattern, bool) {
+	line = strings.TrimRight(line, "\r")
+	if !strings.HasSuffix(line, "\\ ") {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignorePattern{}, false
+	}
+
+	var pattern ignorePattern
+	if strings.HasPrefix(line, "!") {
+		pattern.negated = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A pattern with a slash anywhere but the end is relative to the
+	// .gitignore's directory; otherwise it matches a name at any depth.
+	pattern.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return ignorePattern{}, false
+	}
+	pattern.segments = strings.Split(line, "/")
+	return pattern, true
+}
+
+// Returns true if filePath, in a directory these rules apply to, is ignored.
+// The last pattern that matches decides, and patterns from a directory's own
+// .gitignore come after those of the directories above it.
+func (r *ignoreRules) ignored(filePath string, isDir bool) bool {
+	for rules := r; rules != nil; rules = rules.parent {
+		relative, err := filepath.Rel(rules.base, filePath)
+		if err != nil {
+			continue
+		}
+		segments := strings.Split(filepath.ToSlash(relative), "/")
+		for i := len(rules.patterns) - 1; i >= 0; i-- {
+			if rules.patterns[i].matches(segments, isDir) {
+				return !rules.patterns[i].negated
+			}
+		}
+	}
+	return false
+}
+
+func (p *ignorePattern) matches(segments []string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if !p.anchored {
+		match, _ := filepath.Match(p.segments[0], segments[len(segments)-1])
+		return match
+	}
+	return matchSegments(p.segments, segments)
+}
+
+// Matches a path against a pattern, a segment at a time, where a "**" segment
+// matches any number of path segments.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" && len(pattern) == 1 {
+		// A trailing "/**" matches everything inside a directory, but
+		// not the directory itself.
+		return len(segments) > 0
+	} else if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	match, _ := filepath.Match(pattern[0], segments[0])
+	return match && matchSegments(pattern[1:], segments[1:])
+}
@@ -0,0 +1,53 @@
+package falib
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A set of SHA-256 digests of file contents.
+type HashSet map[[sha256.Size]byte]bool
+
+// Reads a list of SHA-256 digests, one per line.  Anything following the
+// digest on a line is ignored, so the output of sha256sum (or a --manifest)
+// can be used directly; blank lines and lines starting with # are skipped.
+func LoadHashSet(path string) (HashSet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	set := make(HashSet)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		// sha256sum marks lines with escaped names with a backslash.
+		fields[0] = strings.TrimPrefix(fields[0], "\\")
+		var digest [sha256.Size]byte
+		n, err := hex.Decode(digest[:], []byte(fields[0]))
+		if err != nil || n != sha256.Size || len(fields[0]) != 2*sha256.Size {
+			return nil, fmt.Errorf("%s:%d: not a SHA-256 digest", path, lineNumber)
+		}
+		set[digest] = true
+	}
+	return set, scanner.Err()
+}
+
+// Returns the SHA-256 of everything that's left in input.
+func hashContents(input io.Reader) ([sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	hash := sha256.New()
+	_, err := io.Copy(hash, input)
+	copy(digest[:], hash.Sum(nil))
+	return digest, err
+}
@@ -0,0 +1,90 @@
+package falib
+
+import (
+	"runtime"
+	"time"
+)
+
+// A file whose contents are being hashed by the hash stage, and what's done
+// with its digest once they all have been.
+type fileHashing struct {
+	hash     *sizedHash
+	finished func(sum []byte, size int64)
+}
+
+// Hashes the contents of files for the Manifest, ArchiveHook, and Catalog on
+// a pool of HashWorkers goroutines, apart from the file readers, so that
+// hashing doesn't hold up reading, and returns a channel that delivers every
+// block from input in its original order.  A file's blocks have to be hashed
+// in order, so each file is hashed by a single worker, with the files being
+// read spread across them.
+func (a *Archiver) hashBlocks(input <-chan block) <-chan block {
+	workers := a.HashWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	queues := make([]chan blockJob, workers)
+	pending := make(chan chan block, a.BlockQueueSize)
+	output := make(chan block, a.BlockQueueSize)
+
+	for i := range queues {
+		queues[i] = make(chan blockJob, a.BlockQueueSize)
+		go a.hashWorker(queues[i])
+	}
+	go func() {
+		// Each file being hashed goes to the worker with the fewest.
+		assigned := make(map[*fileHashing]int)
+		active := make([]int, workers)
+		for b := range input {
+			result := make(chan block, 1)
+			pending <- result
+			if b.hashing == nil {
+				result <- b
+				continue
+			}
+			worker, ok := assigned[b.hashing]
+			if !ok {
+				for i := range active {
+					if active[i] < active[worker] {
+						worker = i
+					}
+				}
+				assigned[b.hashing] = worker
+				active[worker] += 1
+			}
+			if b.blockType == blockTypeEndOfFile {
+				delete(assigned, b.hashing)
+				active[worker] -= 1
+			}
+			queues[worker] <- blockJob{b, result}
+		}
+		for _, queue := range queues {
+			close(queue)
+		}
+		close(pending)
+	}()
+	go func() {
+		for result := range pending {
+			output <- <-result
+		}
+		close(output)
+	}()
+	return output
+}
+
+func (a *Archiver) hashWorker(jobs <-chan blockJob) {
+	for job := range jobs {
+		b := job.block
+		start := time.Now()
+		switch b.blockType {
+		case blockTypeData, blockTypeChunk:
+			b.hashing.hash.Write(b.buffer[:b.numBytes])
+		case blockTypeRestartFile:
+			b.hashing.hash.Reset()
+		case blockTypeEndOfFile:
+			b.hashing.finished(b.hashing.hash.Sum(nil), b.hashing.hash.size)
+		}
+		addTime(&a.stats.hashTime, start)
+		job.result <- b
+	}
+}
@@ -0,0 +1,277 @@
+package falib
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An Index records where the contents of each file in an archive are stored,
+// so that any part of a file can be read without reading through the archive
+// up to it.  It's built by reading the archive once, keeping only the offsets
+// of the blocks, so the archive must be a file (or anything else that can be
+// read at an offset) that doesn't change while the index is in use.
+//
+// Paths are made relative like RelativePath does, and directories that hold
+// archived files but weren't archived themselves are made up, so that every
+// entry can be reached from the root, ".".  Deletions recorded in incremental
+// archives aren't applied.
+type Index struct {
+	archive    io.ReaderAt
+	entries    map[string]*IndexEntry
+	children   map[string][]string
+	dictionary []byte
+
+	// The most recently read block, since a file is usually read in
+	// pieces smaller than a block.
+	lock        sync.Mutex
+	cachedBlock indexBlock
+	cachedData  []byte
+}
+
+// A file, directory, or special file in an Index.
+type IndexEntry struct {
+	Path    string
+	Mode    os.FileMode
+	Uid     int
+	Gid     int
+	Size    int64
+	ModTime time.Time
+	Major   uint32
+	Minor   uint32
+
+	segments []indexSegment
+}
+
+// Where a block's payload is stored in the archive.
+type indexBlock struct {
+	offset     int64
+	size       int
+	compressed bool
+	numBytes   int
+}
+
+// A part of a file's contents: size bytes starting at offset in the file,
+// which come from block, repeated if it's a repeat block.
+type indexSegment struct {
+	offset int64
+	size   int64
+	block  indexBlock
+}
+
+// A reader that keeps track of how many bytes have been read through it.
+type countingReader struct {
+	innerReader io.Reader
+	count       int64
+}
+
+func (r *countingReader) Read(buf []byte) (int, error) {
+	n, err := r.innerReader.Read(buf)
+	r.count += int64(n)
+	return n, err
+}
+
+// Builds an index of the archive read from archive.
+func NewIndex(archive io.ReaderAt) (*Index, error) {
+	x := &Index{
+		archive:  archive,
+		entries:  map[string]*IndexEntry{".": {Path: ".", Mode: os.ModeDir | 0755}},
+		children: make(map[string][]string),
+	}
+	counter := &countingReader{bufio.NewReader(io.NewSectionReader(archive, 0, 1<<62)), 0}
+	reader := newArchiveReader(counter)
+	err := reader.readHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*IndexEntry)
+	lastBlock := make(map[string]indexBlock)
+	chunks := make(map[[sha256.Size]byte]indexBlock)
+	modTimes := make(map[string]time.Time)
+	for {
+		b, err := reader.readBlock()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		filePath := RelativePath(b.filePath)
+		switch b.blockType {
+		case blockTypeTimes:
+			modTimes[filePath] = b.modTime()
+		case blockTypeDirectory, blockTypeSpecial:
+			x.add(&IndexEntry{Path: filePath, Mode: b.mode, Uid: b.uid, Gid: b.gid, Major: b.major, Minor: b.minor})
+		case blockTypeStartOfFile:
+			entry := &IndexEntry{Path: filePath, Mode: b.mode, Uid: b.uid, Gid: b.gid}
+			files[filePath] = entry
+			x.add(entry)
+		case blockTypeData:
+			entry := files[filePath]
+			if entry == nil {
+				continue
+			}
+			stored := indexBlock{counter.count - int64(b.numBytes), int(b.numBytes), false, int(b.numBytes)}
+			if b.compressed != nil {
+				stored = indexBlock{counter.count - int64(len(b.compressed)), len(b.compressed), true, int(b.numBytes)}
+			}
+			entry.addSegment(stored, int64(b.numBytes))
+			lastBlock[filePath] = stored
+		case blockTypeChunk, blockTypeChunkReference:
+			entry := files[filePath]
+			if entry == nil {
+				continue
+			}
+			if b.blockType == blockTypeChunk {
+				chunks[b.digest] = indexBlock{counter.count - int64(b.numBytes), int(b.numBytes), false, int(b.numBytes)}
+			}
+			stored, ok := chunks[b.digest]
+			if !ok {
+				return nil, ErrUnknownChunk
+			}
+			entry.addSegment(stored, int64(stored.numBytes))
+		case blockTypeRepeat:
+			entry := files[filePath]
+			if entry == nil {
+				continue
+			}
+			stored, ok := lastBlock[filePath]
+			if !ok {
+				return nil, ErrUnexpectedRepeat
+			}
+			entry.addSegment(stored, int64(stored.numBytes)*int64(b.repeat))
+		case blockTypeRestartFile:
+			if entry := files[filePath]; entry != nil {
+				entry.Size = 0
+				entry.segments = nil
+			}
+			delete(lastBlock, filePath)
+		case blockTypeEndOfFile:
+			delete(files, filePath)
+			delete(lastBlock, filePath)
+		}
+	}
+
+	for filePath, modTime := range modTimes {
+		if entry, ok := x.entries[filePath]; ok {
+			entry.ModTime = modTime
+		}
+	}
+	for _, names := range x.children {
+		sort.Strings(names)
+	}
+	x.dictionary = reader.dictionary
+	return x, nil
+}
+
+// Adds entry to the index, along with any of its parent directories that
+// aren't there yet.  A later entry for the same path replaces an earlier one.
+func (x *Index) add(entry *IndexEntry) {
+	if entry.Path == "." {
+		if entry.Mode.IsDir() {
+			x.entries["."] = entry
+		}
+		return
+	}
+	if _, exists := x.entries[entry.Path]; !exists {
+		parent := filepath.Dir(entry.Path)
+		if _, ok := x.entries[parent]; !ok {
+			x.add(&IndexEntry{Path: parent, Mode: os.ModeDir | 0755})
+		}
+		x.children[parent] = append(x.children[parent], filepath.Base(entry.Path))
+	}
+	x.entries[entry.Path] = entry
+}
+
+func (e *IndexEntry) addSegment(stored indexBlock, size int64) {
+	e.segments = append(e.segments, indexSegment{e.Size, size, stored})
+	e.Size += size
+}
+
+// Returns the entry for filePath, or nil if it isn't in the archive.
+func (x *Index) Lookup(filePath string) *IndexEntry {
+	return x.entries[RelativePath(filePath)]
+}
+
+// Returns the names of the entries in the directory filePath, in sorted order.
+func (x *Index) ReadDir(filePath string) []string {
+	return x.children[RelativePath(filePath)]
+}
+
+// Returns a reader of the contents of the file entry, which can seek, and be
+// read at any offset.
+func (x *Index) Open(entry *IndexEntry) *io.SectionReader {
+	return io.NewSectionReader(indexFile{x, entry}, 0, entry.Size)
+}
+
+type indexFile struct {
+	index *Index
+	entry *IndexEntry
+}
+
+func (f indexFile) ReadAt(buf []byte, offset int64) (int, error) {
+	return f.index.ReadAt(f.entry, buf, offset)
+}
+
+// Reads the contents of the file entry, starting at offset, like
+// io.ReaderAt.  It's safe to call from several goroutines at once.
+func (x *Index) ReadAt(entry *IndexEntry, buf []byte, offset int64) (int, error) {
+	// The segment holding offset is the last one starting at or before
+	// it.
+	i := sort.Search(len(entry.segments), func(i int) bool { return entry.segments[i].offset > offset }) - 1
+	n := 0
+	for ; i >= 0 && i < len(entry.segments) && n < len(buf); i++ {
+		segment := entry.segments[i]
+		data, err := x.readBlock(segment.block)
+		if err != nil {
+			return n, err
+		}
+		for n < len(buf) && offset < segment.offset+segment.size {
+			// A repeat segment is the same block over and over.
+			within := int((offset - segment.offset) % int64(len(data)))
+			copied := copy(buf[n:], data[within:])
+			if remaining := segment.offset + segment.size - offset; int64(copied) > remaining {
+				copied = int(remaining)
+			}
+			n += copied
+			offset += int64(copied)
+		}
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Returns the contents of a block, decompressed.
+func (x *Index) readBlock(stored indexBlock) ([]byte, error) {
+	x.lock.Lock()
+	if x.cachedData != nil && x.cachedBlock == stored {
+		data := x.cachedData
+		x.lock.Unlock()
+		return data, nil
+	}
+	x.lock.Unlock()
+
+	data := make([]byte, stored.size)
+	_, err := x.archive.ReadAt(data, stored.offset)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if stored.compressed {
+		data, err = decompressBlock(data, uint16(stored.numBytes), x.dictionary)
+		if err != nil {
+			return nil, err
+		}
+	}
+	x.lock.Lock()
+	x.cachedBlock, x.cachedData = stored, data
+	x.lock.Unlock()
+	return data, nil
+}
@@ -0,0 +1,211 @@
+package falib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Journal records each file that has been completely extracted, so that an
+// interrupted extraction can be rerun without rewriting those files.
+type Journal struct {
+	lock    sync.Mutex
+	file    *os.File
+	entries map[string]journalEntry
+}
+
+type journalEntry struct {
+	size int64
+	sum  []byte
+}
+
+// Opens the journal at path, creating it if it doesn't exist.  Files recorded
+// by a previous run are loaded so that they can be skipped.
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{file: file, entries: make(map[string]journalEntry)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// A line that doesn't parse was probably being written when the
+		// previous run was killed; the file it refers to will be redone.
+		filePath, entry, ok := parseJournalLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		j.entries[filePath] = entry
+	}
+	err = scanner.Err()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func parseJournalLine(line string) (string, journalEntry, bool) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return "", journalEntry{}, false
+	}
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return "", journalEntry{}, false
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", journalEntry{}, false
+	}
+	filePath, err := strconv.Unquote(fields[2])
+	if err != nil {
+		return "", journalEntry{}, false
+	}
+	return filePath, journalEntry{size, sum}, true
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// Records that filePath has been completely written with the given size and
+// sha256 sum.
+func (j *Journal) record(filePath string, size int64, sum []byte) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.entries[filePath] = journalEntry{size, sum}
+	_, err := fmt.Fprintf(j.file, "%x %d %s\n", sum, size, strconv.Quote(filePath))
+	return err
+}
+
+// Returns true if filePath was recorded as complete by a previous run, and the
+// file on disk still has the recorded size and contents.
+func (j *Journal) completed(filePath string) bool {
+	j.lock.Lock()
+	entry, ok := j.entries[filePath]
+	j.lock.Unlock()
+	if !ok {
+		return false
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil || fi.Size() != entry.size {
+		return false
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	return err == nil && bytes.Equal(hash.Sum(nil), entry.sum)
+}
+
+const resumeRequestHeader = "FAST-ARCHIVER-RESUME 1"
+
+// Sends the files that this unarchiver's Journal shows were completely
+// extracted, and are still intact, to the archive's sender so that it can skip
+// them.  An empty request is sent if there is no journal.
+func (u *Unarchiver) WriteResumeRequest(output io.Writer) error {
+	w := bufio.NewWriter(output)
+	fmt.Fprintln(w, resumeRequestHeader)
+	if u.Journal != nil {
+		u.Journal.lock.Lock()
+		entries := make(map[string]journalEntry, len(u.Journal.entries))
+		for filePath, entry := range u.Journal.entries {
+			entries[filePath] = entry
+		}
+		u.Journal.lock.Unlock()
+
+		for filePath, entry := range entries {
+			if !strings.HasPrefix(filePath, u.OutputPath) || !u.Journal.completed(filePath) {
+				continue
+			}
+			archivePath := u.archivedPath(filePath)
+			fmt.Fprintf(w, "%x %d %s\n", entry.sum, entry.size, strconv.Quote(archivePath))
+		}
+	}
+	fmt.Fprintln(w)
+	return w.Flush()
+}
+
+// The files that the receiver of an archive already has, as sent by
+// WriteResumeRequest.
+type ResumeSet struct {
+	entries map[string]journalEntry
+}
+
+// Reads a resume request sent by WriteResumeRequest.  Reading stops at the end
+// of the request, so the archive can be written to the same connection.
+func ReadResumeRequest(input io.Reader) (*ResumeSet, error) {
+	// Read a byte at a time so as to not consume anything past the request.
+	var line []byte
+	readLine := func() (string, error) {
+		line = line[:0]
+		b := make([]byte, 1)
+		for {
+			_, err := io.ReadFull(input, b)
+			if err != nil {
+				return "", err
+			}
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, b[0])
+		}
+	}
+
+	header, err := readLine()
+	if err != nil {
+		return nil, err
+	} else if header != resumeRequestHeader {
+		return nil, ErrResumeRequestMismatch
+	}
+
+	set := &ResumeSet{make(map[string]journalEntry)}
+	for {
+		text, err := readLine()
+		if err != nil {
+			return nil, err
+		} else if text == "" {
+			return set, nil
+		}
+		filePath, entry, ok := parseJournalLine(text)
+		if ok {
+			set.entries[filePath] = entry
+		}
+	}
+}
+
+// Returns the number of files in the set.
+func (s *ResumeSet) Len() int {
+	return len(s.entries)
+}
+
+// Returns true if the receiver already has filePath with the same size and
+// contents as file, which is left positioned at its start either way.
+func (s *ResumeSet) has(filePath string, file *os.File) bool {
+	entry, ok := s.entries[filePath]
+	if !ok {
+		return false
+	}
+	fi, err := file.Stat()
+	if err != nil || fi.Size() != entry.size {
+		return false
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	_, seekErr := file.Seek(0, io.SeekStart)
+	return err == nil && seekErr == nil && bytes.Equal(hash.Sum(nil), entry.sum)
+}
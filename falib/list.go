@@ -0,0 +1,94 @@
+package falib
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// A file or directory in an archive, as reported by List.
+type ListEntry struct {
+	Path      string
+	Directory bool
+	Mode      os.FileMode
+	Uid       int
+	Gid       int
+	Size      int64
+
+	// The target of a symbolic link.
+	Linkname string
+
+	// Set if the file changed while it was being archived, so that its
+	// contents may be inconsistent.
+	Changed bool
+}
+
+// Reads through an archive, calling fn for each directory as it's reached, and
+// for each file once all of its data has been read.  Deletions recorded in
+// incremental archives aren't reported.
+func List(input io.Reader, fn func(entry ListEntry)) error {
+	reader := newArchiveReader(bufio.NewReader(input))
+	err := reader.readHeader()
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]*ListEntry)
+	lastBlockSize := make(map[string]int64)
+	chunkSizes := make(map[[sha256.Size]byte]int64)
+	for {
+		b, err := reader.readBlock()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch b.blockType {
+		case blockTypeDirectory:
+			fn(ListEntry{Path: b.filePath, Directory: true, Mode: b.mode, Uid: b.uid, Gid: b.gid})
+		case blockTypeSpecial:
+			fn(ListEntry{Path: b.filePath, Mode: b.mode, Uid: b.uid, Gid: b.gid})
+		case blockTypeSymlink:
+			fn(ListEntry{Path: b.filePath, Mode: b.mode, Uid: b.uid, Gid: b.gid, Linkname: b.linkTarget})
+		case blockTypeStartOfFile:
+			files[b.filePath] = &ListEntry{Path: b.filePath, Mode: b.mode, Uid: b.uid, Gid: b.gid}
+		case blockTypeData, blockTypeChunk, blockTypeChunkReference, blockTypeRepeat:
+			entry := files[b.filePath]
+			if entry == nil {
+				continue
+			}
+			size := int64(b.numBytes)
+			if b.blockType == blockTypeChunk {
+				chunkSizes[b.digest] = size
+			} else if b.blockType == blockTypeChunkReference {
+				var ok bool
+				size, ok = chunkSizes[b.digest]
+				if !ok {
+					return ErrUnknownChunk
+				}
+			} else if b.blockType == blockTypeRepeat {
+				size = lastBlockSize[b.filePath] * int64(b.repeat)
+			} else {
+				lastBlockSize[b.filePath] = size
+			}
+			entry.Size += size
+		case blockTypeRestartFile:
+			if entry := files[b.filePath]; entry != nil {
+				entry.Size = 0
+			}
+			delete(lastBlockSize, b.filePath)
+		case blockTypeFileChanged:
+			if entry := files[b.filePath]; entry != nil {
+				entry.Changed = true
+			}
+		case blockTypeEndOfFile:
+			if entry := files[b.filePath]; entry != nil {
+				fn(*entry)
+			}
+			delete(files, b.filePath)
+			delete(lastBlockSize, b.filePath)
+		}
+	}
+}
@@ -4,3 +4,9 @@ type Logger interface {
 	Verbose(v ...interface{})
 	Warning(v ...interface{})
 }
+
+// A Logger that discards everything, for library users that don't set one.
+type nullLogger struct{}
+
+func (nullLogger) Verbose(v ...interface{}) {}
+func (nullLogger) Warning(v ...interface{}) {}
@@ -0,0 +1,53 @@
+package falib
+
+import "sync"
+
+// A budget of bytes shared by the file readers, bounding the memory held by
+// blocks that have been read but not yet written.  Readers acquire space
+// before filling a buffer, and the archive writer releases it once the block
+// is written.
+type memoryBudget struct {
+	lock      sync.Mutex
+	released  sync.Cond
+	limit     int64
+	available int64
+}
+
+// Returns a budget of limit bytes, or nil, which never blocks, if limit is 0.
+func newMemoryBudget(limit int64) *memoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	b := &memoryBudget{limit: limit, available: limit}
+	b.released.L = &b.lock
+	return b
+}
+
+// Waits until n bytes are available, and takes them.  A request for more than
+// the whole budget waits for all of it instead, so that it can't wait forever.
+// Returns the number of bytes taken, to be given back to release.
+func (b *memoryBudget) acquire(n int64) int64 {
+	if b == nil {
+		return 0
+	}
+	if n > b.limit {
+		n = b.limit
+	}
+	b.lock.Lock()
+	for b.available < n {
+		b.released.Wait()
+	}
+	b.available -= n
+	b.lock.Unlock()
+	return n
+}
+
+func (b *memoryBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.lock.Lock()
+	b.available += n
+	b.lock.Unlock()
+	b.released.Broadcast()
+}
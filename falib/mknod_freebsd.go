@@ -0,0 +1,8 @@
+package falib
+
+import "syscall"
+
+// FreeBSD's mknod takes a 64-bit device number.
+func mknod(filePath string, mode uint32, dev uint64) error {
+	return syscall.Mknod(filePath, mode, dev)
+}
@@ -0,0 +1,9 @@
+//go:build !windows && !freebsd
+
+package falib
+
+import "syscall"
+
+func mknod(filePath string, mode uint32, dev uint64) error {
+	return syscall.Mknod(filePath, mode, int(dev))
+}
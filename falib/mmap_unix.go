@@ -0,0 +1,17 @@
+//go:build !windows
+
+package falib
+
+import (
+	"os"
+	"syscall"
+)
+
+// Maps the first size bytes of file into memory, read-only.
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,15 @@
+package falib
+
+import (
+	"errors"
+	"os"
+)
+
+// Files are always read with read() on this platform.
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap isn't supported on this platform")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
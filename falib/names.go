@@ -0,0 +1,72 @@
+package falib
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Paths are archived as the raw bytes that the filesystem returns, which on
+// Unix needn't be valid UTF-8, and may contain newlines or other control
+// characters.  They're restored exactly as they were archived, unless the
+// Unarchiver's SanitizeNames is set.
+
+// Returns filePath made relative, the way that tar does: any leading / is
+// removed, and any .. that would climb above the top of the path is dropped,
+// so that it names something inside whatever directory it's extracted into.
+// An empty path becomes ".".
+func RelativePath(filePath string) string {
+	filePath = filepath.Clean("/" + filePath)[1:]
+	if filePath == "" {
+		return "."
+	}
+	return filePath
+}
+
+// Returns filePath with each control character, and each byte that isn't
+// part of valid UTF-8, replaced by a percent sign and its value in hex (eg.
+// a newline becomes %0A), so that the name is safe to display and to use in
+// scripts.
+func sanitizePath(filePath string) string {
+	if !needsSanitizing(filePath) {
+		return filePath
+	}
+	var retval strings.Builder
+	for i := 0; i < len(filePath); {
+		r, size := utf8.DecodeRuneInString(filePath[i:])
+		if (r == utf8.RuneError && size <= 1) || unicode.IsControl(r) {
+			for _, b := range []byte(filePath[i : i+size]) {
+				fmt.Fprintf(&retval, "%%%02X", b)
+			}
+		} else {
+			retval.WriteString(filePath[i : i+size])
+		}
+		i += size
+	}
+	return retval.String()
+}
+
+func needsSanitizing(filePath string) bool {
+	if !utf8.ValidString(filePath) {
+		return true
+	}
+	for _, r := range filePath {
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a --manifest line for a file, escaped the way sha256sum escapes
+// names containing a backslash or newline: the line starts with a backslash,
+// and those characters are written as \\ and \n.
+func manifestLine(filePath string, sum []byte) string {
+	if !strings.ContainsAny(filePath, "\\\n\r") {
+		return fmt.Sprintf("%x  %s\n", sum, filePath)
+	}
+	escaped := strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r").Replace(filePath)
+	return fmt.Sprintf("\\%x  %s\n", sum, escaped)
+}
@@ -0,0 +1,70 @@
+package falib
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// A token bucket shared by everything that it limits: tokens (bytes) are added
+// at a fixed rate, up to a burst of a tenth of a second's worth, and each read
+// or write waits until the tokens it used have been paid back.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+// Returns a limiter for the given number of bytes per second, or nil if the
+// rate is zero (unlimited).
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	rate := float64(bytesPerSecond)
+	return &rateLimiter{rate: rate, burst: rate / 10, tokens: rate / 10, last: time.Now()}
+}
+
+// Takes n tokens from the bucket, sleeping if that leaves it in debt.  The
+// lock is held while sleeping so that waiters are served in turn.
+func (l *rateLimiter) wait(n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		time.Sleep(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+		l.tokens = 0
+		l.last = time.Now()
+	}
+}
+
+type rateLimitedReader struct {
+	innerReader io.Reader
+	limiter     *rateLimiter
+}
+
+func (r rateLimitedReader) Read(buf []byte) (int, error) {
+	n, err := r.innerReader.Read(buf)
+	r.limiter.wait(n)
+	return n, err
+}
+
+type rateLimitedWriter struct {
+	innerWriter io.Writer
+	limiter     *rateLimiter
+}
+
+func (w rateLimitedWriter) Write(buf []byte) (int, error) {
+	w.limiter.wait(len(buf))
+	return w.innerWriter.Write(buf)
+}
@@ -0,0 +1,15 @@
+package falib
+
+import "os"
+
+// A directory entry as returned by the directory reader.  When typeKnown is
+// set, mode contains the file type bits reported by the directory read itself,
+// and no lstat is needed to tell directories, files and symlinks apart.  When
+// the reader has already looked up the entry's metadata, it's in info, and no
+// lstat is needed at all.
+type dirEntry struct {
+	name      string
+	mode      os.FileMode
+	typeKnown bool
+	info      os.FileInfo
+}
@@ -0,0 +1,183 @@
+package falib
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Offsets into struct linux_dirent64.
+const (
+	direntReclenOffset = unsafe.Offsetof(syscall.Dirent{}.Reclen)
+	direntTypeOffset   = unsafe.Offsetof(syscall.Dirent{}.Type)
+	direntNameOffset   = unsafe.Offsetof(syscall.Dirent{}.Name)
+)
+
+// Reads directory entries with getdents64 directly.  Unlike Readdir, this
+// doesn't stat every entry; the d_type field is enough for the scanner to
+// decide what to do with most entries, so directories with hundreds of
+// thousands of files need a handful of syscalls rather than one per entry.
+// The entries that the scanner does need metadata for, because the filesystem
+// doesn't report d_type or because the archiver's options look at more than
+// the type, are looked up with statx relative to the directory, a batch at a
+// time as each buffer of entries is read, rather than lstat'd by full path in
+// the scanner.  Falls back to the portable reader if getdents64 can't be used.
+func (a *Archiver) readdirentries(dir *os.File) chan dirEntry {
+	retval := make(chan dirEntry, 256)
+	go func() {
+		defer close(retval)
+
+		fd := int(dir.Fd())
+		buf := make([]byte, 32*1024)
+		var batch []dirEntry
+		first := true
+		for {
+			n, err := syscall.Getdents(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			} else if err != nil && first {
+				a.readdirnames(dir, retval)
+				return
+			} else if err != nil {
+				a.lossWarning("error reading directory:", err.Error())
+				return
+			} else if n <= 0 {
+				return
+			}
+			first = false
+
+			batch = batch[:0]
+			for offset := 0; offset < n; {
+				rec := buf[offset:n]
+				if len(rec) < int(direntNameOffset) {
+					break
+				}
+				reclen := int(*(*uint16)(unsafe.Pointer(&rec[direntReclenOffset])))
+				if reclen == 0 || reclen > len(rec) {
+					break
+				}
+				offset += reclen
+
+				nameBytes := rec[direntNameOffset:reclen]
+				for i, c := range nameBytes {
+					if c == 0 {
+						nameBytes = nameBytes[:i]
+						break
+					}
+				}
+				name := string(nameBytes)
+				if name == "." || name == ".." {
+					continue
+				}
+
+				mode, known := direntMode(rec[direntTypeOffset])
+				batch = append(batch, dirEntry{name: name, mode: mode, typeKnown: known})
+			}
+
+			for i := range batch {
+				if a.entryNeedsFileInfo(batch[i].mode, batch[i].typeKnown) {
+					// If statx can't be used, the scanner lstats
+					// the entry, and warns about any error.
+					batch[i].info = statAt(fd, batch[i].name)
+				}
+				retval <- batch[i]
+			}
+		}
+	}()
+	return retval
+}
+
+// Set once statx has failed with ENOSYS, on kernels older than 4.11.
+var statxMissing int32
+
+// Returns the metadata of the entry name in the directory dirfd, without
+// following it if it's a symbolic link, or nil if statx can't be used.
+func statAt(dirfd int, name string) os.FileInfo {
+	if sysStatx == 0 || atomic.LoadInt32(&statxMissing) != 0 {
+		return nil
+	}
+	namePtr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil
+	}
+	var info statxInfo
+	for {
+		_, _, errno := syscall.Syscall6(sysStatx, uintptr(dirfd), uintptr(unsafe.Pointer(namePtr)), atSymlinkNofollow,
+			statxBasicStats, uintptr(unsafe.Pointer(&info)), 0)
+		if errno == syscall.EINTR {
+			continue
+		} else if errno == syscall.ENOSYS {
+			atomic.StoreInt32(&statxMissing, 1)
+			return nil
+		} else if errno != 0 || info.mask&statxBasicStats != statxBasicStats {
+			return nil
+		}
+		break
+	}
+	retval := &statFileInfo{name: name}
+	info.fillStat(&retval.stat)
+	return retval
+}
+
+// An os.FileInfo for metadata from statx, which looks to the rest of the
+// archiver just like what os.Lstat returns.
+type statFileInfo struct {
+	name string
+	stat syscall.Stat_t
+}
+
+func (fi *statFileInfo) Name() string       { return fi.name }
+func (fi *statFileInfo) Size() int64        { return fi.stat.Size }
+func (fi *statFileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *statFileInfo) Sys() interface{}   { return &fi.stat }
+func (fi *statFileInfo) ModTime() time.Time { return time.Unix(fi.stat.Mtim.Unix()) }
+
+func (fi *statFileInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.stat.Mode & 0777)
+	switch fi.stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+	if fi.stat.Mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if fi.stat.Mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if fi.stat.Mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+func direntMode(dtype byte) (os.FileMode, bool) {
+	switch dtype {
+	case syscall.DT_REG:
+		return 0, true
+	case syscall.DT_DIR:
+		return os.ModeDir, true
+	case syscall.DT_LNK:
+		return os.ModeSymlink, true
+	case syscall.DT_FIFO:
+		return os.ModeNamedPipe, true
+	case syscall.DT_SOCK:
+		return os.ModeSocket, true
+	case syscall.DT_CHR:
+		return os.ModeDevice | os.ModeCharDevice, true
+	case syscall.DT_BLK:
+		return os.ModeDevice, true
+	}
+	return 0, false
+}
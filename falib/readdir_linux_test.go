@@ -0,0 +1,62 @@
+package falib
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// Checks that the metadata the directory reader looks up with statx is what
+// the scanner would otherwise have got from lstat.
+func TestStatAt(t *testing.T) {
+	if sysStatx == 0 {
+		t.Skip("statx isn't used on this architecture")
+	}
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, create := range []func() error{
+		func() error { return os.Mkdir(filepath.Join(dir, "dir"), 01755) },
+		func() error { return os.Symlink("file", filepath.Join(dir, "link")) },
+		func() error { return syscall.Mkfifo(filepath.Join(dir, "fifo"), 0600) },
+		func() error { return os.Chmod(filepath.Join(dir, "file"), 0640|os.ModeSetuid) },
+	} {
+		if err := create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	directory, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer directory.Close()
+	for _, name := range []string{"file", "dir", "link", "fifo"} {
+		info := statAt(int(directory.Fd()), name)
+		if info == nil {
+			if statxMissing != 0 {
+				t.Skip("statx isn't supported by this kernel")
+			}
+			t.Fatalf("%s: statAt failed", name)
+		}
+		expected, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name() != expected.Name() || info.Mode() != expected.Mode() || info.Size() != expected.Size() ||
+			!info.ModTime().Equal(expected.ModTime()) || info.IsDir() != expected.IsDir() {
+			t.Errorf("%s: got %s %v %d %v, expected %s %v %d %v", name, info.Name(), info.Mode(), info.Size(), info.ModTime(),
+				expected.Name(), expected.Mode(), expected.Size(), expected.ModTime())
+		}
+		if *info.Sys().(*syscall.Stat_t) != *expected.Sys().(*syscall.Stat_t) {
+			t.Errorf("%s: got %+v, expected %+v", name, info.Sys(), expected.Sys())
+		}
+	}
+
+	if statAt(int(directory.Fd()), "missing") != nil {
+		t.Error("statAt succeeded for a missing entry")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package falib
+
+import "os"
+
+func (a *Archiver) readdirentries(dir *os.File) chan dirEntry {
+	retval := make(chan dirEntry, 256)
+	go func() {
+		a.readdirnames(dir, retval)
+		close(retval)
+	}()
+	return retval
+}
@@ -0,0 +1,310 @@
+package falib
+
+import (
+	"bufio"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"os"
+	"time"
+)
+
+// A file, directory, special file, or deletion in an archive, as returned by
+// Reader.Next.
+type Entry struct {
+	Path  string
+	Mode  os.FileMode
+	Uid   int
+	Gid   int
+	Major uint32
+	Minor uint32
+
+	// The target of a symbolic link.
+	Linkname string
+
+	// The modification time, or the zero time if the archive doesn't record
+	// one.
+	ModTime time.Time
+
+	// When the file or directory was created, or the zero time if the
+	// archive doesn't record it (see Archiver.BirthTime).
+	BirthTime time.Time
+
+	// Set for a path recorded as deleted by an incremental archive.
+	Deleted bool
+
+	// The entry's inode flags and capabilities, as encoded in the archive,
+	// so that a Writer given the entry writes them out again.
+	attributes []byte
+}
+
+// Reads the entries of an archive one at a time, in the order they were
+// started, much like archive/tar's Reader.  The contents of the current file
+// entry are read by calling Read.
+//
+// Since the blocks of files archived concurrently are interleaved, the data of
+// files other than the current one that's encountered while reading is held
+// in memory until their entries are reached.  Reading each entry in full
+// before moving on to the next keeps that to a minimum.
+type Reader struct {
+	reader   *archiveReader
+	started  bool
+	queue    []*pendingEntry
+	open     map[string]*pendingEntry
+	current  *pendingEntry
+	lastData map[string][]byte
+	modTimes map[string]time.Time
+	btimes   map[string]time.Time
+	attrs    map[string][]byte
+	chunks   chunkStore
+	err      error
+}
+
+// An entry that has been read from the archive, and whatever of its data has
+// been read but not yet consumed.
+type pendingEntry struct {
+	entry   Entry
+	data    []dataRun
+	ended   bool
+	skipped bool
+	err     error
+
+	// How much of the file's data has been read by Read, and its checksum.
+	// If the file was read again from the start when it was archived, the
+	// same amount of the new data is skipped, as long as it matches.
+	consumed     int64
+	consumedHash hash.Hash64
+	skip         int64
+	skipHash     hash.Hash64
+	skipSum      uint64
+}
+
+// A block of a file's data, repeated count times, of which the first offset
+// bytes of the first repetition have been read.  A repeat block is kept as a
+// single run, so that a large repeat count doesn't take a lot of memory.
+type dataRun struct {
+	data   []byte
+	count  uint32
+	offset int
+}
+
+func NewReader(input io.Reader) *Reader {
+	return &Reader{
+		reader:   newArchiveReader(bufio.NewReader(input)),
+		open:     make(map[string]*pendingEntry),
+		lastData: make(map[string][]byte),
+		modTimes: make(map[string]time.Time),
+		btimes:   make(map[string]time.Time),
+		attrs:    make(map[string][]byte),
+	}
+}
+
+// Advances to the next entry in the archive, skipping whatever remains of the
+// current one.  Returns io.EOF at the end of the archive.
+func (r *Reader) Next() (*Entry, error) {
+	if r.current != nil {
+		r.current.skipped = true
+		r.current.data = nil
+		r.current = nil
+	}
+	if !r.started {
+		r.started = true
+		err := r.reader.readHeader()
+		if err != nil {
+			r.err = err
+		}
+	}
+
+	for len(r.queue) == 0 {
+		if r.err != nil {
+			return nil, r.err
+		}
+		r.err = r.readBlock()
+	}
+
+	r.current = r.queue[0]
+	r.queue = r.queue[1:]
+	entry := r.current.entry
+	return &entry, nil
+}
+
+// Reads the contents of the current entry; directories and other entries
+// without contents are empty.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.current == nil {
+		return 0, io.EOF
+	}
+	for len(r.current.data) == 0 || r.current.err != nil {
+		if r.current.err != nil {
+			return 0, r.current.err
+		} else if r.current.ended {
+			return 0, io.EOF
+		} else if r.err != nil {
+			return 0, unexpectedEOF(r.err)
+		}
+		r.err = r.readBlock()
+	}
+
+	run := &r.current.data[0]
+	n := copy(p, run.data[run.offset:])
+	r.current.consume(p[:n])
+	run.offset += n
+	if run.offset == len(run.data) {
+		run.offset = 0
+		run.count -= 1
+		if run.count == 0 {
+			r.current.data = r.current.data[1:]
+		}
+	}
+	return n, nil
+}
+
+// Releases the temporary storage used to read deduplicated archives.
+func (r *Reader) Close() error {
+	r.chunks.close()
+	return nil
+}
+
+// Reads one block from the archive, and files it under the entry it belongs
+// to.
+func (r *Reader) readBlock() error {
+	b, err := r.reader.readBlock()
+	if err != nil {
+		return err
+	}
+
+	// Times and attributes blocks come just before the block that starts
+	// their entry.
+	switch b.blockType {
+	case blockTypeTimes:
+		r.modTimes[b.filePath] = b.modTime()
+		r.btimes[b.filePath] = b.birthTime()
+		return nil
+	case blockTypeAttributes:
+		r.attrs[b.filePath] = b.buffer
+		return nil
+	}
+	modTime := r.modTimes[b.filePath]
+	birthTime := r.btimes[b.filePath]
+	attributes := r.attrs[b.filePath]
+	delete(r.modTimes, b.filePath)
+	delete(r.btimes, b.filePath)
+	delete(r.attrs, b.filePath)
+
+	switch b.blockType {
+	case blockTypeDirectory, blockTypeSpecial, blockTypeSymlink, blockTypeDelete:
+		entry := Entry{Path: b.filePath, Mode: b.mode, Uid: b.uid, Gid: b.gid, Major: b.major, Minor: b.minor, Linkname: b.linkTarget,
+			ModTime: modTime, BirthTime: birthTime, Deleted: b.blockType == blockTypeDelete, attributes: attributes}
+		r.queue = append(r.queue, &pendingEntry{entry: entry, ended: true})
+
+	case blockTypeStartOfFile:
+		if r.open[b.filePath] != nil {
+			return fmt.Errorf("%w: %s", ErrDuplicateFile, b.filePath)
+		}
+		pending := &pendingEntry{entry: Entry{Path: b.filePath, Mode: b.mode, Uid: b.uid, Gid: b.gid, ModTime: modTime, BirthTime: birthTime,
+			attributes: attributes}}
+		r.open[b.filePath] = pending
+		r.queue = append(r.queue, pending)
+
+	case blockTypeRestartFile:
+		// The file was read again from the start when it was archived,
+		// and its data so far is replaced by what follows.
+		delete(r.lastData, b.filePath)
+		if pending := r.open[b.filePath]; pending != nil {
+			pending.restart()
+		}
+
+	case blockTypeEndOfFile:
+		if pending := r.open[b.filePath]; pending != nil {
+			pending.ended = true
+			if pending.skip > 0 {
+				pending.fail()
+			}
+		}
+		delete(r.open, b.filePath)
+		delete(r.lastData, b.filePath)
+
+	case blockTypeData, blockTypeChunk, blockTypeChunkReference, blockTypeRepeat:
+		data := b.buffer[:b.numBytes]
+		repeat := uint32(1)
+		switch b.blockType {
+		case blockTypeChunk:
+			err = r.chunks.add(b.digest, data)
+		case blockTypeChunkReference:
+			data, err = r.chunks.get(b.digest)
+		case blockTypeRepeat:
+			var ok bool
+			data, ok = r.lastData[b.filePath]
+			repeat = b.repeat
+			if !ok {
+				err = ErrUnexpectedRepeat
+			}
+		}
+		if err != nil {
+			return err
+		}
+		r.lastData[b.filePath] = data
+
+		pending := r.open[b.filePath]
+		if pending == nil || pending.skipped || pending.err != nil || len(data) == 0 || repeat == 0 {
+			return nil
+		}
+		run := dataRun{data: data, count: repeat}
+		if pending.skip > 0 && !pending.skipRun(&run) {
+			return nil
+		}
+		pending.data = append(pending.data, run)
+	}
+	return nil
+}
+
+func (p *pendingEntry) consume(data []byte) {
+	if p.consumedHash == nil {
+		p.consumedHash = crc64.New(crc64.MakeTable(crc64.ECMA))
+	}
+	p.consumedHash.Write(data)
+	p.consumed += int64(len(data))
+}
+
+// Discards the data that hasn't been read yet, and arranges for as much of
+// the new data as was already read to be skipped.
+func (p *pendingEntry) restart() {
+	p.data = nil
+	if p.consumed > 0 && p.err == nil {
+		p.skip = p.consumed
+		p.skipSum = p.consumedHash.Sum64()
+		p.skipHash = crc64.New(crc64.MakeTable(crc64.ECMA))
+	}
+}
+
+// Skips the start of a run of data that was already read before the file was
+// restarted.  Returns false if the whole run was skipped.
+func (p *pendingEntry) skipRun(run *dataRun) bool {
+	for p.skip > 0 && run.count > 0 {
+		n := len(run.data) - run.offset
+		if int64(n) > p.skip {
+			n = int(p.skip)
+		}
+		p.skipHash.Write(run.data[run.offset : run.offset+n])
+		p.skip -= int64(n)
+		run.offset += n
+		if run.offset == len(run.data) {
+			run.offset = 0
+			run.count -= 1
+		}
+	}
+	if p.skip == 0 && p.skipHash.Sum64() != p.skipSum {
+		p.fail()
+		return false
+	}
+	return run.count > 0
+}
+
+// Fails the rest of the entry, because data that was already read turned
+// out to have changed when the file was read again.
+func (p *pendingEntry) fail() {
+	p.skip = 0
+	p.data = nil
+	p.err = fmt.Errorf("%w: %s", ErrFileRestarted, p.entry.Path)
+}
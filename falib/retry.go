@@ -0,0 +1,115 @@
+package falib
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The longest that a retry waits, however many times it has doubled.
+const maxRetryDelay = time.Minute
+
+// Returns true for the errors that network and FUSE filesystems return when
+// a server is briefly unreachable or a file handle has gone stale, and which
+// are worth retrying.
+func transientError(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ESTALE) ||
+		errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ETIMEDOUT)
+}
+
+// Decides whether a failed operation should be tried again, after the given
+// number of retries already made.  If so, it waits first, for RetryDelay
+// doubled with each retry.  Returns false without waiting if the retries are
+// used up, or the error isn't one that retrying can help with.
+func (a *Archiver) retry(retries int, what, filePath string, err error) bool {
+	if retries >= a.Retries || !transientError(err) || a.interrupted() {
+		return false
+	}
+	delay := a.RetryDelay << uint(retries)
+	if delay > maxRetryDelay || delay <= 0 {
+		delay = maxRetryDelay
+	}
+	a.Logger.Verbose("retrying", what, "of", filePath, "in", delay, "after error:", err.Error())
+	atomic.AddInt64(&a.stats.retries, 1)
+	select {
+	case <-time.After(delay):
+		return true
+	case <-a.interrupt:
+		return false
+	}
+}
+
+// Opens a file to be archived, retrying transient errors.
+func (a *Archiver) openFile(filePath string) (*os.File, error) {
+	for retries := 0; ; retries++ {
+		file, err := os.Open(filePath)
+		if err == nil || !a.retry(retries, "open", filePath, err) {
+			return file, err
+		}
+	}
+}
+
+// Reads a file being archived, retrying reads that fail with transient
+// errors.  If the file's handle has gone stale, the file is opened again, and
+// read from where it left off.
+type retryReader struct {
+	archiver *Archiver
+	filePath string
+	file     *os.File
+	reopened *os.File
+	offset   int64
+}
+
+func (r *retryReader) Read(p []byte) (int, error) {
+	for retries := 0; ; retries++ {
+		n, err := r.file.Read(p)
+		r.offset += int64(n)
+		if n > 0 && err != nil && transientError(err) {
+			// Return the data now; the error will come up again on the
+			// next read if it's still there.
+			return n, nil
+		}
+		if err == nil || !r.archiver.retry(retries, "read", r.filePath, err) {
+			return n, err
+		}
+		if errors.Is(err, syscall.ESTALE) {
+			r.reopen()
+		}
+	}
+}
+
+func (r *retryReader) reopen() {
+	file, err := os.Open(r.filePath)
+	if err == nil {
+		_, err = file.Seek(r.offset, io.SeekStart)
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return
+	}
+	r.Close()
+	r.reopened = file
+	r.file = file
+}
+
+func (r *retryReader) Seek(offset int64, whence int) (int64, error) {
+	offset, err := r.file.Seek(offset, whence)
+	if err == nil {
+		r.offset = offset
+	}
+	return offset, err
+}
+
+// Closes the file if it had to be opened again; the original is left to its
+// owner.
+func (r *retryReader) Close() error {
+	if r.reopened != nil {
+		return r.reopened.Close()
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package falib
+
+import "sync"
+
+// The queue of directories waiting to be scanned.  Adding to it never blocks:
+// the directory scanners are the only goroutines taking directories off the
+// queue, and also the ones adding the subdirectories they find, so with a
+// fixed-size queue a deep or wide tree could leave every scanner blocked
+// adding to a full queue that nothing is emptying.
+//
+// Directories are taken off the queue most recently added first, so that the
+// tree is scanned roughly depth-first; the queue then only grows with the
+// depth of the tree and the number of subdirectories per directory, rather
+// than with the number of directories on a whole level of the tree.
+type scanQueue struct {
+	lock   sync.Mutex
+	ready  sync.Cond
+	items  []scanItem
+	closed bool
+}
+
+func newScanQueue(capacity int) *scanQueue {
+	q := &scanQueue{items: make([]scanItem, 0, capacity)}
+	q.ready.L = &q.lock
+	return q
+}
+
+func (q *scanQueue) push(item scanItem) {
+	q.lock.Lock()
+	q.items = append(q.items, item)
+	q.lock.Unlock()
+	q.ready.Signal()
+}
+
+// Takes the next directory off the queue, waiting for one to be added if it's
+// empty.  Returns false once the queue is empty and has been closed.
+func (q *scanQueue) pop() (scanItem, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.ready.Wait()
+	}
+	if len(q.items) == 0 {
+		return scanItem{}, false
+	}
+	item := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return item, true
+}
+
+// Takes every directory off the queue without waiting, in the order they were
+// added.
+func (q *scanQueue) drain() []scanItem {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	items := q.items
+	q.items = nil
+	return items
+}
+
+// Returns the number of directories waiting to be scanned.
+func (q *scanQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items)
+}
+
+// Wakes every goroutine waiting in pop, once there's nothing left to add.
+func (q *scanQueue) close() {
+	q.lock.Lock()
+	q.closed = true
+	q.lock.Unlock()
+	q.ready.Broadcast()
+}
@@ -0,0 +1,123 @@
+package falib
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// The order that files waiting to be read are read in, and so the order they
+// appear in the archive.
+type FileOrder int
+
+const (
+	// Read files in the order the directory scanners find them.
+	OrderAsScanned FileOrder = iota
+	// Read the smallest waiting file next, so that many small files (eg.
+	// configuration) come early in the archive.
+	OrderSmallFirst
+	// Read the largest waiting file next, so that long sequential reads
+	// make up most of the archive.
+	OrderLargeFirst
+)
+
+// The files found by the directory scanners waiting to be read, when they're
+// read in an order other than OrderAsScanned.  It sits between the scanners
+// and the file readers in place of the file read queue, and hands the readers
+// the smallest or largest waiting file.  Like the file read queue it holds at
+// most capacity files, so the order is among the files waiting at the time;
+// files of the same size are read in the order they were found.
+type fileSchedule struct {
+	lock     sync.Mutex
+	ready    sync.Cond
+	space    sync.Cond
+	files    scheduledFiles
+	capacity int
+	sequence int64
+	closed   bool
+}
+
+type scheduledFile struct {
+	item     scanItem
+	size     int64
+	sequence int64
+}
+
+func newFileSchedule(capacity int, order FileOrder) *fileSchedule {
+	if capacity < 1 {
+		capacity = 1
+	}
+	s := &fileSchedule{capacity: capacity}
+	s.files.largeFirst = order == OrderLargeFirst
+	s.ready.L = &s.lock
+	s.space.L = &s.lock
+	return s
+}
+
+// Adds a file of the given size, waiting while the schedule is full.
+func (s *fileSchedule) push(item scanItem, size int64) {
+	s.lock.Lock()
+	for len(s.files.files) >= s.capacity {
+		s.space.Wait()
+	}
+	s.sequence++
+	heap.Push(&s.files, scheduledFile{item, size, s.sequence})
+	s.lock.Unlock()
+	s.ready.Signal()
+}
+
+// Takes the next file to read, waiting for one to be added if there are none.
+// Returns false once there are none and the schedule has been closed.
+func (s *fileSchedule) pop() (scanItem, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.files.files) == 0 && !s.closed {
+		s.ready.Wait()
+	}
+	if len(s.files.files) == 0 {
+		return scanItem{}, false
+	}
+	file := heap.Pop(&s.files).(scheduledFile)
+	s.space.Signal()
+	return file.item, true
+}
+
+// Returns the number of files waiting to be read.
+func (s *fileSchedule) len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.files.files)
+}
+
+// Wakes every file reader waiting in pop, once there's nothing left to add.
+func (s *fileSchedule) close() {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+	s.ready.Broadcast()
+}
+
+// A heap of waiting files, with the next one to read first.
+type scheduledFiles struct {
+	files      []scheduledFile
+	largeFirst bool
+}
+
+func (f *scheduledFiles) Len() int { return len(f.files) }
+
+func (f *scheduledFiles) Less(i, j int) bool {
+	a, b := f.files[i], f.files[j]
+	if a.size != b.size {
+		return (a.size < b.size) != f.largeFirst
+	}
+	return a.sequence < b.sequence
+}
+
+func (f *scheduledFiles) Swap(i, j int) { f.files[i], f.files[j] = f.files[j], f.files[i] }
+
+func (f *scheduledFiles) Push(x interface{}) { f.files = append(f.files, x.(scheduledFile)) }
+
+func (f *scheduledFiles) Pop() interface{} {
+	last := f.files[len(f.files)-1]
+	f.files = f.files[:len(f.files)-1]
+	return last
+}
@@ -0,0 +1,191 @@
+package falib
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Version 1 snapshots don't record the ID of their archive; they're still read,
+// but the archive based on one isn't marked with a parent.
+const (
+	snapshotHeaderV1 = "fast-archiver-snapshot 1"
+	snapshotHeader   = "fast-archiver-snapshot 2"
+)
+
+// A Snapshot records the state of the archived files at the time of an
+// archive, so that a later incremental archive can include only the files
+// that have changed since, and record the ones that have been deleted.  Each
+// archive created with a snapshot is given a random ID, and the ID of the
+// archive it's based on, so that a chain of them can be checked to be
+// complete and in order when it's restored.
+type Snapshot struct {
+	lock      sync.Mutex
+	previous  map[string]snapshotEntry
+	current   map[string]snapshotEntry
+	archiveId []byte
+	parentId  []byte
+}
+
+type snapshotEntry struct {
+	isDir   bool
+	modTime int64
+	size    int64
+}
+
+// Loads the snapshot written by a previous run.  If the file doesn't exist,
+// an empty snapshot is returned, and the archive will be a full one.
+func LoadSnapshot(path string) (*Snapshot, error) {
+	s := &Snapshot{
+		previous:  make(map[string]snapshotEntry),
+		current:   make(map[string]snapshotEntry),
+		archiveId: make([]byte, 16),
+	}
+	_, err := rand.Read(s.archiveId)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return nil, ErrSnapshotHeaderMismatch
+	}
+	switch scanner.Text() {
+	case snapshotHeaderV1:
+	case snapshotHeader:
+		if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), "archive ") {
+			return nil, ErrSnapshotHeaderMismatch
+		}
+		s.parentId, err = hex.DecodeString(strings.TrimPrefix(scanner.Text(), "archive "))
+		if err != nil {
+			return nil, ErrSnapshotHeaderMismatch
+		}
+	default:
+		return nil, ErrSnapshotHeaderMismatch
+	}
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 4)
+		if len(fields) != 4 {
+			return nil, ErrSnapshotHeaderMismatch
+		}
+		modTime, err1 := strconv.ParseInt(fields[1], 10, 64)
+		size, err2 := strconv.ParseInt(fields[2], 10, 64)
+		filePath, err3 := strconv.Unquote(fields[3])
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, ErrSnapshotHeaderMismatch
+		}
+		s.previous[filePath] = snapshotEntry{fields[0] == "d", modTime, size}
+	}
+	return s, scanner.Err()
+}
+
+// Writes the state observed during this run to path, for the next
+// incremental archive to be based on.
+func (s *Snapshot) Save(path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var filePaths []string
+	for filePath := range s.current {
+		filePaths = append(filePaths, filePath)
+	}
+	sort.Strings(filePaths)
+
+	tempPath := path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	fmt.Fprintln(w, snapshotHeader)
+	fmt.Fprintf(w, "archive %x\n", s.archiveId)
+	for _, filePath := range filePaths {
+		entry := s.current[filePath]
+		entryType := "f"
+		if entry.isDir {
+			entryType = "d"
+		}
+		fmt.Fprintf(w, "%s %d %d %s\n", entryType, entry.modTime, entry.size, strconv.Quote(filePath))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// Returns the archive info properties that link this run's archive to the one
+// it's based on.  A nil snapshot has none.
+func (s *Snapshot) chain() fsProperties {
+	if s == nil {
+		return nil
+	}
+	chain := fsProperties{infoArchiveId: hex.EncodeToString(s.archiveId)}
+	if s.parentId != nil {
+		chain[infoParentId] = hex.EncodeToString(s.parentId)
+	}
+	return chain
+}
+
+// Records that filePath exists with the given info, returning true if it's new
+// or has changed since the previous snapshot.
+func (s *Snapshot) observe(filePath string, fi os.FileInfo) bool {
+	entry := snapshotEntry{fi.IsDir(), fi.ModTime().UnixNano(), fi.Size()}
+	if entry.isDir {
+		entry.size = 0
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.current[filePath] = entry
+	previous, ok := s.previous[filePath]
+	return !ok || previous != entry
+}
+
+// Returns the paths in the previous snapshot that weren't observed in this
+// run, in sorted order.  Paths inside deleted directories are left out.
+func (s *Snapshot) deleted() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var retval []string
+	for filePath := range s.previous {
+		if _, ok := s.current[filePath]; !ok {
+			retval = append(retval, filePath)
+		}
+	}
+	sort.Strings(retval)
+
+	var pruned []string
+	for _, filePath := range retval {
+		n := len(pruned)
+		if n > 0 && strings.HasPrefix(filePath, pruned[n-1]+string(filepath.Separator)) {
+			continue
+		}
+		pruned = append(pruned, filePath)
+	}
+	return pruned
+}
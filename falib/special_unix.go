@@ -0,0 +1,24 @@
+//go:build !windows
+
+package falib
+
+import (
+	"os"
+	"syscall"
+)
+
+// Creates a FIFO, device, or socket at filePath.
+func makeSpecial(filePath string, mode os.FileMode, major, minor uint32) error {
+	perm := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return syscall.Mkfifo(filePath, perm)
+	case mode&os.ModeCharDevice != 0:
+		return mknod(filePath, syscall.S_IFCHR|perm, joinDevice(major, minor))
+	case mode&os.ModeDevice != 0:
+		return mknod(filePath, syscall.S_IFBLK|perm, joinDevice(major, minor))
+	case mode&os.ModeSocket != 0:
+		return mknod(filePath, syscall.S_IFSOCK|perm, 0)
+	}
+	return ErrUnrecognizedSpecial
+}
@@ -0,0 +1,8 @@
+package falib
+
+import "os"
+
+// Special files can't be created on this platform.
+func makeSpecial(filePath string, mode os.FileMode, major, minor uint32) error {
+	return ErrSpecialsUnsupported
+}
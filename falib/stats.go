@@ -0,0 +1,133 @@
+package falib
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Counts of the work done by each stage of an Archiver's pipeline, as
+// returned by Archiver.Stats.  The stage times are the total time that the
+// stage's goroutines spent busy, added up across goroutines, so with several
+// file readers ReadTime can be longer than Elapsed.
+type Stats struct {
+	Directories  int64
+	Files        int64
+	Specials     int64
+	Symlinks     int64
+	Deleted      int64
+	BytesRead    int64
+	BytesWritten int64
+
+	// Opens and reads that failed with transient errors and were retried,
+	// and files that changed while they were read and were read again.
+	Retries int64
+	Rereads int64
+
+	// With Compress, the size of the data blocks before and after
+	// compression, and how many of them got smaller and were stored
+	// compressed.
+	CompressedBlocks int64
+	CompressIn       int64
+	CompressOut      int64
+
+	Elapsed      time.Duration
+	ScanTime     time.Duration
+	ReadTime     time.Duration
+	CompressTime time.Duration
+	HashTime     time.Duration
+	WriteTime    time.Duration
+}
+
+// Returns BytesWritten as a fraction of BytesRead, or 0 if nothing was read.
+func (s Stats) Ratio() float64 {
+	if s.BytesRead == 0 {
+		return 0
+	}
+	return float64(s.BytesWritten) / float64(s.BytesRead)
+}
+
+// Atomic counters updated by the pipeline stages as they go.
+type statsCounters struct {
+	directories      int64
+	files            int64
+	specials         int64
+	symlinks         int64
+	deleted          int64
+	bytesRead        int64
+	bytesWritten     int64
+	compressedBlocks int64
+	compressIn       int64
+	compressOut      int64
+	scanTime         int64
+	readTime         int64
+	compressTime     int64
+	hashTime         int64
+	writeTime        int64
+	started          int64
+	finished         int64
+	retries          int64
+	rereads          int64
+}
+
+// Adds the time since start to one of the stage time counters.
+func addTime(counter *int64, start time.Time) {
+	atomic.AddInt64(counter, int64(time.Since(start)))
+}
+
+// Returns what the archiver has done so far; it can be called while Run is in
+// progress, or after it returns.
+func (a *Archiver) Stats() Stats {
+	c := &a.stats
+	elapsed := time.Duration(0)
+	if started := atomic.LoadInt64(&c.started); started != 0 {
+		finished := atomic.LoadInt64(&c.finished)
+		if finished == 0 {
+			finished = time.Now().UnixNano()
+		}
+		elapsed = time.Duration(finished - started)
+	}
+	return Stats{
+		Directories:      atomic.LoadInt64(&c.directories),
+		Files:            atomic.LoadInt64(&c.files),
+		Specials:         atomic.LoadInt64(&c.specials),
+		Symlinks:         atomic.LoadInt64(&c.symlinks),
+		Deleted:          atomic.LoadInt64(&c.deleted),
+		BytesRead:        atomic.LoadInt64(&c.bytesRead),
+		BytesWritten:     atomic.LoadInt64(&c.bytesWritten),
+		Retries:          atomic.LoadInt64(&c.retries),
+		Rereads:          atomic.LoadInt64(&c.rereads),
+		CompressedBlocks: atomic.LoadInt64(&c.compressedBlocks),
+		CompressIn:       atomic.LoadInt64(&c.compressIn),
+		CompressOut:      atomic.LoadInt64(&c.compressOut),
+		Elapsed:          elapsed,
+		ScanTime:         time.Duration(atomic.LoadInt64(&c.scanTime)),
+		ReadTime:         time.Duration(atomic.LoadInt64(&c.readTime)),
+		CompressTime:     time.Duration(atomic.LoadInt64(&c.compressTime)),
+		HashTime:         time.Duration(atomic.LoadInt64(&c.hashTime)),
+		WriteTime:        time.Duration(atomic.LoadInt64(&c.writeTime)),
+	}
+}
+
+// The number of items waiting in each of an Archiver's queues: directories to
+// be scanned, files to be read, and blocks to be written.
+type QueueDepths struct {
+	Directories int
+	Files       int
+	Blocks      int
+}
+
+// Returns how full the archiver's queues are; like Stats, it can be called
+// while Run is in progress.  The queues are all empty before Run starts.
+func (a *Archiver) QueueDepths() QueueDepths {
+	// Run creates the queues before recording its start time.
+	if atomic.LoadInt64(&a.stats.started) == 0 {
+		return QueueDepths{}
+	}
+	depths := QueueDepths{Directories: a.directoryScanQueue.len(), Blocks: len(a.blockQueue)}
+	if a.fileSchedule != nil {
+		depths.Files = a.fileSchedule.len()
+	} else {
+		depths.Files = len(a.fileReadQueue)
+	}
+	return depths
+}
@@ -0,0 +1,22 @@
+package falib
+
+import "syscall"
+
+const sysStatx = 332
+
+// Converts what statx returned into the struct stat that lstat would have.
+func (s *statxInfo) fillStat(stat *syscall.Stat_t) {
+	stat.Dev = joinDevice(s.devMajor, s.devMinor)
+	stat.Ino = s.ino
+	stat.Nlink = uint64(s.nlink)
+	stat.Mode = uint32(s.mode)
+	stat.Uid = s.uid
+	stat.Gid = s.gid
+	stat.Rdev = joinDevice(s.rdevMajor, s.rdevMinor)
+	stat.Size = int64(s.size)
+	stat.Blksize = int64(s.blksize)
+	stat.Blocks = int64(s.blocks)
+	stat.Atim = syscall.Timespec{Sec: s.atime.sec, Nsec: int64(s.atime.nsec)}
+	stat.Mtim = syscall.Timespec{Sec: s.mtime.sec, Nsec: int64(s.mtime.nsec)}
+	stat.Ctim = syscall.Timespec{Sec: s.ctime.sec, Nsec: int64(s.ctime.nsec)}
+}
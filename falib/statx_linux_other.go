@@ -0,0 +1,12 @@
+//go:build linux && !amd64 && !arm64 && !riscv64 && !loong64
+
+package falib
+
+import "syscall"
+
+// statx isn't used on these architectures, so creation times aren't read.
+const sysStatx = 0
+
+// Never called, since sysStatx is 0.
+func (s *statxInfo) fillStat(stat *syscall.Stat_t) {
+}
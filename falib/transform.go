@@ -0,0 +1,104 @@
+package falib
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Filters the contents of a file as it's archived or extracted: whatever is
+// read from the returned reader replaces the file's contents.  If the reader
+// is also an io.Closer, it's closed once the file is done with, even if it
+// wasn't read to the end.  Transform functions are called concurrently for
+// different files.
+type TransformFunc func(filePath string, contents io.Reader) (io.Reader, error)
+
+// A TransformFunc, and the files it applies to.  Pattern is matched (as by
+// filepath.Match) against each file's path, and if it doesn't contain a path
+// separator, against the file's name as well; eg. "*.txt" matches every text
+// file, wherever it is.
+type Transform struct {
+	Pattern string
+	Func    TransformFunc
+}
+
+func (t Transform) matches(filePath string) bool {
+	if match, err := filepath.Match(t.Pattern, filePath); err == nil && match {
+		return true
+	}
+	if !strings.ContainsRune(t.Pattern, filepath.Separator) {
+		match, err := filepath.Match(t.Pattern, filepath.Base(filePath))
+		return err == nil && match
+	}
+	return false
+}
+
+// Returns the transforms that apply to filePath.
+func matchingTransforms(transforms []Transform, filePath string) []Transform {
+	var retval []Transform
+	for _, t := range transforms {
+		if t.matches(filePath) {
+			retval = append(retval, t)
+		}
+	}
+	return retval
+}
+
+// Runs contents through every transform that matches filePath, in order.
+// Returns the transformed contents, and a function that closes the
+// transforms' readers.
+func applyTransforms(transforms []Transform, filePath string, contents io.Reader) (io.Reader, func(), error) {
+	var closers []io.Closer
+	closeAll := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i].Close()
+		}
+	}
+	for _, t := range transforms {
+		if !t.matches(filePath) {
+			continue
+		}
+		transformed, err := t.Func(filePath, contents)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		if closer, ok := transformed.(io.Closer); ok {
+			closers = append(closers, closer)
+		}
+		contents = transformed
+	}
+	return contents, closeAll, nil
+}
+
+// Starts running whatever is written to the returned writer through
+// transforms, and on to output.  Once everything has been written, finish must
+// be called with nil to wait for the transforms to complete, or with an error
+// to abandon them; it returns the first error from the transforms or output.
+func startTransforms(transforms []Transform, filePath string, output io.Writer) (io.Writer, func(error) error, error) {
+	pipeReader, pipeWriter := io.Pipe()
+	transformed, closeTransforms, err := applyTransforms(transforms, filePath, pipeReader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(output, transformed)
+		closeTransforms()
+		if err == nil {
+			// A transform may not need all of its input; let the rest of
+			// the file be written anyway.
+			_, err = io.Copy(ioutil.Discard, pipeReader)
+		}
+		pipeReader.CloseWithError(err)
+		done <- err
+	}()
+
+	finish := func(err error) error {
+		pipeWriter.CloseWithError(err)
+		return <-done
+	}
+	return pipeWriter, finish, nil
+}
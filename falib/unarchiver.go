@@ -3,151 +3,355 @@ package falib
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"hash"
-	"hash/crc64"
 	"io"
+	"math/rand"
 	"os"
-	//"strings"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// An io.Reader implementation that also keeps a crc64 as it reads.  Fancy!
-type hashingReader struct {
-	innerReader io.Reader
-	hasher      hash.Hash64
+// A file that has been completely extracted and renamed into place.
+type RestoredFile struct {
+	Path     string
+	SHA256   []byte
+	Size     int64
+	Duration time.Duration
 }
 
-func (r hashingReader) Read(buf []byte) (int, error) {
-	n, err := r.innerReader.Read(buf)
-	if err == nil {
-		r.hasher.Write(buf[:n])
-	}
-	return n, err
-}
+// Called by the unarchiver after each file is extracted, so that it can be
+// processed (eg. scanned or indexed) as soon as it lands.  Restore hooks are
+// called concurrently from the goroutines writing files.
+type RestoreHookFunc func(file RestoredFile)
+
+// What to do when a file being extracted already exists.
+type OverwritePolicy int
+
+const (
+	// Replace the existing file.
+	OverwriteAlways OverwritePolicy = iota
+	// Keep the existing file, and skip the one in the archive.
+	OverwriteNever
+	// Keep the existing file if it was modified more recently than the one
+	// in the archive, or if the archive doesn't record modification times.
+	OverwriteOlder
+	// Keep the existing file, and fail the extraction.
+	OverwriteError
+)
+
+// What to do when a malformed archive starts a file again before the end of
+// the same path's previous start.
+type DuplicatePolicy int
+
+const (
+	// Fail the extraction with ErrDuplicateFile.
+	DuplicateError DuplicatePolicy = iota
+	// End the first file where the second starts, and extract the second
+	// next to it, with a numeric suffix (eg. "name.1").
+	DuplicateRename
+	// Abandon the first file, and extract the second in its place.
+	DuplicateLastWins
+)
 
 type Unarchiver struct {
 	Logger       Logger
 	IgnorePerms  bool
 	IgnoreOwners bool
 	DryRun       bool
+	Journal      *Journal
+	Fsync        bool
+	Strict       bool
+	RestoreHook  RestoreHookFunc
+	StartHook    StartHookFunc
+	Specials     bool
+	Overwrite    OverwritePolicy
+	Duplicates   DuplicatePolicy
+	Transforms   []Transform
+
+	// If the archive can't be read to the end, because it's truncated or
+	// corrupt, keep what was extracted up to that point rather than
+	// failing straight away: files that were partly extracted are kept
+	// with as much of their contents as could be read, and reported with a
+	// warning.  Run then returns an error wrapping ErrSalvaged.
+	Salvage bool
+
+	// Restore the inode flags (immutable and append-only) and capabilities
+	// recorded in the archive.  Setting them generally needs root.
+	Attributes bool
+
+	// Replace control characters and invalid UTF-8 in extracted paths with
+	// percent-escapes (eg. %0A for a newline), rather than restoring them
+	// as they were archived.
+	SanitizeNames bool
 
-	file io.Reader
+	// Write over existing files in place, only writing the parts that
+	// differ from the archive, instead of replacing them with newly
+	// written copies.  Unlike a normal extraction, an interrupted one can
+	// leave a file partly updated.
+	DiffWrite bool
+
+	// The directory to extract into; the current directory if it's empty.
 	OutputPath string
+
+	// Extract absolute paths, and paths starting with .., where they say,
+	// instead of making them relative to OutputPath by removing any leading
+	// / and ../ components.
+	AbsolutePaths bool
+
+	// Fail with ErrBrokenChain before extracting anything, unless the
+	// archive is the next in a chain of incremental archives: one based on
+	// the archive with the ID ChainParent, or a full archive if ChainParent
+	// is nil.
+	CheckChain  bool
+	ChainParent []byte
+
+	// Restore the creation times of files and directories, where the
+	// archive recorded them and the platform can set them.
+	BirthTime bool
+
+	// Fsync every directory that entries were created or renamed in, once
+	// everything has been extracted, so that the entries themselves, and
+	// not only the contents of files fsynced with Fsync, survive a crash
+	// of the whole system.
+	FsyncDirs bool
+
+	archiveId            []byte
+	diffWritten          int64
+	diffUnchanged        int64
+	unrestoredBirthTimes int64
+
+	file          io.Reader
+	error         error
+	errorLock     sync.Mutex
+	interrupt     chan struct{}
+	interruptOnce sync.Once
+
+	// With FsyncDirs, the directories to fsync at the end.
+	changedDirs     map[string]bool
+	changedDirsLock sync.Mutex
 }
 
 func NewUnarchiver(file io.Reader) *Unarchiver {
 	retval := &Unarchiver{}
 	retval.file = bufio.NewReader(file)
-        retval.OutputPath = "/tmp"
+	retval.interrupt = make(chan struct{})
 	return retval
 }
 
+// Stops a Run in progress before it reads the next block from the archive.
+// Files that were partly extracted are removed, and Run returns
+// ErrInterrupted.  Can be called from any goroutine, such as a signal handler.
+func (u *Unarchiver) Interrupt() {
+	u.interruptOnce.Do(func() { close(u.interrupt) })
+}
+
+// Returns the ID of the archive, once Run has read it, or nil if it wasn't
+// created with a snapshot.
+func (u *Unarchiver) ArchiveId() []byte {
+	return u.archiveId
+}
+
 func (u *Unarchiver) Run() error {
 	var workInProgress sync.WaitGroup
 	fileOutputChan := make(map[string]chan block)
+	lastData := make(map[string]block)
+	modTimes := make(map[string]time.Time)
+	birthTimes := make(map[string]time.Time)
+	attributes := make(map[string]fileAttributes)
+	var directoryAttributes []string
+	var symlinks []pendingSymlink
+	unrestoredAttributes := 0
 
-	reader := hashingReader{u.file, crc64.New(crc64.MakeTable(crc64.ECMA))}
+	// If the run stops early, abandon the files that are still being
+	// written; closing their channels before the end of file block makes
+	// writeFile remove them.
+	defer func() {
+		for _, c := range fileOutputChan {
+			close(c)
+		}
+		workInProgress.Wait()
+	}()
 
-	fileHeader := make([]byte, 8)
-	_, err := io.ReadFull(reader, fileHeader)
+	var chunks chunkStore
+	defer chunks.close()
+
+	reader := newArchiveReader(u.file)
+	err := reader.readHeader()
 	if err != nil {
 		return err
-	} else if !bytes.Equal(fileHeader, fastArchiverHeader) {
-		return ErrFileHeaderMismatch
 	}
 
-	for {
-		var pathSize uint16
-		err = binary.Read(reader, binary.BigEndian, &pathSize)
+	for first := true; ; first = false {
+		select {
+		case <-u.interrupt:
+			return ErrInterrupted
+		default:
+		}
+
+		b, err := reader.readBlock()
+		if err == io.EOF && len(fileOutputChan) > 0 {
+			// The archive ended cleanly between blocks, but before the
+			// end of some files.
+			err = io.ErrUnexpectedEOF
+		}
 		if err == io.EOF {
 			break
+		} else if err != nil && u.Salvage {
+			return u.salvage(err, fileOutputChan, &workInProgress)
 		} else if err != nil {
 			return err
 		}
 
-		buf := make([]byte, pathSize)
-		_, err = io.ReadFull(reader, buf)
-		if err != nil {
-			return err
+		if u.SanitizeNames {
+			b.filePath = sanitizePath(b.filePath)
 		}
-		filePath := string(buf)
-/*
-		if strings.HasPrefix(filePath, "/") {
-			return ErrAbsoluteDirectoryPath
-		}
-*/
-                filePath = u.OutputPath + filePath  
-
-		blockType := make([]byte, 1)
-		_, err = io.ReadFull(reader, blockType)
-		if err != nil {
-			return err
+		if first && u.CheckChain && b.blockType != blockTypeArchiveInfo {
+			return fmt.Errorf("%w: it has no archive ID", ErrBrokenChain)
 		}
-
-		if blockType[0] == byte(blockTypeStartOfFile) {
-			var uid uint32
-			var gid uint32
-			var mode os.FileMode
-
-			err = binary.Read(reader, binary.BigEndian, &uid)
+		if b.blockType == blockTypeArchiveInfo {
+			err = u.readArchiveInfo(decodeFsProperties(b.buffer))
 			if err != nil {
 				return err
 			}
-
-			err = binary.Read(reader, binary.BigEndian, &gid)
-			if err != nil {
-				return err
+			continue
+		} else if b.blockType == blockTypeSourceProperties {
+			u.checkSourceProperties(decodeFsProperties(b.buffer))
+			continue
+		} else if b.blockType == blockTypeTimes {
+			modTimes[u.outputPath(b.filePath)] = b.modTime()
+			if birthTime := b.birthTime(); u.BirthTime && !birthTime.IsZero() {
+				birthTimes[u.outputPath(b.filePath)] = birthTime
 			}
-
-			err = binary.Read(reader, binary.BigEndian, &mode)
+			continue
+		} else if b.blockType == blockTypeFileChanged {
+			u.Logger.Warning("file was changing while it was archived; its contents may be inconsistent:", u.outputPath(b.filePath))
+			continue
+		} else if b.blockType == blockTypeAttributes {
+			if !u.Attributes {
+				u.Logger.Verbose("not restoring flags or capabilities of", u.outputPath(b.filePath))
+				unrestoredAttributes++
+				continue
+			}
+			f, err := decodeAttributes(b.buffer)
 			if err != nil {
-				return err
+				u.lossWarning(u.outputPath(b.filePath), err.Error())
+				continue
 			}
+			attributes[u.outputPath(b.filePath)] = f
+			continue
+		} else if b.blockType >= blockTypeFirstExtension {
+			continue
+		}
+
+		filePath := u.outputPath(b.filePath)
+		b.filePath = filePath
+
+		c, started := fileOutputChan[filePath]
+		if !started && isFileContentBlock(b.blockType) {
+			return fmt.Errorf("%w: %s", ErrUnknownFileId, filePath)
+		}
 
-			c := make(chan block, 1)
+		switch b.blockType {
+		case blockTypeStartOfFile:
+			if started {
+				err = u.handleDuplicate(&b, c, fileOutputChan)
+				if err != nil {
+					return err
+				}
+				delete(lastData, filePath)
+			}
+			c = make(chan block, 1)
 			fileOutputChan[filePath] = c
 			workInProgress.Add(1)
-			go u.writeFile(c, &workInProgress)
-			c <- block{filePath, 0, nil, blockTypeStartOfFile, int(uid), int(gid), mode}
-		} else if blockType[0] == byte(blockTypeEndOfFile) {
-			c := fileOutputChan[filePath]
-			c <- block{filePath, 0, nil, blockTypeEndOfFile, 0, 0, 0}
+			go u.writeFile(c, modTimes[filePath], birthTimes[filePath], attributes[filePath], &workInProgress)
+			delete(modTimes, filePath)
+			delete(birthTimes, filePath)
+			delete(attributes, filePath)
+			c <- b
+		case blockTypeEndOfFile:
+			c <- b
 			close(c)
 			delete(fileOutputChan, filePath)
-		} else if blockType[0] == byte(blockTypeData) {
-			var blockSize uint16
-			err = binary.Read(reader, binary.BigEndian, &blockSize)
-			if err != nil {
-				return err
+			delete(lastData, filePath)
+		case blockTypeData:
+			c <- b
+			lastData[filePath] = b
+		case blockTypeRestartFile:
+			// The file changed while it was being archived, and what
+			// follows is a fresh read of it.
+			c <- b
+			delete(lastData, filePath)
+		case blockTypeRepeat:
+			last, ok := lastData[filePath]
+			if !ok {
+				return ErrUnexpectedRepeat
 			}
-
-			blockData := make([]byte, blockSize)
-			_, err = io.ReadFull(reader, blockData)
-			if err != nil {
-				return err
+			// Neither an empty block nor a dry run writes anything,
+			// however many times the block is repeated; a corrupt
+			// count could otherwise keep this busy for a long time.
+			if last.numBytes == 0 || u.DryRun {
+				continue
 			}
-
-			c := fileOutputChan[filePath]
-			c <- block{filePath, blockSize, blockData, blockTypeData, 0, 0, 0}
-		} else if blockType[0] == byte(blockTypeDirectory) {
-			var uid uint32
-			var gid uint32
-			var mode os.FileMode
-
-			err = binary.Read(reader, binary.BigEndian, &uid)
-			if err != nil {
-				return err
+			for i := uint32(0); i < b.repeat; i++ {
+				c <- last
+			}
+		case blockTypeChunk, blockTypeChunkReference:
+			if b.blockType == blockTypeChunk {
+				err = chunks.add(b.digest, b.buffer)
+			} else {
+				b.buffer, err = chunks.get(b.digest)
+				b.numBytes = uint16(len(b.buffer))
 			}
-			err = binary.Read(reader, binary.BigEndian, &gid)
 			if err != nil {
 				return err
 			}
-			err = binary.Read(reader, binary.BigEndian, &mode)
+			b.blockType = blockTypeData
+			c <- b
+		case blockTypeDelete:
+			u.Logger.Verbose("deleting", filePath)
+			if u.DryRun {
+				continue
+			}
+			err = os.RemoveAll(filePath)
 			if err != nil {
-				return err
+				u.lossWarning("Delete error:", err.Error())
 			}
-
+		case blockTypeSpecial:
+			delete(modTimes, filePath)
+			delete(birthTimes, filePath)
+			delete(attributes, filePath)
+			u.Logger.Verbose(filePath)
+			if u.DryRun {
+				continue
+			}
+			if !u.Specials {
+				u.lossWarning("skipping special file (use --specials to recreate it):", filePath)
+				continue
+			}
+			u.restoreSpecial(b)
+			u.entryChanged(filePath)
+		case blockTypeSymlink:
+			modTime := modTimes[filePath]
+			delete(modTimes, filePath)
+			delete(birthTimes, filePath)
+			delete(attributes, filePath)
+			u.Logger.Verbose(filePath, "->", b.linkTarget)
+			if u.DryRun {
+				continue
+			}
+			symlinks = append(symlinks, pendingSymlink{b, modTime})
+		case blockTypeDirectory:
+			delete(modTimes, filePath)
+			birthTime := birthTimes[filePath]
+			delete(birthTimes, filePath)
+			mode := b.mode
 			if u.IgnorePerms {
 				mode = os.ModeDir | 0755
 			}
@@ -160,75 +364,585 @@ func (u *Unarchiver) Run() error {
 			if err != nil && !os.IsExist(err) {
 				return err
 			}
+			u.entryChanged(filePath)
 			if !u.IgnoreOwners {
-				err = os.Chown(filePath, int(uid), int(gid))
+				err = os.Chown(filePath, b.uid, b.gid)
 				if err != nil {
-					u.Logger.Warning("Directory chown error:", err.Error())
+					u.lossWarning("Directory chown error:", err.Error())
 				}
 			}
-		} else if blockType[0] == byte(blockTypeChecksum) {
-			currentChecksum := reader.hasher.Sum64()
+			u.restoreBirthTime(filePath, birthTime)
+			if _, ok := attributes[filePath]; ok {
+				// An immutable or append-only directory couldn't
+				// have its contents extracted into it, so its flags
+				// are set at the end.
+				directoryAttributes = append(directoryAttributes, filePath)
+			}
+		}
+	}
 
-			var expectedChecksum uint64
-			binary.Read(reader, binary.BigEndian, &expectedChecksum)
+	workInProgress.Wait()
 
-			if expectedChecksum != currentChecksum {
-				return ErrCrcMismatch
-			}
-		} else {
-			return ErrUnrecognizedBlockType
+	for _, symlink := range symlinks {
+		u.restoreSymlink(symlink.block, symlink.modTime)
+	}
+	u.syncChangedDirs()
+	for _, filePath := range directoryAttributes {
+		err := restoreXattrs(filePath, attributes[filePath])
+		if err == nil {
+			err = restoreFileFlags(filePath, attributes[filePath])
 		}
+		if err != nil {
+			u.lossWarning("Unable to restore flags or capabilities:", err.Error())
+		}
+	}
+	if unrestoredAttributes > 0 {
+		u.lossWarning(unrestoredAttributes, "files and directories have flags or capabilities that weren't restored (use --attributes to restore them)")
+	}
+	if n := atomic.LoadInt64(&u.unrestoredBirthTimes); n > 0 {
+		u.lossWarning(n, "files and directories have creation times that weren't restored:", ErrBirthTimeUnsupported.Error())
 	}
 
+	for _, message := range reader.skippedBlockSummary() {
+		u.Logger.Warning(message)
+	}
+
+	u.errorLock.Lock()
+	defer u.errorLock.Unlock()
+	return u.error
+}
+
+// Deals with the start of a file whose path is already being extracted,
+// according to the Duplicates policy; c is the channel of the file that was
+// already started.  With DuplicateRename, b's path is changed to the name the
+// new file is to be extracted under.
+func (u *Unarchiver) handleDuplicate(b *block, c chan block, fileOutputChan map[string]chan block) error {
+	switch u.Duplicates {
+	case DuplicateRename:
+		c <- block{filePath: b.filePath, blockType: blockTypeEndOfFile, incomplete: true}
+		close(c)
+		newPath := duplicateName(b.filePath, fileOutputChan)
+		u.lossWarning("File started twice; the first copy may be incomplete, and the second is extracted as", newPath)
+		b.filePath = newPath
+	case DuplicateLastWins:
+		// Closing the channel before the end of file block abandons the
+		// file.
+		close(c)
+		u.lossWarning("File started twice; extracting only the second copy:", b.filePath)
+	default:
+		return fmt.Errorf("%w: %s", ErrDuplicateFile, b.filePath)
+	}
+	return nil
+}
+
+// Returns the first of filePath.1, filePath.2, ... that isn't already being
+// extracted, and doesn't already exist.
+func duplicateName(filePath string, fileOutputChan map[string]chan block) string {
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s.%d", filePath, i)
+		if _, ok := fileOutputChan[candidate]; ok {
+			continue
+		}
+		if _, err := os.Lstat(candidate); err == nil {
+			continue
+		}
+		return candidate
+	}
+}
+
+// Stops reading an archive that can't be read any further, keeping the files
+// that were partly extracted.  Returns the error for Run.
+func (u *Unarchiver) salvage(readErr error, fileOutputChan map[string]chan block, workInProgress *sync.WaitGroup) error {
+	u.Logger.Warning("Archive read error; salvaging what was extracted:", readErr.Error())
+	var incomplete []string
+	for filePath, c := range fileOutputChan {
+		c <- block{filePath: filePath, blockType: blockTypeEndOfFile, incomplete: true}
+		close(c)
+		delete(fileOutputChan, filePath)
+		incomplete = append(incomplete, filePath)
+	}
 	workInProgress.Wait()
 
+	sort.Strings(incomplete)
+	for _, filePath := range incomplete {
+		u.Logger.Warning("Incomplete file:", filePath)
+	}
+
+	u.errorLock.Lock()
+	defer u.errorLock.Unlock()
+	if u.error != nil {
+		return u.error
+	}
+	return fmt.Errorf("%w (%d incomplete files): %s", ErrSalvaged, len(incomplete), readErr)
+}
+
+// Recreates a FIFO, device, or socket.
+func (u *Unarchiver) restoreSpecial(b block) {
+	mode := b.mode
+	if u.IgnorePerms {
+		mode = mode&^os.ModePerm | 0644
+	}
+	err := makeSpecial(b.filePath, mode, b.major, b.minor)
+	if err != nil {
+		u.lossWarning("Special file create error:", err.Error())
+		return
+	}
+	if !u.IgnoreOwners {
+		err = os.Lchown(b.filePath, b.uid, b.gid)
+		if err != nil {
+			u.lossWarning("Unable to chown file to", b.uid, "/", b.gid, ":", err.Error())
+		}
+	}
+	if !u.IgnorePerms {
+		// mknod's mode is subject to the umask.
+		err = os.Chmod(b.filePath, mode.Perm())
+		if err != nil {
+			u.lossWarning("Unable to chmod file to", mode, ":", err.Error())
+		}
+	}
+}
+
+// A symbolic link that's created once everything else has been extracted, so
+// that no file is written through it, to wherever it points.
+type pendingSymlink struct {
+	block   block
+	modTime time.Time
+}
+
+// Recreates a symbolic link, replacing whatever is at its path if the
+// Overwrite policy allows it.
+func (u *Unarchiver) restoreSymlink(b block, modTime time.Time) {
+	if !u.shouldOverwrite(b.filePath, modTime) {
+		return
+	}
+	tempPath, err := createTempSymlink(b.linkTarget, b.filePath)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(b.filePath), 0777)
+		if err == nil {
+			tempPath, err = createTempSymlink(b.linkTarget, b.filePath)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tempPath, b.filePath)
+		if err != nil {
+			os.Remove(tempPath)
+		}
+	}
+	if err != nil {
+		u.lossWarning("Symbolic link create error:", err.Error())
+		return
+	}
+	u.entryChanged(b.filePath)
+	if !u.IgnoreOwners {
+		err = os.Lchown(b.filePath, b.uid, b.gid)
+		if err != nil {
+			u.lossWarning("Unable to chown symbolic link to", b.uid, "/", b.gid, ":", err.Error())
+		}
+	}
+}
+
+// With FsyncDirs, records that the directory entry for filePath was created
+// or replaced, so that the directory it's in is fsynced at the end.
+func (u *Unarchiver) entryChanged(filePath string) {
+	if !u.FsyncDirs {
+		return
+	}
+	u.changedDirsLock.Lock()
+	defer u.changedDirsLock.Unlock()
+	if u.changedDirs == nil {
+		u.changedDirs = make(map[string]bool)
+	}
+	u.changedDirs[filepath.Dir(filePath)] = true
+}
+
+// Fsyncs the directories that entries were created or replaced in.
+func (u *Unarchiver) syncChangedDirs() {
+	u.changedDirsLock.Lock()
+	defer u.changedDirsLock.Unlock()
+	var directories []string
+	for directory := range u.changedDirs {
+		directories = append(directories, directory)
+	}
+	sort.Strings(directories)
+	for _, directory := range directories {
+		file, err := os.Open(directory)
+		if err == nil {
+			err = file.Sync()
+			file.Close()
+		}
+		if err != nil {
+			u.lossWarning("Directory sync error:", err.Error())
+		}
+	}
+	u.changedDirs = nil
+}
+
+// Returns the path that the archived path filePath is extracted to.
+func (u *Unarchiver) outputPath(filePath string) string {
+	if !u.AbsolutePaths {
+		filePath = RelativePath(filePath)
+	} else if filepath.IsAbs(filePath) {
+		return filePath
+	}
+	if u.OutputPath == "" {
+		return filePath
+	}
+	return filepath.Join(u.OutputPath, filePath)
+}
+
+// Returns the archived path of a file being extracted to filePath, relative
+// to OutputPath.
+func (u *Unarchiver) archivedPath(filePath string) string {
+	if u.OutputPath == "" {
+		return filePath
+	}
+	if relative, err := filepath.Rel(u.OutputPath, filePath); err == nil {
+		return relative
+	}
+	return filePath
+}
+
+// Records the archive's ID, and with CheckChain, checks that it's based on
+// ChainParent.
+func (u *Unarchiver) readArchiveInfo(info fsProperties) error {
+	u.archiveId = nil
+	if id, err := hex.DecodeString(info[infoArchiveId]); err == nil && len(id) > 0 {
+		u.archiveId = id
+	}
+	if !u.CheckChain {
+		return nil
+	}
+	parentId, _ := hex.DecodeString(info[infoParentId])
+	switch {
+	case u.archiveId == nil:
+		return fmt.Errorf("%w: it has no archive ID", ErrBrokenChain)
+	case len(u.ChainParent) == 0 && len(parentId) > 0:
+		return fmt.Errorf("%w: it's an incremental archive, based on %x", ErrBrokenChain, parentId)
+	case len(u.ChainParent) > 0 && !bytes.Equal(parentId, u.ChainParent):
+		if len(parentId) == 0 {
+			return fmt.Errorf("%w: it's a full archive", ErrBrokenChain)
+		}
+		return fmt.Errorf("%w: it's based on %x, not %x", ErrBrokenChain, parentId, u.ChainParent)
+	}
 	return nil
 }
 
-func (u *Unarchiver) writeFile(blockSource chan block, workInProgress *sync.WaitGroup) {
+// Warns up front about any way in which the destination filesystem can't
+// represent everything the source filesystem could.
+func (u *Unarchiver) checkSourceProperties(source fsProperties) {
+	destination := u.OutputPath
+	if fi, err := os.Stat(destination); err != nil || !fi.IsDir() {
+		destination = "."
+	}
+	for _, message := range fidelityDifferences(source, destinationProperties(destination)) {
+		u.Logger.Warning(message)
+	}
+}
+
+// Logs a problem that means the extracted files won't be a faithful copy of
+// the archive.  In Strict mode, this also causes the run to fail.
+func (u *Unarchiver) lossWarning(v ...interface{}) {
+	u.Logger.Warning(v...)
+	if u.Strict {
+		u.errorLock.Lock()
+		if u.error == nil {
+			u.error = fmt.Errorf("%w: %s", ErrStrict, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+		}
+		u.errorLock.Unlock()
+	}
+}
+
+// Returns true if the file at filePath, which was archived with the
+// modification time modTime, should be extracted over whatever is already
+// there, according to the Overwrite policy.
+func (u *Unarchiver) shouldOverwrite(filePath string, modTime time.Time) bool {
+	if u.Overwrite == OverwriteAlways {
+		return true
+	}
+	existing, err := os.Lstat(filePath)
+	if err != nil {
+		return true
+	}
+	switch u.Overwrite {
+	case OverwriteOlder:
+		if !modTime.IsZero() && existing.ModTime().Before(modTime) {
+			return true
+		}
+		u.Logger.Verbose("skipping file that's newer than the archived one", filePath)
+	case OverwriteError:
+		u.errorLock.Lock()
+		if u.error == nil {
+			u.error = fmt.Errorf("%w: %s", ErrFileExists, filePath)
+		}
+		u.errorLock.Unlock()
+	default:
+		u.Logger.Verbose("skipping existing file", filePath)
+	}
+	return false
+}
+
+func (u *Unarchiver) writeFile(blockSource chan block, modTime, birthTime time.Time, attributes fileAttributes, workInProgress *sync.WaitGroup) {
 	var file *os.File = nil
+	var filePath string
+	var tempPath string
+	var inPlace *changedBlockWriter
 	var bufferedFile *bufio.Writer
+	var fileHash hash.Hash
+	var counter *countingWriter
+	var output io.Writer
+	var finishTransforms func(error) error
+	var writeFailed bool
+	var startTime time.Time
+	var archivePath string
 	for block := range blockSource {
 		if block.blockType == blockTypeStartOfFile {
-			u.Logger.Verbose(block.filePath)
+			// Blocks after this one may carry the file's path as it was
+			// archived, rather than the one it's being extracted to.
+			filePath = block.filePath
+			u.Logger.Verbose(filePath)
 
 			if u.DryRun {
 				continue
 			}
 
-			tmp, err := os.Create(block.filePath)
-			if err != nil {
-				u.Logger.Warning("File create error:", err.Error())
+			if u.Journal != nil && u.Journal.completed(block.filePath) {
+				u.Logger.Verbose("skipping already extracted file", block.filePath)
+				file = nil
+				continue
+			}
+			if !u.shouldOverwrite(block.filePath, modTime) {
 				file = nil
 				continue
 			}
-			file = tmp
-			bufferedFile = bufio.NewWriter(file)
+
+			var err error
+			var existing *os.File
+			if u.DiffWrite {
+				existing = openForDiffWrite(block.filePath)
+			}
+			if existing != nil {
+				file = existing
+				inPlace = &changedBlockWriter{file: file, written: &u.diffWritten, unchanged: &u.diffUnchanged}
+				tempPath = block.filePath
+				bufferedFile = bufio.NewWriter(inPlace)
+			} else {
+				file, err = createTempFile(block.filePath)
+				if os.IsNotExist(err) {
+					// Archives of single files have no entries
+					// for the directories they're in.
+					err = os.MkdirAll(filepath.Dir(block.filePath), 0777)
+					if err == nil {
+						file, err = createTempFile(block.filePath)
+					}
+				}
+				if err != nil {
+					u.lossWarning("File create error:", err.Error())
+					file = nil
+					continue
+				}
+				inPlace = nil
+				tempPath = file.Name()
+				bufferedFile = bufio.NewWriter(file)
+			}
+			fileHash = sha256.New()
+			counter = &countingWriter{bufferedFile, 0}
+			output = io.MultiWriter(counter, fileHash)
+			finishTransforms = nil
+			writeFailed = false
+			startTime = time.Now()
+
+			archivePath = u.archivedPath(block.filePath)
+			if transforms := matchingTransforms(u.Transforms, archivePath); len(transforms) > 0 {
+				output, finishTransforms, err = startTransforms(transforms, archivePath, output)
+				if err != nil {
+					u.lossWarning("Transform error; file skipped:", block.filePath, err.Error())
+					file.Close()
+					removeTempFile(tempPath, inPlace)
+					file = nil
+					continue
+				}
+			}
+			if u.StartHook != nil {
+				u.StartHook(block.filePath)
+			}
 
 			if !u.IgnoreOwners {
 				err = file.Chown(block.uid, block.gid)
 				if err != nil {
-					u.Logger.Warning("Unable to chown file to", block.uid, "/", block.gid, ":", err.Error())
+					u.lossWarning("Unable to chown file to", block.uid, "/", block.gid, ":", err.Error())
 				}
 			}
 			if !u.IgnorePerms {
 				err = file.Chmod(block.mode)
 				if err != nil {
-					u.Logger.Warning("Unable to chmod file to", block.mode, ":", err.Error())
+					u.lossWarning("Unable to chmod file to", block.mode, ":", err.Error())
 				}
 			}
 		} else if file == nil {
 			// do nothing; file couldn't be opened for write
+		} else if block.blockType == blockTypeRestartFile {
+			// Start the file over, discarding what was written of it.
+			if finishTransforms != nil {
+				finishTransforms(ErrFileRestarted)
+			}
+			var err error
+			if inPlace != nil {
+				// What's already there is compared with the file
+				// again from the start.
+				bufferedFile.Reset(inPlace)
+				inPlace.offset = 0
+			} else {
+				bufferedFile.Reset(file)
+				_, err = file.Seek(0, io.SeekStart)
+				if err == nil {
+					err = file.Truncate(0)
+				}
+			}
+			if err != nil && !writeFailed {
+				u.lossWarning("File write error:", err.Error())
+				writeFailed = true
+			}
+			fileHash.Reset()
+			counter.count = 0
+			output = io.MultiWriter(counter, fileHash)
+			if finishTransforms != nil {
+				output, finishTransforms, err = startTransforms(u.Transforms, archivePath, output)
+				if err != nil {
+					u.lossWarning("Transform error; file skipped:", filePath, err.Error())
+					file.Close()
+					removeTempFile(tempPath, inPlace)
+					file = nil
+				}
+			}
 		} else if block.blockType == blockTypeEndOfFile {
-			bufferedFile.Flush()
-			file.Close()
+			if finishTransforms != nil {
+				err := finishTransforms(nil)
+				if err != nil {
+					u.lossWarning("Transform error:", filePath, err.Error())
+					writeFailed = true
+				}
+			}
+			err := bufferedFile.Flush()
+			if err == nil && inPlace != nil {
+				// Cut off whatever the existing file had past the
+				// end of the archived one.
+				err = file.Truncate(inPlace.offset)
+			}
+			if err != nil {
+				u.lossWarning("File write error:", err.Error())
+				writeFailed = true
+			}
+			if !writeFailed {
+				// Writing the file clears its capabilities, so they're
+				// set once it's all written.
+				err = restoreXattrs(tempPath, attributes)
+				if err != nil {
+					u.lossWarning("Unable to restore capabilities:", err.Error())
+				}
+			}
+			if u.Fsync && !writeFailed {
+				err = file.Sync()
+				if err != nil {
+					u.lossWarning("File sync error:", err.Error())
+					writeFailed = true
+				}
+			}
+			err = file.Close()
+			if err != nil {
+				u.lossWarning("File close error:", err.Error())
+				writeFailed = true
+			}
 			file = nil
-		} else {
-			_, err := bufferedFile.Write(block.buffer[:block.numBytes])
+
+			if writeFailed {
+				removeTempFile(tempPath, inPlace)
+				continue
+			}
+			if inPlace == nil {
+				err = os.Rename(tempPath, filePath)
+				if err != nil {
+					u.lossWarning("File rename error:", err.Error())
+					os.Remove(tempPath)
+					continue
+				}
+				u.entryChanged(filePath)
+			}
+			u.restoreBirthTime(filePath, birthTime)
+			err = restoreFileFlags(filePath, attributes)
 			if err != nil {
-				u.Logger.Warning("File write error:", err.Error())
+				u.lossWarning("Unable to restore file flags:", err.Error())
+			}
+
+			if block.incomplete {
+				// Neither journal nor hook should take this for a
+				// completely restored file.
+				continue
+			}
+			fileSize := counter.count
+			if u.Journal != nil {
+				err = u.Journal.record(filePath, fileSize, fileHash.Sum(nil))
+				if err != nil {
+					u.Logger.Warning("Journal write error:", err.Error())
+				}
+			}
+			if u.RestoreHook != nil {
+				u.RestoreHook(RestoredFile{filePath, fileHash.Sum(nil), fileSize, time.Since(startTime)})
+			}
+		} else {
+			data := block.buffer[:block.numBytes]
+			_, err := output.Write(data)
+			if err != nil && !writeFailed {
+				u.lossWarning("File write error:", err.Error())
+				writeFailed = true
 			}
 		}
 	}
+	if file != nil {
+		// The archive ended, or extraction was stopped, before the end of
+		// the file.
+		if finishTransforms != nil {
+			finishTransforms(io.ErrUnexpectedEOF)
+		}
+		file.Close()
+		removeTempFile(tempPath, inPlace)
+	}
 	workInProgress.Done()
 }
+
+// Removes a file that wasn't completely written, unless it was being written
+// in place by DiffWrite, in which case it's an existing file and is left
+// partly updated.
+func removeTempFile(tempPath string, inPlace *changedBlockWriter) {
+	if inPlace == nil {
+		os.Remove(tempPath)
+	}
+}
+
+// Creates a symbolic link to target under a temporary name next to filePath,
+// like createTempFile, and returns its path.
+func createTempSymlink(target, filePath string) (string, error) {
+	dir, name := filepath.Split(filePath)
+	for {
+		tempPath := filepath.Join(dir, fmt.Sprintf(".%s.fa-%d", name, rand.Int63()))
+		err := os.Symlink(target, tempPath)
+		if os.IsExist(err) {
+			continue
+		}
+		return tempPath, err
+	}
+}
+
+// Creates a new, uniquely named file in the same directory as filePath, to be
+// renamed over filePath once it has been completely written.  That way an
+// interrupted extraction never leaves a truncated file under the real name.
+func createTempFile(filePath string) (*os.File, error) {
+	dir, name := filepath.Split(filePath)
+	for {
+		tempPath := filepath.Join(dir, fmt.Sprintf(".%s.fa-%d", name, rand.Int63()))
+		file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		return file, err
+	}
+}
@@ -11,7 +11,7 @@ func (a *Archiver) getModeOwnership(file *os.File) (int, int, os.FileMode) {
 	var mode os.FileMode = 0
 	fi, err := file.Stat()
 	if err != nil {
-		a.Logger.Warning("file stat error; uid/gid/mode will be incorrect:", err.Error())
+		a.lossWarning("file stat error; uid/gid/mode will be incorrect:", err.Error())
 	} else {
 		mode = fi.Mode()
 		stat_t := fi.Sys().(*syscall.Stat_t)
@@ -19,8 +19,42 @@ func (a *Archiver) getModeOwnership(file *os.File) (int, int, os.FileMode) {
 			uid = int(stat_t.Uid)
 			gid = int(stat_t.Gid)
 		} else {
-			a.Logger.Warning("unable to find file uid/gid")
+			a.lossWarning("unable to find file uid/gid")
 		}
 	}
 	return uid, gid, mode
 }
+
+// Returns an identifier for the file that fileInfo describes, which is the
+// same whichever path the file was reached by.
+func fileIdentity(fileInfo os.FileInfo) (fileId, bool) {
+	stat_t, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok || stat_t == nil {
+		return fileId{}, false
+	}
+	return fileId{uint64(stat_t.Dev), uint64(stat_t.Ino)}, true
+}
+
+// Returns the user and group IDs of the file that fileInfo describes.
+func fileOwner(fileInfo os.FileInfo) (uid int, gid int, ok bool) {
+	stat_t, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok || stat_t == nil {
+		return 0, 0, false
+	}
+	return int(stat_t.Uid), int(stat_t.Gid), true
+}
+
+// Returns the owner and, for a device, the device number of a special file.
+func (a *Archiver) getSpecialInfo(fileInfo os.FileInfo) (uid int, gid int, major uint32, minor uint32) {
+	stat_t, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok || stat_t == nil {
+		a.lossWarning("unable to find file uid/gid")
+		return
+	}
+	uid = int(stat_t.Uid)
+	gid = int(stat_t.Gid)
+	if fileInfo.Mode()&os.ModeDevice != 0 {
+		major, minor = splitDevice(uint64(stat_t.Rdev))
+	}
+	return
+}
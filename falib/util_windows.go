@@ -5,9 +5,30 @@ import "os"
 func (a *Archiver) getModeOwnership(file *os.File) (uid int, gid int, mode os.FileMode) {
 	fi, err := file.Stat()
 	if err != nil {
-		a.Logger.Warning("file stat error; uid/gid/mode will be incorrect:", err.Error())
+		a.lossWarning("file stat error; uid/gid/mode will be incorrect:", err.Error())
 	} else {
 		mode = fi.Mode()
+		if a.Strict {
+			a.lossWarning("unable to capture file uid/gid on this platform")
+		}
+	}
+	return
+}
+
+// File identities aren't available on this platform, so --dereference can't
+// detect directories that it has already visited.
+func fileIdentity(fileInfo os.FileInfo) (fileId, bool) {
+	return fileId{}, false
+}
+
+// Files have no uid or gid on this platform.
+func fileOwner(fileInfo os.FileInfo) (uid int, gid int, ok bool) {
+	return 0, 0, false
+}
+
+func (a *Archiver) getSpecialInfo(fileInfo os.FileInfo) (uid int, gid int, major uint32, minor uint32) {
+	if a.Strict {
+		a.lossWarning("unable to capture file uid/gid on this platform")
 	}
 	return
 }
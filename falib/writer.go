@@ -0,0 +1,197 @@
+package falib
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"os"
+)
+
+// Writes an archive one entry at a time, much like archive/tar's Writer: each
+// entry is started with WriteHeader, and a file's contents are then written
+// with Write.  Whole directory trees can be added with AddDirectoryTree, which
+// reads them with the same concurrent pipeline as an Archiver.
+//
+// The fields may be changed until the first entry is written.
+type Writer struct {
+	BlockSize     uint16
+	Align         int
+	RunLength     bool
+	Compress      bool
+	FormatVersion int
+	Logger        Logger
+
+	output io.Writer
+	stream *archiveStream
+	inFile bool
+	path   string
+
+	// With Compress, each block is compressed into compressBuffer.
+	compressor     *flate.Writer
+	compressBuffer bytes.Buffer
+}
+
+func NewWriter(output io.Writer) *Writer {
+	return &Writer{BlockSize: 4096, output: output}
+}
+
+// Writes the archive header, the first time anything is written.
+func (w *Writer) start() error {
+	if w.stream != nil {
+		return nil
+	}
+	if w.Align < 0 || w.Align > maxAlign {
+		return ErrInvalidAlignment
+	}
+	if w.FormatVersion < 0 || w.FormatVersion > 2 {
+		return ErrUnsupportedVersion
+	}
+	if w.BlockSize == 0 {
+		w.BlockSize = 4096
+	}
+	if w.Compress {
+		w.compressor, _ = flate.NewWriter(&w.compressBuffer, flate.DefaultCompression)
+	}
+	w.stream = newArchiveStream(w.output, w.Align)
+	w.stream.runLength = w.RunLength
+	if w.FormatVersion != 0 {
+		w.stream.version = w.FormatVersion
+	}
+	err := w.stream.writeHeader()
+	if err == nil {
+		err = w.stream.writeBlock(archiveInfoBlock(w.BlockSize, w.Compress, false, w.RunLength, w.Align, false, nil))
+	}
+	return err
+}
+
+// Ends the file being written, if there is one.
+func (w *Writer) endFile() error {
+	if !w.inFile {
+		return nil
+	}
+	w.inFile = false
+	return w.stream.writeBlock(block{filePath: w.path, blockType: blockTypeEndOfFile})
+}
+
+// Starts a new entry, finishing the current one.  Regular files,
+// directories, special files, symbolic links, and deletions are supported.
+func (w *Writer) WriteHeader(entry *Entry) error {
+	err := w.start()
+	if err == nil {
+		err = w.endFile()
+	}
+	if err != nil {
+		return err
+	}
+
+	b := block{filePath: entry.Path, uid: entry.Uid, gid: entry.Gid, mode: entry.Mode}
+	switch {
+	case entry.Deleted:
+		b = block{filePath: entry.Path, blockType: blockTypeDelete}
+	case entry.Mode.IsDir():
+		b.blockType = blockTypeDirectory
+	case entry.Mode.IsRegular():
+		b.blockType = blockTypeStartOfFile
+		w.inFile = true
+		w.path = entry.Path
+	case entry.Mode&specialFileModes != 0:
+		b.blockType = blockTypeSpecial
+		b.major = entry.Major
+		b.minor = entry.Minor
+	case entry.Mode&os.ModeSymlink != 0:
+		b.blockType = blockTypeSymlink
+		b.linkTarget = entry.Linkname
+	default:
+		return ErrUnsupportedEntry
+	}
+
+	if !entry.ModTime.IsZero() && !entry.Deleted {
+		times := timesBlock(entry.Path, entry.ModTime, 0)
+		if !entry.BirthTime.IsZero() {
+			times = addBirthTime(times, entry.BirthTime)
+		}
+		err = w.stream.writeBlock(times)
+		if err != nil {
+			return err
+		}
+	}
+	if len(entry.attributes) > 0 && !entry.Deleted {
+		err = w.stream.writeBlock(block{filePath: entry.Path, blockType: blockTypeAttributes, buffer: entry.attributes})
+		if err != nil {
+			return err
+		}
+	}
+	return w.stream.writeBlock(b)
+}
+
+// Writes data to the current file entry.
+func (w *Writer) Write(p []byte) (int, error) {
+	if !w.inFile {
+		return 0, ErrNoFileEntry
+	}
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > int(w.BlockSize) {
+			n = int(w.BlockSize)
+		}
+		// The block may outlive this call (to detect repeats), so it needs
+		// its own copy of the data.
+		buffer := make([]byte, n)
+		copy(buffer, p)
+		b := block{filePath: w.path, numBytes: uint16(n), buffer: buffer, blockType: blockTypeData}
+		if w.compressor != nil {
+			w.compressBuffer.Reset()
+			w.compressor.Reset(&w.compressBuffer)
+			w.compressor.Write(buffer)
+			w.compressor.Close()
+			if w.compressBuffer.Len() < n {
+				b.compressed = append([]byte(nil), w.compressBuffer.Bytes()...)
+			}
+		}
+		err := w.stream.writeBlock(b)
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Adds a directory and everything in it to the archive, reading files
+// concurrently just as an Archiver does.  The current entry is finished
+// first.
+func (w *Writer) AddDirectoryTree(directoryPath string) error {
+	err := w.start()
+	if err == nil {
+		err = w.endFile()
+	}
+	if err != nil {
+		return err
+	}
+
+	archiver := NewArchiver(nil)
+	archiver.BlockSize = w.BlockSize
+	archiver.Compress = w.Compress
+	archiver.Logger = w.Logger
+	if archiver.Logger == nil {
+		archiver.Logger = nullLogger{}
+	}
+	archiver.stream = w.stream
+	archiver.AddDir(directoryPath)
+	return archiver.Run()
+}
+
+// Finishes the current entry and the archive, writing its final checksum.
+// The underlying writer is not closed.
+func (w *Writer) Close() error {
+	err := w.start()
+	if err == nil {
+		err = w.endFile()
+	}
+	if err == nil {
+		err = w.stream.finish()
+	}
+	return err
+}
@@ -0,0 +1,12 @@
+package falib
+
+import "syscall"
+
+// Returns whether the filesystem holding path supports extended attributes.
+func xattrsSupported(path string) (bool, bool) {
+	_, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP {
+		return false, true
+	}
+	return err == nil, err == nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package falib
+
+// Returns whether the filesystem holding path supports extended attributes.
+func xattrsSupported(path string) (bool, bool) {
+	return false, false
+}
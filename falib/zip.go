@@ -0,0 +1,163 @@
+package falib
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Converts the zip file read from input, which is size bytes long, into an
+// archive of the same files and directories written to output, so that it
+// can be extracted, listed, or verified like any other archive.  Up to
+// readers files are decompressed at once, with their blocks interleaved as an
+// Archiver's are, so that an Unarchiver writes them out in parallel.
+//
+// A zip file doesn't record owners, so the files are given to the user
+// running the conversion.  Symbolic links can't be archived, and are left out
+// with a warning to logger.
+func ConvertZip(input io.ReaderAt, size int64, output io.Writer, readers int, logger Logger) error {
+	zipReader, err := zip.NewReader(input, size)
+	if err != nil {
+		return err
+	}
+	if readers < 1 {
+		readers = 1
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid < 0 || gid < 0 {
+		uid, gid = 0, 0
+	}
+
+	stream := newArchiveStream(output, 0)
+	err = stream.writeHeader()
+	if err == nil {
+		err = stream.writeBlock(archiveInfoBlock(zipBlockSize, false, false, false, 0, false, nil))
+	}
+	if err != nil {
+		return err
+	}
+
+	// Directories are written first, so that they're there before
+	// anything is extracted into them.
+	var files []*zip.File
+	for _, f := range zipReader.File {
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			filePath := strings.TrimSuffix(f.Name, "/")
+			err = stream.writeBlock(timesBlock(filePath, f.Modified, 0))
+			if err == nil {
+				err = stream.writeBlock(block{filePath: filePath, blockType: blockTypeDirectory, uid: uid, gid: gid, mode: mode})
+			}
+			if err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			files = append(files, f)
+		default:
+			logger.Warning("skipping", f.Name, "in zip file: only files and directories can be archived")
+		}
+	}
+
+	blocks := make(chan block, readers*4)
+	queue := make(chan *zip.File)
+	failed := make(chan error, readers)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	abort := func() { stopOnce.Do(func() { close(stop) }) }
+	var reading sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		reading.Add(1)
+		go func() {
+			defer reading.Done()
+			for f := range queue {
+				err := readZipFile(f, uid, gid, blocks, stop)
+				if err != nil {
+					failed <- err
+					abort()
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(queue)
+		for _, f := range files {
+			select {
+			case queue <- f:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	go func() {
+		reading.Wait()
+		close(blocks)
+	}()
+
+	for b := range blocks {
+		if err == nil {
+			err = stream.writeBlock(b)
+			if err != nil {
+				abort()
+			}
+		}
+	}
+	select {
+	case readErr := <-failed:
+		if err == nil {
+			err = readErr
+		}
+	default:
+	}
+	if err != nil {
+		return err
+	}
+	return stream.finish()
+}
+
+// The block size of a converted zip file.
+const zipBlockSize = 32768
+
+// Sends the blocks of a file in a zip file to blocks, until stop is closed.
+func readZipFile(f *zip.File, uid, gid int, blocks chan<- block, stop <-chan struct{}) error {
+	send := func(b block) bool {
+		select {
+		case blocks <- b:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	contents, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+	if !send(timesBlock(f.Name, f.Modified, 0)) ||
+		!send(block{filePath: f.Name, blockType: blockTypeStartOfFile, uid: uid, gid: gid, mode: f.Mode()}) {
+		return nil
+	}
+	for err == nil {
+		// Each block gets a buffer of its own, since it's held until it's
+		// written.
+		buffer := make([]byte, zipBlockSize)
+		n := 0
+		for n < len(buffer) && err == nil {
+			var read int
+			read, err = contents.Read(buffer[n:])
+			n += read
+		}
+		if n > 0 && !send(block{filePath: f.Name, blockType: blockTypeData, numBytes: uint16(n), buffer: buffer}) {
+			return nil
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+	send(block{filePath: f.Name, blockType: blockTypeEndOfFile})
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The value of --fsync: which of the archive, extracted files, and the
+// directories they're extracted into are flushed to stable storage.  Values
+// can be combined with commas (eg. files,dirs).
+type fsyncPolicy struct {
+	archive bool
+	files   bool
+	dirs    bool
+}
+
+func (p *fsyncPolicy) String() string {
+	if p == nil {
+		return "none"
+	}
+	var names []string
+	if p.archive {
+		names = append(names, "archive")
+	}
+	if p.files {
+		names = append(names, "files")
+	}
+	if p.dirs {
+		names = append(names, "dirs")
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+func (p *fsyncPolicy) Set(value string) error {
+	*p = fsyncPolicy{}
+	for _, name := range strings.Split(value, ",") {
+		switch strings.TrimSpace(name) {
+		case "archive":
+			p.archive = true
+		case "files", "true":
+			p.files = true
+		case "dirs":
+			p.dirs = true
+		case "all":
+			p.archive, p.files, p.dirs = true, true, true
+		case "none", "false":
+		default:
+			return fmt.Errorf("%q isn't one of archive, files, dirs, all, or none", name)
+		}
+	}
+	return nil
+}
+
+// A bare --fsync, without a value, means files, as it did before it took one.
+func (p *fsyncPolicy) IsBoolFlag() bool {
+	return true
+}
+
+// Returns a usage error if the last flag in args is a bare --fsync and the
+// first of the remaining arguments, rest, is a policy: the flag package takes
+// --fsync archive to be --fsync followed by a source called archive.
+func checkBareFsync(fs *flag.FlagSet, args, rest []string) error {
+	last, lastValue := "", ""
+	visitArgFlags(fs, args, func(name, value string) {
+		last, lastValue = name, value
+	})
+	if last != "fsync" || lastValue != "" || len(rest) == 0 {
+		return nil
+	}
+	if (&fsyncPolicy{}).Set(rest[0]) != nil {
+		return nil
+	}
+	return fmt.Errorf("give the policy with an equals sign, as in --fsync=%s; a bare --fsync means files", rest[0])
+}
+
+// Fsyncs output if it's a regular file; pipes, terminals, and uploads are
+// left alone.
+func syncFile(output io.Writer) error {
+	file, ok := output.(*os.File)
+	if !ok {
+		return nil
+	}
+	fileInfo, err := file.Stat()
+	if err != nil || !fileInfo.Mode().IsRegular() {
+		return err
+	}
+	return file.Sync()
+}
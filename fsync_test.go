@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestFsyncPolicy(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected string
+	}{
+		{"true", "files"},
+		{"false", "none"},
+		{"none", "none"},
+		{"archive", "archive"},
+		{"files,dirs", "files,dirs"},
+		{"dirs, archive", "archive,dirs"},
+		{"all", "archive,files,dirs"},
+	} {
+		var policy fsyncPolicy
+		err := policy.Set(test.value)
+		if err != nil {
+			t.Errorf("%s: %v", test.value, err)
+		} else if policy.String() != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.value, policy.String(), test.expected)
+		}
+	}
+
+	var policy fsyncPolicy
+	err := policy.Set("files,bogus")
+	if err == nil || !strings.Contains(err.Error(), `"bogus"`) ||
+		!strings.Contains(err.Error(), "archive, files, dirs, all, or none") {
+		t.Errorf("got %v, expected an error listing the policies", err)
+	}
+}
+
+// Checks that --fsync archive, with a space, isn't taken as a bare --fsync
+// and a source called archive.
+func TestBareFsync(t *testing.T) {
+	for _, test := range []struct {
+		args  string
+		valid bool
+	}{
+		{"--fsync dir", true},
+		{"--fsync=archive dir", true},
+		{"--fsync -v dir", true},
+		{"--fsync", true},
+		{"-v dir archive", true},
+		{"--fsync archive", false},
+		{"--fsync files,dirs dir", false},
+		{"-v --fsync all dir", false},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Bool("v", false, "")
+		fs.Var(&fsyncPolicy{}, "fsync", "")
+		args := strings.Fields(test.args)
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		err := checkBareFsync(fs, args, fs.Args())
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.args, err)
+		} else if !test.valid && (err == nil || !strings.Contains(err.Error(), "--fsync="+fs.Arg(0))) {
+			t.Errorf("%s: got %v, expected an error suggesting --fsync=%s", test.args, err, fs.Arg(0))
+		}
+	}
+}
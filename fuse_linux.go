@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The kernel's FUSE protocol, spoken directly over /dev/fuse: version 7.26,
+// which every kernel since 4.9 supports, and only the requests a read-only
+// filesystem needs.  See linux/fuse.h for the structures below.
+const (
+	fuseKernelVersion = 7
+	fuseMinorVersion  = 26
+	fuseMaxWrite      = 128 * 1024
+	fuseBufferSize    = fuseMaxWrite + 4096
+
+	fuseRootId     = 1
+	fuseAsyncRead  = 1 << 0
+	fuseKeepCache  = 1 << 1
+	fuseCacheValid = 3600
+
+	fuseLookup      = 1
+	fuseForget      = 2
+	fuseGetattr     = 3
+	fuseOpen        = 14
+	fuseRead        = 15
+	fuseStatfs      = 17
+	fuseRelease     = 18
+	fuseFlush       = 25
+	fuseInit        = 26
+	fuseOpendir     = 27
+	fuseReaddir     = 28
+	fuseReleasedir  = 29
+	fuseInterrupt   = 36
+	fuseDestroy     = 38
+	fuseBatchForget = 42
+)
+
+type fuseInHeader struct {
+	Len     uint32
+	Opcode  uint32
+	Unique  uint64
+	Nodeid  uint64
+	Uid     uint32
+	Gid     uint32
+	Pid     uint32
+	Padding uint32
+}
+
+type fuseOutHeader struct {
+	Len    uint32
+	Error  int32
+	Unique uint64
+}
+
+type fuseInitIn struct {
+	Major        uint32
+	Minor        uint32
+	MaxReadahead uint32
+	Flags        uint32
+}
+
+type fuseInitOut struct {
+	Major               uint32
+	Minor               uint32
+	MaxReadahead        uint32
+	Flags               uint32
+	MaxBackground       uint16
+	CongestionThreshold uint16
+	MaxWrite            uint32
+	TimeGran            uint32
+	Unused              [9]uint32
+}
+
+type fuseAttr struct {
+	Ino       uint64
+	Size      uint64
+	Blocks    uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Nlink     uint32
+	Uid       uint32
+	Gid       uint32
+	Rdev      uint32
+	Blksize   uint32
+	Padding   uint32
+}
+
+type fuseEntryOut struct {
+	Nodeid         uint64
+	Generation     uint64
+	EntryValid     uint64
+	AttrValid      uint64
+	EntryValidNsec uint32
+	AttrValidNsec  uint32
+	Attr           fuseAttr
+}
+
+type fuseAttrOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Dummy         uint32
+	Attr          fuseAttr
+}
+
+type fuseOpenIn struct {
+	Flags  uint32
+	Unused uint32
+}
+
+type fuseOpenOut struct {
+	Fh        uint64
+	OpenFlags uint32
+	Padding   uint32
+}
+
+type fuseReadIn struct {
+	Fh        uint64
+	Offset    uint64
+	Size      uint32
+	ReadFlags uint32
+	LockOwner uint64
+	Flags     uint32
+	Padding   uint32
+}
+
+type fuseDirent struct {
+	Ino     uint64
+	Off     uint64
+	Namelen uint32
+	Type    uint32
+}
+
+type fuseStatfsOut struct {
+	Blocks  uint64
+	Bfree   uint64
+	Bavail  uint64
+	Files   uint64
+	Ffree   uint64
+	Bsize   uint32
+	Namelen uint32
+	Frsize  uint32
+	Padding uint32
+	Spare   [6]uint32
+}
+
+// Returns the bytes of a protocol structure, as the kernel lays it out.
+func fuseBytes(p unsafe.Pointer, size uintptr) []byte {
+	return (*[1 << 20]byte)(p)[:size:size]
+}
+
+// Mounts index at mountPoint, and serves it until it's unmounted, or the run
+// is interrupted.
+func mountArchive(index *falib.Index, mountPoint string, allowOther bool, logger *MultiLevelLogger) error {
+	dev, err := mountFuse(mountPoint, allowOther)
+	if err != nil {
+		return failure(exitError, "Error mounting "+mountPoint+":", err.Error())
+	}
+	defer dev.Close()
+	logger.Verbose("mounted at", mountPoint+"; unmount it, or interrupt, to stop")
+	handleInterrupts(func() {
+		err := unmountFuse(mountPoint)
+		if err != nil {
+			logger.Warning("Error unmounting "+mountPoint+":", err.Error())
+		}
+	})
+
+	err = newFuseServer(dev, index, logger).serve()
+	if err != nil {
+		unmountFuse(mountPoint)
+		return failure(exitError, "Error serving "+mountPoint+":", err.Error())
+	}
+	return nil
+}
+
+// Mounts a FUSE filesystem at mountPoint, and returns the /dev/fuse
+// connection to serve it on.  As root, it's mounted directly; otherwise the
+// fusermount helper does it, and passes the connection back over a socket.
+func mountFuse(mountPoint string, allowOther bool) (*os.File, error) {
+	if os.Geteuid() == 0 {
+		dev, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		options := fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0,default_permissions", dev.Fd())
+		if allowOther {
+			options += ",allow_other"
+		}
+		err = syscall.Mount("fast-archiver", mountPoint, "fuse.fast-archiver", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, options)
+		if err != nil {
+			dev.Close()
+			return nil, err
+		}
+		return dev, nil
+	}
+
+	fusermount, err := findFusermount()
+	if err != nil {
+		return nil, err
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	local := os.NewFile(uintptr(fds[0]), "fusermount")
+	remote := os.NewFile(uintptr(fds[1]), "fusermount")
+	defer local.Close()
+
+	options := "ro,nosuid,nodev,default_permissions,fsname=fast-archiver,subtype=fast-archiver"
+	if allowOther {
+		options += ",allow_other"
+	}
+	cmd := exec.Command(fusermount, "-o", options, "--", mountPoint)
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	remote.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, recvErr := syscall.Recvmsg(int(local.Fd()), buf, oob, 0)
+	err = cmd.Wait()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s", filepath.Base(fusermount), err.Error())
+	} else if recvErr != nil {
+		return nil, recvErr
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(messages) == 0 {
+		return nil, errors.New("fusermount didn't pass back a /dev/fuse connection")
+	}
+	passed, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil || len(passed) == 0 {
+		return nil, errors.New("fusermount didn't pass back a /dev/fuse connection")
+	}
+	syscall.CloseOnExec(passed[0])
+	return os.NewFile(uintptr(passed[0]), "/dev/fuse"), nil
+}
+
+func findFusermount() (string, error) {
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("mounting without root needs fusermount, from the fuse package")
+}
+
+// Unmounts mountPoint, which makes the serving loop return.  If the
+// filesystem is still in use, it's detached, and goes away once it isn't.
+func unmountFuse(mountPoint string) error {
+	if os.Geteuid() == 0 {
+		err := syscall.Unmount(mountPoint, 0)
+		if err == syscall.EBUSY {
+			err = syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+		}
+		return err
+	}
+	fusermount, err := findFusermount()
+	if err != nil {
+		return err
+	}
+	return exec.Command(fusermount, "-u", "-z", "--", mountPoint).Run()
+}
+
+// Serves the files in an index over a FUSE connection.  Inode numbers are
+// handed out as the kernel looks paths up, and are kept for as long as the
+// filesystem is mounted.
+type fuseServer struct {
+	dev    *os.File
+	index  *falib.Index
+	logger *MultiLevelLogger
+
+	lock  sync.Mutex
+	paths []string
+	ids   map[string]uint64
+}
+
+func newFuseServer(dev *os.File, index *falib.Index, logger *MultiLevelLogger) *fuseServer {
+	// Node IDs start at 1, the root.
+	return &fuseServer{dev: dev, index: index, logger: logger, paths: []string{"", "."}, ids: map[string]uint64{".": fuseRootId}}
+}
+
+// Handles requests until the filesystem is unmounted.  Reads are answered
+// concurrently, since each may have to read blocks from the archive.
+func (s *fuseServer) serve() error {
+	var reading sync.WaitGroup
+	defer reading.Wait()
+	buf := make([]byte, fuseBufferSize)
+	for {
+		n, err := syscall.Read(int(s.dev.Fd()), buf)
+		if err == syscall.ENODEV {
+			// Unmounted.
+			return nil
+		} else if err == syscall.EINTR || err == syscall.EAGAIN || err == syscall.ENOENT {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if n < int(unsafe.Sizeof(fuseInHeader{})) {
+			return errors.New("short FUSE request")
+		}
+		header := *(*fuseInHeader)(unsafe.Pointer(&buf[0]))
+		body := buf[unsafe.Sizeof(header):n]
+
+		switch header.Opcode {
+		case fuseRead:
+			in := *(*fuseReadIn)(unsafe.Pointer(&body[0]))
+			reading.Add(1)
+			go func() {
+				defer reading.Done()
+				s.read(header, &in)
+			}()
+		case fuseDestroy:
+			return nil
+		default:
+			s.handle(header, body)
+		}
+	}
+}
+
+func (s *fuseServer) handle(header fuseInHeader, body []byte) {
+	switch header.Opcode {
+	case fuseInit:
+		in := (*fuseInitIn)(unsafe.Pointer(&body[0]))
+		if in.Major != fuseKernelVersion {
+			s.fail(header, syscall.EPROTO)
+			return
+		}
+		out := fuseInitOut{
+			Major:        fuseKernelVersion,
+			Minor:        fuseMinorVersion,
+			MaxReadahead: in.MaxReadahead,
+			Flags:        in.Flags & fuseAsyncRead,
+			MaxWrite:     fuseMaxWrite,
+			TimeGran:     1,
+		}
+		if in.Minor < out.Minor {
+			out.Minor = in.Minor
+		}
+		s.reply(header, fuseBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)))
+
+	case fuseLookup:
+		parent, ok := s.path(header.Nodeid)
+		name := string(body)
+		if end := bytes.IndexByte(body, 0); end >= 0 {
+			name = string(body[:end])
+		}
+		var entry *falib.IndexEntry
+		if ok {
+			entry = s.index.Lookup(filepath.Join(parent, name))
+		}
+		if entry == nil {
+			s.fail(header, syscall.ENOENT)
+			return
+		}
+		out := fuseEntryOut{
+			Nodeid:     s.id(entry.Path),
+			EntryValid: fuseCacheValid,
+			AttrValid:  fuseCacheValid,
+		}
+		out.Attr = s.attributes(out.Nodeid, entry)
+		s.reply(header, fuseBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)))
+
+	case fuseGetattr:
+		entry := s.entry(header.Nodeid)
+		if entry == nil {
+			s.fail(header, syscall.ENOENT)
+			return
+		}
+		out := fuseAttrOut{AttrValid: fuseCacheValid, Attr: s.attributes(header.Nodeid, entry)}
+		s.reply(header, fuseBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)))
+
+	case fuseOpen, fuseOpendir:
+		in := (*fuseOpenIn)(unsafe.Pointer(&body[0]))
+		entry := s.entry(header.Nodeid)
+		if entry == nil {
+			s.fail(header, syscall.ENOENT)
+			return
+		} else if in.Flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+			s.fail(header, syscall.EROFS)
+			return
+		}
+		// The archive doesn't change, so the kernel can keep what it
+		// has cached from one open to the next.
+		out := fuseOpenOut{OpenFlags: fuseKeepCache}
+		s.reply(header, fuseBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)))
+
+	case fuseReaddir:
+		s.readdir(header, (*fuseReadIn)(unsafe.Pointer(&body[0])))
+
+	case fuseStatfs:
+		out := fuseStatfsOut{Bsize: 4096, Frsize: 4096, Namelen: 255}
+		s.reply(header, fuseBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)))
+
+	case fuseRelease, fuseReleasedir, fuseFlush:
+		s.reply(header, nil)
+
+	case fuseForget, fuseBatchForget, fuseInterrupt:
+		// These get no reply.
+
+	default:
+		s.fail(header, syscall.ENOSYS)
+	}
+}
+
+func (s *fuseServer) read(header fuseInHeader, in *fuseReadIn) {
+	entry := s.entry(header.Nodeid)
+	if entry == nil {
+		s.fail(header, syscall.ENOENT)
+		return
+	}
+	buf := make([]byte, in.Size)
+	n, err := s.index.ReadAt(entry, buf, int64(in.Offset))
+	if err != nil && n < len(buf) && int64(in.Offset)+int64(n) < entry.Size {
+		s.logger.Warning("Error reading", entry.Path+":", err.Error())
+		s.fail(header, syscall.EIO)
+		return
+	}
+	s.reply(header, buf[:n])
+}
+
+// Lists a directory, starting at the in.Offset'th entry, with as many entries
+// as fit in in.Size bytes; the offset of each entry is that of the next one.
+func (s *fuseServer) readdir(header fuseInHeader, in *fuseReadIn) {
+	dirPath, ok := s.path(header.Nodeid)
+	if !ok {
+		s.fail(header, syscall.ENOENT)
+		return
+	}
+	names := append([]string{".", ".."}, s.index.ReadDir(dirPath)...)
+	var out []byte
+	for i := int(in.Offset); i < len(names); i++ {
+		var entry *falib.IndexEntry
+		switch names[i] {
+		case ".":
+			entry = s.index.Lookup(dirPath)
+		case "..":
+			entry = s.index.Lookup(filepath.Dir(dirPath))
+		default:
+			entry = s.index.Lookup(filepath.Join(dirPath, names[i]))
+		}
+		dirent := fuseDirent{
+			Ino:     s.id(entry.Path),
+			Off:     uint64(i + 1),
+			Namelen: uint32(len(names[i])),
+			Type:    unixMode(entry.Mode) >> 12,
+		}
+		size := int(unsafe.Sizeof(dirent)) + len(names[i])
+		padded := (size + 7) &^ 7
+		if len(out)+padded > int(in.Size) {
+			break
+		}
+		out = append(out, fuseBytes(unsafe.Pointer(&dirent), unsafe.Sizeof(dirent))...)
+		out = append(out, names[i]...)
+		out = append(out, make([]byte, padded-size)...)
+	}
+	s.reply(header, out)
+}
+
+func (s *fuseServer) attributes(id uint64, entry *falib.IndexEntry) fuseAttr {
+	mtime := entry.ModTime.UnixNano()
+	if entry.ModTime.IsZero() {
+		mtime = 0
+	}
+	attr := fuseAttr{
+		Ino:       id,
+		Size:      uint64(entry.Size),
+		Blocks:    uint64((entry.Size + 511) / 512),
+		Atime:     uint64(mtime / 1e9),
+		Mtime:     uint64(mtime / 1e9),
+		Ctime:     uint64(mtime / 1e9),
+		Atimensec: uint32(mtime % 1e9),
+		Mtimensec: uint32(mtime % 1e9),
+		Ctimensec: uint32(mtime % 1e9),
+		Mode:      unixMode(entry.Mode),
+		Nlink:     1,
+		Uid:       uint32(entry.Uid),
+		Gid:       uint32(entry.Gid),
+		Rdev:      (entry.Major&0xfff)<<8 | entry.Minor&0xff | (entry.Minor&^0xff)<<12,
+		Blksize:   4096,
+	}
+	if entry.Mode.IsDir() {
+		attr.Nlink = 2
+	}
+	return attr
+}
+
+// Converts a FileMode to the mode bits of stat(2).
+func unixMode(mode os.FileMode) uint32 {
+	retval := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeDir != 0:
+		retval |= syscall.S_IFDIR
+	case mode&os.ModeCharDevice != 0:
+		retval |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		retval |= syscall.S_IFBLK
+	case mode&os.ModeNamedPipe != 0:
+		retval |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		retval |= syscall.S_IFSOCK
+	default:
+		retval |= syscall.S_IFREG
+	}
+	if mode&os.ModeSetuid != 0 {
+		retval |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		retval |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		retval |= syscall.S_ISVTX
+	}
+	return retval
+}
+
+// Returns the node ID for filePath, handing out a new one the first time.
+func (s *fuseServer) id(filePath string) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if id, ok := s.ids[filePath]; ok {
+		return id
+	}
+	id := uint64(len(s.paths))
+	s.paths = append(s.paths, filePath)
+	s.ids[filePath] = id
+	return id
+}
+
+func (s *fuseServer) path(id uint64) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if id == 0 || id >= uint64(len(s.paths)) {
+		return "", false
+	}
+	return s.paths[id], true
+}
+
+func (s *fuseServer) entry(id uint64) *falib.IndexEntry {
+	filePath, ok := s.path(id)
+	if !ok {
+		return nil
+	}
+	return s.index.Lookup(filePath)
+}
+
+func (s *fuseServer) reply(header fuseInHeader, data []byte) {
+	out := fuseOutHeader{Len: uint32(unsafe.Sizeof(fuseOutHeader{})) + uint32(len(data)), Unique: header.Unique}
+	s.write(append(fuseBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)), data...))
+}
+
+func (s *fuseServer) fail(header fuseInHeader, errno syscall.Errno) {
+	out := fuseOutHeader{Len: uint32(unsafe.Sizeof(fuseOutHeader{})), Error: -int32(errno), Unique: header.Unique}
+	s.write(fuseBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)))
+}
+
+// Each reply is written in one write; the kernel matches it to its request
+// by the unique ID.  A request that was interrupted gets ENOENT, which can be
+// ignored.
+func (s *fuseServer) write(data []byte) {
+	_, err := syscall.Write(int(s.dev.Fd()), data)
+	if err != nil && err != syscall.ENOENT {
+		s.logger.Verbose("error replying to FUSE request:", err.Error())
+	}
+}
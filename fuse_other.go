@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "github.com/replicon/fast-archiver/falib"
+
+func mountArchive(index *falib.Index, mountPoint string, allowOther bool, logger *MultiLevelLogger) error {
+	return failure(exitError, "mounting archives is only supported on Linux")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/replicon/fast-archiver/falib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Checks that the golden archives in testdata/golden, made by make.sh, still
+// read back as they did when they were made, so that changes to the file
+// format can't break existing archives.
+func TestGoldenArchives(t *testing.T) {
+	golden := filepath.Join("testdata", "golden")
+	sums, err := readSHA256Sums(filepath.Join(golden, "SHA256SUMS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archives, _ := filepath.Glob(filepath.Join(golden, "*.fa"))
+	if len(archives) == 0 {
+		t.Fatal("no golden archives found")
+	}
+	for _, archive := range archives {
+		name := strings.TrimSuffix(filepath.Base(archive), ".fa")
+		t.Run(name, func(t *testing.T) {
+			t.Run("verify", func(t *testing.T) {
+				input, err := os.Open(archive)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer input.Close()
+				unarchiver := falib.NewUnarchiver(input)
+				unarchiver.Logger = &MultiLevelLogger{logger, false}
+				unarchiver.DryRun = true
+				err = unarchiver.Run()
+				if err != nil {
+					t.Error(err)
+				}
+			})
+
+			t.Run("list", func(t *testing.T) {
+				expected, err := ioutil.ReadFile(filepath.Join(golden, name+".list"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				input, err := os.Open(archive)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer input.Close()
+				var listing strings.Builder
+				err = falib.List(input, func(entry falib.ListEntry) {
+					listing.WriteString(listLine(entry, true) + "\n")
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if listing.String() != string(expected) {
+					t.Errorf("listed:\n%s\nexpected:\n%s", listing.String(), expected)
+				}
+			})
+
+			t.Run("extract", func(t *testing.T) {
+				out := t.TempDir()
+				err := testExtract(t, out, "--specials", "--ignore-owners", "-i", archive)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for filePath, sum := range sums {
+					data, err := ioutil.ReadFile(filepath.Join(out, filePath))
+					if err != nil {
+						t.Error(err)
+						continue
+					}
+					actual := sha256.Sum256(data)
+					if hex.EncodeToString(actual[:]) != sum {
+						t.Errorf("contents of %s differ", filePath)
+					}
+				}
+			})
+		})
+	}
+}
+
+// Reads a sha256sum manifest into a map of paths to hex SHA-256s.
+func readSHA256Sums(fileName string) (map[string]string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(fields) == 2 {
+			sums[fields[1]] = fields[0]
+		}
+	}
+	return sums, scanner.Err()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"github.com/replicon/fast-archiver/falib"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// Computes the SHA-256 of every file in directory trees, reading them with
+// the same concurrent scanners and readers as create, and writes them out as
+// a sha256sum manifest, without writing an archive.
+func setupHash(fs *flag.FlagSet) func(args []string) {
+	verbose := fs.Bool("v", false, "verbose output on stderr")
+	outputFileName := fs.String("o", "", "write the manifest to this file; defaults to stdout")
+	multiCpu := fs.Int("multicpu", runtime.NumCPU(), "maximum number of CPUs that can be executing simultaneously")
+	dirReaderCount := fs.Int("dir-readers", 16, "number of simultaneous directory readers")
+	fileReaderCount := fs.Int("file-readers", 16, "number of simultaneous file readers")
+	hashWorkers := fs.Int("hash-workers", 0, "number of goroutines hashing files, apart from the file readers; defaults to --multicpu")
+	exclude := fs.String("exclude", "", "file patterns to exclude (eg. core.*); can be path list separated (eg. : in Linux) for multiple excludes")
+	excludeVCS := fs.Bool("exclude-vcs", false, "leave out version control directories (.git, .hg, .svn, .bzr, CVS, _darcs)")
+	excludeVCSIgnores := fs.Bool("exclude-vcs-ignores", false, "leave out files ignored by .gitignore files and .git/info/exclude")
+	dereference := fs.Bool("dereference", false, "hash the files and directories that symbolic links point to, instead of skipping the links")
+	oneFileSystem := fs.Bool("one-file-system", false, "don't descend into directories on other filesystems than the directory being hashed")
+	minSize := fs.String("min-size", "", "only hash files of at least this size (eg. 100M)")
+	maxSize := fs.String("max-size", "", "only hash files of at most this size (eg. 4G)")
+	owner := fs.String("owner", "", "only hash files owned by these users, as names or uids separated by commas")
+	group := fs.String("group", "", "only hash files belonging to these groups, as names or gids separated by commas")
+	maxDepth := fs.Int("max-depth", 0, "only descend this many directories below each directory being hashed; 0 is unlimited")
+	newerThan := fs.String("newer-than", "", "only hash files modified after this RFC 3339 timestamp or date")
+	newerMtime := fs.String("newer-mtime", "", "only hash files modified within this long (eg. 7d, 12h) before now, or after this timestamp or date")
+	olderMtime := fs.String("older-mtime", "", "only hash files modified more than this long (eg. 30d) before now, or before this timestamp or date")
+	filesFrom := fs.String("files-from", "", "hash exactly the paths listed in this file, one per line, instead of scanning directories; - reads stdin")
+	nulSeparated := fs.Bool("0", false, "paths in --files-from are separated by NUL bytes (eg. find -print0)")
+	return func(args []string) {
+		if len(args) == 0 && *filesFrom == "" {
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		if *newerThan != "" && *newerMtime != "" {
+			fatal(exitUsage, "--newer-than and --newer-mtime cannot be used together")
+		}
+		if *maxDepth < 0 {
+			fatal(exitUsage, "--max-depth can't be negative")
+		}
+		runtime.GOMAXPROCS(*multiCpu)
+
+		archiver := falib.NewArchiver(nil)
+		archiver.HashOnly = true
+		// The blocks are only hashed, so larger ones just mean fewer reads.
+		archiver.BlockSize = 32768
+		// Paths are listed as they were found, so that sha256sum -c can
+		// check them from the same directory.
+		archiver.AbsolutePaths = true
+		archiver.Logger = &MultiLevelLogger{logger, *verbose}
+		archiver.DirReaderCount = *dirReaderCount
+		archiver.FileReaderCount = *fileReaderCount
+		archiver.HashWorkers = *hashWorkers
+		archiver.ExcludePatterns = filepath.SplitList(*exclude)
+		archiver.ExcludeVCS = *excludeVCS
+		archiver.ExcludeVCSIgnores = *excludeVCSIgnores
+		archiver.Dereference = *dereference
+		archiver.OneFileSystem = *oneFileSystem
+		archiver.MaxDepth = *maxDepth
+		if *owner != "" {
+			ids, err := parseIds(*owner, lookupUid)
+			if err != nil {
+				fatal(exitUsage, "Invalid --owner:", err.Error())
+			}
+			archiver.Owners = ids
+		}
+		if *group != "" {
+			ids, err := parseIds(*group, lookupGid)
+			if err != nil {
+				fatal(exitUsage, "Invalid --group:", err.Error())
+			}
+			archiver.Groups = ids
+		}
+		archiver.FilesFromNul = *nulSeparated
+		if *minSize != "" {
+			size, err := parseSize(*minSize)
+			if err != nil {
+				fatal(exitUsage, "Invalid --min-size:", err.Error())
+			}
+			archiver.MinSize = size
+		}
+		if *maxSize != "" {
+			size, err := parseSize(*maxSize)
+			if err != nil {
+				fatal(exitUsage, "Invalid --max-size:", err.Error())
+			}
+			archiver.MaxSize = size
+		}
+		if *newerThan != "" {
+			t, err := parseTimestamp(*newerThan)
+			if err != nil {
+				fatal(exitUsage, "Invalid --newer-than timestamp:", err.Error())
+			}
+			archiver.NewerThan = t
+		}
+		if *newerMtime != "" {
+			t, err := parseMtime(*newerMtime, time.Now())
+			if err != nil {
+				fatal(exitUsage, "Invalid --newer-mtime:", err.Error())
+			}
+			archiver.NewerThan = t
+		}
+		if *olderMtime != "" {
+			t, err := parseMtime(*olderMtime, time.Now())
+			if err != nil {
+				fatal(exitUsage, "Invalid --older-mtime:", err.Error())
+			}
+			archiver.OlderThan = t
+		}
+		if *filesFrom == "-" {
+			archiver.FilesFrom = os.Stdin
+		} else if *filesFrom != "" {
+			file, err := os.Open(*filesFrom)
+			if err != nil {
+				fatal(exitError, "Error opening --files-from list:", err.Error())
+			}
+			defer file.Close()
+			archiver.FilesFrom = file
+		}
+
+		var output io.WriteCloser = os.Stdout
+		if *outputFileName != "" {
+			file, err := os.Create(*outputFileName)
+			if err != nil {
+				fatal(exitError, "Error creating manifest file:", err.Error())
+			}
+			output = file
+		}
+		manifest := bufio.NewWriter(output)
+		archiver.Manifest = manifest
+		for _, directory := range args {
+			archiver.AddDir(directory)
+		}
+
+		handleInterrupts(archiver.Interrupt)
+		err := archiver.Run()
+		if err == nil {
+			err = manifest.Flush()
+		}
+		if err == nil && output != os.Stdout {
+			err = output.Close()
+		}
+		if err != nil {
+			if output != os.Stdout {
+				output.Close()
+				os.Remove(*outputFileName)
+			}
+			if err == falib.ErrInterrupted {
+				exitWith(err)
+			}
+			fatal(exitError, "Error hashing files:", err.Error())
+		}
+		exitIfWarned()
+	}
+}
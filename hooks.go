@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The JSON record sent to a --restore-hook for each extracted file.
+type restoreHookRecord struct {
+	Path     string  `json:"path"`
+	SHA256   string  `json:"sha256"`
+	Size     int64   `json:"size"`
+	Duration float64 `json:"duration"`
+}
+
+// Creates a restore hook that reports each extracted file to target, which is
+// either an http:// or https:// URL to POST a JSON record to, or unix:PATH to
+// write a line of JSON per file to a Unix domain socket.  Failures to deliver
+// a record are passed to warn rather than stopping the extraction.
+func newRestoreHook(target string, warn func(v ...interface{})) (falib.RestoreHookFunc, io.Closer, error) {
+	encode := func(file falib.RestoredFile) []byte {
+		record, _ := json.Marshal(restoreHookRecord{file.Path, hex.EncodeToString(file.SHA256), file.Size, file.Duration.Seconds()})
+		return record
+	}
+
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		hook := func(file falib.RestoredFile) {
+			resp, err := http.Post(target, "application/json", bytes.NewReader(encode(file)))
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode/100 != 2 {
+					err = fmt.Errorf("%s", resp.Status)
+				}
+			}
+			if err != nil {
+				warn("Restore hook error for", file.Path, ":", err.Error())
+			}
+		}
+		return hook, nil, nil
+	}
+
+	if strings.HasPrefix(target, "unix:") {
+		conn, err := net.Dial("unix", strings.TrimPrefix(target, "unix:"))
+		if err != nil {
+			return nil, nil, err
+		}
+		var lock sync.Mutex
+		hook := func(file falib.RestoredFile) {
+			lock.Lock()
+			defer lock.Unlock()
+			_, err := conn.Write(append(encode(file), '\n'))
+			if err != nil {
+				warn("Restore hook error for", file.Path, ":", err.Error())
+			}
+		}
+		return hook, conn, nil
+	}
+
+	return nil, nil, fmt.Errorf("restore hook must be an http:// or https:// URL, or unix:PATH")
+}
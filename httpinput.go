@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The number of times a dropped download is resumed in a row before giving
+// up.
+const httpResumeRetries = 3
+
+// Returns true if the given -i argument is an http:// or https:// URL.
+func isHTTPURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// An archive downloaded from a web server or CDN as it's read.  If the
+// connection drops partway through, and the server supports range requests,
+// the download carries on from where it left off, provided the file hasn't
+// changed in the meantime.
+type httpReader struct {
+	url       string
+	body      io.ReadCloser
+	offset    int64
+	size      int64
+	ranges    bool
+	validator string
+	failures  int
+}
+
+func openHTTPReader(url string) (*httpReader, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	r := &httpReader{url: url, body: resp.Body, size: resp.ContentLength}
+	// A resumed download has to be of the same file, which is checked
+	// with the ETag, or failing that the modification time.
+	r.validator = resp.Header.Get("ETag")
+	if r.validator == "" || strings.HasPrefix(r.validator, "W/") {
+		r.validator = resp.Header.Get("Last-Modified")
+	}
+	r.ranges = resp.Header.Get("Accept-Ranges") == "bytes" && r.validator != ""
+	return r, nil
+}
+
+func (r *httpReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF && r.size >= 0 && r.offset < r.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if n > 0 {
+			r.failures = 0
+			if err == io.EOF {
+				err = nil
+			} else if err != nil {
+				// Return the data now; the connection is resumed on
+				// the next read.
+				return n, nil
+			}
+			return n, err
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		resumeErr := r.resume(err)
+		if resumeErr != nil {
+			return 0, resumeErr
+		}
+	}
+}
+
+// Requests the rest of the file, from the current offset, after the download
+// failed with err.
+func (r *httpReader) resume(err error) error {
+	if !r.ranges || r.failures >= httpResumeRetries {
+		return err
+	}
+	r.failures++
+	time.Sleep(time.Duration(r.failures) * time.Second)
+	logger.Println("resuming download of", r.url, "at byte", r.offset, "after error:", err.Error())
+
+	req, reqErr := http.NewRequest("GET", r.url, nil)
+	if reqErr != nil {
+		return reqErr
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+	req.Header.Set("If-Range", r.validator)
+	resp, reqErr := doRequest(req)
+	if reqErr != nil {
+		// Keep trying until the retries run out.
+		return r.resume(reqErr)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		// The server sent the whole file, because it has changed.
+		resp.Body.Close()
+		return errors.New(r.url + " changed while it was being downloaded")
+	}
+	r.body.Close()
+	r.body = resp.Body
+	return nil
+}
+
+func (r *httpReader) Close() error {
+	return r.body.Close()
+}
@@ -3,18 +3,17 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/replicon/fast-archiver/falib"
-	"io"
 	"log"
-	"math"
 	"os"
-	"path/filepath"
-	"runtime"
+	"strings"
+	"sync/atomic"
 )
 
 var tag string
 var rev string
 
+var logger = log.New(os.Stderr, "", 0)
+
 type MultiLevelLogger struct {
 	logger  *log.Logger
 	verbose bool
@@ -26,7 +25,9 @@ func (l *MultiLevelLogger) Verbose(v ...interface{}) {
 	}
 }
 func (l *MultiLevelLogger) Warning(v ...interface{}) {
+	atomic.AddInt64(&warningCount, 1)
 	l.logger.Println(v...)
+	events.error(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
 }
 
 type sink bool
@@ -35,109 +36,55 @@ func (s sink) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
-func main() {
-	flag.Usage = func() {
-		if tag != "" || rev != "" {
-			fmt.Fprintf(os.Stderr, "%s (tag: %s, rev: %s)\n", os.Args[0], tag, rev)
-		} else {
-			fmt.Fprintf(os.Stderr, "%s\n", os.Args[0])
-		}
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		flag.PrintDefaults()
-	}
-
-	extract := flag.Bool("x", false, "extract archive")
-	create := flag.Bool("c", false, "create archive")
-	inputFileName := flag.String("i", "", "input file for extraction; defaults to stdin (-x only)")
-	outputFileName := flag.String("o", "", "output file for creation; defaults to stdout (-c only)")
-	requestedBlockSize := flag.Uint("block-size", 4096, "internal block-size (-c only)")
-	dirReaderCount := flag.Int("dir-readers", 16, "number of simultaneous directory readers (-c only)")
-	fileReaderCount := flag.Int("file-readers", 16, "number of simultaneous file readers (-c only)")
-	directoryScanQueueSize := flag.Int("queue-dir", 128, "queue size for scanning directories (-c only)")
-	fileReadQueueSize := flag.Int("queue-read", 128, "queue size for reading files (-c only)")
-	blockQueueSize := flag.Int("queue-write", 128, "queue size for archive write (-c only); increasing can cause increased memory usage")
-	multiCpu := flag.Int("multicpu", 1, "maximum number of CPUs that can be executing simultaneously")
-	exclude := flag.String("exclude", "", "file patterns to exclude (eg. core.*); can be path list separated (eg. : in Linux) for multiple excludes (-c only)")
-	verbose := flag.Bool("v", false, "verbose output on stderr")
-	dryRun := flag.Bool("n", false, "dry run; show what would be done, but do not write anything")
-	ignorePerms := flag.Bool("ignore-perms", false, "ignore permissions when restoring files (-x only)")
-	ignoreOwners := flag.Bool("ignore-owners", false, "ignore owners when restoring files (-x only)")
-	flag.Parse()
-
-	runtime.GOMAXPROCS(*multiCpu)
-	logger := log.New(os.Stderr, "", 0)
-
-	if *requestedBlockSize > math.MaxUint16 {
-		logger.Fatalln("block-size must be less than or equal to", math.MaxUint16)
+// Prints the commands, for help without a command and before the options of
+// the original -c and -x forms.
+func printCommands() {
+	if tag != "" || rev != "" {
+		fmt.Fprintf(os.Stderr, "%s (tag: %s, rev: %s)\n", os.Args[0], tag, rev)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s\n", os.Args[0])
 	}
-
-	if *dryRun {
-		*verbose = true
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", c.name, c.summary)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s help <command>' for a command's options.\n", os.Args[0])
+}
 
-	if *extract && !*create {
-		var inputFile *os.File
-		if *inputFileName != "" {
-			file, err := os.Open(*inputFileName)
-			if err != nil {
-				logger.Fatalln("Error opening input file:", err.Error())
-			}
-			inputFile = file
-		} else {
-			inputFile = os.Stdin
-		}
+func usage() {
+	printCommands()
+	fmt.Fprintf(os.Stderr, "\nThe original -c and -x forms are still accepted, with these options:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\n%s\n", envHelp)
+}
 
-		unarchiver := falib.NewUnarchiver(inputFile)
-		unarchiver.Logger = &MultiLevelLogger{logger, *verbose}
-		unarchiver.IgnorePerms = *ignorePerms
-		unarchiver.IgnoreOwners = *ignoreOwners
-		unarchiver.DryRun = *dryRun
-		err := unarchiver.Run()
-		if err != nil {
-			logger.Fatalln("Fatal error in archiver:", err.Error())
+func main() {
+	if len(os.Args) > 1 {
+		if c, ok := findCommand(os.Args[1]); ok {
+			c.run(os.Args[2:])
+			exit(exitOK)
 		}
-		inputFile.Close()
+	}
 
+	// Without a command, the original flat set of flags is used, where -c or
+	// -x selects between creating and extracting.
+	flag.Usage = usage
+	extract := flag.Bool("x", false, "extract archive")
+	create := flag.Bool("c", false, "create archive")
+	common := addCommonFlags(flag.CommandLine)
+	createOpts := addCreateFlags(flag.CommandLine)
+	input := addInputFlags(flag.CommandLine)
+	extractOpts := addExtractFlags(flag.CommandLine)
+	args := parseFlags(flag.CommandLine, os.Args[1:])
+
+	if *extractOpts.diff && !*create {
+		exitWith(runExtract(common, input, extractOpts))
+	} else if *extract && !*create {
+		exitWith(runExtract(common, input, extractOpts))
 	} else if *create && !*extract {
-		if flag.NArg() == 0 {
-			logger.Fatalln("Directories to archive must be specified")
-		}
-
-		var outputFile *os.File
-		var outputWriter io.Writer
-		if *dryRun {
-			outputWriter = sink(true)
-		} else if *outputFileName != "" {
-			outputFile, err := os.Create(*outputFileName)
-			if err != nil {
-				logger.Fatalln("Error creating output file:", err.Error())
-			}
-			outputWriter = outputFile
-		} else {
-			outputFile = os.Stdout
-			outputWriter = os.Stdout
-		}
-
-		archiver := falib.NewArchiver(outputWriter)
-		archiver.BlockSize = uint16(*requestedBlockSize)
-		archiver.DirScanQueueSize = *directoryScanQueueSize
-		archiver.FileReadQueueSize = *fileReadQueueSize
-		archiver.BlockQueueSize = *blockQueueSize
-		archiver.ExcludePatterns = filepath.SplitList(*exclude)
-		archiver.DirReaderCount = *dirReaderCount
-		archiver.FileReaderCount = *fileReaderCount
-		archiver.Logger = &MultiLevelLogger{logger, *verbose}
-		for i := 0; i < flag.NArg(); i++ {
-			archiver.AddDir(flag.Arg(i))
-		}
-		err := archiver.Run()
-		if err != nil {
-			logger.Fatalln("Fatal error in archiver:", err.Error())
-		}
-		if !*dryRun {
-			outputFile.Close()
-		}
+		exitWith(runCreate(common, createOpts, args))
 	} else {
-		logger.Fatalln("exactly one of extract (-x) or create (-c) flag must be provided")
+		fatal(exitUsage, "exactly one of extract (-x) or create (-c) flag must be provided")
 	}
+	exit(exitOK)
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The --metrics-listen server, or nil if it wasn't asked for.
+var metrics *metricsServer
+
+// Serves the progress of archive creation in the Prometheus text format, at
+// /metrics.  Counters add up every archive created by the process, so that
+// with --watch they keep counting up from one archive to the next.
+type metricsServer struct {
+	lock      sync.Mutex
+	current   *falib.Archiver
+	completed falib.Stats
+	archives  int64
+	failures  int64
+	succeeded time.Time
+}
+
+// Starts serving metrics on address (eg. ":9100").
+func startMetrics(address string) (*metricsServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	m := &metricsServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.serve)
+	go http.Serve(listener, mux)
+	return m, nil
+}
+
+// Starts reporting the progress of archiver, which is about to be run.
+func (m *metricsServer) track(archiver *falib.Archiver) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.current = archiver
+}
+
+// Adds the final counts of the tracked archiver's run, which ended with err,
+// to the totals.
+func (m *metricsServer) done(archiver *falib.Archiver, err error) {
+	if m == nil {
+		return
+	}
+	stats := archiver.Stats()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	addCounts(&m.completed, stats)
+	if err != nil {
+		m.failures++
+	} else {
+		m.archives++
+		m.succeeded = time.Now()
+	}
+	m.current = nil
+}
+
+// Adds the counts in stats to totals.
+func addCounts(totals *falib.Stats, stats falib.Stats) {
+	totals.Directories += stats.Directories
+	totals.Files += stats.Files
+	totals.Specials += stats.Specials
+	totals.Symlinks += stats.Symlinks
+	totals.Deleted += stats.Deleted
+	totals.BytesRead += stats.BytesRead
+	totals.BytesWritten += stats.BytesWritten
+	totals.Retries += stats.Retries
+	totals.Rereads += stats.Rereads
+}
+
+func (m *metricsServer) serve(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	totals := m.completed
+	var depths falib.QueueDepths
+	running := 0
+	if m.current != nil {
+		addCounts(&totals, m.current.Stats())
+		depths = m.current.QueueDepths()
+		running = 1
+	}
+	archives, failures, succeeded := m.archives, m.failures, m.succeeded
+	m.lock.Unlock()
+
+	var out bytes.Buffer
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("fast_archiver_directories_total", "counter", "Directories archived.", totals.Directories)
+	metric("fast_archiver_files_total", "counter", "Files archived.", totals.Files)
+	metric("fast_archiver_special_files_total", "counter", "FIFOs, devices, and sockets archived.", totals.Specials)
+	metric("fast_archiver_symlinks_total", "counter", "Symbolic links archived.", totals.Symlinks)
+	metric("fast_archiver_deleted_total", "counter", "Deletions recorded in incremental archives.", totals.Deleted)
+	metric("fast_archiver_read_bytes_total", "counter", "Bytes read from files.", totals.BytesRead)
+	metric("fast_archiver_written_bytes_total", "counter", "Bytes written to archives.", totals.BytesWritten)
+	metric("fast_archiver_retries_total", "counter", "Opens and reads retried after transient errors.", totals.Retries)
+	metric("fast_archiver_rereads_total", "counter", "Files read again after changing while being read.", totals.Rereads)
+	metric("fast_archiver_warnings_total", "counter", "Warnings logged.", atomic.LoadInt64(&warningCount))
+	metric("fast_archiver_archives_total", "counter", "Archives completed.", archives)
+	metric("fast_archiver_archive_failures_total", "counter", "Archives that failed.", failures)
+	if !succeeded.IsZero() {
+		metric("fast_archiver_last_success_timestamp_seconds", "gauge", "When the last archive was completed.", succeeded.Unix())
+	}
+	metric("fast_archiver_running", "gauge", "Whether an archive is being created.", running)
+	fmt.Fprintf(&out, "# HELP fast_archiver_queue_depth Items waiting in each queue of the archive being created.\n")
+	fmt.Fprintf(&out, "# TYPE fast_archiver_queue_depth gauge\n")
+	fmt.Fprintf(&out, "fast_archiver_queue_depth{queue=\"directories\"} %d\n", depths.Directories)
+	fmt.Fprintf(&out, "fast_archiver_queue_depth{queue=\"files\"} %d\n", depths.Files)
+	fmt.Fprintf(&out, "fast_archiver_queue_depth{queue=\"blocks\"} %d\n", depths.Blocks)
+	metric("go_goroutines", "gauge", "Number of goroutines.", runtime.NumGoroutine())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(out.Bytes())
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"github.com/replicon/fast-archiver/falib"
+	"os"
+)
+
+// Serves an archive as a read-only FUSE filesystem, so that its files can be
+// browsed and copied without extracting all of them.  The archive is read
+// once to index where each file's blocks are, and after that only the blocks
+// of the files being read are.
+func setupMount(fs *flag.FlagSet) func(args []string) {
+	verbose := fs.Bool("v", false, "verbose output on stderr")
+	allowOther := fs.Bool("allow-other", false, "let other users see the mounted files; without root, needs user_allow_other in /etc/fuse.conf")
+	return func(args []string) {
+		if len(args) != 2 {
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		archiveName, mountPoint := args[0], args[1]
+		logger := &MultiLevelLogger{logger, *verbose}
+
+		file, err := os.Open(archiveName)
+		if err != nil {
+			fatal(exitError, "Error opening archive:", err.Error())
+		}
+		defer file.Close()
+		logger.Verbose("indexing", archiveName)
+		index, err := falib.NewIndex(file)
+		if err != nil {
+			fatal(archiveErrorStatus(err), "Error reading archive:", err.Error())
+		}
+		exitWith(mountArchive(index, mountPoint, *allowOther, logger))
+		exitIfWarned()
+	}
+}
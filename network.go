@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/replicon/fast-archiver/falib"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// How long to wait for a connecting client to send its resume request.
+const resumeRequestTimeout = 30 * time.Second
+
+// Returns true if the given -i argument refers to a network stream.
+func isNetworkURL(name string) bool {
+	return strings.HasPrefix(name, "tcp://") || strings.HasPrefix(name, "tls://")
+}
+
+// Waits for a single extracting client to connect on address, and returns the
+// connection to write the archive to.  If certFile and keyFile are provided,
+// the connection is TLS.
+func listenForArchive(address, certFile, keyFile string) (net.Conn, error) {
+	var listener net.Listener
+	var err error
+	if certFile != "" || keyFile != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		listener, err = tls.Listen("tcp", address, &tls.Config{Certificates: []tls.Certificate{cert}})
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	return listener.Accept()
+}
+
+// Reads the extracting client's resume request from a --listen connection.
+func readResumeRequest(conn net.Conn) (*falib.ResumeSet, error) {
+	conn.SetReadDeadline(time.Now().Add(resumeRequestTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	return falib.ReadResumeRequest(conn)
+}
+
+// Connects to a fast-archiver running with --listen.  tls:// URLs are verified
+// against the system roots, or against caFile if given.
+func dialArchive(name, caFile string) (net.Conn, error) {
+	if strings.HasPrefix(name, "tcp://") {
+		return net.Dial("tcp", strings.TrimPrefix(name, "tcp://"))
+	}
+
+	address := strings.TrimPrefix(name, "tls://")
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+	}
+	return tls.Dial("tcp", address, config)
+}
+
+// Sends a resume request that doesn't skip anything, for commands that read a
+// network archive without a journal.
+func sendEmptyResumeRequest(conn net.Conn) error {
+	return (&falib.Unarchiver{}).WriteResumeRequest(conn)
+}
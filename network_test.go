@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a self-signed certificate and its key into dir, and returns their
+// file names.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestListenForArchiveAddressInUse(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	bound, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bound.Close()
+
+	for _, test := range []struct {
+		name              string
+		certFile, keyFile string
+	}{
+		{"tcp", "", ""},
+		{"tls", certFile, keyFile},
+	} {
+		conn, err := listenForArchive(bound.Addr().String(), test.certFile, test.keyFile)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: listening on an address in use succeeded", test.name)
+		}
+	}
+}
+
+func TestListenForArchiveTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir)
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := probe.Addr().String()
+	probe.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := listenForArchive(address, certFile, keyFile)
+		if err == nil {
+			_, err = conn.Write([]byte("archive"))
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		conn, err = dialArchive("tls://"+address, certFile)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 7)
+	_, err = conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "archive" {
+		t.Errorf("read %q, expected %q", buf, "archive")
+	}
+	err = <-accepted
+	if err != nil {
+		t.Fatal(err)
+	}
+}
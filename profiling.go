@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// The profiles being recorded for --cpuprofile and --trace, and the file to
+// write a --memprofile heap profile to when the run ends.
+var profiling struct {
+	cpu         *os.File
+	trace       *os.File
+	memFileName string
+}
+
+// Starts the profiles asked for by the common options.  They're written out by
+// stopProfiling, however the run ends.
+func startProfiling(opts *commonOptions) {
+	if *opts.cpuProfile != "" {
+		file, err := os.Create(*opts.cpuProfile)
+		if err != nil {
+			fatal(exitError, "Error creating --cpuprofile:", err.Error())
+		}
+		err = pprof.StartCPUProfile(file)
+		if err != nil {
+			fatal(exitError, "Error starting CPU profile:", err.Error())
+		}
+		profiling.cpu = file
+	}
+	if *opts.trace != "" {
+		file, err := os.Create(*opts.trace)
+		if err != nil {
+			fatal(exitError, "Error creating --trace:", err.Error())
+		}
+		err = trace.Start(file)
+		if err != nil {
+			fatal(exitError, "Error starting trace:", err.Error())
+		}
+		profiling.trace = file
+	}
+	profiling.memFileName = *opts.memProfile
+}
+
+// Finishes the profiles started by startProfiling.  Errors are logged, since
+// the run itself is over.
+func stopProfiling() {
+	if profiling.cpu != nil {
+		pprof.StopCPUProfile()
+		profiling.cpu.Close()
+		profiling.cpu = nil
+	}
+	if profiling.trace != nil {
+		trace.Stop()
+		profiling.trace.Close()
+		profiling.trace = nil
+	}
+	if profiling.memFileName != "" {
+		fileName := profiling.memFileName
+		profiling.memFileName = ""
+		file, err := os.Create(fileName)
+		if err != nil {
+			logger.Println("Error creating --memprofile:", err.Error())
+			return
+		}
+		defer file.Close()
+		// Collect garbage first, so that the profile shows what's
+		// actually still in use.
+		runtime.GC()
+		err = pprof.WriteHeapProfile(file)
+		if err != nil {
+			logger.Println("Error writing --memprofile:", err.Error())
+		}
+	}
+}
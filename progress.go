@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"os"
+	"strings"
+	"time"
+)
+
+// How often progress is shown on a terminal, and in a log when stderr isn't
+// one.
+const (
+	progressInterval    = time.Second
+	progressLogInterval = 10 * time.Second
+)
+
+// Shows the progress of an archiver's Run on stderr until it's stopped.  On
+// a terminal the line is updated in place; otherwise a line is logged every
+// progressLogInterval.  With an estimate, progress is shown as a percentage
+// of it, with the time left at the current rate.
+type progressDisplay struct {
+	archiver *falib.Archiver
+	estimate *falib.Estimate
+	terminal bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func startProgress(archiver *falib.Archiver, estimate *falib.Estimate) *progressDisplay {
+	p := &progressDisplay{archiver: archiver, estimate: estimate, stop: make(chan struct{}), done: make(chan struct{})}
+	if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		p.terminal = true
+	}
+	go p.run()
+	return p
+}
+
+func (p *progressDisplay) run() {
+	defer close(p.done)
+	interval := progressLogInterval
+	if p.terminal {
+		interval = progressInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	width := 0
+	for {
+		select {
+		case <-p.stop:
+			if p.terminal && width > 0 {
+				fmt.Fprintf(os.Stderr, "\r%s\r", strings.Repeat(" ", width))
+			}
+			return
+		case <-ticker.C:
+		}
+		line := p.line(p.archiver.Stats())
+		if p.terminal {
+			// Pad over the rest of a longer previous line.
+			padding := ""
+			if len(line) < width {
+				padding = strings.Repeat(" ", width-len(line))
+			}
+			fmt.Fprintf(os.Stderr, "\r%s%s", line, padding)
+			width = len(line)
+		} else {
+			logger.Println(line)
+		}
+	}
+}
+
+// Formats a progress line, eg. "42.0% 1200/2900 files, 1.2 GiB/2.9 GiB,
+// 85.3 MiB/s, 20s left".
+func (p *progressDisplay) line(stats falib.Stats) string {
+	rate := int64(0)
+	if seconds := stats.Elapsed.Seconds(); seconds > 0 {
+		rate = int64(float64(stats.BytesRead) / seconds)
+	}
+	if p.estimate == nil {
+		return fmt.Sprintf("%d files, %s, %s/s", stats.Files, formatSize(stats.BytesRead), formatSize(rate))
+	}
+
+	// Files can grow, or be added, after the estimate was made.
+	total := p.estimate.Bytes
+	if stats.BytesRead > total {
+		total = stats.BytesRead
+	}
+	percent := 100.0
+	if total > 0 {
+		percent = 100 * float64(stats.BytesRead) / float64(total)
+	}
+	left := "unknown time left"
+	if rate > 0 {
+		seconds := float64(total-stats.BytesRead) / float64(rate)
+		left = time.Duration(seconds*float64(time.Second)).Round(time.Second).String() + " left"
+	}
+	return fmt.Sprintf("%.1f%% %d/%d files, %s/%s, %s/s, %s", percent, stats.Files, p.estimate.Files,
+		formatSize(stats.BytesRead), formatSize(total), formatSize(rate), left)
+}
+
+// Stops the display, clearing the line on a terminal.
+func (p *progressDisplay) close() {
+	close(p.stop)
+	<-p.done
+}
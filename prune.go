@@ -0,0 +1,234 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A --prune retention policy: the number of most recent archives to keep, and
+// the number of most recent hours, days, weeks, months, and years to keep the
+// newest archive of.  An archive is kept if any of them keeps it.
+type retentionPolicy struct {
+	last    int
+	hourly  int
+	daily   int
+	weekly  int
+	monthly int
+	yearly  int
+}
+
+// Parses a policy like keep-daily=7,keep-weekly=4.
+func parseRetention(value string) (retentionPolicy, error) {
+	var policy retentionPolicy
+	rules := map[string]*int{
+		"keep-last":    &policy.last,
+		"keep-hourly":  &policy.hourly,
+		"keep-daily":   &policy.daily,
+		"keep-weekly":  &policy.weekly,
+		"keep-monthly": &policy.monthly,
+		"keep-yearly":  &policy.yearly,
+	}
+	for _, rule := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+		count, ok := rules[parts[0]]
+		if !ok || len(parts) != 2 {
+			return policy, fmt.Errorf("%q isn't one of keep-last, keep-hourly, keep-daily, keep-weekly, keep-monthly, or keep-yearly=N", rule)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 {
+			return policy, fmt.Errorf("invalid count in %q", rule)
+		}
+		*count = n
+	}
+	if policy == (retentionPolicy{}) {
+		return policy, fmt.Errorf("%q would keep nothing", value)
+	}
+	return policy, nil
+}
+
+// An archive whose name includes the time it was created.
+type datedArchive struct {
+	name    string
+	created time.Time
+}
+
+// Returns the archives of a policy's archives, sorted newest first, that it
+// doesn't keep.  Periods are in local time.
+func (p retentionPolicy) expired(archives []datedArchive) []datedArchive {
+	keep := make([]bool, len(archives))
+	for i := 0; i < p.last && i < len(archives); i++ {
+		keep[i] = true
+	}
+	for _, rule := range []struct {
+		count  int
+		period func(t time.Time) string
+	}{
+		{p.hourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{p.daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{p.monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{p.yearly, func(t time.Time) string { return t.Format("2006") }},
+	} {
+		kept, last := 0, ""
+		for i, archive := range archives {
+			if kept == rule.count {
+				break
+			}
+			if period := rule.period(archive.created.Local()); period != last {
+				keep[i] = true
+				kept++
+				last = period
+			}
+		}
+	}
+
+	var retval []datedArchive
+	for i, archive := range archives {
+		if !keep[i] {
+			retval = append(retval, archive)
+		}
+	}
+	return retval
+}
+
+// Returns the archives, in a local directory or object storage, named like
+// pattern with a time in place of its %t, sorted newest first.  Names with
+// anything else in place of %t are left out.
+func findDatedArchives(pattern string) ([]datedArchive, error) {
+	at := strings.Index(pattern, "%t")
+	prefix, suffix := pattern[:at], pattern[at+2:]
+	var names []string
+	if isObjectURL(pattern) {
+		store, err := newObjectPrefix(prefix)
+		if err != nil {
+			return nil, err
+		}
+		rests, err := store.list()
+		if err != nil {
+			return nil, err
+		}
+		for _, rest := range rests {
+			names = append(names, prefix+rest)
+		}
+	} else {
+		var err error
+		names, err = filepath.Glob(globEscape(prefix) + "*" + globEscape(suffix))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var archives []datedArchive
+	for _, name := range names {
+		if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		created, err := time.Parse(archiveTimestampFormat, name[len(prefix):len(name)-len(suffix)])
+		if err == nil {
+			archives = append(archives, datedArchive{name, created})
+		}
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].created.After(archives[j].created)
+	})
+	return archives, nil
+}
+
+// Escapes the characters in name that filepath.Glob treats specially.
+func globEscape(name string) string {
+	var retval strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(`*?[\`, r) {
+			retval.WriteRune('\\')
+		}
+		retval.WriteRune(r)
+	}
+	return retval.String()
+}
+
+// Deletes the archives named like pattern that policy doesn't keep; with
+// dryRun, they're only listed.
+func pruneArchives(pattern string, policy retentionPolicy, dryRun bool, log *MultiLevelLogger) error {
+	archives, err := findDatedArchives(pattern)
+	if err != nil {
+		return failure(exitError, "Error listing archives to prune:", err.Error())
+	}
+	for _, archive := range policy.expired(archives) {
+		if dryRun {
+			log.Verbose("would prune", archive.name)
+			continue
+		}
+		log.Verbose("pruning", archive.name)
+		if isObjectURL(archive.name) {
+			var store objectStore
+			store, err = newObjectStore(archive.name)
+			if err == nil {
+				err = store.delete()
+			}
+		} else {
+			err = os.Remove(archive.name)
+		}
+		if err != nil {
+			return failure(exitError, "Error pruning "+archive.name+":", err.Error())
+		}
+	}
+	return nil
+}
+
+// Lists or prunes the archives named like a pattern with a time in place of
+// its %t, such as those written by create -o /backups/app-%t.fa: repo list
+// shows them newest first, and repo prune deletes those that --keep doesn't
+// keep, as create --prune does after each run.
+func setupRepo(fs *flag.FlagSet) func(args []string) {
+	keep := fs.String("keep", "", "with prune, the archives to keep (eg. keep-daily=7,keep-weekly=4)")
+	dryRun := fs.Bool("n", false, "with prune, list the archives that would be deleted without deleting them")
+	verbose := fs.Bool("v", false, "with prune, list each archive as it's deleted")
+	return func(args []string) {
+		if len(args) == 0 {
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		// Options can follow the action, as in repo prune --keep keep-last=3.
+		action := args[0]
+		args = parseFlags(fs, args[1:])
+		if len(args) != 1 {
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		pattern := args[0]
+		if !strings.Contains(pattern, "%t") || isSSHPath(pattern) {
+			fatal(exitUsage, "The pattern must be a local or object storage name containing", "%t")
+		}
+
+		switch action {
+		case "list":
+			archives, err := findDatedArchives(pattern)
+			if err != nil {
+				fatal(exitError, "Error listing archives:", err.Error())
+			}
+			for _, archive := range archives {
+				fmt.Println(archive.created.Format(time.RFC3339), displayPath(archive.name))
+			}
+		case "prune":
+			if *keep == "" {
+				fatal(exitUsage, "repo prune requires --keep")
+			}
+			policy, err := parseRetention(*keep)
+			if err != nil {
+				fatal(exitUsage, "Invalid --keep:", err.Error())
+			}
+			exitWith(pruneArchives(pattern, policy, *dryRun, &MultiLevelLogger{logger, *verbose || *dryRun}))
+		default:
+			fatal(exitUsage, "Unknown repo command:", action)
+		}
+	}
+}
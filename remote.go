@@ -0,0 +1,709 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Archives written to object storage are uploaded in parts of objectPartSize
+// to start with.  S3 allows at most objectMaxParts parts, so the part size
+// doubles every objectPartsPerSize parts, up to objectMaxPartSize; small
+// archives are buffered in small parts, and archives of up to ~6.8 TiB, more
+// than S3's 5 TiB limit on an object, still fit.
+const (
+	objectPartSize     = 64 * 1024 * 1024
+	objectMaxPartSize  = 1024 * 1024 * 1024
+	objectPartsPerSize = 1000
+	objectMaxParts     = 10000
+)
+
+// Returns the size of the given part of an upload (numbered from 1).
+func objectPartSizeFor(partNumber int) int {
+	size := int64(objectPartSize)
+	for n := objectPartsPerSize; n < partNumber && size < objectMaxPartSize; n += objectPartsPerSize {
+		size *= 2
+	}
+	if size > objectMaxPartSize {
+		size = objectMaxPartSize
+	}
+	return int(size)
+}
+
+const objectUploadRetries = 3
+
+// A store that can stream objects down and upload them in parts.  Implemented
+// for S3 (and S3-compatible services, including GCS's interoperability API)
+// and Azure Blob Storage.
+type objectStore interface {
+	get() (io.ReadCloser, error)
+	startUpload() (string, error)
+	resumeUpload(uploadId string)
+	uploadPart(partNumber int, data []byte) (string, error)
+	completeUpload(partIds []string) error
+	abortUpload() error
+	// Lists the objects whose names start with the store's, returning the
+	// rest of each name.
+	list() ([]string, error)
+	delete() error
+}
+
+// Returns true if the given -i/-o argument refers to object storage.
+func isObjectURL(name string) bool {
+	for _, scheme := range []string{"s3://", "gs://", "az://"} {
+		if strings.HasPrefix(name, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func newObjectStore(name string) (objectStore, error) {
+	return objectStoreFor(name, false)
+}
+
+// Returns the store for objects whose names start with prefix, for listing
+// them.  Unlike an object's name, the prefix needn't have a key.
+func newObjectPrefix(prefix string) (objectStore, error) {
+	return objectStoreFor(prefix, true)
+}
+
+func objectStoreFor(name string, prefix bool) (objectStore, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || (key == "" && !prefix) {
+		return nil, fmt.Errorf("object URL must be of the form %s://bucket/key", u.Scheme)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		if region == "" {
+			region = "us-east-1"
+		}
+		return &s3Store{
+			endpoint:     os.Getenv("AWS_ENDPOINT_URL"),
+			region:       region,
+			bucket:       u.Host,
+			key:          key,
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	case "gs":
+		// GCS's XML API is S3-compatible when used with HMAC keys.
+		return &s3Store{
+			endpoint:  "https://storage.googleapis.com",
+			region:    "auto",
+			bucket:    u.Host,
+			key:       key,
+			accessKey: os.Getenv("GCS_HMAC_ACCESS_ID"),
+			secretKey: os.Getenv("GCS_HMAC_SECRET"),
+		}, nil
+	case "az":
+		// az://account/container/blob
+		parts := strings.SplitN(key, "/", 2)
+		if prefix && len(parts) == 1 && parts[0] != "" {
+			parts = append(parts, "")
+		}
+		if len(parts) != 2 || (parts[1] == "" && !prefix) {
+			return nil, errors.New("object URL must be of the form az://account/container/blob")
+		}
+		return &azureStore{
+			account:   u.Host,
+			container: parts[0],
+			blob:      parts[1],
+			sasToken:  strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported object storage scheme %q", u.Scheme)
+}
+
+func openObjectReader(name string) (io.ReadCloser, error) {
+	store, err := newObjectStore(name)
+	if err != nil {
+		return nil, err
+	}
+	return store.get()
+}
+
+// An io.WriteCloser that buffers into parts and uploads each one as it fills
+// up, so that an archive can be streamed into object storage without being
+// staged on local disk.  Close completes the upload; Abort discards it.
+//
+// With an uploadState, the parts are recorded as they're uploaded, and a
+// failed upload is left in place to be resumed, rather than discarded.
+// Resuming it, parts with the same contents as those already uploaded are
+// skipped.
+type objectWriter struct {
+	store    objectStore
+	buffer   []byte
+	partIds  []string
+	err      error
+	name     string
+	state    *uploadState
+	previous []uploadedPart
+	skipped  int
+}
+
+func createObjectWriter(name string, state *uploadState) (*objectWriter, error) {
+	store, err := newObjectStore(name)
+	if err != nil {
+		return nil, err
+	}
+	w := &objectWriter{store: store, buffer: make([]byte, 0, objectPartSizeFor(1)), name: name, state: state}
+	if state != nil {
+		if upload, ok := state.upload(name); ok {
+			store.resumeUpload(upload.UploadId)
+			w.previous = upload.Parts
+			logger.Println("resuming upload of", name, "with", len(upload.Parts), "parts already uploaded")
+			return w, nil
+		}
+	}
+	uploadId, err := store.startUpload()
+	if err != nil {
+		return nil, err
+	}
+	if state != nil {
+		err = state.start(name, uploadId)
+		if err != nil {
+			store.abortUpload()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// A full part is only uploaded once there's more to write, so that the last
+// part allowed can be filled, and an archive that needs more parts than that
+// fails as soon as it does, rather than when the upload is completed.
+func (w *objectWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.err == nil && len(w.buffer) == cap(w.buffer) {
+			if len(w.partIds)+1 >= objectMaxParts {
+				w.err = fmt.Errorf("archive is too large to upload to %s in %d parts", w.name, objectMaxParts)
+			} else {
+				w.flushPart()
+			}
+		}
+		if w.err != nil {
+			return written, w.err
+		}
+		n := copy(w.buffer[len(w.buffer):cap(w.buffer)], p)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, w.err
+}
+
+func (w *objectWriter) flushPart() {
+	partNumber := len(w.partIds) + 1
+	var digest string
+	if w.state != nil {
+		sum := sha256.Sum256(w.buffer)
+		digest = hex.EncodeToString(sum[:])
+		if len(w.previous) >= partNumber {
+			previous := w.previous[partNumber-1]
+			if previous.Size == len(w.buffer) && previous.SHA256 == digest {
+				w.partIds = append(w.partIds, previous.Id)
+				w.nextPart()
+				w.skipped++
+				return
+			}
+			// What follows was uploaded from different data.
+			w.previous = nil
+		}
+	}
+
+	var partId string
+	var err error
+	for attempt := 0; attempt < objectUploadRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		partId, err = w.store.uploadPart(partNumber, w.buffer)
+		if err == nil {
+			break
+		}
+	}
+	if err == nil && w.state != nil {
+		err = w.state.record(w.name, partNumber, uploadedPart{len(w.buffer), digest, partId})
+	}
+	if err != nil {
+		w.err = err
+		return
+	}
+	w.partIds = append(w.partIds, partId)
+	w.nextPart()
+}
+
+// Empties the buffer for the next part, making it bigger if the next part is
+// to be.
+func (w *objectWriter) nextPart() {
+	size := objectPartSizeFor(len(w.partIds) + 1)
+	if size > cap(w.buffer) {
+		w.buffer = make([]byte, 0, size)
+	} else {
+		w.buffer = w.buffer[:0]
+	}
+}
+
+func (w *objectWriter) Close() error {
+	if w.err == nil && (len(w.buffer) > 0 || len(w.partIds) == 0) {
+		w.flushPart()
+	}
+	if w.err != nil {
+		w.Abort()
+		return w.err
+	}
+	err := w.store.completeUpload(w.partIds)
+	if err != nil || w.state == nil {
+		return err
+	}
+	if w.skipped > 0 {
+		logger.Println("skipped", w.skipped, "parts of", w.name, "that were already uploaded")
+	}
+	return w.state.finish(w.name)
+}
+
+func (w *objectWriter) Abort() error {
+	if w.state != nil {
+		// Keep what was uploaded, to be resumed.
+		return nil
+	}
+	return w.store.abortUpload()
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	return fmt.Errorf("%s %s: %s %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+}
+
+func doRequest(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	err = checkResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// S3, signed with AWS Signature Version 4.
+type s3Store struct {
+	endpoint     string
+	region       string
+	bucket       string
+	key          string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	uploadId     string
+}
+
+func (s *s3Store) objectURL(query url.Values) *url.URL {
+	u := &url.URL{Scheme: "https"}
+	if s.endpoint != "" {
+		endpoint, err := url.Parse(s.endpoint)
+		if err == nil {
+			u.Scheme = endpoint.Scheme
+			u.Host = endpoint.Host
+		}
+		u.Path = "/" + s.bucket + "/" + s.key
+	} else {
+		u.Host = s.bucket + ".s3." + s.region + ".amazonaws.com"
+		u.Path = "/" + s.key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	if query != nil {
+		u.RawQuery = s3EscapeQuery(query)
+	}
+	return u
+}
+
+func (s *s3Store) request(method string, query url.Values, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body, time.Now().UTC())
+	return doRequest(req)
+}
+
+func (s *s3Store) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+
+	headerNames := []string{"host"}
+	for name := range req.Header {
+		headerNames = append(headerNames, strings.ToLower(name))
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range headerNames {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// URI-encodes each path segment as SigV4 requires: everything except the
+// RFC 3986 unreserved characters.
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3EscapeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, s3Escape(key)+"="+s3Escape(query.Get(key)))
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3Escape(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func (s *s3Store) get() (io.ReadCloser, error) {
+	resp, err := s.request("GET", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) startUpload() (string, error) {
+	resp, err := s.request("POST", url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadId string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+	s.uploadId = result.UploadId
+	return s.uploadId, nil
+}
+
+func (s *s3Store) resumeUpload(uploadId string) {
+	s.uploadId = uploadId
+}
+
+func (s *s3Store) uploadPart(partNumber int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {fmt.Sprint(partNumber)}, "uploadId": {s.uploadId}}
+	resp, err := s.request("PUT", query, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s *s3Store) completeUpload(partIds []string) error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var request struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for i, etag := range partIds {
+		request.Parts = append(request.Parts, part{i + 1, etag})
+	}
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := s.request("POST", url.Values{"uploadId": {s.uploadId}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 can report a failure with a 200 status once the response has begun.
+	var result struct {
+		XMLName xml.Name
+		Message string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err == nil && result.XMLName.Local == "Error" {
+		return errors.New("complete multipart upload: " + result.Message)
+	}
+	return nil
+}
+
+func (s *s3Store) abortUpload() error {
+	resp, err := s.request("DELETE", url.Values{"uploadId": {s.uploadId}}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) list() ([]string, error) {
+	bucket := *s
+	bucket.key = ""
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.key}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := bucket.request("GET", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, s.key))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Store) delete() error {
+	resp, err := s.request("DELETE", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Azure Blob Storage, authorized with a SAS token; uploads are staged as
+// blocks and committed with a block list.
+type azureStore struct {
+	account   string
+	container string
+	blob      string
+	sasToken  string
+}
+
+func (s *azureStore) request(method string, query string, body []byte) (*http.Response, error) {
+	u := &url.URL{
+		Scheme: "https",
+		Host:   s.account + ".blob.core.windows.net",
+		Path:   "/" + s.container,
+	}
+	if s.blob != "" {
+		u.Path += "/" + s.blob
+	}
+	rawQuery := s.sasToken
+	if query != "" {
+		if rawQuery != "" {
+			rawQuery += "&"
+		}
+		rawQuery += query
+	}
+	u.RawQuery = rawQuery
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("x-ms-version", "2020-10-02")
+	return doRequest(req)
+}
+
+func (s *azureStore) get() (io.ReadCloser, error) {
+	resp, err := s.request("GET", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *azureStore) startUpload() (string, error) {
+	return "", nil
+}
+
+// Blocks that have been staged, but not committed, are kept for a week.
+func (s *azureStore) resumeUpload(uploadId string) {
+}
+
+func (s *azureStore) uploadPart(partNumber int, data []byte) (string, error) {
+	// Block ids must all be the same length within a blob.
+	blockId := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", partNumber)))
+	resp, err := s.request("PUT", "comp=block&blockid="+url.QueryEscape(blockId), data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return blockId, nil
+}
+
+func (s *azureStore) completeUpload(partIds []string) error {
+	var request struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string
+	}
+	request.Latest = partIds
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := s.request("PUT", "comp=blocklist", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *azureStore) abortUpload() error {
+	// Uncommitted blocks are garbage collected by the service.
+	return nil
+}
+
+func (s *azureStore) list() ([]string, error) {
+	container := *s
+	container.blob = ""
+	var names []string
+	marker := ""
+	for {
+		query := "restype=container&comp=list&prefix=" + url.QueryEscape(s.blob)
+		if marker != "" {
+			query += "&marker=" + url.QueryEscape(marker)
+		}
+		resp, err := container.request("GET", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Blobs struct {
+				Blob []struct {
+					Name string
+				}
+			}
+			NextMarker string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range result.Blobs.Blob {
+			names = append(names, strings.TrimPrefix(blob.Name, s.blob))
+		}
+		if result.NextMarker == "" {
+			return names, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+func (s *azureStore) delete() error {
+	resp, err := s.request("DELETE", "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
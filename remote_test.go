@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// An objectStore that records the sizes of the parts uploaded to it.
+type fakeObjectStore struct {
+	partSizes []int
+	completed []string
+}
+
+func (s *fakeObjectStore) get() (io.ReadCloser, error)  { return nil, nil }
+func (s *fakeObjectStore) startUpload() (string, error) { return "upload", nil }
+func (s *fakeObjectStore) resumeUpload(uploadId string) {}
+func (s *fakeObjectStore) abortUpload() error           { return nil }
+func (s *fakeObjectStore) list() ([]string, error)      { return nil, nil }
+func (s *fakeObjectStore) delete() error                { return nil }
+
+func (s *fakeObjectStore) uploadPart(partNumber int, data []byte) (string, error) {
+	s.partSizes = append(s.partSizes, len(data))
+	return fmt.Sprint("part-", partNumber), nil
+}
+
+func (s *fakeObjectStore) completeUpload(partIds []string) error {
+	s.completed = partIds
+	return nil
+}
+
+func TestObjectPartSizes(t *testing.T) {
+	for _, test := range []struct {
+		partNumber int
+		size       int
+	}{
+		{1, objectPartSize},
+		{objectPartsPerSize, objectPartSize},
+		{objectPartsPerSize + 1, 2 * objectPartSize},
+		{2*objectPartsPerSize + 1, 4 * objectPartSize},
+		{objectMaxParts, objectMaxPartSize},
+	} {
+		if size := objectPartSizeFor(test.partNumber); size != test.size {
+			t.Errorf("part %d is %d bytes, expected %d", test.partNumber, size, test.size)
+		}
+	}
+
+	// Every archive that S3 will store as one object has to fit.
+	var total int64
+	for partNumber := 1; partNumber <= objectMaxParts; partNumber++ {
+		total += int64(objectPartSizeFor(partNumber))
+	}
+	if total < 5<<40 {
+		t.Errorf("parts only hold %d bytes", total)
+	}
+}
+
+func TestObjectWriterPartLimit(t *testing.T) {
+	store := &fakeObjectStore{}
+	w := &objectWriter{
+		store:   store,
+		name:    "s3://bucket/archive.fa",
+		buffer:  make([]byte, 0, 4),
+		partIds: make([]string, objectMaxParts-1),
+	}
+
+	// The last part allowed can be filled.
+	n, err := w.Write([]byte("abcd"))
+	if n != 4 || err != nil {
+		t.Fatalf("wrote %d bytes, %v; expected all 4", n, err)
+	}
+
+	// There's no room for any more.
+	n, err = w.Write([]byte("e"))
+	if n != 0 || err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("wrote %d bytes, %v; expected an error", n, err)
+	}
+	if len(store.partSizes) != 0 {
+		t.Errorf("uploaded %d parts, expected none", len(store.partSizes))
+	}
+}
+
+func TestObjectWriterClose(t *testing.T) {
+	store := &fakeObjectStore{}
+	w := &objectWriter{store: store, name: "s3://bucket/archive.fa", buffer: make([]byte, 0, 4)}
+	n, err := w.Write([]byte("abcdefghij"))
+	if n != 10 || err != nil {
+		t.Fatalf("wrote %d bytes, %v; expected all 10", n, err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(store.completed) != "[part-1 part-2]" {
+		t.Errorf("completed with %v", store.completed)
+	}
+	// The second part is as big as objectPartSizeFor says, rather than as
+	// big as the first.
+	if fmt.Sprint(store.partSizes) != "[4 6]" {
+		t.Errorf("uploaded parts of %v bytes", store.partSizes)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"unicode"
+)
+
+// The size of the one large file in a generated tree.
+const roundTripHugeSize = 8 << 20
+
+// Runs the create command with args, as given on the command line.
+func testCreate(t *testing.T, args ...string) error {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	common := addCommonFlags(fs)
+	opts := addCreateFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt64(&warningCount, 0)
+	return runCreate(common, opts, fs.Args())
+}
+
+// Runs the extract command with args, as given on the command line, extracting
+// into outputPath.
+func testExtract(t *testing.T, outputPath string, args ...string) error {
+	fs := flag.NewFlagSet("extract", flag.ContinueOnError)
+	common := addCommonFlags(fs)
+	input := addInputFlags(fs)
+	opts := addExtractFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	opts.outputPath = outputPath
+	atomic.StoreInt64(&warningCount, 0)
+	return runExtract(common, input, opts)
+}
+
+// Generates a randomized directory tree in root, with deep nesting, unicode
+// and arbitrary-byte names, empty files and directories, runs of identical
+// blocks, and one large file.  The same seed generates the same tree.
+func generateTree(t *testing.T, root string, seed int64) {
+	random := rand.New(rand.NewSource(seed))
+	mkdir := func(dir string) {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(name string, data []byte) {
+		if err := ioutil.WriteFile(filepath.Join(root, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	randomBytes := func(n int) []byte {
+		data := make([]byte, n)
+		random.Read(data)
+		return data
+	}
+
+	deep := "deep"
+	for i := 1; i <= 30+random.Intn(30); i++ {
+		deep = filepath.Join(deep, fmt.Sprintf("d%d", i))
+	}
+	mkdir(deep)
+	write(filepath.Join(deep, "bottom.txt"), []byte("bottom\n"))
+
+	names := []string{"café", "日本語", "ελληνικά", "emoji-😀", "with space", "tab\tname", "-dash", "#hash", "quote'\"",
+		"back\\slash", "CamelCase", "camelcase", "new\nline", "carriage\rreturn", "escape\x1b[0m"}
+	if runtime.GOOS == "linux" {
+		// Names are bytes, but not every filesystem will store them.
+		names = append(names, "latin1-\xe9", "invalid-\xff\xfe", "overlong-\xc0\xaf")
+	}
+	for _, name := range names {
+		mkdir(filepath.Join("names", name))
+		write(filepath.Join("names", name, name+".txt"), []byte(name+"\n"))
+	}
+
+	mkdir(filepath.Join("empty", "dir", "nested"))
+	for i := 1; i <= 1+random.Intn(20); i++ {
+		write(filepath.Join("empty", fmt.Sprintf("file%d", i)), nil)
+	}
+
+	// Small files of random sizes, including ones that straddle block
+	// boundaries.
+	for d := 1; d <= 5+random.Intn(10); d++ {
+		mkdir(filepath.Join("small", fmt.Sprint(d)))
+		for f := 1; f <= 10+random.Intn(50); f++ {
+			write(filepath.Join("small", fmt.Sprint(d), fmt.Sprint(f)), randomBytes(random.Intn(20000)))
+		}
+	}
+	for _, size := range []int{4095, 4096, 4097, 8192, 65535, 65536, 65537} {
+		write(filepath.Join("small", fmt.Sprintf("exact-%d", size)), randomBytes(size))
+	}
+
+	// Repeated blocks and repeated files, for --run-length and --dedup.
+	write("zeros", make([]byte, (1+random.Intn(4))<<20))
+	copied := randomBytes(100000)
+	write("copy1", copied)
+	write("copy2", copied)
+
+	write("huge", randomBytes(roundTripHugeSize))
+
+	for name, mode := range map[string]os.FileMode{
+		"small/1/1":           0600,
+		"small/exact-4096":    0755,
+		"empty/dir":           0700,
+		"names/café/café.txt": 0640,
+	} {
+		if err := os.Chmod(filepath.Join(root, name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Reports each difference between the trees at want and got: entries missing
+// from either, and entries that differ in type, permissions, or contents.
+func compareTrees(t *testing.T, want, got string) {
+	describe := func(root string) map[string]os.FileInfo {
+		entries := make(map[string]os.FileInfo)
+		err := filepath.Walk(root, func(filePath string, fileInfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			relative, _ := filepath.Rel(root, filePath)
+			entries[relative] = fileInfo
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	wantEntries, gotEntries := describe(want), describe(got)
+	for name, wantInfo := range wantEntries {
+		gotInfo, ok := gotEntries[name]
+		if !ok {
+			t.Errorf("%q wasn't extracted", name)
+			continue
+		}
+		if wantInfo.Mode() != gotInfo.Mode() {
+			t.Errorf("%q: mode is %v, expected %v", name, gotInfo.Mode(), wantInfo.Mode())
+		}
+		if !wantInfo.Mode().IsRegular() {
+			continue
+		}
+		wantData, err := ioutil.ReadFile(filepath.Join(want, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotData, err := ioutil.ReadFile(filepath.Join(got, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(wantData, gotData) {
+			t.Errorf("%q: contents differ", name)
+		}
+	}
+	for name := range gotEntries {
+		if _, ok := wantEntries[name]; !ok {
+			t.Errorf("%q was extracted, but wasn't archived", name)
+		}
+	}
+}
+
+// Archives a generated tree with each of a variety of options, extracts it,
+// and checks that it comes back as it was.
+func TestRoundTrip(t *testing.T) {
+	work := t.TempDir()
+	src := filepath.Join(work, "src")
+	generateTree(t, src, 1)
+	archive := filepath.Join(work, "archive.fa")
+
+	for _, options := range []string{
+		"",
+		"--format-version 2",
+		"--compress",
+		"--dedup",
+		"--run-length",
+		"--align 4096",
+		"--block-size 65535",
+		"--block-size 1",
+		"--mmap",
+		"--order small-first --one-file-system",
+		"--format-version 2 --compress --dedup --run-length",
+	} {
+		name := options
+		if name == "" {
+			name = "defaults"
+		}
+		t.Run(name, func(t *testing.T) {
+			if options == "--block-size 1" && testing.Short() {
+				t.Skip("one-byte blocks are slow")
+			}
+			args := append([]string{"-o", archive}, strings.Fields(options)...)
+			err := testCreate(t, append(args, src)...)
+			if err != nil {
+				t.Fatal("create:", err)
+			}
+			out := t.TempDir()
+			err = testExtract(t, out, "-i", archive)
+			if err != nil {
+				t.Fatal("extract:", err)
+			}
+			compareTrees(t, src, filepath.Join(out, falib.RelativePath(src)))
+		})
+	}
+}
+
+// Checks that --sanitize-names leaves no control characters in extracted
+// names.
+func TestRoundTripSanitizeNames(t *testing.T) {
+	work := t.TempDir()
+	src := filepath.Join(work, "src")
+	generateTree(t, src, 2)
+	archive := filepath.Join(work, "archive.fa")
+	err := testCreate(t, "-o", archive, src)
+	if err != nil {
+		t.Fatal("create:", err)
+	}
+	out := t.TempDir()
+	err = testExtract(t, out, "--sanitize-names", "-i", archive)
+	if err != nil {
+		t.Fatal("extract:", err)
+	}
+	extracted := filepath.Join(out, falib.RelativePath(src))
+	filepath.Walk(extracted, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if strings.IndexFunc(filepath.Base(filePath), unicode.IsControl) >= 0 {
+			t.Errorf("%q has control characters", filePath)
+		}
+		return nil
+	})
+	_, err = os.Stat(filepath.Join(extracted, "names", "new%0Aline", "new%0Aline.txt"))
+	if err != nil {
+		t.Error("a newline wasn't escaped:", err)
+	}
+}
+
+// Checks that a usage error is returned with its exit status, rather than
+// exiting the process.
+func TestCreateUsageError(t *testing.T) {
+	err := testCreate(t, "--compress", "--align", "4096", t.TempDir())
+	statusErr, ok := err.(*statusError)
+	if !ok || statusErr.status != exitUsage {
+		t.Errorf("got %v, expected a usage error", err)
+	}
+}
+
+// Checks that the snapshot file isn't updated when an output can't be closed,
+// so that the next incremental archive still has the changes.
+func TestSnapshotAfterFailedClose(t *testing.T) {
+	work := t.TempDir()
+	src := filepath.Join(work, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "first.txt"), []byte("first\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := filepath.Join(work, "snapshot")
+	err := testCreate(t, "--snapshot-file", snapshot, "-o", filepath.Join(work, "full.fa"), src)
+	if err != nil {
+		t.Fatal("create:", err)
+	}
+	saved, err := ioutil.ReadFile(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(src, "second.txt"), []byte("second\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The program reads the whole archive, so only closing the output fails.
+	err = testCreate(t, "--snapshot-file", snapshot, "--use-compress-program", "cat >/dev/null; exit 1",
+		"-o", filepath.Join(work, "incremental.fa"), src)
+	if err == nil || !strings.Contains(err.Error(), "closing output") {
+		t.Fatalf("got %v, expected an error closing the output", err)
+	}
+	current, err := ioutil.ReadFile(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(current, saved) {
+		t.Error("the snapshot file was updated")
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"flag"
+	"github.com/replicon/fast-archiver/falib"
+	"html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Serves an archive over HTTP, for browsing in a web browser and for scripts:
+//
+//	/browse/PATH       a page listing the directory PATH
+//	/api/list/PATH     the entries of the directory PATH, as JSON
+//	/files/PATH        the contents of the file PATH; ranges are supported
+//	/archive/PATH      PATH and everything in it, as a fast-archiver archive,
+//	                   or with ?format=tar, as a tar file
+//
+// Like mount, the archive is indexed when the server starts, so that any file
+// can be read without reading the archive up to it.
+func setupServe(fs *flag.FlagSet) func(args []string) {
+	listen := fs.String("listen", ":8080", "address to serve on")
+	verbose := fs.Bool("v", false, "log each request on stderr")
+	return func(args []string) {
+		if len(args) != 1 {
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		file, err := os.Open(args[0])
+		if err != nil {
+			fatal(exitError, "Error opening archive:", err.Error())
+		}
+		defer file.Close()
+		s := &archiveServer{name: path.Base(args[0]), logger: &MultiLevelLogger{logger, *verbose}}
+		s.logger.Verbose("indexing", args[0])
+		s.index, err = falib.NewIndex(file)
+		if err != nil {
+			fatal(archiveErrorStatus(err), "Error reading archive:", err.Error())
+		}
+
+		listener, err := net.Listen("tcp", *listen)
+		if err != nil {
+			fatal(exitError, "Error listening on --listen address:", err.Error())
+		}
+		server := &http.Server{Handler: s.handler()}
+		handleInterrupts(func() { server.Close() })
+		logger.Println("serving", args[0], "at http://"+listener.Addr().String()+"/")
+		err = server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			fatal(exitError, "Error serving:", err.Error())
+		}
+	}
+}
+
+type archiveServer struct {
+	index  *falib.Index
+	name   string
+	logger *MultiLevelLogger
+}
+
+func (s *archiveServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/browse/", http.StatusFound)
+	})
+	mux.HandleFunc("/browse/", s.serveBrowse)
+	mux.HandleFunc("/api/list/", s.serveList)
+	mux.HandleFunc("/files/", s.serveFile)
+	mux.HandleFunc("/archive/", s.serveArchive)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.logger.Verbose(r.RemoteAddr, r.Method, r.URL.String())
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Returns the entry named by the rest of the request's path after prefix, or
+// nil after replying with an error if there isn't one.
+func (s *archiveServer) entry(w http.ResponseWriter, r *http.Request, prefix string) *falib.IndexEntry {
+	entry := s.index.Lookup(strings.TrimPrefix(r.URL.Path, prefix))
+	if entry == nil {
+		http.NotFound(w, r)
+	}
+	return entry
+}
+
+// Returns the URL path of filePath under prefix.
+func entryURL(prefix, filePath string) string {
+	if filePath == "." {
+		return prefix
+	}
+	return (&url.URL{Path: prefix + filePath}).String()
+}
+
+// An entry as it's described by /api/list.
+type listedEntry struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Type     string    `json:"type"`
+	Mode     string    `json:"mode"`
+	Size     int64     `json:"size"`
+	Uid      int       `json:"uid"`
+	Gid      int       `json:"gid"`
+	Modified time.Time `json:"modified"`
+}
+
+func listEntry(entry *falib.IndexEntry) listedEntry {
+	entryType := "special"
+	if entry.Mode.IsDir() {
+		entryType = "directory"
+	} else if entry.Mode.IsRegular() {
+		entryType = "file"
+	}
+	return listedEntry{path.Base(entry.Path), entry.Path, entryType, entry.Mode.String(), entry.Size, entry.Uid, entry.Gid, entry.ModTime}
+}
+
+// Returns the entries of the directory entry, in order of name.
+func (s *archiveServer) children(entry *falib.IndexEntry) []listedEntry {
+	retval := []listedEntry{}
+	for _, name := range s.index.ReadDir(entry.Path) {
+		retval = append(retval, listEntry(s.index.Lookup(path.Join(entry.Path, name))))
+	}
+	return retval
+}
+
+func (s *archiveServer) serveList(w http.ResponseWriter, r *http.Request) {
+	entry := s.entry(w, r, "/api/list/")
+	if entry == nil {
+		return
+	}
+	var response struct {
+		listedEntry
+		Entries []listedEntry `json:"entries,omitempty"`
+	}
+	response.listedEntry = listEntry(entry)
+	if entry.Mode.IsDir() {
+		response.Entries = s.children(entry)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *archiveServer) serveFile(w http.ResponseWriter, r *http.Request) {
+	entry := s.entry(w, r, "/files/")
+	if entry == nil {
+		return
+	} else if entry.Mode.IsDir() {
+		http.Redirect(w, r, entryURL("/browse/", entry.Path)+"/", http.StatusFound)
+		return
+	} else if !entry.Mode.IsRegular() {
+		http.Error(w, "not a regular file", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Disposition", attachment(path.Base(entry.Path)))
+	http.ServeContent(w, r, entry.Path, entry.ModTime, s.index.Open(entry))
+}
+
+// Returns a Content-Disposition header that saves a download as name.
+func attachment(name string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name})
+}
+
+var browseTemplate = template.Must(template.New("browse").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Archive}}: {{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1em; text-align: left; }
+td.size { text-align: right; font-family: monospace; }
+td.mode { font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>{{.Archive}}</h1>
+<p>{{range .Crumbs}}<a href="{{.URL}}">{{.Name}}</a> / {{end}}
+&mdash; download as <a href="{{.ArchiveURL}}">fast-archiver</a> or <a href="{{.ArchiveURL}}?format=tar">tar</a></p>
+<table>
+<tr><th>Name</th><th>Mode</th><th>Size</th><th>Modified</th></tr>
+{{range .Entries}}<tr>
+<td>{{if eq .Type "special"}}{{.Name}}{{else}}<a href="{{.URL}}">{{.Name}}{{if eq .Type "directory"}}/{{end}}</a>{{end}}</td>
+<td class="mode">{{.Mode}}</td>
+<td class="size">{{if eq .Type "file"}}{{.Size}}{{end}}</td>
+<td>{{if not .Modified.IsZero}}{{.Modified.Format "2006-01-02 15:04:05"}}{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (s *archiveServer) serveBrowse(w http.ResponseWriter, r *http.Request) {
+	entry := s.entry(w, r, "/browse/")
+	if entry == nil {
+		return
+	} else if !entry.Mode.IsDir() {
+		http.Redirect(w, r, entryURL("/files/", entry.Path), http.StatusFound)
+		return
+	}
+
+	type link struct {
+		Name string
+		URL  string
+	}
+	crumbs := []link{{s.name, "/browse/"}}
+	if entry.Path != "." {
+		parts := strings.Split(entry.Path, "/")
+		for i := range parts {
+			crumbs = append(crumbs, link{parts[i], entryURL("/browse/", strings.Join(parts[:i+1], "/")) + "/"})
+		}
+	}
+	type browsedEntry struct {
+		listedEntry
+		URL string
+	}
+	var entries []browsedEntry
+	for _, child := range s.children(entry) {
+		childURL := entryURL("/files/", child.Path)
+		if child.Type == "directory" {
+			childURL = entryURL("/browse/", child.Path) + "/"
+		}
+		entries = append(entries, browsedEntry{child, childURL})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := browseTemplate.Execute(w, map[string]interface{}{
+		"Archive":    s.name,
+		"Path":       entry.Path,
+		"Crumbs":     crumbs,
+		"ArchiveURL": entryURL("/archive/", entry.Path),
+		"Entries":    entries,
+	})
+	if err != nil {
+		s.logger.Verbose("error writing page:", err.Error())
+	}
+}
+
+// Sends an entry and everything in it as an archive of the requested format.
+// The entries keep their paths in the served archive.
+func (s *archiveServer) serveArchive(w http.ResponseWriter, r *http.Request) {
+	entry := s.entry(w, r, "/archive/")
+	if entry == nil {
+		return
+	}
+	name := path.Base(entry.Path)
+	if entry.Path == "." {
+		name = strings.TrimSuffix(s.name, path.Ext(s.name))
+	}
+
+	var err error
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "fast-archiver":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", attachment(name+".fast-archive"))
+		err = s.writeArchive(w, entry)
+	case "tar":
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", attachment(name+".tar"))
+		err = s.writeTar(w, entry)
+	default:
+		http.Error(w, "format must be fast-archiver or tar", http.StatusBadRequest)
+		return
+	}
+	// The response has already started, so all that can be done about an
+	// error is to cut it short.
+	if err != nil {
+		s.logger.Warning("Error sending", entry.Path+":", err.Error())
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// Calls fn with entry and everything inside it, each directory before what's
+// in it.
+func (s *archiveServer) walk(entry *falib.IndexEntry, fn func(entry *falib.IndexEntry) error) error {
+	err := fn(entry)
+	if err != nil || !entry.Mode.IsDir() {
+		return err
+	}
+	for _, name := range s.index.ReadDir(entry.Path) {
+		err = s.walk(s.index.Lookup(path.Join(entry.Path, name)), fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *archiveServer) writeArchive(output io.Writer, top *falib.IndexEntry) error {
+	writer := falib.NewWriter(output)
+	err := s.walk(top, func(entry *falib.IndexEntry) error {
+		if entry.Path == "." {
+			return nil
+		}
+		err := writer.WriteHeader(&falib.Entry{Path: entry.Path, Mode: entry.Mode, Uid: entry.Uid, Gid: entry.Gid,
+			Major: entry.Major, Minor: entry.Minor, ModTime: entry.ModTime})
+		if err == nil && entry.Mode.IsRegular() {
+			_, err = io.Copy(writer, s.index.Open(entry))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+func (s *archiveServer) writeTar(output io.Writer, top *falib.IndexEntry) error {
+	writer := tar.NewWriter(output)
+	err := s.walk(top, func(entry *falib.IndexEntry) error {
+		if entry.Path == "." {
+			return nil
+		}
+		header, ok := tarHeader(&falib.Entry{Path: entry.Path, Mode: entry.Mode, Uid: entry.Uid, Gid: entry.Gid,
+			Major: entry.Major, Minor: entry.Minor, ModTime: entry.ModTime}, entry.Size)
+		if !ok {
+			// Sockets can't be stored in a tar file.
+			return nil
+		}
+		err := writer.WriteHeader(header)
+		if err == nil && entry.Mode.IsRegular() {
+			_, err = io.Copy(writer, s.index.Open(entry))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
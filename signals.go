@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var interruptLock sync.Mutex
+var interruptSignal os.Signal
+var interruptStop func()
+var interruptSetup sync.Once
+
+// Calls stop when SIGINT or SIGTERM is received, so that the run can wind
+// down and clean up after itself.  A second signal exits immediately, in case
+// the run is stuck (eg. waiting on a stalled network input).  Calling it again
+// replaces the stop function, for a process that runs several archivers in
+// turn.
+func handleInterrupts(stop func()) {
+	interruptLock.Lock()
+	interruptStop = stop
+	interruptLock.Unlock()
+	interruptSetup.Do(func() {
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			interruptLock.Lock()
+			interruptSignal = sig
+			stop := interruptStop
+			interruptLock.Unlock()
+			logger.Println("interrupted; stopping (interrupt again to exit immediately)")
+			stop()
+
+			<-signals
+			exit(interruptedStatus())
+		}()
+	})
+}
+
+// Returns true once SIGINT or SIGTERM has been received.
+func interruptReceived() bool {
+	interruptLock.Lock()
+	defer interruptLock.Unlock()
+	return interruptSignal != nil
+}
+
+// Returns the exit status for a run stopped by a signal: 128 plus the signal
+// number, as shells report it (130 for SIGINT, 143 for SIGTERM).
+func interruptedStatus() int {
+	interruptLock.Lock()
+	defer interruptLock.Unlock()
+	if sig, ok := interruptSignal.(syscall.Signal); ok {
+		return 128 + int(sig)
+	}
+	return 130
+}
+
+// Exits after a run was stopped by a signal.
+func exitInterrupted() {
+	logger.Println("interrupted")
+	exit(interruptedStatus())
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Returns true if name refers to a file on another host, in scp's
+// [user@]host:path form: a colon before any slash.  A local file whose name
+// contains a colon can be given as ./name.
+func isSSHPath(name string) bool {
+	if isNetworkURL(name) || isObjectURL(name) || strings.Contains(name, "://") {
+		return false
+	}
+	i := strings.IndexByte(name, ':')
+	if i < 0 || strings.ContainsRune(name[:i], '/') {
+		return false
+	}
+	// A single letter is a Windows drive, not a host.
+	return i > 1
+}
+
+func splitSSHPath(name string) (host, path string) {
+	i := strings.IndexByte(name, ':')
+	host, path = name[:i], name[i+1:]
+	if path == "" {
+		path = "."
+	}
+	return host, path
+}
+
+// Quotes s for the remote shell that ssh runs commands with.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func sshCommand(host, command string) *exec.Cmd {
+	return exec.Command("ssh", "--", host, command)
+}
+
+// Where a remote file's contents are written from: the ssh command's stdout
+// is discarded, and removing the target removes the remote file.
+type sshTarget struct {
+	host string
+	path string
+}
+
+func (t *sshTarget) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (t *sshTarget) Close() error {
+	return nil
+}
+
+func (t *sshTarget) remove() error {
+	return sshCommand(t.host, "rm -f -- "+shellQuote(t.path)).Run()
+}
+
+// Creates a file on another host, written through ssh.
+func createSSHWriter(name string) (io.WriteCloser, error) {
+	host, path := splitSSHPath(name)
+	target := &sshTarget{host, path}
+	writer, err := startProgramWriter(sshCommand(host, "cat > "+shellQuote(path)), "ssh", target)
+	if err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Reads a file on another host through ssh.
+func openSSHReader(name string) (io.ReadCloser, error) {
+	host, path := splitSSHPath(name)
+	cmd := sshCommand(host, "cat -- "+shellQuote(path))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &commandReader{cmd: cmd, stdout: stdout, name: "ssh"}, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"io/ioutil"
+	"time"
+)
+
+// The --stats-json summary of a run.  Times are in seconds, and throughputs in
+// bytes per second of elapsed time.
+type statsRecord struct {
+	Directories      int64        `json:"directories"`
+	Files            int64        `json:"files"`
+	Specials         int64        `json:"specials"`
+	Symlinks         int64        `json:"symlinks"`
+	Deleted          int64        `json:"deleted"`
+	BytesRead        int64        `json:"bytes_read"`
+	BytesWritten     int64        `json:"bytes_written"`
+	Ratio            float64      `json:"ratio"`
+	CompressedBlocks int64        `json:"compressed_blocks"`
+	Retries          int64        `json:"retries"`
+	Rereads          int64        `json:"rereads"`
+	Elapsed          float64      `json:"elapsed"`
+	Stages           []stageStats `json:"stages"`
+}
+
+type stageStats struct {
+	Name       string  `json:"name"`
+	Bytes      int64   `json:"bytes"`
+	Busy       float64 `json:"busy"`
+	Throughput float64 `json:"throughput"`
+}
+
+func stages(stats falib.Stats) []stageStats {
+	stage := func(name string, bytes int64, busy time.Duration) stageStats {
+		throughput := 0.0
+		if stats.Elapsed > 0 {
+			throughput = float64(bytes) / stats.Elapsed.Seconds()
+		}
+		return stageStats{name, bytes, busy.Seconds(), throughput}
+	}
+	retval := []stageStats{
+		stage("scan", 0, stats.ScanTime),
+		stage("read", stats.BytesRead, stats.ReadTime),
+	}
+	if stats.HashTime > 0 {
+		retval = append(retval, stage("hash", stats.BytesRead, stats.HashTime))
+	}
+	if stats.CompressTime > 0 {
+		retval = append(retval, stage("compress", stats.CompressIn, stats.CompressTime))
+	}
+	return append(retval, stage("write", stats.BytesWritten, stats.WriteTime))
+}
+
+// Prints a summary of an archiver's run to stderr.
+func printStats(stats falib.Stats) {
+	logger.Printf("archived %d files, %d directories, and %d special files in %s\n",
+		stats.Files, stats.Directories, stats.Specials, stats.Elapsed.Round(time.Millisecond))
+	logger.Printf("read %s, wrote %s (%.1f%%)\n", formatSize(stats.BytesRead), formatSize(stats.BytesWritten), 100*stats.Ratio())
+	if stats.Symlinks > 0 {
+		logger.Printf("archived %d symbolic links\n", stats.Symlinks)
+	}
+	if stats.Retries > 0 {
+		logger.Printf("retried %d opens and reads after transient errors\n", stats.Retries)
+	}
+	if stats.Rereads > 0 {
+		logger.Printf("read files again %d times after they changed while being read\n", stats.Rereads)
+	}
+	for _, s := range stages(stats) {
+		rate := ""
+		if s.Bytes > 0 {
+			rate = fmt.Sprintf("%s/s", formatSize(int64(s.Throughput)))
+		}
+		logger.Printf("  %-9s %12s  busy %s\n", s.Name, rate, time.Duration(s.Busy*float64(time.Second)).Round(time.Millisecond))
+	}
+}
+
+// Writes a summary of an archiver's run to fileName as JSON.
+func writeStatsJSON(fileName string, stats falib.Stats) error {
+	record := statsRecord{
+		Directories:      stats.Directories,
+		Files:            stats.Files,
+		Specials:         stats.Specials,
+		Symlinks:         stats.Symlinks,
+		Deleted:          stats.Deleted,
+		BytesRead:        stats.BytesRead,
+		BytesWritten:     stats.BytesWritten,
+		Ratio:            stats.Ratio(),
+		CompressedBlocks: stats.CompressedBlocks,
+		Retries:          stats.Retries,
+		Rereads:          stats.Rereads,
+		Elapsed:          stats.Elapsed.Seconds(),
+		Stages:           stages(stats),
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, append(data, '\n'), 0666)
+}
@@ -0,0 +1,32 @@
+#!/bin/bash
+#
+# Regenerates the golden archives, and what they're expected to contain, with
+# the given fast-archiver binary:
+#
+#     testdata/golden/make.sh ./fast-archiver
+#
+# Only do this for a deliberate change to the file format; the point of the
+# golden archives is that every later version can still read them.
+
+set -e
+
+FA=$(realpath "${1:-./fast-archiver}")
+golden=$(cd "$(dirname "$0")" && pwd)
+work=$(mktemp -d)
+trap 'rm -rf "$work"' EXIT
+
+"$golden/tree.sh" "$work"
+cd "$work"
+
+golden_archive() {
+    local name=$1
+    shift
+    "$FA" create -o "$golden/$name.fa" "$@" tree
+    "$FA" list -v -i "$golden/$name.fa" > "$golden/$name.list"
+}
+golden_archive v1
+golden_archive v2 --format-version 2
+golden_archive v2-compress-runlength --format-version 2 --compress --run-length
+golden_archive v1-dedup-align --dedup --align 512 --block-size 1024
+
+find tree -type f -exec sha256sum {} + | sort -k 2 > "$golden/SHA256SUMS"
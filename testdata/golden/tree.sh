@@ -0,0 +1,32 @@
+#!/bin/bash
+#
+# Creates the tree that the golden archives were made from, in DIR/tree:
+#
+#     testdata/golden/tree.sh DIR
+#
+# Everything about it is fixed, so that archives of it only differ by the
+# time and host they were created on.
+
+set -e
+
+if [ -z "$1" ]; then
+    echo "Usage: $0 DIR" >&2
+    exit 2
+fi
+tree=$1/tree
+
+mkdir -p "$tree/a/b/c" "$tree/empty" "$tree/café"
+echo hello > "$tree/a/hello.txt"
+: > "$tree/a/b/empty.txt"
+printf 'line one\nline two\n' > "$tree/café/日本語.txt"
+# Deterministic, incompressible-looking data, and runs of identical blocks.
+for i in $(seq 1 2000); do
+    echo "$i $((i * 7919 % 104729)) $((i * i % 65521))"
+done > "$tree/a/b/c/numbers"
+head -c 40000 /dev/zero > "$tree/zeros"
+cp "$tree/a/b/c/numbers" "$tree/numbers-copy"
+mkfifo "$tree/fifo"
+
+chmod 640 "$tree/a/hello.txt"
+chmod 750 "$tree/a/b"
+find "$tree" -exec touch -h -d "2020-01-02T03:04:05Z" {} +
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"github.com/replicon/fast-archiver/falib"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Builds a preset dictionary for create --compress-dict from samples of the
+// files in directory trees.  Only small files are sampled, since those are
+// the ones that a dictionary helps; larger files compress well on their own.
+func setupTrainDictionary(fs *flag.FlagSet) func(args []string) {
+	verbose := fs.Bool("v", false, "list each file as it's sampled")
+	outputFileName := fs.String("o", "", "write the dictionary to this file; defaults to stdout")
+	size := fs.Int("size", 32768, "size of the dictionary, in bytes; at most 32768")
+	maxFileSize := fs.Int64("max-file-size", 64*1024, "only sample files up to this many bytes")
+	sampleLimit := fs.Int64("sample-limit", 8*1024*1024, "stop sampling after this many bytes of files")
+	exclude := fs.String("exclude", "", "file patterns to exclude (eg. core.*); can be path list separated (eg. : in Linux) for multiple excludes")
+	return func(args []string) {
+		if len(args) == 0 {
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		if *size <= 0 || *size > 32768 {
+			fatal(exitUsage, "--size must be between 1 and 32768")
+		}
+		logger := &MultiLevelLogger{logger, *verbose}
+		excludePatterns := filepath.SplitList(*exclude)
+
+		var samples [][]byte
+		var sampled int64
+		for _, directory := range args {
+			err := filepath.Walk(directory, func(filePath string, fileInfo os.FileInfo, err error) error {
+				if err != nil {
+					logger.Warning("skipping", filePath+":", err.Error())
+					return nil
+				}
+				for _, pattern := range excludePatterns {
+					if match, _ := filepath.Match(pattern, fileInfo.Name()); match {
+						if fileInfo.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+				}
+				if !fileInfo.Mode().IsRegular() || fileInfo.Size() == 0 || fileInfo.Size() > *maxFileSize {
+					return nil
+				}
+				if sampled >= *sampleLimit {
+					return io.EOF
+				}
+				data, err := ioutil.ReadFile(filePath)
+				if err != nil {
+					logger.Warning("skipping", filePath+":", err.Error())
+					return nil
+				}
+				logger.Verbose(filePath)
+				samples = append(samples, data)
+				sampled += int64(len(data))
+				return nil
+			})
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				fatal(exitError, "Error scanning", directory+":", err.Error())
+			}
+		}
+
+		dictionary := falib.TrainDictionary(samples, *size)
+		if len(dictionary) == 0 {
+			fatal(exitError, "Unable to build a dictionary: the sampled files have nothing in common")
+		}
+		var err error
+		if *outputFileName != "" {
+			err = ioutil.WriteFile(*outputFileName, dictionary, 0644)
+		} else {
+			_, err = os.Stdout.Write(dictionary)
+		}
+		if err != nil {
+			fatal(exitError, "Error writing dictionary:", err.Error())
+		}
+		logger.Verbose("sampled", len(samples), "files,", sampled, "bytes; wrote a dictionary of", len(dictionary), "bytes")
+		exitIfWarned()
+	}
+}
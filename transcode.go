@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"github.com/replicon/fast-archiver/falib"
+	"io"
+	"math"
+	"net"
+	"os"
+)
+
+// Rewrites an archive with different settings, such as compression or block
+// size, reading it entry by entry and writing each one straight out again, so
+// that nothing is extracted to disk.
+func setupTranscode(fs *flag.FlagSet) func(args []string) {
+	input := addInputFlags(fs)
+	verbose := fs.Bool("v", false, "list each entry as it's copied")
+	outputFileName := fs.String("o", "", "output archive file, object, or [user@]host:path over ssh; defaults to stdout")
+	outputProgram := fs.String("output-compress-program", "", "pipe the new archive through this command (eg. \"zstd -T0\", or \"gpg -e -r KEY\" to encrypt it)")
+	blockSize := fs.Uint("block-size", 4096, "internal block-size of the new archive")
+	compress := fs.Bool("compress", false, "compress each data block of the new archive with deflate")
+	runLength := fs.Bool("run-length", false, "store runs of identical blocks within a file as a single block and a repeat count")
+	align := fs.Int("align", 0, "pad the new archive so that file data starts at multiples of this many bytes")
+	formatVersion := fs.Int("format-version", 1, "format version of the new archive; 2 is smaller, but can't be read by older versions of fast-archiver")
+	return func(args []string) {
+		if len(args) != 0 {
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		if *blockSize == 0 || *blockSize > math.MaxUint16 {
+			fatal(exitUsage, "block-size must be between 1 and", math.MaxUint16)
+		}
+		if *compress && *align != 0 {
+			fatal(exitUsage, "--compress and --align cannot be used together")
+		}
+		logger := &MultiLevelLogger{logger, *verbose}
+
+		inputFile := input.open()
+		defer inputFile.Close()
+		if conn, ok := inputFile.(net.Conn); ok {
+			err := sendEmptyResumeRequest(conn)
+			if err != nil {
+				fatal(exitError, "Error sending resume request:", err.Error())
+			}
+		}
+
+		var output io.WriteCloser = os.Stdout
+		if *outputFileName != "" {
+			var err error
+			output, err = createOutput(*outputFileName, nil)
+			if err != nil {
+				fatal(exitError, "Error creating output:", err.Error())
+			}
+		}
+		if *outputProgram != "" {
+			writer, err := compressOutput(*outputProgram, output)
+			if err != nil {
+				abortOutput(output, true)
+				fatal(exitError, "Error starting compress program:", err.Error())
+			}
+			output = writer
+		}
+
+		reader := falib.NewReader(inputFile)
+		defer reader.Close()
+		writer := falib.NewWriter(output)
+		writer.BlockSize = uint16(*blockSize)
+		writer.Compress = *compress
+		writer.RunLength = *runLength
+		writer.Align = *align
+		writer.FormatVersion = *formatVersion
+		writer.Logger = logger
+
+		err := transcode(reader, writer, int(*blockSize), logger)
+		if err == nil {
+			err = writer.Close()
+		}
+		if err == nil && output != os.Stdout {
+			err = output.Close()
+		}
+		if err != nil {
+			abortOutput(output, true)
+			fatal(archiveErrorStatus(err), "Error transcoding archive:", err.Error())
+		}
+	}
+}
+
+// Copies every entry of the archive read by reader to writer.  Each read of a
+// file returns at most one of the old archive's blocks, so the data is
+// gathered into full blocks of the new size before it's written.
+func transcode(reader *falib.Reader, writer *falib.Writer, blockSize int, logger *MultiLevelLogger) error {
+	buffer := make([]byte, blockSize)
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		logger.Verbose(entry.Path)
+		err = writer.WriteHeader(entry)
+		if err != nil {
+			return err
+		}
+		for entry.Mode.IsRegular() && !entry.Deleted {
+			n := 0
+			for n < len(buffer) && err == nil {
+				var read int
+				read, err = reader.Read(buffer[n:])
+				n += read
+			}
+			if n > 0 {
+				_, writeErr := writer.Write(buffer[:n])
+				if writeErr != nil {
+					return writeErr
+				}
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Transforms built into fast-archiver, used with --transform PATTERN=@NAME.
+var namedTransforms = map[string]falib.TransformFunc{
+	"crlf-to-lf": lineEndingTransform(false),
+	"lf-to-crlf": lineEndingTransform(true),
+}
+
+// The values of --transform flags, each PATTERN=COMMAND or PATTERN=@NAME.  The
+// flag can be given more than once.
+type transformFlags []falib.Transform
+
+func (t *transformFlags) String() string {
+	return ""
+}
+
+func (t *transformFlags) Set(value string) error {
+	i := strings.IndexByte(value, '=')
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("expected PATTERN=COMMAND or PATTERN=@NAME")
+	}
+	pattern, action := value[:i], value[i+1:]
+	if strings.HasPrefix(action, "@") {
+		transform, ok := namedTransforms[action[1:]]
+		if !ok {
+			return fmt.Errorf("unknown transform %s", action)
+		}
+		*t = append(*t, falib.Transform{Pattern: pattern, Func: transform})
+	} else {
+		*t = append(*t, falib.Transform{Pattern: pattern, Func: commandTransform(action)})
+	}
+	return nil
+}
+
+func (t *transformFlags) reset() {
+	*t = nil
+}
+
+// Returns a transform that runs each file's contents through a shell command,
+// from its stdin to its stdout.  The file's path is in $FA_PATH.  If the
+// command exits unsuccessfully, reading its output fails.
+func commandTransform(command string) falib.TransformFunc {
+	return func(filePath string, contents io.Reader) (io.Reader, error) {
+		cmd := exec.Command("/bin/sh", "-c", command)
+		cmd.Env = append(os.Environ(), "FA_PATH="+filePath)
+		cmd.Stdin = contents
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		err = cmd.Start()
+		if err != nil {
+			return nil, err
+		}
+		return &commandReader{cmd: cmd, stdout: stdout, name: "transform command"}, nil
+	}
+}
+
+// The output of a command, which reports the command's failure once its
+// output has been read.  name describes the command in errors.
+type commandReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	name   string
+	waited bool
+	err    error
+}
+
+func (r *commandReader) Read(p []byte) (int, error) {
+	if r.waited {
+		// The output was already read to the end, and the pipe closed.
+		return 0, r.eof()
+	}
+	n, err := r.stdout.Read(p)
+	if err == io.EOF {
+		err = r.eof()
+	}
+	return n, err
+}
+
+// Returns the error to give once the output has been read to the end: EOF,
+// or the command's failure.
+func (r *commandReader) eof() error {
+	if werr := r.wait(); werr != nil {
+		return fmt.Errorf("%s: %w", r.name, werr)
+	}
+	return io.EOF
+}
+
+func (r *commandReader) wait() error {
+	if !r.waited {
+		r.waited = true
+		r.err = r.cmd.Wait()
+	}
+	return r.err
+}
+
+// Stops the command if it's still running, eg. because the file couldn't be
+// read to the end.
+func (r *commandReader) Close() error {
+	if !r.waited {
+		r.stdout.Close()
+		r.cmd.Process.Kill()
+		r.wait()
+	}
+	return nil
+}
+
+// Returns a transform that converts line endings to CRLF, or to LF.
+func lineEndingTransform(crlf bool) falib.TransformFunc {
+	return func(filePath string, contents io.Reader) (io.Reader, error) {
+		pipeReader, pipeWriter := io.Pipe()
+		go func() {
+			input := bufio.NewReader(contents)
+			output := bufio.NewWriter(pipeWriter)
+			var err error
+			for err == nil {
+				var line []byte
+				line, err = input.ReadBytes('\n')
+				if bytes.HasSuffix(line, []byte("\n")) {
+					line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+					if crlf {
+						line = append(line, '\r', '\n')
+					} else {
+						line = append(line, '\n')
+					}
+				}
+				_, werr := output.Write(line)
+				if werr != nil {
+					err = werr
+				}
+			}
+			if err == io.EOF {
+				err = output.Flush()
+			}
+			pipeWriter.CloseWithError(err)
+		}()
+		return pipeReader, nil
+	}
+}
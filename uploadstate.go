@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// The parts of object storage uploads that have been completed, kept in a
+// local file with --resume-upload so that a failed upload can carry on from
+// where it left off when the archive is created again.  Parts whose data
+// turns out the same the next time aren't uploaded again.
+type uploadState struct {
+	fileName string
+	lock     sync.Mutex
+	Uploads  map[string]*resumableUpload `json:"uploads"`
+}
+
+// An upload that's in progress, and the parts of it that have been uploaded.
+type resumableUpload struct {
+	UploadId string         `json:"upload_id"`
+	PartSize int            `json:"part_size"`
+	Parts    []uploadedPart `json:"parts"`
+}
+
+type uploadedPart struct {
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+	Id     string `json:"id"`
+}
+
+// Loads the upload state from fileName.  A file that doesn't exist has no
+// uploads in progress.
+func loadUploadState(fileName string) (*uploadState, error) {
+	s := &uploadState{fileName: fileName, Uploads: make(map[string]*resumableUpload)}
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Uploads == nil {
+		s.Uploads = make(map[string]*resumableUpload)
+	}
+	return s, nil
+}
+
+// Returns the upload of name that's in progress, if it was uploaded in parts
+// of the current size.
+func (s *uploadState) upload(name string) (resumableUpload, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	upload, ok := s.Uploads[name]
+	if !ok || upload.PartSize != objectPartSize {
+		return resumableUpload{}, false
+	}
+	return *upload, true
+}
+
+// Records the start of an upload of name, replacing any earlier one.
+func (s *uploadState) start(name, uploadId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Uploads[name] = &resumableUpload{UploadId: uploadId, PartSize: objectPartSize}
+	return s.save()
+}
+
+// Records that a part of name's upload has been uploaded.  Parts after it
+// were uploaded with different data in an earlier run, and have to be
+// uploaded again.
+func (s *uploadState) record(name string, partNumber int, part uploadedPart) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	upload := s.Uploads[name]
+	if len(upload.Parts) >= partNumber {
+		upload.Parts = upload.Parts[:partNumber-1]
+	}
+	upload.Parts = append(upload.Parts, part)
+	return s.save()
+}
+
+// Forgets the upload of name, once it has been completed.  The file is
+// removed when no uploads are left in it.
+func (s *uploadState) finish(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.Uploads, name)
+	if len(s.Uploads) == 0 {
+		err := os.Remove(s.fileName)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	return s.save()
+}
+
+// Writes the state to its file, replacing it in one step so that a crash
+// can't leave it half written.
+func (s *uploadState) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tempName := s.fileName + ".tmp"
+	err = ioutil.WriteFile(tempName, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempName, s.fileName)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The read-only snapshots taken for --snapshot=auto, so that directories on
+// live volumes are archived as they were at a single point in time.
+// Directories on the same volume share its snapshot.
+type volumeSnapshots struct {
+	logger  falib.Logger
+	taken   map[string]*volumeSnapshot
+	order   []*volumeSnapshot
+	sources map[string]string
+}
+
+// A snapshot of one volume, whose contents can be read under path.
+type volumeSnapshot struct {
+	volume  snapshotVolume
+	path    string
+	release func() error
+}
+
+// Takes a snapshot of each volume that the directories are on, and works out
+// where in the snapshots each directory can be read from.  Directories that
+// aren't on a volume that can be snapshotted are read where they are, with a
+// warning.  If a snapshot can't be taken, those already taken are released.
+func takeVolumeSnapshots(directories []string, logger falib.Logger) (*volumeSnapshots, error) {
+	s := &volumeSnapshots{logger: logger, taken: make(map[string]*volumeSnapshot), sources: make(map[string]string)}
+	name := fmt.Sprintf("fast-archiver-%d", os.Getpid())
+	for _, directory := range directories {
+		resolved, err := filepath.Abs(directory)
+		if err == nil {
+			resolved, err = filepath.EvalSymlinks(resolved)
+		}
+		var volume snapshotVolume
+		var ok bool
+		if err == nil {
+			volume, ok, err = findSnapshotVolume(resolved)
+		}
+		if err != nil {
+			s.release()
+			return nil, fmt.Errorf("%s: %w", directory, err)
+		}
+		if !ok {
+			logger.Warning("not on a btrfs, ZFS, or LVM thin volume; archiving it without a snapshot:", directory)
+			s.sources[directory] = directory
+			continue
+		}
+
+		snapshot := s.taken[volume.key]
+		if snapshot == nil {
+			path, release, err := volume.snapshot(name)
+			if err != nil {
+				s.release()
+				return nil, fmt.Errorf("snapshot of %s: %w", volume.root, err)
+			}
+			logger.Verbose("took", volume.kind, "snapshot of", volume.root, "at", path)
+			snapshot = &volumeSnapshot{volume, path, release}
+			s.taken[volume.key] = snapshot
+			s.order = append(s.order, snapshot)
+		}
+		relative, err := filepath.Rel(volume.root, resolved)
+		if err != nil {
+			s.release()
+			return nil, err
+		}
+		s.sources[directory] = filepath.Join(snapshot.path, relative)
+	}
+	return s, nil
+}
+
+// Returns the path to read directory from.
+func (s *volumeSnapshots) source(directory string) string {
+	if source, ok := s.sources[directory]; ok {
+		return source
+	}
+	return directory
+}
+
+// Removes the snapshots, most recent first.  Snapshots that can't be removed
+// are warned about, since they'll keep using space until they're removed by
+// hand.
+func (s *volumeSnapshots) release() {
+	for i := len(s.order) - 1; i >= 0; i-- {
+		snapshot := s.order[i]
+		if err := snapshot.release(); err != nil {
+			s.logger.Warning("unable to remove", snapshot.volume.kind, "snapshot", snapshot.path, ":", err.Error())
+		}
+	}
+	s.order = nil
+}
+
+// Runs a snapshot management command, returning an error that includes its
+// output if it fails.
+func runSnapshotCommand(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return fmt.Errorf("%s: %w: %s", name, err, message)
+		}
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
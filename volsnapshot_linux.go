@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The inode number of the root directory of every btrfs subvolume.
+const btrfsSubvolumeInode = 256
+
+// A volume that a snapshot can be taken of.  key identifies the volume, and
+// root is the directory that its snapshots have the contents of.
+type snapshotVolume struct {
+	kind   string
+	key    string
+	root   string
+	device string
+	fsType string
+}
+
+// A line of /proc/self/mountinfo.
+type mountEntry struct {
+	mountPoint string
+	fsType     string
+	source     string
+}
+
+// Finds the volume that path, an absolute path with no symbolic links, is on.
+// Returns false if it isn't on a btrfs subvolume, a ZFS dataset, or an LVM
+// thin volume.
+func findSnapshotVolume(path string) (snapshotVolume, bool, error) {
+	mount, err := findMount(path)
+	if err != nil {
+		return snapshotVolume{}, false, err
+	}
+
+	switch {
+	case mount.fsType == "btrfs":
+		root, err := btrfsSubvolume(path, mount.mountPoint)
+		if err != nil {
+			return snapshotVolume{}, false, err
+		}
+		return snapshotVolume{kind: "btrfs", key: "btrfs:" + root, root: root}, true, nil
+	case mount.fsType == "zfs":
+		return snapshotVolume{kind: "zfs", key: "zfs:" + mount.source, root: mount.mountPoint, device: mount.source}, true, nil
+	case strings.HasPrefix(mount.source, "/dev/"):
+		// An LVM thin volume has "V" as the first character of its
+		// attributes; other devices, and errors from lvs (eg. when LVM
+		// isn't installed), mean it's not one.
+		output, err := exec.Command("lvs", "--noheadings", "-o", "lv_attr,vg_name,lv_name", mount.source).Output()
+		fields := strings.Fields(string(output))
+		if err != nil || len(fields) != 3 || !strings.HasPrefix(fields[0], "V") {
+			return snapshotVolume{}, false, nil
+		}
+		name := fields[1] + "/" + fields[2]
+		return snapshotVolume{kind: "lvm", key: "lvm:" + name, root: mount.mountPoint, device: name, fsType: mount.fsType}, true, nil
+	}
+	return snapshotVolume{}, false, nil
+}
+
+// Takes a read-only snapshot of the volume with the given name, returning the
+// directory that its contents can be read from, and a function that removes
+// it.
+func (v snapshotVolume) snapshot(name string) (string, func() error, error) {
+	switch v.kind {
+	case "btrfs":
+		path := filepath.Join(v.root, "."+name)
+		err := runSnapshotCommand("btrfs", "subvolume", "snapshot", "-r", v.root, path)
+		if err != nil {
+			return "", nil, err
+		}
+		return path, func() error { return runSnapshotCommand("btrfs", "subvolume", "delete", path) }, nil
+
+	case "zfs":
+		snapshot := v.device + "@" + name
+		err := runSnapshotCommand("zfs", "snapshot", snapshot)
+		if err != nil {
+			return "", nil, err
+		}
+		path := filepath.Join(v.root, ".zfs", "snapshot", name)
+		return path, func() error { return runSnapshotCommand("zfs", "destroy", snapshot) }, nil
+
+	case "lvm":
+		// Thin snapshots are created with activation skipped by default;
+		// -kn activates this one, so that it can be mounted.
+		snapshot := filepath.Dir(v.device) + "/" + name
+		err := runSnapshotCommand("lvcreate", "--snapshot", "-kn", "--name", name, v.device)
+		if err != nil {
+			return "", nil, err
+		}
+		remove := func() error { return runSnapshotCommand("lvremove", "-f", snapshot) }
+		path, err := os.MkdirTemp("", name)
+		if err != nil {
+			remove()
+			return "", nil, err
+		}
+		options := "ro"
+		if v.fsType == "xfs" {
+			// XFS refuses to mount a filesystem with the same UUID as
+			// one that's already mounted.
+			options += ",nouuid"
+		}
+		err = runSnapshotCommand("mount", "-t", v.fsType, "-o", options, "/dev/"+snapshot, path)
+		if err != nil {
+			os.Remove(path)
+			remove()
+			return "", nil, err
+		}
+		release := func() error {
+			err := runSnapshotCommand("umount", path)
+			if err != nil {
+				return err
+			}
+			os.Remove(path)
+			return remove()
+		}
+		return path, release, nil
+	}
+	return "", nil, errors.New("can't take snapshots of " + v.kind + " volumes")
+}
+
+// Returns the mount that path is on: the one with the longest mount point
+// that contains it.
+func findMount(path string) (mountEntry, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return mountEntry{}, err
+	}
+	defer file.Close()
+
+	var found mountEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The fields are: ID, parent ID, device, root, mount point,
+		// options, optional fields, then "-", filesystem type, source,
+		// and superblock options.
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			if field == "-" && i >= 6 {
+				separator = i
+				break
+			}
+		}
+		if separator < 0 || separator+2 >= len(fields) {
+			continue
+		}
+		mountPoint := unescapeMountField(fields[4])
+		if !containsPath(mountPoint, path) || len(mountPoint) < len(found.mountPoint) {
+			continue
+		}
+		found = mountEntry{mountPoint, fields[separator+1], unescapeMountField(fields[separator+2])}
+	}
+	return found, scanner.Err()
+}
+
+// Returns true if path is directory, or inside it.
+func containsPath(directory, path string) bool {
+	return directory == "/" || path == directory || strings.HasPrefix(path, directory+"/")
+}
+
+// Undoes the octal escaping of spaces, tabs, newlines, and backslashes in
+// /proc/self/mountinfo.
+func unescapeMountField(field string) string {
+	var retval strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if b, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				retval.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+		retval.WriteByte(field[i])
+	}
+	return retval.String()
+}
+
+// Returns the root of the btrfs subvolume that path is in, which is the
+// nearest directory above it (no higher than the mount point) with the inode
+// number that subvolume roots have.
+func btrfsSubvolume(path, mountPoint string) (string, error) {
+	for directory := path; ; directory = filepath.Dir(directory) {
+		var stat syscall.Stat_t
+		err := syscall.Stat(directory, &stat)
+		if err != nil {
+			return "", err
+		}
+		if (stat.Mode&syscall.S_IFMT == syscall.S_IFDIR && stat.Ino == btrfsSubvolumeInode) ||
+			directory == mountPoint || directory == "/" {
+			return directory, nil
+		}
+	}
+}
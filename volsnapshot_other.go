@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Volume snapshots aren't supported on this platform.
+type snapshotVolume struct {
+	kind string
+	key  string
+	root string
+}
+
+func findSnapshotVolume(path string) (snapshotVolume, bool, error) {
+	return snapshotVolume{}, false, errors.New("--snapshot isn't supported on this platform")
+}
+
+func (v snapshotVolume) snapshot(name string) (string, func() error, error) {
+	return "", nil, errors.New("--snapshot isn't supported on this platform")
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Every volume begins with a continuation header identifying the archive it
+// belongs to and its position in the sequence, and ends with a one-byte
+// trailer saying whether another volume follows.
+var volumeHeader = []byte{0x89, 0x46, 0x41, 0x56, 0x0D, 0x0A, 0x1A, 0x0A}
+
+const volumeIdSize = 16
+const volumeHeaderSize = 8 + volumeIdSize + 4
+const volumeTrailerSize = 1
+
+const (
+	volumeTrailerMore byte = 0
+	volumeTrailerLast byte = 1
+)
+
+// Returns the name of volume number (counting from 1) of an archive.
+func volumeName(name string, number int) string {
+	return fmt.Sprintf("%s.%03d", name, number)
+}
+
+// Parses a size such as 4096, 500M, or 4G; suffixes are powers of 1024.
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.TrimSuffix(strings.ToUpper(value), "B")
+	if len(number) > 0 {
+		if i := strings.IndexByte("KMGT", number[len(number)-1]); i >= 0 {
+			multiplier = 1 << (10 * uint(i+1))
+			number = number[:len(number)-1]
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
+
+// Formats a number of bytes for people, eg. 1.5 GiB.
+func formatSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	unit := -1
+	for value >= 1024 && unit < len("KMGT")-1 {
+		value /= 1024
+		unit += 1
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGT"[unit])
+}
+
+// Splits an archive across volumes of at most size bytes each, named
+// name.001, name.002, and so on.  Volumes are created as they're needed.
+type volumeWriter struct {
+	name      string
+	size      int64
+	id        [volumeIdSize]byte
+	number    int
+	current   io.WriteCloser
+	remaining int64
+	uploads   *uploadState
+
+	// Fsync each volume that's a file before closing it.
+	sync bool
+}
+
+func newVolumeWriter(name string, size int64, uploads *uploadState) (*volumeWriter, error) {
+	if size <= volumeHeaderSize+volumeTrailerSize {
+		return nil, fmt.Errorf("volume size must be larger than %d bytes", volumeHeaderSize+volumeTrailerSize)
+	}
+	w := &volumeWriter{name: name, size: size, uploads: uploads}
+	_, err := rand.Read(w.id[:])
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.current == nil || w.remaining == 0 {
+			err := w.nextVolume()
+			if err != nil {
+				return written, err
+			}
+		}
+		n := len(p)
+		if int64(n) > w.remaining {
+			n = int(w.remaining)
+		}
+		n, err := w.current.Write(p[:n])
+		written += n
+		w.remaining -= int64(n)
+		p = p[n:]
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Finishes the current volume, if any, and starts the next one.
+func (w *volumeWriter) nextVolume() error {
+	if w.current != nil {
+		err := w.finishVolume(volumeTrailerMore)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.number += 1
+	output, err := createOutput(volumeName(w.name, w.number), w.uploads)
+	if err != nil {
+		return err
+	}
+	w.current = output
+
+	header := make([]byte, 0, volumeHeaderSize)
+	header = append(header, volumeHeader...)
+	header = append(header, w.id[:]...)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[len(header)-4:], uint32(w.number))
+	_, err = w.current.Write(header)
+	w.remaining = w.size - volumeHeaderSize - volumeTrailerSize
+	return err
+}
+
+func (w *volumeWriter) finishVolume(trailer byte) error {
+	_, err := w.current.Write([]byte{trailer})
+	if err == nil && w.sync {
+		err = syncFile(w.current)
+	}
+	closeErr := w.current.Close()
+	if err == nil {
+		err = closeErr
+	}
+	w.current = nil
+	return err
+}
+
+func (w *volumeWriter) Close() error {
+	if w.current == nil {
+		// An archive always has at least one volume, even if it's empty.
+		err := w.nextVolume()
+		if err != nil {
+			return err
+		}
+	}
+	return w.finishVolume(volumeTrailerLast)
+}
+
+// Abandons the volume being written, removing it if it's a local file.
+// Volumes that were already completed are left in place.
+func (w *volumeWriter) Abort() error {
+	if writer, ok := w.current.(*objectWriter); ok {
+		return writer.Abort()
+	} else if file, ok := w.current.(*os.File); ok {
+		file.Close()
+		return os.Remove(file.Name())
+	}
+	return nil
+}
+
+// Returns true if name is a volume of a set other than the first, which is
+// read along with the first.
+func laterVolume(name string) bool {
+	ext := filepath.Ext(name)
+	if len(ext) != 4 || ext == ".001" {
+		return false
+	}
+	_, err := strconv.Atoi(ext[1:])
+	return err == nil
+}
+
+// Returns the base name of a volume set if the -i argument refers to one:
+// either the first volume itself, or a local name that doesn't exist but
+// whose first volume does.
+func volumeSetName(name string) (string, bool) {
+	if strings.HasSuffix(name, ".001") {
+		return strings.TrimSuffix(name, ".001"), true
+	}
+	if isObjectURL(name) || isHTTPURL(name) || isSSHPath(name) {
+		return "", false
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		return "", false
+	}
+	if _, err := os.Stat(volumeName(name, 1)); err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+// Reads an archive back out of a set of volumes, opening each one in turn and
+// checking that it's the next volume of the same archive.
+type volumeReader struct {
+	name    string
+	number  int
+	id      []byte
+	file    io.ReadCloser
+	current *bufio.Reader
+	done    bool
+}
+
+func openVolumes(name string) *volumeReader {
+	return &volumeReader{name: name}
+}
+
+func (r *volumeReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.done {
+				return 0, io.EOF
+			}
+			err := r.nextVolume()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		// Always hold back enough of the volume to be sure that the trailer
+		// isn't returned as archive data.
+		want := len(p) + volumeTrailerSize
+		if want > r.current.Size() {
+			want = r.current.Size()
+		}
+		buf, err := r.current.Peek(want)
+		if len(buf) > volumeTrailerSize {
+			n := copy(p, buf[:len(buf)-volumeTrailerSize])
+			r.current.Discard(n)
+			return n, nil
+		} else if err != io.EOF {
+			return 0, err
+		}
+
+		if len(buf) != volumeTrailerSize || buf[0] > volumeTrailerLast {
+			return 0, fmt.Errorf("%s: volume is truncated", volumeName(r.name, r.number))
+		}
+		r.done = buf[0] == volumeTrailerLast
+		r.file.Close()
+		r.file = nil
+		r.current = nil
+	}
+}
+
+func (r *volumeReader) nextVolume() error {
+	r.number += 1
+	name := volumeName(r.name, r.number)
+
+	var file io.ReadCloser
+	var err error
+	if isObjectURL(name) {
+		file, err = openObjectReader(name)
+	} else if isHTTPURL(name) {
+		file, err = openHTTPReader(name)
+	} else if isSSHPath(name) {
+		file, err = openSSHReader(name)
+	} else {
+		file, err = os.Open(name)
+	}
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, volumeHeaderSize)
+	_, err = io.ReadFull(file, header)
+	if err != nil || !bytes.Equal(header[:len(volumeHeader)], volumeHeader) {
+		file.Close()
+		return fmt.Errorf("%s: not an archive volume", name)
+	}
+	id := header[len(volumeHeader) : len(volumeHeader)+volumeIdSize]
+	if r.id == nil {
+		r.id = id
+	} else if !bytes.Equal(id, r.id) {
+		file.Close()
+		return fmt.Errorf("%s: volume belongs to a different archive", name)
+	}
+	if int(binary.BigEndian.Uint32(header[volumeHeaderSize-4:])) != r.number {
+		file.Close()
+		return fmt.Errorf("%s: volumes are out of order", name)
+	}
+
+	r.file = file
+	r.current = bufio.NewReaderSize(file, 64*1024)
+	return nil
+}
+
+func (r *volumeReader) Close() error {
+	if r.file != nil {
+		return r.file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/replicon/fast-archiver/falib"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The format of the UTC time substituted into -o names: for %t, and for %s in
+// the name of each --watch archive.
+const archiveTimestampFormat = "20060102T150405Z"
+
+// Archives the changes to directories continuously: each time something
+// changes, at most once per --watch-interval, an incremental archive of the
+// changes since the last one is written, named by substituting the time for
+// %s in -o.  Runs until interrupted, or an archive can't be written.
+func runWatch(common *commonOptions, opts *createOptions, directories []string) error {
+	if *opts.snapshotFileName == "" {
+		return failure(exitUsage, "--watch requires --snapshot-file")
+	}
+	if !strings.Contains(*opts.outputFileName, "%s") {
+		return failure(exitUsage, "--watch requires an -o name containing", "%s")
+	}
+	if *opts.listen != "" || *opts.splitByDir || *opts.filesFrom != "" || *opts.volumeSize != "" || *opts.shards > 1 {
+		return failure(exitUsage, "--watch cannot be used with --listen, --split-by-dir, --files-from, --volume-size, or --shards")
+	}
+	interval := *opts.watchInterval
+	if interval < time.Second {
+		return failure(exitUsage, "--watch-interval must be at least 1s")
+	}
+
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	stopWatching := func() { stopOnce.Do(func() { close(stop) }) }
+	handleInterrupts(stopWatching)
+
+	var changes <-chan struct{}
+	watcher, err := newChangeWatcher(directories)
+	if err != nil {
+		logger.Println("Unable to watch for changes; checking every", interval, "instead:", err.Error())
+	} else {
+		changes = watcher.changes
+	}
+
+	for {
+		// The first archive has whatever changed since the snapshot file
+		// was last saved.
+		name := strings.Replace(*opts.outputFileName, "%s", time.Now().UTC().Format(archiveTimestampFormat), -1)
+		previousSnapshot, _ := ioutil.ReadFile(*opts.snapshotFileName)
+		stats, err := createArchive(common, opts, directories, name)
+		if err != nil {
+			return err
+		}
+		handleInterrupts(stopWatching)
+		if interruptReceived() {
+			return falib.ErrInterrupted
+		}
+		if stats.Files+stats.Specials+stats.Symlinks+stats.Deleted == 0 && !*common.dryRun && !isObjectURL(name) {
+			common.logger().Verbose("nothing changed; removing", name)
+			os.Remove(name)
+			// The next archive is based on the last one kept, so
+			// put back the snapshot that records its ID.
+			if previousSnapshot != nil {
+				err = ioutil.WriteFile(*opts.snapshotFileName, previousSnapshot, 0644)
+				if err != nil {
+					return failure(exitError, "Error restoring snapshot file:", err.Error())
+				}
+			}
+		} else {
+			logger.Println("archived", stats.Files, "changed files and", stats.Deleted, "deletions to", name)
+		}
+
+		// Changes made in the meantime are left for the next archive.
+		select {
+		case <-stop:
+			return falib.ErrInterrupted
+		case <-time.After(interval):
+		}
+		if changes != nil {
+			select {
+			case <-stop:
+				return falib.ErrInterrupted
+			case <-changes:
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const watchEvents = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF
+
+// Watches directory trees for changes with inotify.  Something is sent on
+// changes (which holds at most one pending notification) after any change.
+type changeWatcher struct {
+	fd      int
+	changes chan struct{}
+	lock    sync.Mutex
+	watches map[int32]string
+}
+
+func newChangeWatcher(directories []string) (*changeWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &changeWatcher{fd: fd, changes: make(chan struct{}, 1), watches: make(map[int32]string)}
+	for _, directory := range directories {
+		err = w.addTree(directory)
+		if err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Watches directory and every directory below it.
+func (w *changeWatcher) addTree(directory string) error {
+	return filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			// Anything that disappeared or can't be read will be
+			// reported by the next archive.
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchEvents)
+		if err != nil {
+			return err
+		}
+		w.lock.Lock()
+		w.watches[int32(wd)] = path
+		w.lock.Unlock()
+		return nil
+	})
+}
+
+func (w *changeWatcher) readEvents() {
+	var buf [64 * 1024]byte
+	for {
+		n, err := syscall.Read(w.fd, buf[:])
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil || n <= 0 {
+			logger.Println("Error watching for changes:", err)
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			// New directories need watching too.
+			if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				w.lock.Lock()
+				parent := w.watches[event.Wd]
+				w.lock.Unlock()
+				name := string(bytes.TrimRight(nameBytes, "\x00"))
+				err := w.addTree(filepath.Join(parent, name))
+				if err != nil {
+					logger.Println("Error watching for changes:", err.Error())
+				}
+			}
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				w.lock.Lock()
+				delete(w.watches, event.Wd)
+				w.lock.Unlock()
+				continue
+			}
+			w.notify()
+		}
+	}
+}
+
+func (w *changeWatcher) notify() {
+	select {
+	case w.changes <- struct{}{}:
+	default:
+	}
+}
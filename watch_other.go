@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Changes can't be watched for on this platform, so the watch loop checks for
+// them at every interval instead.
+type changeWatcher struct {
+	changes chan struct{}
+}
+
+func newChangeWatcher(directories []string) (*changeWatcher, error) {
+	return nil, errors.New("watching for changes isn't supported on this platform")
+}
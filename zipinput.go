@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/replicon/fast-archiver/falib"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+)
+
+// What a zip file starts with: a local file header, or for an empty zip file,
+// the end of central directory record.
+var zipSignatures = [][]byte{[]byte("PK\x03\x04"), []byte("PK\x05\x06")}
+
+func isZipSignature(magic []byte) bool {
+	for _, signature := range zipSignatures {
+		if bytes.Equal(magic, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns input as it is, unless it's a zip file, in which case the returned
+// reader is of an archive that it's converted into as it's read, with
+// falib.ConvertZip.  A zip file's index is at its end, so one read from a
+// pipe is copied to a temporary file first.
+func zipInput(input *os.File) (io.ReadCloser, error) {
+	fileInfo, err := input.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var zipFile *os.File
+	var temporary bool
+	if fileInfo.Mode().IsRegular() {
+		magic := make([]byte, 4)
+		n, _ := input.ReadAt(magic, 0)
+		if !isZipSignature(magic[:n]) {
+			return input, nil
+		}
+		zipFile = input
+	} else {
+		buffered := bufio.NewReader(input)
+		magic, _ := buffered.Peek(4)
+		if !isZipSignature(magic) {
+			return readCloser{buffered, input}, nil
+		}
+		zipFile, err = ioutil.TempFile("", "fast-archiver-zip")
+		if err != nil {
+			return nil, err
+		}
+		temporary = true
+		_, err = io.Copy(zipFile, buffered)
+		input.Close()
+		if err == nil {
+			fileInfo, err = zipFile.Stat()
+		}
+		if err != nil {
+			zipFile.Close()
+			os.Remove(zipFile.Name())
+			return nil, err
+		}
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		err := falib.ConvertZip(zipFile, fileInfo.Size(), writer, runtime.NumCPU(), &MultiLevelLogger{logger, false})
+		writer.CloseWithError(err)
+	}()
+	return &convertedZip{reader, zipFile, temporary}, nil
+}
+
+// A reader and the file that it reads from, which is closed along with it.
+type readCloser struct {
+	io.Reader
+	file *os.File
+}
+
+func (r readCloser) Close() error {
+	return r.file.Close()
+}
+
+// The archive that a zip file is being converted into.
+type convertedZip struct {
+	*io.PipeReader
+	zipFile   *os.File
+	temporary bool
+}
+
+// Stops the conversion, and closes the zip file, removing it if it's a
+// temporary copy.
+func (c *convertedZip) Close() error {
+	c.PipeReader.Close()
+	err := c.zipFile.Close()
+	if c.temporary {
+		os.Remove(c.zipFile.Name())
+	}
+	return err
+}